@@ -19,6 +19,7 @@ package advanced
 	// After Find
 
 	// There is a demo segment, but I didn't watch it
+	* The validation package registers a callback after BeforeSave that aborts any save whose validate tags fail
 */
 
 /*
@@ -28,35 +29,35 @@ package advanced
 */
 
 import (
+	"context"
 	"fmt"
 
-	// Anonymous import - package just needs to initialize in order to establish itself as a database driver
-	_ "github.com/go-sql-driver/mysql"
-
 	"github.com/jinzhu/gorm"
 
 	"github.com/annicaburns/learngorm/query"
+	"github.com/annicaburns/learngorm/registry"
 )
 
+func init() {
+	registry.Register("advanced.scope", "Find long meetings with a reusable scope function", Scope)
+}
+
 // Scope demonstrates how to codify a scope
-func Scope() {
+func Scope(ctx context.Context, db *gorm.DB) error {
 
 	// Only seed the database once
-	// query.SeedDB()
-
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
-	if err != nil {
-		panic(err.Error())
-	}
+	// query.SeedDB(ctx, db)
 
 	appointments := []query.AppointmentQuery{}
 
-	db.Scopes(LongMeetings).Find(&appointments)
+	if err := db.Scopes(LongMeetings).Find(&appointments).Error; err != nil {
+		return registry.Step("find long meetings", err)
+	}
 
 	for _, appointment := range appointments {
 		fmt.Printf("\n%v\n", appointment)
 	}
-
+	return nil
 }
 
 // LongMeetings is an example of a scoping function
@@ -0,0 +1,34 @@
+package advanced
+
+import (
+	"context"
+	"testing"
+
+	"github.com/annicaburns/learngorm/query"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+func TestLongMeetings(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	if err := query.SeedDB(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := Scope(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	appointments := []query.AppointmentQuery{}
+	if err := db.Scopes(LongMeetings).Find(&appointments).Error; err != nil {
+		t.Fatal(err)
+	}
+	// The fixtures have two meetings of exactly 60 minutes - the scope wants longer than that
+	if len(appointments) != 1 || appointments[0].Subject != "Explore Planet Builder's Homeworld" {
+		t.Errorf("LongMeetings found %v, want only the trip to Magrathea", appointments)
+	}
+	for _, appointment := range appointments {
+		if appointment.Length <= 60 {
+			t.Errorf("%s is %d minutes long, want more than 60", appointment.Subject, appointment.Length)
+		}
+	}
+}
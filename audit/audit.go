@@ -0,0 +1,318 @@
+package audit
+
+/*
+* An audit trail - every create, update and delete of a model writes a row to audit_log saying what changed, who changed it and when
+	* Changes is a JSON object of the columns that changed, each with its old and new value - creates only have new values, deletes only old ones
+	* Updates of many rows at once write an entry per row, and a soft delete is a delete - restoring the row is an update of deleted_at
+	* updated_at is left out of update diffs, since the entry has its own timestamp - an update that changes nothing else isn't recorded
+	* The entry is written in the same transaction as the change, so a rolled back change leaves no trail
+* The actor comes from the context - jinzhu/gorm can't pass one to a callback, so DB copies it onto the connection
+	* audit.DB(audit.WithActor(ctx, "arthur"), db).Save(&user)
+	* The repository and softdelete calls take a ctx and do this themselves - locking.Retry is handed a db that already has it
+* A row with a composite primary key, like relationships.Attendance, is logged under its key values joined with commas - History(ctx, db, &Attendance{}, "3,7")
+* Only statements that go through GORM's callbacks are seen - the bulk package and Exec write SQL of their own, so they aren't audited
+* The callbacks go into GORM's DefaultCallback when the package is imported, like the locking package's
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/registry"
+)
+
+// Operations recorded in Entry.Operation
+const (
+	Create = "create"
+	Update = "update"
+	Delete = "delete"
+)
+
+// Entry is one row of the audit log
+type Entry struct {
+	ID        uint
+	Table     string `gorm:"column:table_name;size:64;not null;index:idx_audit_log_record"`
+	RecordID  string `gorm:"size:64;not null;index:idx_audit_log_record"`
+	Operation string `gorm:"size:16;not null"`
+	// Changes is the JSON encoded map[string]Change - Diff decodes it
+	Changes   string `gorm:"type:text;not null"`
+	Actor     string `gorm:"size:255;not null"`
+	CreatedAt time.Time
+}
+
+// TableName pins the table name - the log is one table, not a collection of entries
+func (Entry) TableName() string {
+	return "audit_log"
+}
+
+// Change is one column's value before and after - Old is missing for a create and New for a delete
+type Change struct {
+	Old json.RawMessage `json:"old,omitempty"`
+	New json.RawMessage `json:"new,omitempty"`
+}
+
+// Diff decodes the entry's changes
+func (e Entry) Diff() (map[string]Change, error) {
+	changes := map[string]Change{}
+	if err := json.Unmarshal([]byte(e.Changes), &changes); err != nil {
+		return nil, fmt.Errorf("audit: entry %d: %w", e.ID, err)
+	}
+	return changes, nil
+}
+
+// Keys for the values the callbacks pass along on the scope
+const (
+	actorKey  = "audit:actor"
+	beforeKey = "audit:before"
+)
+
+type actorContextKey struct{}
+
+// WithActor returns a copy of ctx that names who is making the changes
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// Actor returns the actor WithActor put in ctx, or "" if there isn't one
+func Actor(ctx context.Context) string {
+	actor, _ := ctx.Value(actorContextKey{}).(string)
+	return actor
+}
+
+// DB returns db with the actor from ctx set on it, for the callbacks to record
+func DB(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if actor := Actor(ctx); actor != "" {
+		return db.Set(actorKey, actor)
+	}
+	return db
+}
+
+func init() {
+	registry.RegisterModels(&Entry{})
+	gorm.DefaultCallback.Create().After("gorm:save_after_associations").Register("audit:record_create", recordCreate)
+	gorm.DefaultCallback.Update().Before("gorm:update").Register("audit:load_before_update", loadBefore)
+	gorm.DefaultCallback.Update().After("gorm:save_after_associations").Register("audit:record_update", recordUpdate)
+	gorm.DefaultCallback.Delete().Before("gorm:delete").Register("audit:load_before_delete", loadBefore)
+	gorm.DefaultCallback.Delete().After("gorm:delete").Register("audit:record_delete", recordDelete)
+}
+
+// skipped are the tables whose changes aren't audited - the log itself, and the migrations' bookkeeping
+var skipped = map[string]bool{"audit_log": true, "schema_migrations": true}
+
+// audited reports whether scope's changes should be recorded
+func audited(scope *gorm.Scope) bool {
+	if scope.HasError() || skipped[scope.TableName()] || scope.PrimaryField() == nil {
+		return false
+	}
+	model := scope.GetModelStruct().ModelType
+	return model != nil && model.Kind() == reflect.Struct
+}
+
+// recordCreate records the new row's columns - after the associations, so their ids are in place too
+func recordCreate(scope *gorm.Scope) {
+	if !audited(scope) || scope.IndirectValue().Kind() != reflect.Struct {
+		return
+	}
+	changes := map[string]Change{}
+	for column, value := range columns(scope) {
+		changes[column] = Change{New: value}
+	}
+	write(scope, Create, recordOf(scope).id, changes)
+}
+
+// loadBefore reads the rows an UPDATE or DELETE is about to change, with the same conditions it will use
+func loadBefore(scope *gorm.Scope) {
+	if !audited(scope) {
+		return
+	}
+	rows, err := matching(scope)
+	if err != nil {
+		scope.Err(fmt.Errorf("audit: reading %s before the change: %w", scope.TableName(), err))
+		return
+	}
+	scope.InstanceSet(beforeKey, rows)
+}
+
+// recordUpdate compares the rows read by loadBefore with what they hold now
+func recordUpdate(scope *gorm.Scope) {
+	before, ok := beforeRows(scope)
+	if !ok || len(before) == 0 {
+		return
+	}
+	condition, args := sameKeys(scope, before)
+	after, err := load(scope, scope.NewDB().Unscoped().Where(condition, args...))
+	if err != nil {
+		scope.Err(fmt.Errorf("audit: reading %s after the change: %w", scope.TableName(), err))
+		return
+	}
+	byID := map[string]map[string]json.RawMessage{}
+	for _, row := range after {
+		byID[fmt.Sprint(row.id)] = row.columns
+	}
+	for _, old := range before {
+		changes := map[string]Change{}
+		for column, value := range byID[fmt.Sprint(old.id)] {
+			if column == "updated_at" || bytes.Equal(value, old.columns[column]) {
+				continue
+			}
+			changes[column] = Change{Old: old.columns[column], New: value}
+		}
+		if len(changes) > 0 {
+			write(scope, Update, old.id, changes)
+		}
+	}
+}
+
+// recordDelete records the columns of the rows that were deleted
+func recordDelete(scope *gorm.Scope) {
+	before, ok := beforeRows(scope)
+	if !ok {
+		return
+	}
+	for _, row := range before {
+		changes := map[string]Change{}
+		for column, value := range row.columns {
+			changes[column] = Change{Old: value}
+		}
+		write(scope, Delete, row.id, changes)
+	}
+}
+
+func beforeRows(scope *gorm.Scope) ([]record, bool) {
+	if scope.HasError() {
+		return nil, false
+	}
+	rows, ok := scope.InstanceGet(beforeKey)
+	if !ok {
+		return nil, false
+	}
+	return rows.([]record), true
+}
+
+// write adds one entry to the log, on the connection - and so in the transaction - the change was made in
+func write(scope *gorm.Scope, operation string, id interface{}, changes map[string]Change) {
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		scope.Err(fmt.Errorf("audit: encoding the %s of %s %v: %w", operation, scope.TableName(), id, err))
+		return
+	}
+	actor, _ := scope.Get(actorKey)
+	name, _ := actor.(string)
+	entry := Entry{
+		Table:     scope.TableName(),
+		RecordID:  fmt.Sprint(id),
+		Operation: operation,
+		Changes:   string(encoded),
+		Actor:     name,
+	}
+	if err := scope.NewDB().Create(&entry).Error; err != nil {
+		scope.Err(fmt.Errorf("audit: recording the %s of %s %v: %w", operation, scope.TableName(), id, err))
+	}
+}
+
+// record is a row's primary key and its columns, JSON encoded so they can be compared and stored as they are
+type record struct {
+	id interface{}
+	// keys are the values of the primary key columns, one for most tables
+	keys    []interface{}
+	columns map[string]json.RawMessage
+}
+
+// columns JSON encodes every column of the scope's model
+func columns(scope *gorm.Scope) map[string]json.RawMessage {
+	values := map[string]json.RawMessage{}
+	for _, field := range scope.Fields() {
+		if !field.IsNormal {
+			continue
+		}
+		encoded, err := json.Marshal(field.Field.Interface())
+		if err != nil {
+			encoded, _ = json.Marshal(fmt.Sprint(field.Field.Interface()))
+		}
+		values[field.DBName] = encoded
+	}
+	return values
+}
+
+// matching reads the rows the scope's statement will touch
+// The conditions are rendered on a copy of the scope, so the statement's own SQL and variables are left as they were
+func matching(scope *gorm.Scope) ([]record, error) {
+	copied := *scope
+	copied.SQLVars = nil
+	query := fmt.Sprintf("SELECT * FROM %s%s", scope.QuotedTableName(), copied.CombinedConditionSql())
+	// MySQL's and SQLite's bind variables come out as $$$ until Raw swaps them for ? - MySQL rejects them, and SQLite would bind every one of them to the first value
+	query = strings.Replace(query, "$$$", "?", -1)
+	rows, err := scope.NewDB().CommonDB().Query(query, copied.SQLVars...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []record{}
+	db := scope.NewDB()
+	for rows.Next() {
+		value := reflect.New(scope.GetModelStruct().ModelType).Interface()
+		if err := db.ScanRows(rows, value); err != nil {
+			return nil, err
+		}
+		records = append(records, recordOf(db.NewScope(value)))
+	}
+	return records, rows.Err()
+}
+
+// load reads the rows query finds
+func load(scope *gorm.Scope, query *gorm.DB) ([]record, error) {
+	values := reflect.New(reflect.SliceOf(scope.GetModelStruct().ModelType))
+	if err := query.Find(values.Interface()).Error; err != nil {
+		return nil, err
+	}
+	records := []record{}
+	for i := 0; i < values.Elem().Len(); i++ {
+		records = append(records, recordOf(scope.NewDB().NewScope(values.Elem().Index(i).Addr().Interface())))
+	}
+	return records, nil
+}
+
+func recordOf(scope *gorm.Scope) record {
+	fields := scope.PrimaryFields()
+	if len(fields) < 2 {
+		id := scope.PrimaryKeyValue()
+		return record{id: id, keys: []interface{}{id}, columns: columns(scope)}
+	}
+	keys := make([]interface{}, len(fields))
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		keys[i] = field.Field.Interface()
+		values[i] = fmt.Sprint(keys[i])
+	}
+	return record{id: strings.Join(values, ","), keys: keys, columns: columns(scope)}
+}
+
+// sameKeys is a condition that finds rows again by their primary keys
+func sameKeys(scope *gorm.Scope, rows []record) (string, []interface{}) {
+	fields := scope.PrimaryFields()
+	if len(fields) < 2 {
+		ids := make([]interface{}, 0, len(rows))
+		for _, row := range rows {
+			ids = append(ids, row.id)
+		}
+		return fmt.Sprintf("%s.%s IN (?)", scope.QuotedTableName(), scope.Quote(scope.PrimaryKey())), []interface{}{ids}
+	}
+	matches := make([]string, 0, len(rows))
+	args := []interface{}{}
+	for _, row := range rows {
+		columns := make([]string, len(fields))
+		for i, field := range fields {
+			columns[i] = fmt.Sprintf("%s.%s = ?", scope.QuotedTableName(), scope.Quote(field.DBName))
+		}
+		matches = append(matches, "("+strings.Join(columns, " AND ")+")")
+		args = append(args, row.keys...)
+	}
+	return strings.Join(matches, " OR "), args
+}
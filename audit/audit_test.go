@@ -0,0 +1,218 @@
+package audit_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/audit"
+	"github.com/annicaburns/learngorm/crud"
+	"github.com/annicaburns/learngorm/relationships"
+	"github.com/annicaburns/learngorm/softdelete"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+func TestBatchUpdateRecordsEveryRow(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := audit.WithActor(context.Background(), "payroll")
+	for _, first := range []string{"Arthur", "Ford", "Tricia"} {
+		if err := db.Create(&crud.CruddyUser3{FirstName: first, Salary: 100}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := audit.DB(ctx, db).Model(&crud.CruddyUser3{}).Where("first_name <> ?", "Tricia").
+		Update("salary", gorm.Expr("salary + ?", 50)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "audit_log", "operation = ? AND actor = ?", audit.Update, "payroll"); n != 2 {
+		t.Errorf("%d update entries, want one for Arthur and one for Ford", n)
+	}
+	history, err := audit.History(ctx, db, &crud.CruddyUser3{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := history[len(history)-1].Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(changes["salary"].Old) != "100" || string(changes["salary"].New) != "150" {
+		t.Errorf("salary changed %s -> %s, want 100 -> 150", changes["salary"].Old, changes["salary"].New)
+	}
+	if _, ok := changes["updated_at"]; ok {
+		t.Error("updated_at is in the diff")
+	}
+}
+
+// The rows read before an update have to come from every bound condition, not just the first
+func TestUpdateWithSeveralConditions(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := audit.WithActor(context.Background(), "payroll")
+	for _, first := range []string{"Arthur", "Ford", "Tricia"} {
+		if err := db.Create(&crud.CruddyUser3{FirstName: first, Salary: 100}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := audit.DB(ctx, db).Model(&crud.CruddyUser3{}).Where("first_name IN (?) AND salary < ?", []string{"Ford", "Tricia"}, 200).
+		Update("salary", 120).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, first := range map[int]string{2: "Ford", 3: "Tricia"} {
+		history, err := audit.History(ctx, db, &crud.CruddyUser3{}, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 2 || history[1].Operation != audit.Update {
+			t.Errorf("%s has %d entries, want the create and the update", first, len(history))
+			continue
+		}
+		changes, err := history[1].Diff()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(changes["salary"].Old) != "100" || string(changes["salary"].New) != "120" {
+			t.Errorf("%s's salary changed %s -> %s, want 100 -> 120", first, changes["salary"].Old, changes["salary"].New)
+		}
+	}
+	if n := testdb.Count(t, db, "audit_log", "operation = ?", audit.Update); n != 2 {
+		t.Errorf("%d update entries, want Ford's and Tricia's", n)
+	}
+}
+
+func TestRolledBackChangesLeaveNoTrail(t *testing.T) {
+	db := testdb.Open(t)
+	tx := db.Begin()
+	if err := tx.Create(&crud.CruddyUser2{FirstName: "Arthur"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	if n := testdb.Count(t, db, "audit_log"); n != 0 {
+		t.Errorf("%d entries left by a rolled back create", n)
+	}
+}
+
+func TestFailedUpdatesAreNotRecorded(t *testing.T) {
+	db := testdb.Open(t)
+	user := crud.CruddyUser2{FirstName: "Arthur"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	stale := user
+	if err := db.Model(&user).Update("first_name", "Zaphod").Error; err != nil {
+		t.Fatal(err)
+	}
+	stale.FirstName = "Ford"
+	if err := db.Save(&stale).Error; err == nil {
+		t.Fatal("saving a stale copy worked")
+	}
+	if n := testdb.Count(t, db, "audit_log", "operation = ?", audit.Update); n != 1 {
+		t.Errorf("%d update entries, want only the one that went through", n)
+	}
+}
+
+func TestStateAtFollowsSoftDeleteAndRestore(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	user := crud.CruddyUser{FirstName: "Arthur", LastName: "Dent"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := softdelete.Delete(ctx, db, &crud.CruddyUser{}, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := softdelete.Restore(ctx, db, &crud.CruddyUser{}, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := audit.History(ctx, db, &crud.CruddyUser{}, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operations := []string{}
+	for _, entry := range history {
+		operations = append(operations, entry.Operation)
+	}
+	if len(operations) != 3 || operations[1] != audit.Delete || operations[2] != audit.Update {
+		t.Fatalf("history is %v, want create, delete and the restore's update", operations)
+	}
+
+	deleted := crud.CruddyUser{}
+	if exists, err := audit.Replay(db, &deleted, history[:2]); err != nil || exists {
+		t.Errorf("after the delete Replay says exists=%v (%v), want it gone", exists, err)
+	}
+	now := crud.CruddyUser{}
+	exists, err := audit.StateAt(ctx, db, &now, user.ID, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || now.FirstName != "Arthur" || now.DeletedAt != nil {
+		t.Errorf("StateAt now gives %+v, exists=%v - want Arthur, restored", now, exists)
+	}
+	if exists, _ := audit.StateAt(ctx, db, &crud.CruddyUser{}, user.ID, user.CreatedAt.Add(-time.Minute)); exists {
+		t.Error("the user existed before it was created")
+	}
+}
+
+func TestEntriesAreNotAudited(t *testing.T) {
+	db := testdb.Open(t)
+	if err := db.Create(&crud.CruddyUser4{FirstName: "Ford"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	entry := audit.Entry{}
+	if err := db.First(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(&audit.Entry{}).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("deleting an entry logged another one: %v", err)
+	}
+}
+
+func TestCompositeKeys(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	// Two rows that share the first half of their key
+	for _, attendance := range []relationships.Attendance{
+		{AppointmentID: 3, RelationshipUserID: 7, Status: relationships.Invited, Role: relationships.Required},
+		{AppointmentID: 3, RelationshipUserID: 8, Status: relationships.Invited, Role: relationships.Required},
+	} {
+		if err := db.Create(&attendance).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	second := relationships.Attendance{}
+	if err := db.Where("appointment_id = ? AND relationship_user_id = ?", 3, 8).First(&second).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&second).Update("role", relationships.Optional).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[string]int{"3,7": 1, "3,8": 2} {
+		history, err := audit.History(ctx, db, &relationships.Attendance{}, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != want {
+			t.Errorf("%s has %d entries, want %d", id, len(history), want)
+		}
+	}
+	history, _ := audit.History(ctx, db, &relationships.Attendance{}, "3,8")
+	if len(history) == 2 {
+		changes, err := history[1].Diff()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(changes["role"].Old) != `"required"` || string(changes["role"].New) != `"optional"` || len(changes) != 1 {
+			t.Errorf("the update recorded %v, want only role required -> optional", changes)
+		}
+	}
+}
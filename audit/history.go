@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// History lists the entries for one record of model's table, oldest first
+func History(ctx context.Context, db *gorm.DB, model interface{}, id interface{}) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	err := db.Where("table_name = ? AND record_id = ?", db.NewScope(model).TableName(), fmt.Sprint(id)).
+		Order("id").Find(&entries).Error
+	if err != nil {
+		return nil, fmt.Errorf("audit: reading the history of %s %v: %w", db.NewScope(model).TableName(), id, err)
+	}
+	return entries, nil
+}
+
+// StateAt rebuilds a record as it was at a point in time by replaying its history into value, a pointer to a blank model
+// It reports false if the record didn't exist then - it hadn't been created yet, or had been deleted
+func StateAt(ctx context.Context, db *gorm.DB, value interface{}, id interface{}, at time.Time) (bool, error) {
+	entries, err := History(ctx, db, value, id)
+	if err != nil {
+		return false, err
+	}
+	n := 0
+	for n < len(entries) && !entries[n].CreatedAt.After(at) {
+		n++
+	}
+	return Replay(db, value, entries[:n])
+}
+
+// Replay applies a record's entries, oldest first, to value - a pointer to a blank model - and reports whether the record exists after the last of them
+// Only what the log recorded can be rebuilt - a record created before auditing started is missing the columns it has never changed since
+func Replay(db *gorm.DB, value interface{}, entries []Entry) (bool, error) {
+	state := map[string]json.RawMessage{}
+	exists := false
+	for _, entry := range entries {
+		changes, err := entry.Diff()
+		if err != nil {
+			return false, err
+		}
+		// A soft deleted row keeps its columns, so a later restore carries on from them
+		exists = entry.Operation != Delete
+		for column, change := range changes {
+			if change.New != nil {
+				state[column] = change.New
+			} else if _, ok := state[column]; !ok {
+				state[column] = change.Old
+			}
+		}
+	}
+
+	scope := db.NewScope(value)
+	for column, raw := range state {
+		field, ok := scope.FieldByName(column)
+		if !ok {
+			// A column the model has since dropped
+			continue
+		}
+		if err := json.Unmarshal(raw, field.Field.Addr().Interface()); err != nil {
+			return false, fmt.Errorf("audit: rebuilding %s.%s: %w", scope.TableName(), column, err)
+		}
+	}
+	return exists, nil
+}
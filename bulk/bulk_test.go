@@ -0,0 +1,397 @@
+package bulk_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/bulk"
+	"github.com/annicaburns/learngorm/crud"
+	"github.com/annicaburns/learngorm/dbSchema"
+	"github.com/annicaburns/learngorm/dberrors"
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/query"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+func TestUpsert(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	if err := db.Create(&query.UserQuery{Username: "adent", FirstName: "Arthur", LastName: "Dent"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	original := query.UserQuery{}
+	db.First(&original)
+
+	users := []*query.UserQuery{
+		{Username: "adent", FirstName: "Arthur Philip", LastName: "Dent"},
+		{Username: "fprefect", FirstName: "Ford", LastName: "Prefect"},
+	}
+	if err := bulk.Upsert(ctx, db, users, bulk.UpsertOptions{On: []string{"username"}}); err != nil {
+		t.Fatal(err)
+	}
+	if users[1].CreatedAt.IsZero() {
+		t.Error("Upsert didn't stamp CreatedAt on the structs")
+	}
+
+	got := []query.UserQuery{}
+	if err := db.Order("id").Find(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d users, want 2", len(got))
+	}
+	if got[0].ID != original.ID || got[0].FirstName != "Arthur Philip" {
+		t.Errorf("adent is %d %s, want %d Arthur Philip", got[0].ID, got[0].FirstName, original.ID)
+	}
+	// created_at is left out of the default update
+	if !got[0].CreatedAt.Equal(original.CreatedAt) {
+		t.Errorf("adent's created_at moved from %v to %v", original.CreatedAt, got[0].CreatedAt)
+	}
+	if got[1].Username != "fprefect" {
+		t.Errorf("the new user is %s, want fprefect", got[1].Username)
+	}
+}
+
+func TestUpsertChosenColumns(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	if err := db.Create(&dbSchema.BasicUser{Username: "adent", FirstName: "Arthur", LastName: "Dent"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// LastName is the unique key, and only the username gets overwritten
+	users := []dbSchema.BasicUser{{Username: "arthur", FirstName: "Not Arthur", LastName: "Dent"}}
+	if err := bulk.Upsert(ctx, db, users, bulk.UpsertOptions{On: []string{"LastName"}, Update: []string{"username"}}); err != nil {
+		t.Fatal(err)
+	}
+	got := dbSchema.BasicUser{}
+	if err := db.First(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got.Username != "arthur" || got.FirstName != "Arthur" {
+		t.Errorf("got %s %s, want the username changed and the first name kept", got.Username, got.FirstName)
+	}
+
+	if err := bulk.Upsert(ctx, db, users, bulk.UpsertOptions{On: []string{"last_name"}}); err == nil {
+		t.Error("upserting on a column that doesn't exist worked, want an error")
+	}
+}
+
+func TestUpsertOtherKeyTaken(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	if dialect.Of(db).Name() == "mysql" {
+		t.Skip("MySQL's ON DUPLICATE KEY UPDATE covers every unique key, whatever On says")
+	}
+	arthur := dbSchema.BasicUser{Username: "adent", FirstName: "Arthur", LastName: "Dent"}
+	if err := db.Create(&arthur).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// A new last name, but Arthur's id - the primary key isn't the conflict target, so nothing catches it
+	users := []dbSchema.BasicUser{{Model: gorm.Model{ID: arthur.ID}, Username: "fprefect", FirstName: "Ford", LastName: "Prefect"}}
+	err := bulk.Upsert(ctx, db, users, bulk.UpsertOptions{On: []string{"LastName"}})
+	if !errors.Is(err, &dberrors.ErrUniqueViolation{Table: "basic_users"}) {
+		t.Errorf("Upsert returned %v, want a dberrors.ErrUniqueViolation", err)
+	}
+}
+
+func TestUpsertDoNothing(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	if err := db.Create(&query.UserQuery{Username: "adent", FirstName: "Arthur"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	users := []query.UserQuery{{Username: "adent", FirstName: "Zaphod"}, {Username: "mrobot", FirstName: "Marvin"}}
+	if err := bulk.Upsert(ctx, db, users, bulk.UpsertOptions{On: []string{"username"}, DoNothing: true}); err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "user_queries", "first_name = ?", "Arthur"); n != 1 {
+		t.Error("DoNothing overwrote the existing row")
+	}
+	if n := testdb.Count(t, db, "user_queries"); n != 2 {
+		t.Errorf("user_queries has %d rows, want 2", n)
+	}
+}
+
+func TestUpsertBatches(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	users := make([]query.UserQuery, 25)
+	for i := range users {
+		users[i] = query.UserQuery{Username: string(rune('a'+i)) + "user", FirstName: "First"}
+	}
+	// Twice, so the second round is all updates
+	for round := 0; round < 2; round++ {
+		if err := bulk.Upsert(ctx, db, users, bulk.UpsertOptions{On: []string{"username"}, BatchSize: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := testdb.Count(t, db, "user_queries"); n != len(users) {
+		t.Errorf("user_queries has %d rows, want %d", n, len(users))
+	}
+}
+
+func TestUpsertBumpsVersion(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	user := crud.CruddyUser2{FirstName: "Arthur", LastName: "Dent"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	// The primary key is a unique key too
+	updated := crud.CruddyUser2{FirstName: "Zaphod", LastName: "Beeblebrox"}
+	updated.ID = user.ID
+	if err := bulk.Upsert(ctx, db, &updated, bulk.UpsertOptions{On: []string{"id"}}); err != nil {
+		t.Fatal(err)
+	}
+	got := crud.CruddyUser2{}
+	if err := db.First(&got, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstName != "Zaphod" || got.Version != 1 {
+		t.Errorf("got %s at version %d, want Zaphod at version 1", got.FirstName, got.Version)
+	}
+}
+
+// hooked counts its hooks, and refuses a blank last name
+type hooked struct {
+	crud.CruddyUser2
+}
+
+var hookCalls = map[string]int{}
+
+func (h *hooked) BeforeSave() error {
+	hookCalls["BeforeSave"]++
+	if h.LastName == "" {
+		return errors.New("no last name")
+	}
+	return nil
+}
+
+func (h *hooked) BeforeCreate(scope *gorm.Scope) error {
+	hookCalls["BeforeCreate"]++
+	return scope.SetColumn("FirstName", strings.ToUpper(h.FirstName))
+}
+
+func (h *hooked) AfterCreate() { hookCalls["AfterCreate"]++ }
+
+func (h *hooked) AfterSave() { hookCalls["AfterSave"]++ }
+
+func (hooked) TableName() string { return "cruddy_user2" }
+
+func TestCreateInBatches(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	// Something already there, so the ids don't start at 1
+	if err := db.Create(&crud.CruddyUser{FirstName: "Marvin"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	users := make([]crud.CruddyUser, 25)
+	for i := range users {
+		users[i].FirstName = fmt.Sprintf("User %d", i)
+	}
+	if err := bulk.CreateInBatches(ctx, db, users, 10); err != nil {
+		t.Fatal(err)
+	}
+	for i, user := range users {
+		saved := crud.CruddyUser{}
+		if err := db.First(&saved, user.ID).Error; err != nil {
+			t.Fatalf("user %d got id %d, which isn't there: %v", i, user.ID, err)
+		}
+		if saved.FirstName != user.FirstName {
+			t.Errorf("id %d is %s, want %s", user.ID, saved.FirstName, user.FirstName)
+		}
+		if user.CreatedAt.IsZero() {
+			t.Errorf("user %d has no CreatedAt", i)
+		}
+	}
+}
+
+// unevenIDs is SQLite pretending to be a MySQL server whose ids can't be counted on, and noting how many rows each INSERT had
+type unevenIDs struct {
+	dialect.Dialect
+	rows []int
+}
+
+func (d *unevenIDs) InsertIDStep(db *gorm.DB) (int64, error) {
+	return 0, nil
+}
+
+func (d *unevenIDs) FirstInsertID(lastInsertID int64, n int) int64 {
+	d.rows = append(d.rows, n)
+	return d.Dialect.FirstInsertID(lastInsertID, n)
+}
+
+func TestCreateInBatchesUnevenIDs(t *testing.T) {
+	db := testdb.Open(t)
+	sqlite := dialect.Of(db)
+	if sqlite.Name() != "sqlite3" {
+		t.Skip("only stands in for SQLite")
+	}
+	uneven := &unevenIDs{Dialect: sqlite}
+	dialect.Register(uneven)
+	t.Cleanup(func() { dialect.Register(sqlite) })
+
+	users := make([]crud.CruddyUser, 5)
+	for i := range users {
+		users[i].FirstName = fmt.Sprintf("User %d", i)
+	}
+	if err := bulk.CreateInBatches(context.Background(), db, users, 10); err != nil {
+		t.Fatal(err)
+	}
+	// CruddyUser has no unique key to find the rows by
+	if len(uneven.rows) != len(users) {
+		t.Errorf("inserted in %d statements of %v rows, want one per user", len(uneven.rows), uneven.rows)
+	}
+	for _, user := range users {
+		saved := crud.CruddyUser{}
+		if err := db.First(&saved, user.ID).Error; err != nil || saved.FirstName != user.FirstName {
+			t.Errorf("id %d is %q (%v), want %s", user.ID, saved.FirstName, err, user.FirstName)
+		}
+	}
+}
+
+func TestCreateInBatchesUnevenIDsByUniqueKey(t *testing.T) {
+	db := testdb.Open(t)
+	sqlite := dialect.Of(db)
+	if sqlite.Name() != "sqlite3" {
+		t.Skip("only stands in for SQLite")
+	}
+	// Something already there, so the ids don't start at 1
+	if err := db.Create(&query.UserQuery{Username: "marvin"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	uneven := &unevenIDs{Dialect: sqlite}
+	dialect.Register(uneven)
+	t.Cleanup(func() { dialect.Register(sqlite) })
+
+	// Username has a unique index, so the ids are looked up by it rather than worked out from LastInsertId
+	users := make([]query.UserQuery, 5)
+	for i := range users {
+		users[i].Username = fmt.Sprintf("user%d", i)
+	}
+	if err := bulk.CreateInBatches(context.Background(), db, users, 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(uneven.rows) != 0 {
+		t.Errorf("ids were worked out from LastInsertId for INSERTs of %v rows, want them looked up by username", uneven.rows)
+	}
+	for _, user := range users {
+		saved := query.UserQuery{}
+		if err := db.First(&saved, user.ID).Error; err != nil || saved.Username != user.Username {
+			t.Errorf("id %d is %q (%v), want %s", user.ID, saved.Username, err, user.Username)
+		}
+	}
+}
+
+func TestCreateInBatchesDefaults(t *testing.T) {
+	db := testdb.Open(t)
+	// smith has no first name, so like Create the column is left to its DEFAULT and read back
+	users := []*dbSchema.BasicUser{
+		{Username: "adent", FirstName: "Arthur", LastName: "Dent"},
+		{Username: "smith", LastName: "Smith"},
+		{Username: "jones", LastName: "Jones"},
+	}
+	if err := bulk.CreateInBatches(context.Background(), db, users, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range users {
+		if user.ID == 0 {
+			t.Errorf("%s has no id", user.Username)
+		}
+	}
+	if users[1].FirstName != "Annica" || users[2].FirstName != "Annica" {
+		t.Errorf("the defaulted first names are %q and %q, want Annica", users[1].FirstName, users[2].FirstName)
+	}
+	if n := testdb.Count(t, db, "basic_users", "first_name = ?", "Annica"); n != 2 {
+		t.Errorf("%d users are called Annica, want 2", n)
+	}
+}
+
+func TestCreateInBatchesHooks(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	hookCalls = map[string]int{}
+	users := []hooked{{}, {}}
+	users[0].FirstName, users[0].LastName = "arthur", "Dent"
+	users[1].FirstName, users[1].LastName = "ford", "Prefect"
+	if err := bulk.CreateInBatches(ctx, db, users, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, hook := range []string{"BeforeSave", "BeforeCreate", "AfterCreate", "AfterSave"} {
+		if hookCalls[hook] != 2 {
+			t.Errorf("%s ran %d times, want 2", hook, hookCalls[hook])
+		}
+	}
+	if n := testdb.Count(t, db, "cruddy_user2", "first_name = ?", "ARTHUR"); n != 1 {
+		t.Error("the change BeforeCreate made wasn't saved")
+	}
+
+	// One bad model stops the lot
+	bad := []hooked{{}, {}}
+	bad[0].FirstName, bad[0].LastName = "Tricia", "Macmillan"
+	bad[1].FirstName = "Zaphod"
+	if err := bulk.CreateInBatches(ctx, db, bad, 0); err == nil {
+		t.Error("a BeforeSave error didn't stop CreateInBatches")
+	}
+	if n := testdb.Count(t, db, "cruddy_user2"); n != 2 {
+		t.Errorf("cruddy_user2 has %d rows, want nothing from the failed batch", n)
+	}
+}
+
+// The benchmarks insert the same 1000 users one Create at a time and with CreateInBatches
+// go test ./bulk -bench . -run XXX
+
+const benchmarkUsers = 1000
+
+func benchmarkCreate(b *testing.B, create func(ctx context.Context, db *gorm.DB, users []crud.CruddyUser) error) {
+	db := testdb.Open(b)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := db.Exec("DELETE FROM cruddy_users").Error; err != nil {
+			b.Fatal(err)
+		}
+		users := make([]crud.CruddyUser, benchmarkUsers)
+		for j := range users {
+			users[j] = crud.CruddyUser{FirstName: "Arthur", LastName: fmt.Sprintf("Dent %d", j)}
+		}
+		b.StartTimer()
+		if err := create(ctx, db, users); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*benchmarkUsers)/b.Elapsed().Seconds(), "rows/s")
+}
+
+func BenchmarkCreateOneByOne(b *testing.B) {
+	benchmarkCreate(b, func(ctx context.Context, db *gorm.DB, users []crud.CruddyUser) error {
+		// In a transaction, to be fair - otherwise every row is its own commit and it's slower still
+		tx := db.BeginTx(ctx, nil)
+		for i := range users {
+			if err := tx.Create(&users[i]).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit().Error
+	})
+}
+
+func BenchmarkCreateInBatches(b *testing.B) {
+	for _, size := range []int{10, 100, 500} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			benchmarkCreate(b, func(ctx context.Context, db *gorm.DB, users []crud.CruddyUser) error {
+				return bulk.CreateInBatches(ctx, db, users, size)
+			})
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package bulk
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/integrity"
+	"github.com/annicaburns/learngorm/validation"
+)
+
+// CreateInBatches does what Create does for every model in values, but with one multi-row INSERT per size rows (DefaultBatchSize when 0)
+// values is a slice of models or pointers to them - their ids are filled in afterwards, and so are blank fields the database gave a DEFAULT
+// On MySQL with innodb_autoinc_lock_mode=2 (MySQL 8's default) one statement's ids can have gaps, so they're looked up again by a unique key - see dialect.InsertIDStep
+// A model with no unique key of one column, set in every row, has nothing to look them up by - those models go in one per INSERT, as slowly as Create
+// BeforeSave, BeforeCreate, AfterCreate and AfterSave run for every model, the before hooks ahead of the first INSERT and the after hooks once the last is done
+// Every model is validated after the before hooks, and one that fails stops the lot - see the validation package
+// An error from a hook or a statement rolls the whole lot back
+// Associations aren't saved - create them with another CreateInBatches once their parents have ids
+func CreateInBatches(ctx context.Context, db *gorm.DB, values interface{}, size int) error {
+	elems, err := elements(values)
+	if err != nil || len(elems) == 0 {
+		return err
+	}
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	return inTx(ctx, db, func(tx *gorm.DB, exec execer) error {
+		if err := callHooks(tx, elems, "BeforeSave", "BeforeCreate"); err != nil {
+			return err
+		}
+		if err := validate(tx, elems); err != nil {
+			return err
+		}
+		// Read after the hooks, which may have changed the models
+		r, err := read(tx, elems, gorm.NowFunc(), true)
+		if err != nil {
+			return err
+		}
+		// The ids of one INSERT are worked out from the last one, which only works if the database spaces them evenly
+		// When it doesn't, they're found again by a unique key, and without one the rows go in one at a time
+		step := int64(1)
+		var key *column
+		if r.model.primary != nil && r.primaryKey == "" {
+			if step, err = dialect.Of(tx).InsertIDStep(tx); err != nil {
+				return err
+			}
+			if step == 0 {
+				if key = r.uniqueKey(); key == nil {
+					size = 1
+				}
+			}
+		}
+		for _, group := range r.groups(size) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := create(ctx, tx, exec, r, group, step, key); err != nil {
+				return fmt.Errorf("creating %s: %w", r.table, err)
+			}
+		}
+		return callHooks(tx, elems, "AfterCreate", "AfterSave")
+	})
+}
+
+// callHooks calls the named methods on every model that has them, stopping at the first error
+func callHooks(tx *gorm.DB, elems []reflect.Value, methods ...string) error {
+	// Every model is the same type, so when it has none of the methods there's no need for a Scope per model
+	has := false
+	for _, method := range methods {
+		if _, ok := elems[0].Addr().Type().MethodByName(method); ok {
+			has = true
+		}
+	}
+	if !has {
+		return nil
+	}
+	for _, elem := range elems {
+		scope := tx.NewScope(elem.Addr().Interface())
+		for _, method := range methods {
+			if scope.CallMethod(method); scope.HasError() {
+				return scope.DB().Error
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks every model the way the validation and integrity packages' callbacks would - GORM's callbacks never see these rows
+func validate(db *gorm.DB, elems []reflect.Value) error {
+	for i, elem := range elems {
+		if err := validation.Check(db, elem.Addr().Interface()); err != nil {
+			return fmt.Errorf("row %d: %w", i, err)
+		}
+		if err := integrity.Check(db, elem.Addr().Interface()); err != nil {
+			return fmt.Errorf("row %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// create inserts one group of rows, then writes the ids and defaults the database chose back into the models - step apart, from the first
+// With a key, the ids are looked up by it instead
+func create(ctx context.Context, tx *gorm.DB, exec execer, r *rows, group []row, step int64, key *column) error {
+	d := dialect.Of(tx)
+	primary := r.model.primary
+	backfill := primary != nil && r.primaryKey == ""
+
+	// PostgreSQL has no LastInsertId, so GORM's dialect asks for the ids with RETURNING - the others say nothing
+	suffix := ""
+	if backfill {
+		suffix = tx.Dialect().LastInsertIDReturningSuffix(d.Quote(r.table), d.Quote(primary.DBName))
+	}
+	sql, args := insert(tx, r.table, group, suffix)
+
+	ids := make([]int64, 0, len(group))
+	if suffix != "" {
+		returned, err := exec.QueryContext(ctx, sql, args...)
+		if err != nil {
+			return err
+		}
+		defer returned.Close()
+		for returned.Next() {
+			var id int64
+			if err := returned.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if err := returned.Err(); err != nil {
+			return err
+		}
+	} else {
+		result, err := exec.ExecContext(ctx, sql, args...)
+		if err != nil {
+			return err
+		}
+		switch {
+		case backfill && key != nil:
+			if ids, err = findIDs(ctx, tx, exec, r, group, key); err != nil {
+				return err
+			}
+		case backfill:
+			last, err := result.LastInsertId()
+			if err != nil {
+				return err
+			}
+			first := d.FirstInsertID(last, len(group))
+			for i := range group {
+				ids = append(ids, first+step*int64(i))
+			}
+		}
+	}
+
+	if backfill {
+		if len(ids) != len(group) {
+			return fmt.Errorf("inserted %d rows but got %d ids back", len(group), len(ids))
+		}
+		for i, row := range group {
+			if err := set(primary.value(row.elem), ids[i]); err != nil {
+				return fmt.Errorf("setting %s: %w", primary.Name, err)
+			}
+		}
+	}
+	if len(group[0].defaulted) > 0 && primary != nil {
+		return reloadDefaults(ctx, tx, exec, r.table, primary.DBName, group)
+	}
+	return nil
+}
+
+// findIDs looks up the ids of a group just inserted by a unique key, in the same transaction - for when the database doesn't space them evenly
+func findIDs(ctx context.Context, tx *gorm.DB, exec execer, r *rows, group []row, key *column) ([]int64, error) {
+	d := dialect.Of(tx)
+	byKey := map[string]int{}
+	placeholders := make([]string, len(group))
+	args := make([]interface{}, len(group))
+	for i, row := range group {
+		args[i] = reflect.Indirect(key.value(row.elem)).Interface()
+		placeholders[i] = dialect.BindVar(tx, i+1)
+		byKey[fmt.Sprint(args[i])] = i
+	}
+	sql := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IN (%s)",
+		d.Quote(r.model.primary.DBName), d.Quote(key.DBName), d.Quote(r.table), d.Quote(key.DBName), strings.Join(placeholders, ", "))
+
+	found, err := exec.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("finding the ids by %s: %w", key.DBName, err)
+	}
+	defer found.Close()
+	ids := make([]int64, len(group))
+	matched := 0
+	for found.Next() {
+		// The key is a string or an integer, so it scans into a string just as fmt.Sprint printed it
+		var id int64
+		var value string
+		if err := found.Scan(&id, &value); err != nil {
+			return nil, fmt.Errorf("finding the ids by %s: %w", key.DBName, err)
+		}
+		if i, ok := byKey[value]; ok {
+			ids[i] = id
+			matched++
+		}
+	}
+	if err := found.Err(); err != nil {
+		return nil, fmt.Errorf("finding the ids by %s: %w", key.DBName, err)
+	}
+	return ids[:matched], nil
+}
+
+// reloadDefaults reads back the columns the rows left to their DEFAULT, like Create does after inserting one model
+func reloadDefaults(ctx context.Context, tx *gorm.DB, exec execer, table, primaryKey string, group []row) error {
+	d := dialect.Of(tx)
+	columns := []string{d.Quote(primaryKey)}
+	for _, column := range group[0].defaulted {
+		columns = append(columns, d.Quote(column))
+	}
+	byID := map[string]row{}
+	placeholders := make([]string, len(group))
+	args := make([]interface{}, len(group))
+	for i, row := range group {
+		args[i] = tx.NewScope(row.elem.Addr().Interface()).PrimaryKeyValue()
+		placeholders[i] = dialect.BindVar(tx, i+1)
+		byID[fmt.Sprint(args[i])] = row
+	}
+	sql := fmt.Sprintf("SELECT %s FROM %s WHERE %s IN (%s)",
+		strings.Join(columns, ", "), d.Quote(table), d.Quote(primaryKey), strings.Join(placeholders, ", "))
+
+	found, err := exec.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("reloading defaults: %w", err)
+	}
+	defer found.Close()
+	for found.Next() {
+		// The rows come back in any order, so scan loosely and match them up by id before setting the fields
+		var id int64
+		values := make([]interface{}, len(group[0].defaulted))
+		dest := []interface{}{&id}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := found.Scan(dest...); err != nil {
+			return fmt.Errorf("reloading defaults: %w", err)
+		}
+		row, ok := byID[fmt.Sprint(id)]
+		if !ok {
+			continue
+		}
+		scope := tx.NewScope(row.elem.Addr().Interface())
+		for i, column := range group[0].defaulted {
+			if field, ok := scope.FieldByName(column); ok {
+				if err := field.Set(values[i]); err != nil {
+					return fmt.Errorf("reloading %s: %w", column, err)
+				}
+			}
+		}
+	}
+	return found.Err()
+}
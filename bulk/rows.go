@@ -0,0 +1,309 @@
+package bulk
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/transaction"
+)
+
+// DefaultBatchSize is how many rows go in one statement when the options don't say
+const DefaultBatchSize = 500
+
+// row is one model read out into the columns and values of an INSERT
+type row struct {
+	elem    reflect.Value
+	columns []string
+	values  []interface{}
+	// defaulted are the blank columns left out for the database to fill in from their DEFAULT
+	defaulted []string
+}
+
+// rows are the models being written to one table
+type rows struct {
+	model *model
+	table string
+	// primaryKey is the primary key column, or "" when the rows leave it to the database
+	primaryKey string
+	list       []row
+}
+
+// model is what the rows need from GORM's view of a struct, worked out once rather than for every row - building a Scope per row is slow
+type model struct {
+	table   string
+	columns []column
+	primary *column
+}
+
+// column is a field that maps to a column, with the path to it through any embedded structs
+type column struct {
+	*gorm.StructField
+	path [][]int
+}
+
+// newModel reads the model struct of elem's type
+func newModel(db *gorm.DB, elem reflect.Value) *model {
+	scope := db.NewScope(elem.Addr().Interface())
+	m := &model{table: scope.TableName()}
+	primary := scope.PrimaryField()
+	for _, field := range scope.GetModelStruct().StructFields {
+		if field.IsIgnored || !field.IsNormal {
+			continue
+		}
+		c := column{StructField: field}
+		t := elem.Type()
+		for _, name := range field.Names {
+			for t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			f, _ := t.FieldByName(name)
+			c.path = append(c.path, f.Index)
+			t = f.Type
+		}
+		m.columns = append(m.columns, c)
+		if primary != nil && field.DBName == primary.DBName {
+			m.primary = &m.columns[len(m.columns)-1]
+		}
+	}
+	// The pointer into columns is only safe once it has stopped growing
+	if m.primary != nil {
+		for i := range m.columns {
+			if m.columns[i].DBName == m.primary.DBName {
+				m.primary = &m.columns[i]
+			}
+		}
+	}
+	return m
+}
+
+// value finds the column's field in elem, filling in nil embedded pointers on the way like Scope.Fields does
+func (c column) value(elem reflect.Value) reflect.Value {
+	v := elem
+	for _, index := range c.path {
+		for _, i := range index {
+			if v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					v.Set(reflect.New(v.Type().Elem()))
+				}
+				v = v.Elem()
+			}
+			v = v.Field(i)
+		}
+	}
+	return v
+}
+
+// elements takes a slice of structs, a slice of pointers to them, a pointer to either, or a pointer to a single struct
+func elements(values interface{}) ([]reflect.Value, error) {
+	v := reflect.ValueOf(values)
+	for v.Kind() == reflect.Ptr && v.Elem().Kind() != reflect.Struct {
+		v = v.Elem()
+	}
+	elems := []reflect.Value{}
+	switch {
+	case v.Kind() == reflect.Ptr:
+		elems = append(elems, v.Elem())
+	case v.Kind() == reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			elem := v.Index(i)
+			if elem.Kind() == reflect.Ptr {
+				elem = elem.Elem()
+			}
+			if elem.Kind() != reflect.Struct {
+				return nil, fmt.Errorf("bulk: want a slice of structs, got %T", values)
+			}
+			elems = append(elems, elem)
+		}
+	default:
+		return nil, fmt.Errorf("bulk: want a slice of structs or a pointer to one, got %T", values)
+	}
+	if len(elems) > 0 && !elems[0].CanAddr() {
+		return nil, fmt.Errorf("bulk: can't write back to the %s values - pass the slice itself, not an array", elems[0].Type())
+	}
+	return elems, nil
+}
+
+// read reads the models the way Create does - blank CreatedAt and UpdatedAt fields are stamped with now, in the structs as well as the rows
+// With omitDefaults, blank fields that have a default (a DEFAULT or AUTO_INCREMENT tag) are left out, so rows can end up with different columns
+func read(db *gorm.DB, elems []reflect.Value, now time.Time, omitDefaults bool) (*rows, error) {
+	m := newModel(db, elems[0])
+	r := &rows{model: m, table: m.table}
+	// Like Create, leave a blank primary key for the database to fill in - but then it has to be blank in every row
+	if m.primary != nil && !m.primary.value(elems[0]).IsZero() {
+		r.primaryKey = m.primary.DBName
+	}
+	for i, elem := range elems {
+		row := row{elem: elem}
+		for _, c := range m.columns {
+			v := c.value(elem)
+			blank := v.IsZero()
+			if m.primary != nil && c.DBName == m.primary.DBName {
+				if blank != (r.primaryKey == "") {
+					return nil, fmt.Errorf("bulk: %s row %d: either every row has a primary key or none do", r.table, i)
+				}
+				if blank {
+					continue
+				}
+			}
+			if omitDefaults && blank && c.HasDefaultValue {
+				row.defaulted = append(row.defaulted, c.DBName)
+				continue
+			}
+			if (c.Name == "CreatedAt" || c.Name == "UpdatedAt") && blank {
+				if err := set(v, now); err != nil {
+					return nil, fmt.Errorf("bulk: %s row %d: %s: %w", r.table, i, c.Name, err)
+				}
+			}
+			row.columns = append(row.columns, c.DBName)
+			row.values = append(row.values, v.Interface())
+		}
+		r.list = append(r.list, row)
+	}
+	return r, nil
+}
+
+// uniqueKey finds a column besides the primary key that's unique on its own and set in every row, to find the rows by once they're inserted
+// Only strings and integers will do, since they read back the same way they were written
+func (r *rows) uniqueKey() *column {
+	// A unique_index named on more than one field is one index over all of them
+	indexes := map[string]int{}
+	for _, c := range r.model.columns {
+		if name, ok := c.TagSettingsGet("UNIQUE_INDEX"); ok {
+			indexes[name]++
+		}
+	}
+	for i := range r.model.columns {
+		c := &r.model.columns[i]
+		if c == r.model.primary {
+			continue
+		}
+		_, unique := c.TagSettingsGet("UNIQUE")
+		// An unnamed unique_index has its own name as the setting
+		if name, ok := c.TagSettingsGet("UNIQUE_INDEX"); ok && (name == "UNIQUE_INDEX" || indexes[name] == 1) {
+			unique = true
+		}
+		if !unique || !keyKind(c.Struct.Type) {
+			continue
+		}
+		set := true
+		for _, row := range r.list {
+			if !row.has(c.DBName) || c.value(row.elem).IsZero() {
+				set = false
+				break
+			}
+		}
+		if set {
+			return c
+		}
+	}
+	return nil
+}
+
+// keyKind reports whether t, or what it points to, is a string or an integer
+func keyKind(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// set assigns x to v, converting it or taking its address as needed - e.g. a time.Time into a *time.Time field
+func set(v reflect.Value, x interface{}) error {
+	xv := reflect.ValueOf(x)
+	switch {
+	case xv.Type().AssignableTo(v.Type()):
+		v.Set(xv)
+	case xv.Type().ConvertibleTo(v.Type()):
+		v.Set(xv.Convert(v.Type()))
+	case v.Kind() == reflect.Ptr && xv.Type().ConvertibleTo(v.Type().Elem()):
+		p := reflect.New(v.Type().Elem())
+		p.Elem().Set(xv.Convert(v.Type().Elem()))
+		v.Set(p)
+	default:
+		return fmt.Errorf("can't set a %s to a %s", v.Type(), xv.Type())
+	}
+	return nil
+}
+
+// has reports whether column is one of the columns being inserted
+func (r row) has(column string) bool {
+	for _, c := range r.columns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// groups splits the rows into runs that insert the same columns, in order, each at most size rows long
+func (r *rows) groups(size int) [][]row {
+	byColumns := map[string]int{}
+	groups := [][]row{}
+	for _, row := range r.list {
+		key := strings.Join(row.columns, ",")
+		i, ok := byColumns[key]
+		if !ok || len(groups[i]) == size {
+			i = len(groups)
+			byColumns[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], row)
+	}
+	return groups
+}
+
+// insert renders an INSERT of rows that share their columns, followed by suffix, and returns it with its arguments
+func insert(db *gorm.DB, table string, rows []row, suffix string) (string, []interface{}) {
+	d := dialect.Of(db)
+	quoted := make([]string, len(rows[0].columns))
+	for i, column := range rows[0].columns {
+		quoted[i] = d.Quote(column)
+	}
+	sql := &strings.Builder{}
+	fmt.Fprintf(sql, "INSERT INTO %s (%s) VALUES ", d.Quote(table), strings.Join(quoted, ", "))
+	args := make([]interface{}, 0, len(rows)*len(quoted))
+	for i, row := range rows {
+		if i > 0 {
+			sql.WriteString(", ")
+		}
+		sql.WriteString("(")
+		for col, value := range row.values {
+			if col > 0 {
+				sql.WriteString(", ")
+			}
+			args = append(args, value)
+			sql.WriteString(dialect.BindVar(db, len(args)))
+		}
+		sql.WriteString(")")
+	}
+	if suffix != "" {
+		sql.WriteString(" " + suffix)
+	}
+	return sql.String(), args
+}
+
+// execer is what *sql.DB and *sql.Tx have in common
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// inTx runs fn in a transaction tied to ctx, or in a savepoint when db is a transaction already
+// The statements go straight to database/sql - GORM's Exec rewrites the placeholders one at a time, which crawls with thousands of them
+func inTx(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB, exec execer) error) error {
+	return transaction.WithTx(ctx, db, func(tx *gorm.DB) error {
+		return fn(tx, tx.CommonDB().(*sql.Tx))
+	})
+}
@@ -0,0 +1,115 @@
+package bulk
+
+/*
+* Statements that write many rows at once, for the jobs where one GORM call per row is too slow or can't say what we mean
+	* CreateInBatches is Create for a whole slice, a few hundred rows per INSERT
+	* Upsert inserts rows, or updates the ones whose unique key is already taken - FirstOrCreate only manages one record, and never updates it
+* Rows are read from the models the way Create reads them - a blank primary key is left to the database and blank CreatedAt/UpdatedAt fields are stamped
+* Everything runs in one transaction, or in a savepoint of the caller's if db is one already
+*/
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/dberrors"
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/locking"
+)
+
+// UpsertOptions picks the unique key and what happens to a row that already has it
+type UpsertOptions struct {
+	// On lists the columns of the unique key, by their database names - e.g. "username" or BasicUser's "LastName"
+	// PostgreSQL and SQLite need a unique index or constraint on exactly these columns; MySQL checks every unique key whatever On says
+	On []string
+	// Update lists the columns to overwrite on an existing row
+	// Leave it empty to overwrite every column being inserted except On, the primary key, created_at and deleted_at - so a soft deleted row stays deleted
+	Update []string
+	// DoNothing leaves existing rows exactly as they are - only new rows go in
+	DoNothing bool
+	// BatchSize is the number of rows per statement - DefaultBatchSize when 0
+	BatchSize int
+}
+
+// Upsert inserts values, updating the rows that already exist with the same On columns
+// values is a slice of models (or pointers to them), or a pointer to one model
+// IDs aren't read back - the databases can't all say which rows were inserted and which were updated, so reload by the On columns if they're needed
+// Every model is validated first, as a whole - see the validation package
+// A model with a Version field has its version bumped on every row that gets updated, so open copies of them go stale - see the locking package
+func Upsert(ctx context.Context, db *gorm.DB, values interface{}, opts UpsertOptions) error {
+	elems, err := elements(values)
+	if err != nil || len(elems) == 0 {
+		return err
+	}
+	if err := validate(db, elems); err != nil {
+		return err
+	}
+	// Every row inserts every column, blank or not - a conflict should overwrite with exactly what was given
+	r, err := read(db, elems, gorm.NowFunc(), false)
+	if err != nil {
+		return err
+	}
+	if len(opts.On) == 0 {
+		return fmt.Errorf("bulk: upserting into %s needs the On columns of a unique key", r.table)
+	}
+	for _, column := range append(append([]string{}, opts.On...), opts.Update...) {
+		if !r.list[0].has(column) {
+			return fmt.Errorf("bulk: %s has no column %q to upsert on", r.table, column)
+		}
+	}
+
+	d := dialect.Of(db)
+	set := []string{}
+	if !opts.DoNothing {
+		update := opts.Update
+		if len(update) == 0 {
+			update = defaultUpdate(r, opts.On)
+		}
+		version := ""
+		if field, ok := locking.VersionField(db.NewScope(elems[0].Addr().Interface())); ok {
+			version = field.DBName
+		}
+		for _, column := range update {
+			if column == version {
+				continue
+			}
+			set = append(set, d.Quote(column)+" = "+d.Excluded(column))
+		}
+		if version != "" && len(set) > 0 {
+			set = append(set, fmt.Sprintf("%s = %s.%s + 1", d.Quote(version), d.Quote(r.table), d.Quote(version)))
+		}
+	}
+	suffix := d.UpsertSQL(opts.On, set)
+
+	size := opts.BatchSize
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	return inTx(ctx, db, func(tx *gorm.DB, exec execer) error {
+		for _, group := range r.groups(size) {
+			sql, args := insert(tx, r.table, group, suffix)
+			if _, err := exec.ExecContext(ctx, sql, args...); err != nil {
+				// The statement is ours rather than GORM's, so the dberrors callbacks never see the error
+				return fmt.Errorf("upserting into %s: %w", r.table, dberrors.Classify(err))
+			}
+		}
+		return nil
+	})
+}
+
+// defaultUpdate is every inserted column the row's identity and history don't depend on
+func defaultUpdate(r *rows, on []string) []string {
+	skip := map[string]bool{r.primaryKey: true, "created_at": true, "deleted_at": true}
+	for _, column := range on {
+		skip[column] = true
+	}
+	update := []string{}
+	for _, column := range r.list[0].columns {
+		if !skip[column] {
+			update = append(update, column)
+		}
+	}
+	return update
+}
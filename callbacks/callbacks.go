@@ -0,0 +1,22 @@
+package callbacks
+
+/*
+* Importing this package switches on every callback the other packages add to GORM's DefaultCallback
+	* jinzhu/gorm has one global set of callbacks, so each package registers its own from init - but only once something imports it
+	* connection and testdb both import this, so the CLI's connections and the tests' get the same ones
+	* A new package with callbacks of its own belongs in the list below, not in connection or testdb
+* Order doesn't matter here - each callback says where it goes relative to GORM's own with Before and After
+*/
+
+import (
+	// Optimistic locking for models with a Version field
+	_ "github.com/annicaburns/learngorm/locking"
+	// The audit log of every create, update and delete
+	_ "github.com/annicaburns/learngorm/audit"
+	// Constraint violations as dberrors' typed errors
+	_ "github.com/annicaburns/learngorm/dberrors"
+	// Validation of validate tags and Validate() before a save
+	_ "github.com/annicaburns/learngorm/validation"
+	// Polymorphic owner checks before a save
+	_ "github.com/annicaburns/learngorm/integrity"
+)
@@ -0,0 +1,288 @@
+package connection
+
+/*
+* Every demo used to call gorm.Open with its own hardcoded connection string
+	* Now the connection details live in a Config struct that can be filled from defaults, a JSON config file and environment variables (in that order)
+	* Open turns a Config into a *gorm.DB handle that gets passed into each demo function
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	// Every connection gets the callbacks the other packages register
+	_ "github.com/annicaburns/learngorm/callbacks"
+	"github.com/annicaburns/learngorm/dialect"
+)
+
+// Environment variables read by FromEnv
+const (
+	EnvConfigFile      = "LEARNGORM_CONFIG"
+	EnvDSN             = "LEARNGORM_DSN"
+	EnvDriver          = "LEARNGORM_DB_DRIVER"
+	EnvHost            = "LEARNGORM_DB_HOST"
+	EnvPort            = "LEARNGORM_DB_PORT"
+	EnvUser            = "LEARNGORM_DB_USER"
+	EnvPassword        = "LEARNGORM_DB_PASSWORD"
+	EnvDatabase        = "LEARNGORM_DB_NAME"
+	EnvParams          = "LEARNGORM_DB_PARAMS"
+	EnvMaxIdleConns    = "LEARNGORM_DB_MAX_IDLE_CONNS"
+	EnvMaxOpenConns    = "LEARNGORM_DB_MAX_OPEN_CONNS"
+	EnvConnMaxLifetime = "LEARNGORM_DB_CONN_MAX_LIFETIME"
+)
+
+// Config holds everything needed to open a database connection
+type Config struct {
+	// Driver is the dialect name - mysql, postgres or sqlite3
+	Driver   string `json:"driver"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// For sqlite3 Database is a file path, or :memory: for a throwaway in-memory database
+	Database string `json:"database"`
+	// Params are appended to the connection string - e.g. parseTime, loc, charset
+	// Need to include parseTime=true if you want the gorm model fields to update updated_at when anything related to the object changes
+	// https://github.com/jinzhu/gorm/issues/958
+	Params map[string]string `json:"params"`
+	// RawDSN is used verbatim instead of building a connection string from the fields above
+	RawDSN string `json:"dsn"`
+	// Pool settings are handed to the underlying *sql.DB - zero leaves the database/sql default in place
+	MaxIdleConns    int      `json:"maxIdleConns"`
+	MaxOpenConns    int      `json:"maxOpenConns"`
+	ConnMaxLifetime Duration `json:"connMaxLifetime"`
+}
+
+// Duration lets the config file spell out durations as strings like "5m"
+type Duration time.Duration
+
+// UnmarshalJSON accepts either a duration string or a number of nanoseconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+	var n int64
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("duration must be a string or a number: %s", b)
+	}
+	*d = Duration(n)
+	return nil
+}
+
+// DefaultConfig matches the MySQL server the demos were originally written against
+func DefaultConfig() Config {
+	return Config{
+		Driver:   "mysql",
+		Host:     "localhost",
+		Port:     23306,
+		User:     "gorm",
+		Password: "gorm",
+		Database: "gorm",
+		Params:   map[string]string{"parseTime": "true"},
+	}
+}
+
+// Load builds a Config from the defaults, then the config file (if path isn't empty), then the environment
+func Load(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		var err error
+		if cfg, err = LoadFile(path, cfg); err != nil {
+			return cfg, err
+		}
+	}
+	return FromEnv(cfg)
+}
+
+// LoadFile reads a JSON config file over the top of cfg - fields missing from the file keep their values from cfg
+func LoadFile(path string, cfg Config) (Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("reading config file: %v", err)
+	}
+	// Params are merged rather than replaced so the file only has to list the ones it cares about
+	params := cfg.Params
+	cfg.Params = nil
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing config file %s: %v", path, err)
+	}
+	cfg.Params = mergeParams(params, cfg.Params)
+	return cfg, nil
+}
+
+// FromEnv overrides cfg with LEARNGORM_DSN and any LEARNGORM_DB_* environment variables that are set
+func FromEnv(cfg Config) (Config, error) {
+	setString := func(key string, field *string) {
+		if v, ok := os.LookupEnv(key); ok {
+			*field = v
+		}
+	}
+	setInt := func(key string, field *int) error {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		*field = n
+		return nil
+	}
+
+	setString(EnvDSN, &cfg.RawDSN)
+	setString(EnvDriver, &cfg.Driver)
+	setString(EnvHost, &cfg.Host)
+	setString(EnvUser, &cfg.User)
+	setString(EnvPassword, &cfg.Password)
+	setString(EnvDatabase, &cfg.Database)
+	for key, field := range map[string]*int{
+		EnvPort:         &cfg.Port,
+		EnvMaxIdleConns: &cfg.MaxIdleConns,
+		EnvMaxOpenConns: &cfg.MaxOpenConns,
+	} {
+		if err := setInt(key, field); err != nil {
+			return cfg, err
+		}
+	}
+	if v, ok := os.LookupEnv(EnvConnMaxLifetime); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %v", EnvConnMaxLifetime, err)
+		}
+		cfg.ConnMaxLifetime = Duration(d)
+	}
+	// Params come in query string form: parseTime=true&loc=Local
+	if v, ok := os.LookupEnv(EnvParams); ok {
+		params := map[string]string{}
+		for _, pair := range strings.Split(v, "&") {
+			if pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return cfg, fmt.Errorf("%s: %q is not key=value", EnvParams, pair)
+			}
+			params[kv[0]] = kv[1]
+		}
+		cfg.Params = mergeParams(cfg.Params, params)
+	}
+	return cfg, nil
+}
+
+func mergeParams(base, overrides map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+// DSN renders the connection string gorm.Open expects for the configured driver
+func (c Config) DSN() (string, error) {
+	if c.RawDSN != "" {
+		return c.RawDSN, nil
+	}
+	switch c.Driver {
+	case "mysql":
+		// gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true
+		dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", c.User, c.Password, c.Host, c.Port, c.Database)
+		if query := c.query(); query != "" {
+			dsn += "?" + query
+		}
+		return dsn, nil
+	case "postgres":
+		// host=localhost port=5432 user=gorm password=gorm dbname=gorm sslmode=disable
+		// parseTime is a MySQL driver setting - pq always hands back time.Time, and would pass an unknown key on to the server
+		pairs := []string{
+			"host=" + c.Host,
+			"port=" + strconv.Itoa(c.Port),
+			"user=" + c.User,
+			"password=" + c.Password,
+			"dbname=" + c.Database,
+		}
+		for _, pair := range strings.Split(c.query(), "&") {
+			if pair != "" && !strings.HasPrefix(pair, "parseTime=") {
+				pairs = append(pairs, pair)
+			}
+		}
+		return strings.Join(pairs, " "), nil
+	case "sqlite3":
+		// Host, port and credentials mean nothing to SQLite
+		// A plain :memory: database would be private to a single pooled connection, so share its cache between them
+		dsn := "file:" + c.Database
+		params := c.query()
+		if c.Database == "" || c.Database == ":memory:" {
+			dsn = "file::memory:"
+			params = strings.TrimPrefix(params+"&cache=shared", "&")
+		}
+		// SQLite only enforces FK constraints on connections that ask, and the driver asks on every one it opens with _foreign_keys=1
+		if c.Params["_foreign_keys"] == "" && c.Params["_fk"] == "" {
+			params = strings.TrimPrefix(params+"&_foreign_keys=1", "&")
+		}
+		if params != "" {
+			dsn += "?" + params
+		}
+		return dsn, nil
+	default:
+		return "", fmt.Errorf("unsupported driver %q", c.Driver)
+	}
+}
+
+// query joins the params in key order so the same config always produces the same DSN
+func (c Config) query() string {
+	keys := make([]string, 0, len(c.Params))
+	for k := range c.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+c.Params[k])
+	}
+	return strings.Join(pairs, "&")
+}
+
+// Open connects to the database described by cfg and applies the pool settings
+// The caller owns the returned handle and should Close it when done
+func Open(cfg Config) (*gorm.DB, error) {
+	dsn, err := cfg.DSN()
+	if err != nil {
+		return nil, err
+	}
+	d, err := dialect.Get(cfg.Driver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := d.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.DB().SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.MaxOpenConns > 0 {
+		db.DB().SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		db.DB().SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime))
+	}
+	return db, nil
+}
@@ -1,27 +1,42 @@
 package crud
 
 import (
+	"context"
+	"errors"
 	"time"
-	// Anonymous import - package just needs to initialize in order to establish itself as a database driver
-	_ "github.com/go-sql-driver/mysql"
 
 	"fmt"
 
 	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/audit"
+	"github.com/annicaburns/learngorm/locking"
+	"github.com/annicaburns/learngorm/registry"
+	"github.com/annicaburns/learngorm/repository"
+	"github.com/annicaburns/learngorm/softdelete"
+	"github.com/annicaburns/learngorm/transaction"
 )
 
+func init() {
+	registry.Register("crud.create-with-child-records", "Create a user and its appointments in one call", CreateWithChildRecords)
+	registry.Register("crud.update-records", "Update a user with Updates and a map of columns", UpdateRecords)
+	registry.Register("crud.batch-updates", "Update every row matching a where clause, including with a SQL expression", BatchUpdates)
+	registry.Register("crud.delete-records", "Hard delete a model with a plain ID, soft delete one with gorm.Model", DeleteRecords)
+	registry.Register("crud.batch-deletes", "Delete every row matching a where clause", BatchDeletes)
+	registry.Register("crud.transactions", "Create and update a user inside a transaction that gets rolled back", Transactions)
+	registry.Register("crud.optimistic-locking", "Two copies of one user saved in turn - the second is stale and gets retried", OptimisticLocking)
+	registry.Register("crud.repository", "The same create, update and delete calls through a generic repository", Repository)
+	registry.Register("crud.audit", "Three people change a user - the audit log says who did what, and what the user looked like before the delete", Audit)
+	registry.Register("crud.trash", "Soft delete a user with their appointments, list the trash, restore the user and purge what's old", Trash)
+	registry.RegisterModels(&CruddyUser{}, &CruddyAppointment{}, &CruddyUser2{}, &CruddyUser3{}, &CruddyUser4{})
+}
+
 // CreateWithChildRecords demonstrates some basic operations
-func CreateWithChildRecords() {
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
-	if err != nil {
-		panic(err.Error())
+func CreateWithChildRecords(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "cruddy_appointments", "cruddy_users"); err != nil {
+		return err
 	}
 
-	db.DropTableIfExists(&CruddyUser{})
-	db.CreateTable(&CruddyUser{})
-	db.DropTableIfExists(&CruddyAppointment{})
-	db.CreateTable(&CruddyAppointment{})
-
 	user := CruddyUser{
 		FirstName: "Arthur",
 		LastName:  "Dent",
@@ -37,28 +52,29 @@ func CreateWithChildRecords() {
 
 	// It may not be obvious in production code if the record you want to create exists yet - NewRecord returns a bool with the answer
 	if db.NewRecord(&user) {
-		db.Create(&user)
+		if err := db.Create(&user).Error; err != nil {
+			return registry.Step("create user with appointments", err)
+		}
 	}
 
 	// fmt.Println(db.NewRecord(&user))
 
+	return nil
 }
 
 // UpdateRecords demonstrates some update operations
-func UpdateRecords() {
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
-	if err != nil {
-		panic(err.Error())
+func UpdateRecords(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "cruddy_user2"); err != nil {
+		return err
 	}
 
-	db.DropTableIfExists(&CruddyUser2{})
-	db.CreateTable(&CruddyUser2{})
-
 	user := CruddyUser2{
 		FirstName: "Arthur",
 		LastName:  "Dent",
 	}
-	db.Create(&user)
+	if err := db.Create(&user).Error; err != nil {
+		return registry.Step("create user", err)
+	}
 	fmt.Println(user)
 	fmt.Println()
 
@@ -72,69 +88,78 @@ func UpdateRecords() {
 	// db.Model(&user).Update("first_name", "Marker")
 
 	// Can also use .Updates with a map to update muliple properties at once
-	db.Model(&user).Updates(
+	err := db.Model(&user).Updates(
 		map[string]interface{}{
 			"first_name": "Zaphod",
 			"last_name":  "Beeblebrox",
-		})
+		}).Error
+	if err != nil {
+		return registry.Step("update first and last name", err)
+	}
 
 	fmt.Println(user)
-
+	return nil
 }
 
 // BatchUpdates demonstrates scoping to a particular table and making a bunch of updates
-func BatchUpdates() {
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
-	if err != nil {
-		panic(err.Error())
+func BatchUpdates(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "cruddy_user3"); err != nil {
+		return err
 	}
 
-	db.DropTableIfExists(&CruddyUser3{})
-	db.CreateTable(&CruddyUser3{})
-
-	db.Create(&CruddyUser3{
+	err := db.Create(&CruddyUser3{
 		FirstName: "Tricia",
 		LastName:  "Dent",
 		Salary:    50000,
-	})
+	}).Error
+	if err != nil {
+		return registry.Step("create Tricia", err)
+	}
 
-	db.Create(&CruddyUser3{
+	err = db.Create(&CruddyUser3{
 		FirstName: "Arthur",
 		LastName:  "Dent",
 		Salary:    30000,
-	})
+	}).Error
+	if err != nil {
+		return registry.Step("create Arthur", err)
+	}
 
 	// The Table method scopes calls to a particular table - but we must speak about things (and call things) from the database perspective
 	// The Model method uses the semantics (and naming) of GO
-	db.Table("cruddy_user3").Where("last_name = ?", "Dent").Update("last_name", "Macmillan-Dent")
-
-	db.Table("cruddy_user3").Where("salary > ?", 40000).Update("salary", gorm.Expr("salary + 5000"))
+	err = db.Table("cruddy_user3").Where("last_name = ?", "Dent").Update("last_name", "Macmillan-Dent").Error
+	if err != nil {
+		return registry.Step("rename the Dents", err)
+	}
 
+	err = db.Table("cruddy_user3").Where("salary > ?", 40000).Update("salary", gorm.Expr("salary + 5000")).Error
+	if err != nil {
+		return registry.Step("raise salaries over 40000", err)
+	}
+	return nil
 }
 
 // DeleteRecords demonstrates hard and soft deletes
-func DeleteRecords() {
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
-	if err != nil {
-		panic(err.Error())
+func DeleteRecords(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "cruddy_user4", "cruddy_user2"); err != nil {
+		return err
 	}
 
-	db.DropTableIfExists(&CruddyUser4{})
-	db.CreateTable(&CruddyUser4{})
-	db.DropTableIfExists(&CruddyUser2{})
-	db.CreateTable(&CruddyUser2{})
-
 	// Note that the CruddyUser4 model has an ID field instead of the GORM model fields - a hard delete will occur
 	user := CruddyUser4{
 		FirstName: "Ford",
 		LastName:  "Prefect",
 	}
 
-	db.Create(&user)
+	if err := db.Create(&user).Error; err != nil {
+		return registry.Step("create CruddyUser4", err)
+	}
 
 	// By passing in the user object, GORM is smart enough to write a SQL statement based on the properties on that user object
 	// In this case it will know that we are using an object with an ID field and it's where clause will use the ID
-	db.Debug().Delete(&user)
+	if err := db.Debug().Delete(&user).Error; err != nil {
+		return registry.Step("hard delete CruddyUser4", err)
+	}
 
 	// A soft delete will happen here because we are deleting a model object that includes the GORM model fields instead of an ID field
 	modelUser := CruddyUser2{
@@ -142,70 +167,276 @@ func DeleteRecords() {
 		LastName:  "Prefect",
 	}
 
-	db.Create(&modelUser)
-	db.Debug().Delete(&modelUser)
+	if err := db.Create(&modelUser).Error; err != nil {
+		return registry.Step("create CruddyUser2", err)
+	}
+	if err := db.Debug().Delete(&modelUser).Error; err != nil {
+		return registry.Step("soft delete CruddyUser2", err)
+	}
 
 	// GORM considers this soft deleted record as truly deleted and will not return it from most queries
+	// So First comes back with gorm.ErrRecordNotFound - which is the point of the demo rather than a failure
 	user2 := CruddyUser2{}
-	db.First(&user2)
+	if err := db.First(&user2).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return registry.Step("look for the soft deleted user", err)
+	}
 	fmt.Println()
 	fmt.Println(user2)
-
+	return nil
 }
 
 // BatchDeletes demonstrates the obvious
-func BatchDeletes() {
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
-	if err != nil {
-		panic(err.Error())
+func BatchDeletes(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "cruddy_user2"); err != nil {
+		return err
 	}
 
-	db.DropTableIfExists(&CruddyUser2{})
-	db.CreateTable(&CruddyUser2{})
-
-	db.Create(&CruddyUser2{
+	err := db.Create(&CruddyUser2{
 		FirstName: "Tricia",
 		LastName:  "Macmillan-Dent",
-	})
+	}).Error
+	if err != nil {
+		return registry.Step("create Tricia", err)
+	}
 
-	db.Create(&CruddyUser2{
+	err = db.Create(&CruddyUser2{
 		FirstName: "Arthur",
 		LastName:  "Dent",
-	})
-
-	db.Where("last_name LIKE ?", "Mac%").Delete(&CruddyUser2{})
+	}).Error
+	if err != nil {
+		return registry.Step("create Arthur", err)
+	}
 
+	if err := db.Where("last_name LIKE ?", "Mac%").Delete(&CruddyUser2{}).Error; err != nil {
+		return registry.Step("delete the Macs", err)
+	}
+	return nil
 }
 
 // Transactions demonstrates the obvious
-func Transactions() {
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
-	if err != nil {
-		panic(err.Error())
+func Transactions(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "cruddy_user2"); err != nil {
+		return err
 	}
 
-	db.DropTableIfExists(&CruddyUser2{})
-	db.CreateTable(&CruddyUser2{})
-
 	user := CruddyUser2{
 		FirstName: "Marvin",
 		LastName:  "Robot",
 	}
 
-	// Create a transaction object
-	transaction := db.Begin()
+	// WithTx begins the transaction, commits it if the function returns nil and rolls it back if it returns an error or panics
+	// It's tied to ctx too - if ctx is cancelled the database rolls it back for us
+	err := transaction.WithTx(ctx, db, func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return registry.Step("create user", err)
+		}
+
+		// A nested WithTx is a savepoint - its failure only undoes its own changes, and the outer transaction carries on
+		err := transaction.WithTx(ctx, tx, func(tx *gorm.DB) error {
+			if err := tx.Model(&user).Update("last_name", "The Happy Robot").Error; err != nil {
+				return err
+			}
+			return errors.New("Marvin is never happy")
+		})
+		fmt.Println("nested:", err)
+
+		// The Update set the version and last name on the struct as well, so reload what the savepoint left behind
+		if err := tx.First(&user, user.ID).Error; err != nil {
+			return registry.Step("reload user", err)
+		}
+		fmt.Println(user.FirstName, user.LastName)
 
-	if err = transaction.Create(&user).Error; err != nil {
-		transaction.Rollback()
+		// Intentionally roll back the whole transaction - the error comes back out of WithTx
+		return errRolledBack
+	})
+	if !errors.Is(err, errRolledBack) {
+		return registry.Step("rollback", fmt.Errorf("got %v, want the rollback the demo asked for", err))
 	}
+	return nil
+}
 
-	user.LastName = "The Happy Robot"
-	// Intentionally rollback the transaction
-	if err = transaction.Save(&user).Error; err == nil {
-		transaction.Rollback()
+// errRolledBack is returned by the Transactions demo to roll its transaction back
+var errRolledBack = errors.New("rolled back on purpose")
+
+// OptimisticLocking demonstrates what the Version field on CruddyUser2 buys over UpdateRecords' last-writer-wins saves
+func OptimisticLocking(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "cruddy_user2"); err != nil {
+		return err
+	}
+	user := CruddyUser2{FirstName: "Arthur", LastName: "Dent"}
+	if err := db.Create(&user).Error; err != nil {
+		return registry.Step("create user", err)
+	}
+
+	// Two copies of the same row, as if two requests had loaded it at once
+	mine, theirs := CruddyUser2{}, CruddyUser2{}
+	if err := db.First(&mine, user.ID).Error; err != nil {
+		return registry.Step("load my copy", err)
+	}
+	if err := db.First(&theirs, user.ID).Error; err != nil {
+		return registry.Step("load their copy", err)
 	}
 
-	transaction.Commit()
+	// Their save bumps the version, so mine was loaded against a version that no longer exists
+	if err := db.Model(&theirs).Updates(map[string]interface{}{"last_name": "Beeblebrox"}).Error; err != nil {
+		return registry.Step("save their copy", err)
+	}
+	mine.FirstName = "Zaphod"
+	err := db.Save(&mine).Error
+	if !errors.Is(err, locking.ErrStaleObject) {
+		return registry.Step("save my stale copy", fmt.Errorf("got %v, want ErrStaleObject", err))
+	}
+	fmt.Println(err)
+
+	// Retry reloads the row and applies the change again - this time to their last name rather than over it
+	err = locking.Retry(ctx, audit.DB(ctx, db), &mine, 0, func(user *CruddyUser2) error {
+		user.FirstName = "Zaphod"
+		return nil
+	})
+	if err != nil {
+		return registry.Step("retry my change", err)
+	}
+	fmt.Println(mine)
+	return nil
+}
+
+// Repository demonstrates the repository package - the calls above, without repeating them for every struct
+func Repository(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "cruddy_user2"); err != nil {
+		return err
+	}
+	users := repository.New[CruddyUser2](db)
+
+	created := []CruddyUser2{
+		{FirstName: "Arthur", LastName: "Dent"},
+		{FirstName: "Ford", LastName: "Prefect"},
+		{FirstName: "Tricia", LastName: "Macmillan"},
+	}
+	for i := range created {
+		if err := users.Create(ctx, &created[i]); err != nil {
+			return registry.Step("create "+created[i].FirstName, err)
+		}
+	}
+
+	// A partial update with a map, like UpdateRecords - the BeforeUpdate and AfterUpdate callbacks still fire
+	arthur, err := users.Get(ctx, created[0].ID)
+	if err != nil {
+		return registry.Step("get Arthur", err)
+	}
+	if err := users.UpdateFields(ctx, arthur, map[string]interface{}{"first_name": "Zaphod", "last_name": "Beeblebrox"}); err != nil {
+		return registry.Step("update Arthur", err)
+	}
+
+	// Soft delete Ford, then list a page of what's left - Ford only shows up again once he's restored
+	// ResetTables doesn't reset the ids, so use the ones Create filled in
+	ford := created[1].ID
+	if err := users.Delete(ctx, ford); err != nil {
+		return registry.Step("delete Ford", err)
+	}
+	page, err := users.List(ctx, repository.ListOptions{Order: []string{"first_name"}, Limit: 2})
+	if err != nil {
+		return registry.Step("list users", err)
+	}
+	fmt.Println(page)
+	if err := users.Restore(ctx, ford); err != nil {
+		return registry.Step("restore Ford", err)
+	}
+
+	// Missing rows come back as repository.ErrNotFound rather than gorm.ErrRecordNotFound or a silent no-op
+	if _, err := users.Get(ctx, 42); !errors.Is(err, repository.ErrNotFound) {
+		return registry.Step("get a user that isn't there", fmt.Errorf("got %v, want ErrNotFound", err))
+	}
+	return nil
+}
+
+// Trash demonstrates the softdelete package - the deleted rows DeleteRecords loses track of, listed, brought back and cleared out
+func Trash(ctx context.Context, db *gorm.DB) error {
+	// Arthur and his First, Second and Third appointments
+	if err := CreateWithChildRecords(ctx, db); err != nil {
+		return err
+	}
+	user := CruddyUser{}
+	if err := db.Preload("Appointments").First(&user).Error; err != nil {
+		return registry.Step("load the user", err)
+	}
+
+	// The Third appointment was cancelled on its own an hour ago
+	cancelled := gorm.NowFunc().Add(-time.Hour)
+	if err := db.Model(&CruddyAppointment{}).Where("subject = ?", "Third").UpdateColumn("deleted_at", cancelled).Error; err != nil {
+		return registry.Step("cancel the Third appointment", err)
+	}
+
+	// Deleting Arthur takes the appointments he still has with him
+	counts, err := softdelete.Delete(ctx, db, &CruddyUser{}, user.ID)
+	if err != nil {
+		return registry.Step("delete the user", err)
+	}
+	fmt.Println("deleted", counts)
+
+	trashed := []CruddyAppointment{}
+	if err := softdelete.Trashed(ctx, db.Order("subject"), &trashed); err != nil {
+		return registry.Step("list deleted appointments", err)
+	}
+	for _, appointment := range trashed {
+		fmt.Println(appointment.Subject, "deleted at", appointment.DeletedAt.Format(time.RFC3339))
+	}
+
+	// Restoring Arthur brings back First and Second, but not the appointment that was cancelled before he went
+	if counts, err = softdelete.Restore(ctx, db, &CruddyUser{}, user.ID); err != nil {
+		return registry.Step("restore the user", err)
+	}
+	fmt.Println("restored", counts)
+
+	// Anything deleted more than half an hour ago goes for good
+	if counts, err = softdelete.Purge(ctx, db, &CruddyAppointment{}, gorm.NowFunc().Add(-30*time.Minute)); err != nil {
+		return registry.Step("purge old appointments", err)
+	}
+	fmt.Println("purged", counts)
+	return nil
+}
+
+// Audit demonstrates the audit package - the BeforeUpdate and AfterUpdate hooks on CruddyUser2 only print, the audit log keeps a record
+func Audit(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "cruddy_user2"); err != nil {
+		return err
+	}
+	if err := db.Where("table_name = ?", "cruddy_user2").Delete(&audit.Entry{}).Error; err != nil {
+		return registry.Step("clear the user's history", err)
+	}
+	users := repository.New[CruddyUser2](db)
+
+	// Each change is made by someone else - the repository hands the actor in ctx to the audit callbacks
+	user := CruddyUser2{FirstName: "Arthur", LastName: "Dent"}
+	if err := users.Create(audit.WithActor(ctx, "arthur"), &user); err != nil {
+		return registry.Step("create the user", err)
+	}
+	if err := users.UpdateFields(audit.WithActor(ctx, "ford"), &user, map[string]interface{}{"first_name": "Zaphod", "last_name": "Beeblebrox"}); err != nil {
+		return registry.Step("rename the user", err)
+	}
+	if err := users.Delete(audit.WithActor(ctx, "vogon"), user.ID); err != nil {
+		return registry.Step("delete the user", err)
+	}
+
+	history, err := audit.History(ctx, db, &CruddyUser2{}, user.ID)
+	if err != nil {
+		return registry.Step("read the history", err)
+	}
+	for _, entry := range history {
+		fmt.Println(entry.CreatedAt.Format(time.RFC3339), entry.Actor, entry.Operation, entry.Changes)
+	}
+
+	// Everything up to the rename, replayed - the user as it was just before the delete
+	// Without the audit callbacks (nothing imported the callbacks package) there is no history to replay
+	if len(history) < 2 {
+		return registry.Step("replay the history", fmt.Errorf("found %d entries for user %d, want the create, the rename and the delete", len(history), user.ID))
+	}
+	before := CruddyUser2{}
+	exists, err := audit.Replay(db, &before, history[:len(history)-1])
+	if err != nil {
+		return registry.Step("replay the history", err)
+	}
+	fmt.Println(before, "exists:", exists)
+	return nil
 }
 
 // CruddyUser is specific to this class file
@@ -232,6 +463,8 @@ type CruddyUser2 struct {
 	gorm.Model
 	FirstName string
 	LastName  string
+	// Version opts in to optimistic locking - see the locking package
+	Version uint `sql:"not null"`
 }
 
 // BeforeUpdate method is a built in callback that fires before the .Save, .Update and .Updates methods are called
@@ -254,6 +487,7 @@ type CruddyUser3 struct {
 	FirstName string
 	LastName  string
 	Salary    uint
+	Version   uint `sql:"not null"`
 }
 
 // CruddyUser4 is used with DeleteRecords function
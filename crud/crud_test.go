@@ -0,0 +1,186 @@
+package crud
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/audit"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+func TestCreateWithChildRecords(t *testing.T) {
+	db := testdb.Open(t)
+	if err := CreateWithChildRecords(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	user := CruddyUser{}
+	if err := db.Preload("Appointments").First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Appointments) != 3 {
+		t.Errorf("the user has %d appointments, want the 3 created with it", len(user.Appointments))
+	}
+}
+
+func TestUpdateRecords(t *testing.T) {
+	db := testdb.Open(t)
+	if err := UpdateRecords(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	user := CruddyUser2{}
+	if err := db.First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.FirstName != "Zaphod" || user.LastName != "Beeblebrox" {
+		t.Errorf("the user is %s %s, want Zaphod Beeblebrox", user.FirstName, user.LastName)
+	}
+}
+
+func TestBatchUpdates(t *testing.T) {
+	db := testdb.Open(t)
+	if err := BatchUpdates(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	users := []CruddyUser3{}
+	if err := db.Order("first_name").Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := []CruddyUser3{
+		{FirstName: "Arthur", LastName: "Macmillan-Dent", Salary: 30000},
+		{FirstName: "Tricia", LastName: "Macmillan-Dent", Salary: 55000},
+	}
+	if len(users) != len(want) {
+		t.Fatalf("found %d users, want %d", len(users), len(want))
+	}
+	for i, user := range users {
+		if user.FirstName != want[i].FirstName || user.LastName != want[i].LastName || user.Salary != want[i].Salary {
+			t.Errorf("got %s %s on %d, want %s %s on %d",
+				user.FirstName, user.LastName, user.Salary, want[i].FirstName, want[i].LastName, want[i].Salary)
+		}
+	}
+}
+
+func TestDeleteRecords(t *testing.T) {
+	db := testdb.Open(t)
+	if err := DeleteRecords(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	// CruddyUser4 has a plain ID, so the row is really gone
+	if n := testdb.Count(t, db, "cruddy_user4"); n != 0 {
+		t.Errorf("cruddy_user4 has %d rows after a hard delete, want 0", n)
+	}
+
+	// CruddyUser2 has gorm.Model, so the row stays with deleted_at set and GORM stops returning it
+	err := db.First(&CruddyUser2{}).Error
+	if !gorm.IsRecordNotFoundError(err) {
+		t.Errorf("First found a soft deleted CruddyUser2 (err %v), want record not found", err)
+	}
+	user := CruddyUser2{}
+	if err := db.Unscoped().First(&user).Error; err != nil {
+		t.Fatalf("Unscoped didn't find the soft deleted CruddyUser2: %v", err)
+	}
+	if user.DeletedAt == nil {
+		t.Error("the soft deleted CruddyUser2 has no deleted_at")
+	}
+}
+
+func TestBatchDeletes(t *testing.T) {
+	db := testdb.Open(t)
+	if err := BatchDeletes(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	users := []CruddyUser2{}
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].FirstName != "Arthur" {
+		t.Errorf("found %v, want only Arthur left", users)
+	}
+	// The Macs are soft deleted, not gone
+	if n := testdb.Count(t, db, "cruddy_user2"); n != 2 {
+		t.Errorf("cruddy_user2 has %d rows, want 2", n)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	db := testdb.Open(t)
+	if err := Transactions(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	// Counting the table directly sees soft deleted rows too - the rollback should leave nothing at all
+	if n := testdb.Count(t, db, "cruddy_user2"); n != 0 {
+		t.Errorf("cruddy_user2 has %d rows after the rollback, want 0", n)
+	}
+}
+
+func TestRepository(t *testing.T) {
+	db := testdb.Open(t)
+	if err := Repository(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	users := []CruddyUser2{}
+	if err := db.Order("id").Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("found %d users, want 3 with Ford restored", len(users))
+	}
+	if users[0].FirstName != "Zaphod" || users[1].FirstName != "Ford" {
+		t.Errorf("found %s and %s, want Zaphod and Ford", users[0].FirstName, users[1].FirstName)
+	}
+}
+
+func TestOptimisticLocking(t *testing.T) {
+	db := testdb.Open(t)
+	if err := OptimisticLocking(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	user := CruddyUser2{}
+	if err := db.First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Both changes made it, and each save bumped the version once
+	if user.FirstName != "Zaphod" || user.LastName != "Beeblebrox" || user.Version != 2 {
+		t.Errorf("got %s %s at version %d, want Zaphod Beeblebrox at version 2", user.FirstName, user.LastName, user.Version)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	db := testdb.Open(t)
+	if err := Trash(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	// Arthur is back with First and Second, and the Third appointment he'd cancelled is gone for good
+	if n := testdb.Count(t, db, "cruddy_users", "deleted_at IS NULL"); n != 1 {
+		t.Errorf("%d live users, want Arthur restored", n)
+	}
+	appointments := []CruddyAppointment{}
+	if err := db.Unscoped().Order("subject").Find(&appointments).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(appointments) != 2 || appointments[0].Subject != "First" || appointments[1].Subject != "Second" || appointments[0].DeletedAt != nil {
+		t.Errorf("appointments are %v, want First and Second restored and Third purged", appointments)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	db := testdb.Open(t)
+	if err := Audit(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	history, err := audit.History(context.Background(), db, &CruddyUser2{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, entry := range history {
+		got = append(got, entry.Actor+" "+entry.Operation)
+	}
+	if strings.Join(got, ", ") != "arthur create, ford update, vogon delete" {
+		t.Errorf("the log has %v, want the create, update and delete with their actors", got)
+	}
+}
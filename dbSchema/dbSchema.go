@@ -1,17 +1,30 @@
 package dbSchema
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"regexp"
 
 	"github.com/jinzhu/gorm"
 
-	// anonymous import - package just needs to initialize in order to establish itself as a database driver
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/annicaburns/learngorm/bulk"
+	"github.com/annicaburns/learngorm/dberrors"
+	"github.com/annicaburns/learngorm/registry"
+	"github.com/annicaburns/learngorm/validation"
 )
 
+func init() {
+	registry.Register("dbschema.basic-methods", "Create the basic_users table and insert a few users", BasicMethods)
+	registry.Register("dbschema.embed-child-objects", "Flatten gorm.Model into clean_users with the embedded tag and add an index", EmbedChildObjects)
+	registry.Register("dbschema.validation", "Catch a too long username before it gets to the database", Validation)
+	registry.Register("dbschema.constraint-errors", "Break basic_users' and calendars' constraints and tell the errors apart", ConstraintErrors)
+	registry.RegisterModels(&BasicUser{}, &CleanUser{})
+}
+
 // BasicMethods demonstrates GORM basic schema and query methods
-func BasicMethods() {
-	// gorm.Open() to connect to a database
+func BasicMethods(ctx context.Context, db *gorm.DB) error {
+	// gorm.Open() to connect to a database - see the connection package
 
 	// other methods operate on the instance of the database connection
 	//.CreateTable()
@@ -23,19 +36,20 @@ func BasicMethods() {
 	//.First (dbase record)
 	//.Last (dbase record)
 	//.Delete (dbase record)
+	// Each of these returns a *gorm.DB - check its .Error field to find out if the call worked
 
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm")
-	if err != nil {
-		panic(err.Error())
-	}
-	defer db.Close()
-	// NOTE that droping and creating tables is ONLY useful for this demo where we are constantly changing schema
+	// NOTE that droping and creating tables was ONLY useful while we were constantly changing schema
 	// GORM is generally not used to create the schema - just to reflect it
-	db.DropTableIfExists(&BasicUser{})
-	db.CreateTable(&BasicUser{})
+	// The basic_users table now comes from the migrations package, so the demo just clears out the rows from last time
+	if err := registry.ResetTables(db, "basic_users"); err != nil {
+		return err
+	}
 
-	for _, basicUser := range basicUsers {
-		db.Create(&basicUser)
+	// One INSERT for all of them instead of one per user - see the bulk package
+	// Copy the users first, since their ids get filled in and the next run should start from blank ones again
+	users := append([]BasicUser{}, basicUsers...)
+	if err := bulk.CreateInBatches(ctx, db, users, 0); err != nil {
+		return registry.Step("insert basic users", err)
 	}
 
 	// u := User{Username: "tmacmillan"}
@@ -51,7 +65,7 @@ func BasicMethods() {
 	// db.Where(&User{Username: "adent"}).Delete(&User{})
 
 	fmt.Println("done")
-
+	return nil
 }
 
 // CustomizationMethods demonstrates methods to customize schema and do something outside of the GO conventions
@@ -71,6 +85,96 @@ func CustomizationMethods() {
 // 	return "alternate_name"
 // }
 
+// Signup is a BasicUser coming in through a sign up form that only takes lower case usernames
+// It's only here to show a Validate() method alongside the tags - BasicUser itself has no rules beyond its columns
+type Signup struct {
+	BasicUser
+}
+
+// TableName saves a Signup as the BasicUser it is
+func (Signup) TableName() string {
+	return "basic_users"
+}
+
+var usernameChars = regexp.MustCompile(`^[a-z0-9]*$`)
+
+// Validate checks what the validate tags can't - it runs on every Create and Save, see the validation package
+func (s *Signup) Validate() error {
+	if !usernameChars.MatchString(s.Username) {
+		return validation.FieldError{Field: "Username", Column: "username", Rule: "Validate", Message: "username can only have lower case letters and digits"}
+	}
+	return nil
+}
+
+// Validation demonstrates the validation package
+func Validation(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "basic_users"); err != nil {
+		return err
+	}
+
+	// Too long for VARCHAR(15), and not just letters and digits - the tags and Validate both fail, and the INSERT never runs
+	zaphod := Signup{BasicUser{Username: "Zaphod.Beeblebrox", FirstName: "Zaphod", LastName: "Beeblebrox"}}
+	err := db.Create(&zaphod).Error
+	var invalid validation.ValidationErrors
+	if !errors.As(err, &invalid) {
+		return registry.Step("create zaphod", fmt.Errorf("want validation errors, got %v", err))
+	}
+	for _, fieldErr := range invalid {
+		fmt.Printf("%s (%s): %s\n", fieldErr.Field, fieldErr.Rule, fieldErr.Message)
+	}
+	if zaphod.ID != 0 {
+		return registry.Step("create zaphod", fmt.Errorf("got id %d for a user that failed validation", zaphod.ID))
+	}
+
+	zaphod.Username = "zbeeblebrox"
+	if err := db.Create(&zaphod).Error; err != nil {
+		return registry.Step("create zbeeblebrox", err)
+	}
+	// Update only checks the columns it sets
+	err = db.Model(&zaphod).Update("username", "").Error
+	if !errors.As(err, &invalid) || len(invalid.Field("Username")) != 1 {
+		return registry.Step("blank zbeeblebrox's username", fmt.Errorf("want a required error, got %v", err))
+	}
+	fmt.Println(err)
+	return nil
+}
+
+// ConstraintErrors demonstrates the dberrors package
+// The same checks work on every database, where the driver errors underneath have nothing in common
+func ConstraintErrors(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "basic_users"); err != nil {
+		return err
+	}
+	arthur := BasicUser{Username: "adent", FirstName: "Arthur", LastName: "Dent"}
+	if err := db.Create(&arthur).Error; err != nil {
+		return registry.Step("create adent", err)
+	}
+
+	// LastName is unique, so a second Dent is refused
+	err := db.Create(&BasicUser{Username: "tdent", FirstName: "Tricia", LastName: "Dent"}).Error
+	var unique *dberrors.ErrUniqueViolation
+	if !errors.As(err, &unique) {
+		return registry.Step("create a second Dent", fmt.Errorf("want a unique violation, got %v", err))
+	}
+	fmt.Printf("duplicate: table %q, constraint %q, column %q\n", unique.Table, unique.Constraint, unique.Column)
+
+	// Username is NOT NULL - GORM would write "" for a blank string, so it takes an explicit NULL to break it
+	err = db.Model(&arthur).UpdateColumn("username", gorm.Expr("NULL")).Error
+	if !errors.Is(err, &dberrors.ErrNotNullViolation{Column: "username"}) {
+		return registry.Step("clear adent's username", fmt.Errorf("want a not null violation on username, got %v", err))
+	}
+	fmt.Println("missing:", err)
+
+	// Exec doesn't run callbacks, so its errors go through Classify by hand
+	err = dberrors.Classify(db.Exec("INSERT INTO calendars (name, relationship_user_id) VALUES (?, ?)", "Nobody's calendar", 0).Error)
+	var foreignKey *dberrors.ErrForeignKeyViolation
+	if !errors.As(err, &foreignKey) {
+		return registry.Step("insert an orphan calendar", fmt.Errorf("want a foreign key violation, got %v", err))
+	}
+	fmt.Println("orphan:", err)
+	return nil
+}
+
 // BasicUser is our BasicUser object
 type BasicUser struct {
 	// If a field is named "ID" gorm will interpret this as a primary key and will make it auto-incrementing and create the PK constratints
@@ -83,11 +187,12 @@ type BasicUser struct {
 	// capitalized fields will show up in the database in all lowercase
 	// use 'type' tag to specify a type other than the default (default string type is VARCHAR(255))
 	// use 'not null' tag to add a null constraint
-	Username string `sql:"type:VARCHAR(15);not null"`
+	// the database only finds out a username is too long when it's written - the validate tag checks first, see the validation package
+	Username string `sql:"type:VARCHAR(15);not null" validate:"required,max=15"`
 	// pascal-cased names like this will be converted to this format: first_name
 	// use 'size' tag to accept the default type, but use a different size
 	// use the DEFAULT tag to provide a default in cases where the user hasn't
-	FirstName string `sql:"size:100;not null;DEFAULT:'Annica'"`
+	FirstName string `sql:"size:100;not null;DEFAULT:'Annica'" validate:"max=100"`
 	// To exert control over the exact name of the field, use the gorm "column" tag
 	// use 'unique' tag to add a unique constraint, and 'unique_index' to add a unique index to take advantage of the unique constraint
 	// although these seemed to be redundant in MySQL - we ended up with two unique indexes so far as I could tell in workbench
@@ -110,26 +215,26 @@ var basicUsers = []BasicUser{
 }
 
 // EmbedChildObjects demonstrates embedding child objects
-func EmbedChildObjects() {
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm")
-	if err != nil {
-		panic(err.Error())
+func EmbedChildObjects(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "clean_users"); err != nil {
+		return err
 	}
-	defer db.Close()
-
-	db.DropTableIfExists(&CleanUser{})
-	db.CreateTable(&CleanUser{})
 
 	// Call .AddIndex method on the database instance to manually create indexes so we can name them and include multiple columns
 	// And because we know the names, we can remove them with the .RemoveIndex method
 	// Column names are the way the database sees them
 	// the Model method scopes any subsequent calls to the table represented by the empty interface supplied as the argument
-	db.Model(&CleanUser{}).AddIndex("idx_first_name", "first_name")
+	// The clean_users migration already creates this index, so check for it first - adding it twice is an error
+	if !db.Dialect().HasIndex("clean_users", "idx_first_name") {
+		if err := db.Model(&CleanUser{}).AddIndex("idx_first_name", "first_name").Error; err != nil {
+			return registry.Step("add idx_first_name", err)
+		}
+	}
 
 	for _, f := range db.NewScope(&CleanUser{}).Fields() {
 		fmt.Println(f.Name)
 	}
-
+	return nil
 }
 
 // CleanUser is used to demonstrate embedding child object
@@ -0,0 +1,87 @@
+package dbSchema
+
+import (
+	"context"
+	"testing"
+
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+func TestBasicMethods(t *testing.T) {
+	db := testdb.Open(t)
+	// Run it twice - the demo is supposed to clear out its own rows, so the unique LastName doesn't trip
+	for i := 0; i < 2; i++ {
+		if err := BasicMethods(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := testdb.Count(t, db, "basic_users"); n != len(basicUsers) {
+		t.Errorf("basic_users has %d rows, want %d", n, len(basicUsers))
+	}
+
+	// smith was created without a FirstName, so the DEFAULT tag fills it in
+	smith := BasicUser{}
+	if err := db.Where("username = ?", "smith").First(&smith).Error; err != nil {
+		t.Fatal(err)
+	}
+	if smith.FirstName != "Annica" {
+		t.Errorf("smith's first_name is %q, want the default %q", smith.FirstName, "Annica")
+	}
+
+	if err := db.Create(&BasicUser{Username: "adent2", FirstName: "Arthur", LastName: "Dent"}).Error; err == nil {
+		t.Error("a second Dent was created, want the unique LastName to reject it")
+	}
+}
+
+func TestEmbedChildObjects(t *testing.T) {
+	db := testdb.Open(t)
+	for i := 0; i < 2; i++ {
+		if err := EmbedChildObjects(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !db.Dialect().HasIndex("clean_users", "idx_first_name") {
+		t.Error("clean_users has no idx_first_name index")
+	}
+
+	// The embedded tag flattens gorm.Model into CleanUser's own columns
+	for _, column := range []string{"id", "created_at", "updated_at", "deleted_at", "first_name", "last_name"} {
+		if !db.Dialect().HasColumn("clean_users", column) {
+			t.Errorf("clean_users has no %s column", column)
+		}
+	}
+	user := CleanUser{FirstName: "Arthur", LastName: "Dent"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Model.ID == 0 || user.Model.CreatedAt.IsZero() {
+		t.Errorf("the embedded model wasn't filled in: %+v", user.Model)
+	}
+}
+
+func TestConstraintErrors(t *testing.T) {
+	db := testdb.Open(t)
+	if err := ConstraintErrors(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "basic_users"); n != 1 {
+		t.Errorf("basic_users has %d rows, want only adent", n)
+	}
+	if n := testdb.Count(t, db, "calendars"); n != 0 {
+		t.Errorf("calendars has %d rows, want the orphan gone", n)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	db := testdb.Open(t)
+	if err := Validation(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	users := []BasicUser{}
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Username != "zbeeblebrox" {
+		t.Errorf("found %v, want only zbeeblebrox, with the username it was created with", users)
+	}
+}
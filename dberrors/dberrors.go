@@ -0,0 +1,268 @@
+package dberrors
+
+/*
+* Each driver reports a broken constraint its own way - a number from MySQL, a SQLSTATE from PostgreSQL, an extended result code from SQLite
+	* Classify turns those into one typed error per kind of constraint, naming the table, constraint and column where the database says which
+	* The typed errors wrap the driver's, so errors.As still finds the *mysql.MySQLError or pq.Error underneath
+	* errors.Is matches on the fields that are set - errors.Is(err, &dberrors.ErrUniqueViolation{Column: "LastName"}) is any duplicate last name
+* The callbacks registered here classify the errors from Create, Save, Update and Delete, for any connection that imports the package
+	* Exec, Raw and Row don't run callbacks, so pass their errors through Classify by hand
+	* Not every database says as much - SQLite never names a foreign key or the column a check failed on, and MySQL names the index rather than the column for a duplicate
+*/
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrUniqueViolation is a row that would duplicate the key of a unique index or constraint, or a primary key
+type ErrUniqueViolation struct {
+	Table      string
+	Constraint string
+	// Column lists the key's columns, comma separated when there's more than one
+	Column string
+	// Err is the driver's error
+	Err error
+}
+
+func (e *ErrUniqueViolation) Error() string {
+	return describe("unique", e.Table, e.Constraint, e.Column, e.Err)
+}
+
+func (e *ErrUniqueViolation) Unwrap() error { return e.Err }
+
+func (e *ErrUniqueViolation) Is(target error) bool {
+	t, ok := target.(*ErrUniqueViolation)
+	return ok && matches(t.Table, e.Table) && matches(t.Constraint, e.Constraint) && matches(t.Column, e.Column)
+}
+
+// ErrForeignKeyViolation is a row that refers to a missing parent, or a parent that still has children
+type ErrForeignKeyViolation struct {
+	// Table is the table the statement changed - the child for an insert, the parent for a delete on MySQL
+	Table      string
+	Constraint string
+	Column     string
+	Err        error
+}
+
+func (e *ErrForeignKeyViolation) Error() string {
+	return describe("foreign key", e.Table, e.Constraint, e.Column, e.Err)
+}
+
+func (e *ErrForeignKeyViolation) Unwrap() error { return e.Err }
+
+func (e *ErrForeignKeyViolation) Is(target error) bool {
+	t, ok := target.(*ErrForeignKeyViolation)
+	return ok && matches(t.Table, e.Table) && matches(t.Constraint, e.Constraint) && matches(t.Column, e.Column)
+}
+
+// ErrNotNullViolation is a NULL in a NOT NULL column
+type ErrNotNullViolation struct {
+	Table  string
+	Column string
+	Err    error
+}
+
+func (e *ErrNotNullViolation) Error() string {
+	return describe("not null", e.Table, "", e.Column, e.Err)
+}
+
+func (e *ErrNotNullViolation) Unwrap() error { return e.Err }
+
+func (e *ErrNotNullViolation) Is(target error) bool {
+	t, ok := target.(*ErrNotNullViolation)
+	return ok && matches(t.Table, e.Table) && matches(t.Column, e.Column)
+}
+
+// ErrCheckViolation is a row that fails a CHECK constraint
+type ErrCheckViolation struct {
+	Table string
+	// Constraint is the constraint's name - or on SQLite, its expression when it has no name
+	Constraint string
+	Err        error
+}
+
+func (e *ErrCheckViolation) Error() string {
+	return describe("check", e.Table, e.Constraint, "", e.Err)
+}
+
+func (e *ErrCheckViolation) Unwrap() error { return e.Err }
+
+func (e *ErrCheckViolation) Is(target error) bool {
+	t, ok := target.(*ErrCheckViolation)
+	return ok && matches(t.Table, e.Table) && matches(t.Constraint, e.Constraint)
+}
+
+// describe builds e.g. "dberrors: unique violation on basic_users.LastName: <driver error>"
+func describe(kind, table, constraint, column string, err error) string {
+	on := table
+	if column != "" {
+		on = strings.TrimPrefix(table+"."+column, ".")
+	}
+	if constraint != "" {
+		on = strings.TrimSpace(on + " (" + constraint + ")")
+	}
+	if on != "" {
+		on = " on " + on
+	}
+	return fmt.Sprintf("dberrors: %s violation%s: %v", kind, on, err)
+}
+
+// matches compares a field of the target given to errors.Is, where blank matches anything
+// Identifiers are compared ignoring case, since MySQL and SQLite ignore it too
+func matches(want, got string) bool {
+	return want == "" || strings.EqualFold(want, got)
+}
+
+func init() {
+	gorm.DefaultCallback.Create().Register("dberrors:classify", classify)
+	gorm.DefaultCallback.Update().Register("dberrors:classify", classify)
+	gorm.DefaultCallback.Delete().Register("dberrors:classify", classify)
+}
+
+// classify replaces the error a create, update or delete ended with by its typed equivalent
+func classify(scope *gorm.Scope) {
+	if scope.HasError() {
+		scope.DB().Error = Classify(scope.DB().Error)
+	}
+}
+
+// Classify returns the typed error for a constraint violation reported by any of the drivers the dialect package supports, and err unchanged for anything else
+func Classify(err error) error {
+	if err == nil || classified(err) {
+		return err
+	}
+	// GORM collects several errors from one call into gorm.Errors, which errors.As can't see inside
+	if errs, ok := err.(gorm.Errors); ok {
+		out := make(gorm.Errors, len(errs))
+		for i, err := range errs {
+			out[i] = Classify(err)
+		}
+		return out
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return fromMySQL(mysqlErr, err)
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return fromPostgres(pqErr, err)
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return fromSQLite(sqliteErr, err)
+	}
+	return err
+}
+
+func classified(err error) bool {
+	var unique *ErrUniqueViolation
+	var foreignKey *ErrForeignKeyViolation
+	var notNull *ErrNotNullViolation
+	var check *ErrCheckViolation
+	return errors.As(err, &unique) || errors.As(err, &foreignKey) || errors.As(err, &notNull) || errors.As(err, &check)
+}
+
+var (
+	// Duplicate entry 'Dent' for key 'basic_users.LastName' - MySQL 8 puts the table in front of the key name, 5.7 doesn't
+	mysqlDuplicateKey = regexp.MustCompile("for key '(?:([^'.]+)\\.)?([^']+)'")
+	// Cannot add or update a child row: a foreign key constraint fails (`learngorm`.`calendars`, CONSTRAINT `calendars_..._foreign` FOREIGN KEY (`relationship_user_id`) REFERENCES ...
+	mysqlForeignKey = regexp.MustCompile("\\(`[^`]+`\\.`([^`]+)`, CONSTRAINT `([^`]+)` FOREIGN KEY \\(`([^`]+)`\\)")
+	// Column 'username' cannot be null, or Field 'username' doesn't have a default value
+	mysqlColumn = regexp.MustCompile("(?:Column|Field) '([^']+)'")
+	// Check constraint 'positive_length' is violated.
+	mysqlCheck = regexp.MustCompile("[Cc]heck constraint '([^']+)'")
+	// Key (username)=(adent) already exists. - PostgreSQL's Detail for unique and foreign key violations
+	postgresKey = regexp.MustCompile(`Key \((.+?)\)=`)
+)
+
+func fromMySQL(mysqlErr *mysql.MySQLError, err error) error {
+	switch mysqlErr.Number {
+	case 1062: // ER_DUP_ENTRY
+		unique := &ErrUniqueViolation{Err: err}
+		if m := mysqlDuplicateKey.FindStringSubmatch(mysqlErr.Message); m != nil {
+			unique.Table, unique.Constraint = m[1], m[2]
+		}
+		return unique
+	case 1451, 1452, 1216, 1217: // ER_ROW_IS_REFERENCED_2, ER_NO_REFERENCED_ROW_2 and the older messages without the details
+		foreignKey := &ErrForeignKeyViolation{Err: err}
+		if m := mysqlForeignKey.FindStringSubmatch(mysqlErr.Message); m != nil {
+			foreignKey.Table, foreignKey.Constraint, foreignKey.Column = m[1], m[2], m[3]
+		}
+		return foreignKey
+	case 1048, 1364: // ER_BAD_NULL_ERROR, ER_NO_DEFAULT_FOR_FIELD
+		notNull := &ErrNotNullViolation{Err: err}
+		if m := mysqlColumn.FindStringSubmatch(mysqlErr.Message); m != nil {
+			notNull.Column = m[1]
+		}
+		return notNull
+	case 3819: // ER_CHECK_CONSTRAINT_VIOLATED
+		check := &ErrCheckViolation{Err: err}
+		if m := mysqlCheck.FindStringSubmatch(mysqlErr.Message); m != nil {
+			check.Constraint = m[1]
+		}
+		return check
+	}
+	return err
+}
+
+func fromPostgres(pqErr *pq.Error, err error) error {
+	column := pqErr.Column
+	if m := postgresKey.FindStringSubmatch(pqErr.Detail); column == "" && m != nil {
+		column = m[1]
+	}
+	switch pqErr.Code {
+	case "23505": // unique_violation
+		return &ErrUniqueViolation{Table: pqErr.Table, Constraint: pqErr.Constraint, Column: column, Err: err}
+	case "23503": // foreign_key_violation
+		return &ErrForeignKeyViolation{Table: pqErr.Table, Constraint: pqErr.Constraint, Column: column, Err: err}
+	case "23502": // not_null_violation
+		return &ErrNotNullViolation{Table: pqErr.Table, Column: column, Err: err}
+	case "23514": // check_violation
+		return &ErrCheckViolation{Table: pqErr.Table, Constraint: pqErr.Constraint, Err: err}
+	}
+	return err
+}
+
+func fromSQLite(sqliteErr sqlite3.Error, err error) error {
+	// The message ends with the failing columns as table.column, or a check's name - UNIQUE constraint failed: basic_users.LastName
+	detail := ""
+	if i := strings.Index(sqliteErr.Error(), "constraint failed: "); i >= 0 {
+		detail = sqliteErr.Error()[i+len("constraint failed: "):]
+	}
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		table, column := columns(detail)
+		return &ErrUniqueViolation{Table: table, Column: column, Err: err}
+	case sqlite3.ErrConstraintForeignKey:
+		return &ErrForeignKeyViolation{Err: err}
+	case sqlite3.ErrConstraintNotNull:
+		table, column := columns(detail)
+		return &ErrNotNullViolation{Table: table, Column: column, Err: err}
+	case sqlite3.ErrConstraintCheck:
+		return &ErrCheckViolation{Constraint: detail, Err: err}
+	}
+	return err
+}
+
+// columns splits SQLite's "t.a, t.b" into t and "a,b"
+func columns(detail string) (string, string) {
+	table, names := "", []string{}
+	for _, qualified := range strings.Split(detail, ", ") {
+		if i := strings.LastIndex(qualified, "."); i >= 0 {
+			table, qualified = qualified[:i], qualified[i+1:]
+		}
+		if qualified != "" {
+			names = append(names, qualified)
+		}
+	}
+	return table, strings.Join(names, ",")
+}
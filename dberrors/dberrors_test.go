@@ -0,0 +1,87 @@
+package dberrors_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+
+	"github.com/annicaburns/learngorm/dbSchema"
+	"github.com/annicaburns/learngorm/dberrors"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+func TestServerErrors(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want error
+	}{
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'Dent' for key 'basic_users.LastName'"},
+			&dberrors.ErrUniqueViolation{Table: "basic_users", Constraint: "LastName"}},
+		{&mysql.MySQLError{Number: 1452, Message: "Cannot add or update a child row: a foreign key constraint fails (`learngorm`.`calendars`, CONSTRAINT `calendars_relationship_user_id_relationship_users_id_foreign` FOREIGN KEY (`relationship_user_id`) REFERENCES `relationship_users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE)"},
+			&dberrors.ErrForeignKeyViolation{Table: "calendars", Constraint: "calendars_relationship_user_id_relationship_users_id_foreign", Column: "relationship_user_id"}},
+		{&mysql.MySQLError{Number: 1048, Message: "Column 'username' cannot be null"},
+			&dberrors.ErrNotNullViolation{Column: "username"}},
+		{&mysql.MySQLError{Number: 3819, Message: "Check constraint 'positive_length' is violated."},
+			&dberrors.ErrCheckViolation{Constraint: "positive_length"}},
+		{&pq.Error{Code: "23505", Table: "user_queries", Constraint: "user_queries_username_key", Detail: "Key (username)=(adent) already exists."},
+			&dberrors.ErrUniqueViolation{Table: "user_queries", Constraint: "user_queries_username_key", Column: "username"}},
+		{&pq.Error{Code: "23503", Table: "calendars", Constraint: "calendars_relationship_user_id_relationship_users_id_foreign", Detail: "Key (relationship_user_id)=(9) is not present in table \"relationship_users\"."},
+			&dberrors.ErrForeignKeyViolation{Column: "relationship_user_id"}},
+		{&pq.Error{Code: "23502", Table: "basic_users", Column: "username"},
+			&dberrors.ErrNotNullViolation{Table: "basic_users", Column: "username"}},
+		{&pq.Error{Code: "23514", Table: "appointments", Constraint: "positive_length"},
+			&dberrors.ErrCheckViolation{Constraint: "positive_length"}},
+	} {
+		err := dberrors.Classify(fmt.Errorf("wrapped: %w", test.err))
+		if !errors.Is(err, test.want) {
+			t.Errorf("Classify(%v) = %v, want %+v", test.err, err, test.want)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("Classify(%v) lost the driver error", test.err)
+		}
+	}
+
+	other := &mysql.MySQLError{Number: 1213}
+	if err := dberrors.Classify(other); err != other {
+		t.Errorf("Classify changed a deadlock into %v", err)
+	}
+	if errors.Is(dberrors.Classify(&pq.Error{Code: "23505"}), &dberrors.ErrForeignKeyViolation{}) {
+		t.Error("a unique violation matched ErrForeignKeyViolation")
+	}
+}
+
+func TestSQLiteErrors(t *testing.T) {
+	db := testdb.Open(t)
+	arthur := dbSchema.BasicUser{Username: "adent", LastName: "Dent"}
+	if err := db.Create(&arthur).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The callbacks classify Create's error without being asked
+	err := db.Create(&dbSchema.BasicUser{Username: "tdent", LastName: "Dent"}).Error
+	var unique *dberrors.ErrUniqueViolation
+	if !errors.As(err, &unique) || unique.Table != "basic_users" || unique.Column != "LastName" {
+		t.Errorf("a second Dent returned %v, want a unique violation on basic_users.LastName", err)
+	}
+	err = db.Model(&arthur).UpdateColumn("username", gorm.Expr("NULL")).Error
+	if !errors.Is(err, &dberrors.ErrNotNullViolation{Table: "basic_users", Column: "username"}) {
+		t.Errorf("a NULL username returned %v, want a not null violation", err)
+	}
+
+	if err := db.Exec("CREATE TABLE lengths (length int CONSTRAINT positive_length CHECK (length > 0))").Error; err != nil {
+		t.Fatal(err)
+	}
+	err = dberrors.Classify(db.Exec("INSERT INTO lengths (length) VALUES (-1)").Error)
+	if !errors.Is(err, &dberrors.ErrCheckViolation{}) {
+		t.Errorf("a negative length returned %v, want a check violation", err)
+	}
+
+	err = dberrors.Classify(db.Exec("INSERT INTO calendars (name, relationship_user_id) VALUES (?, ?)", "Nobody's", 42).Error)
+	if !errors.Is(err, &dberrors.ErrForeignKeyViolation{}) {
+		t.Errorf("an orphan calendar returned %v, want a foreign key violation", err)
+	}
+}
@@ -0,0 +1,188 @@
+package dialect
+
+/*
+* GORM already hides most of the differences between databases behind its own gorm.Dialect
+	* This package covers the handful of things the demos do that GORM leaves to the database - like adding FK constraints after the fact
+	* Each backend registers itself by the same name GORM uses, so Of(db) can find the right one from any *gorm.DB handle
+*/
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrUnsupported is returned for what a database can't do at all, like SQLite adding a FK constraint to an existing table - check for it with errors.Is
+var ErrUnsupported = errors.New("not supported by this database")
+
+// Dialect is implemented once per supported database backend
+type Dialect interface {
+	// Name is the name the connection package's Driver field uses, which is also what GORM calls the backend
+	Name() string
+	// Open connects to the database using a connection string in the driver's own format
+	Open(dsn string) (*gorm.DB, error)
+	// AddForeignKey adds a FK constraint to the table db is scoped to with the Model method - ErrUnsupported if the database can't
+	AddForeignKey(db *gorm.DB, field, dest, onDelete, onUpdate string) error
+	// Quote quotes an identifier - needed for mixed case column names like BasicUser's LastName
+	Quote(identifier string) string
+	// ColumnType translates one of the generic type names used by the migrations package into the database's own
+	// The names follow the Go types GORM maps: pk (an auto-incrementing uint primary key), uint, int, datetime, bool and text
+	ColumnType(name string) (string, bool)
+
+	// Columns and Indexes describe a table as it actually exists in the database
+	Columns(db *gorm.DB, table string) ([]Column, error)
+	Indexes(db *gorm.DB, table string) ([]Index, error)
+	// ForeignKeys lists a table's FK constraints, one per column - multi-column constraints aren't reported
+	ForeignKeys(db *gorm.DB, table string) ([]ForeignKey, error)
+	// NormalizeType reduces a column type to a form that can be compared - e.g. MySQL reports boolean as tinyint(1)
+	NormalizeType(typ string) string
+	// ModifyColumnSQL changes a column's type in place - false if the database can't
+	ModifyColumnSQL(table, column, typ string) (string, bool)
+	// DropIndexSQL removes an index
+	DropIndexSQL(table, index string) string
+	// ForeignKeySQL adds a FK constraint to an existing table - false if it can only be declared in CREATE TABLE
+	ForeignKeySQL(table, name, column, dest, onDelete, onUpdate string) (string, bool)
+	// ResetSequenceSQL moves an auto-incrementing column's counter past the rows already in the table - false if the database keeps up on its own
+	ResetSequenceSQL(table, column string) (string, bool)
+	// UpsertSQL is the clause that goes after INSERT ... VALUES to update the row already holding the conflict columns' values instead
+	// set holds ready-made assignments like "name = " + Excluded("name") - with none, the existing row is left alone
+	UpsertSQL(conflict, set []string) string
+	// Excluded refers to a column of the row that was going to be inserted, inside UpsertSQL's set
+	Excluded(column string) string
+	// FirstInsertID is the id of the first row of a multi-row INSERT, given the LastInsertId it reported for n rows
+	// The rest follow InsertIDStep apart. PostgreSQL has no LastInsertId - GORM's LastInsertIDReturningSuffix hands the ids back instead
+	FirstInsertID(lastInsertID int64, n int) int64
+	// InsertIDStep is the gap between the ids of the rows of one multi-row INSERT on db's connection
+	// 0 means the database can't promise they're evenly spaced, so rows that need their ids back have to be inserted one at a time
+	InsertIDStep(db *gorm.DB) (int64, error)
+}
+
+// Column is a column as the database reports it
+type Column struct {
+	Name     string
+	Type     string
+	Nullable bool
+	Default  *string
+}
+
+// Index is an index as the database reports it - including the ones it builds for primary keys and UNIQUE constraints
+type Index struct {
+	Name    string
+	Columns []string
+	Unique  bool
+	Primary bool
+}
+
+// ForeignKey is a FK constraint as the database reports it
+type ForeignKey struct {
+	// Name is blank on SQLite, which doesn't keep constraint names
+	Name      string
+	Column    string
+	RefTable  string
+	RefColumn string
+	// OnDelete and OnUpdate are upper case - CASCADE, SET NULL, SET DEFAULT, RESTRICT or NO ACTION
+	OnDelete string
+	OnUpdate string
+}
+
+var dialects = map[string]Dialect{}
+
+// gormAliases maps the names of GORM dialects we wrap back to the Dialect they belong to
+var gormAliases = map[string]string{}
+
+// Register makes a Dialect available to Get and Of
+func Register(d Dialect) {
+	dialects[d.Name()] = d
+}
+
+// Get returns the Dialect registered under name
+func Get(name string) (Dialect, error) {
+	if d, ok := dialects[name]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("unsupported dialect %q (supported: %v)", name, Names())
+}
+
+// Of returns the Dialect behind an open connection
+func Of(db *gorm.DB) Dialect {
+	name := db.Dialect().GetName()
+	if alias, ok := gormAliases[name]; ok {
+		name = alias
+	}
+	d, err := Get(name)
+	if err != nil {
+		panic(err.Error())
+	}
+	return d
+}
+
+// BindVar is the i'th placeholder (counting from 1) in a statement run straight through database/sql rather than GORM
+// Most GORM dialects hand back $$$ and swap it for ? just before running a statement, so that swap happens here too
+func BindVar(db *gorm.DB, i int) string {
+	if v := db.Dialect().BindVar(i); v != "$$$" {
+		return v
+	}
+	return "?"
+}
+
+// Offline returns a handle that speaks the named dialect without being connected to anything
+// GORM can still read models and pick column types through it, but any statement it tries to run fails
+func Offline(name string) (*gorm.DB, error) {
+	if _, err := Get(name); err != nil {
+		return nil, err
+	}
+	gormName := name
+	for alias, n := range gormAliases {
+		if n == name {
+			gormName = alias
+		}
+	}
+	return gorm.Open(gormName, offline{})
+}
+
+var errOffline = errors.New("dialect: offline handle can't run statements")
+
+// offline stands in for a database connection - it satisfies gorm.SQLCommon, which stops gorm.Open trying to ping it
+type offline struct{}
+
+func (offline) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return nil, errOffline
+}
+
+func (offline) Prepare(query string) (*sql.Stmt, error) {
+	return nil, errOffline
+}
+
+func (offline) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, errOffline
+}
+
+func (offline) QueryRow(query string, args ...interface{}) *sql.Row {
+	return nil
+}
+
+// Names lists the registered dialects in alphabetical order
+func Names() []string {
+	names := make([]string, 0, len(dialects))
+	for name := range dialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// onConflict is the ON CONFLICT clause PostgreSQL and SQLite share
+func onConflict(d Dialect, conflict, set []string) string {
+	quoted := make([]string, len(conflict))
+	for i, column := range conflict {
+		quoted[i] = d.Quote(column)
+	}
+	if len(set) == 0 {
+		return fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", strings.Join(quoted, ", "))
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(quoted, ", "), strings.Join(set, ", "))
+}
@@ -0,0 +1,26 @@
+package dialect_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/relationships"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+func TestSQLiteAddForeignKey(t *testing.T) {
+	db := testdb.Open(t)
+	d := dialect.Of(db)
+	if d.Name() != "sqlite3" {
+		t.Skip("only SQLite can't add a FK constraint")
+	}
+	// The migration declares calendars' constraint in CREATE TABLE, so there's nothing to add
+	if err := d.AddForeignKey(db.Model(&relationships.Calendar{}), "relationship_user_id", "relationship_users(id)", "CASCADE", "CASCADE"); err != nil {
+		t.Errorf("calendars' existing constraint returned %v", err)
+	}
+	err := d.AddForeignKey(db.Model(&relationships.TaskList{}), "relationship_user_id", "relationship_users(id)", "CASCADE", "CASCADE")
+	if !errors.Is(err, dialect.ErrUnsupported) {
+		t.Errorf("task_lists' missing constraint returned %v, want ErrUnsupported", err)
+	}
+}
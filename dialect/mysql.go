@@ -0,0 +1,186 @@
+package dialect
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	// Anonymous import - package just needs to initialize in order to establish itself as a database driver
+	_ "github.com/go-sql-driver/mysql"
+)
+
+type mysql struct{}
+
+func init() {
+	Register(mysql{})
+}
+
+func (mysql) Name() string {
+	return "mysql"
+}
+
+func (mysql) Open(dsn string) (*gorm.DB, error) {
+	return gorm.Open("mysql", dsn)
+}
+
+func (mysql) AddForeignKey(db *gorm.DB, field, dest, onDelete, onUpdate string) error {
+	return db.AddForeignKey(field, dest, onDelete, onUpdate).Error
+}
+
+func (mysql) Quote(identifier string) string {
+	return "`" + identifier + "`"
+}
+
+// mysqlColumnTypes match what GORM's mysql dialect picks for the same Go types
+var mysqlColumnTypes = map[string]string{
+	"pk":       "int unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY",
+	"uint":     "int unsigned",
+	"int":      "int",
+	"datetime": "DATETIME NULL",
+	"bool":     "boolean",
+	"text":     "longtext",
+}
+
+func (mysql) ColumnType(name string) (string, bool) {
+	t, ok := mysqlColumnTypes[name]
+	return t, ok
+}
+
+// Columns reads information_schema for the current database
+func (mysql) Columns(db *gorm.DB, table string) ([]Column, error) {
+	rows, err := db.New().Raw(`SELECT column_name, column_type, is_nullable, column_default
+		FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ?
+		ORDER BY ordinal_position`, table).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := []Column{}
+	for rows.Next() {
+		column := Column{}
+		var nullable string
+		if err := rows.Scan(&column.Name, &column.Type, &nullable, &column.Default); err != nil {
+			return nil, err
+		}
+		column.Nullable = nullable == "YES"
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// Indexes reads information_schema.statistics - one row per column per index, in column order
+func (mysql) Indexes(db *gorm.DB, table string) ([]Index, error) {
+	rows, err := db.New().Raw(`SELECT index_name, non_unique, column_name
+		FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = ?
+		ORDER BY index_name, seq_in_index`, table).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := []Index{}
+	for rows.Next() {
+		var name, column string
+		var nonUnique int
+		if err := rows.Scan(&name, &nonUnique, &column); err != nil {
+			return nil, err
+		}
+		if n := len(indexes); n > 0 && indexes[n-1].Name == name {
+			indexes[n-1].Columns = append(indexes[n-1].Columns, column)
+			continue
+		}
+		indexes = append(indexes, Index{Name: name, Columns: []string{column}, Unique: nonUnique == 0, Primary: name == "PRIMARY"})
+	}
+	return indexes, rows.Err()
+}
+
+// ForeignKeys joins key_column_usage, which has the columns, to referential_constraints, which has the actions
+func (mysql) ForeignKeys(db *gorm.DB, table string) ([]ForeignKey, error) {
+	rows, err := db.New().Raw(`SELECT k.constraint_name, k.column_name, k.referenced_table_name, k.referenced_column_name, r.delete_rule, r.update_rule
+		FROM information_schema.key_column_usage k
+		JOIN information_schema.referential_constraints r ON r.constraint_schema = k.constraint_schema AND r.constraint_name = k.constraint_name
+		WHERE k.table_schema = DATABASE() AND k.table_name = ? AND k.referenced_table_name IS NOT NULL
+		ORDER BY k.constraint_name, k.ordinal_position`, table).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []ForeignKey{}
+	for rows.Next() {
+		key := ForeignKey{}
+		if err := rows.Scan(&key.Name, &key.Column, &key.RefTable, &key.RefColumn, &key.OnDelete, &key.OnUpdate); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Older MySQL versions report a display width on integer types - int(10) unsigned - which means nothing for comparing
+var mysqlDisplayWidth = regexp.MustCompile(`^(tinyint|smallint|mediumint|int|bigint)\(\d+\)`)
+
+func (mysql) NormalizeType(typ string) string {
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	if typ == "boolean" || typ == "bool" {
+		return "tinyint(1)"
+	}
+	if strings.HasPrefix(typ, "tinyint(1)") {
+		return typ
+	}
+	return mysqlDisplayWidth.ReplaceAllString(typ, "$1")
+}
+
+func (d mysql) ModifyColumnSQL(table, column, typ string) (string, bool) {
+	return fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s", d.Quote(table), d.Quote(column), typ), true
+}
+
+func (d mysql) DropIndexSQL(table, index string) string {
+	return fmt.Sprintf("DROP INDEX %s ON %s", d.Quote(index), d.Quote(table))
+}
+
+func (d mysql) ForeignKeySQL(table, name, column, dest, onDelete, onUpdate string) (string, bool) {
+	return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s ON DELETE %s ON UPDATE %s",
+		d.Quote(table), d.Quote(name), d.Quote(column), dest, onDelete, onUpdate), true
+}
+
+// ResetSequenceSQL isn't needed - AUTO_INCREMENT always carries on from the highest id
+func (mysql) ResetSequenceSQL(table, column string) (string, bool) {
+	return "", false
+}
+
+// UpsertSQL ignores the conflict columns - MySQL checks every unique key, not just the one asked for
+// Setting a column to itself is the usual way to leave the row alone, without INSERT IGNORE swallowing every other error too
+func (d mysql) UpsertSQL(conflict, set []string) string {
+	if len(set) == 0 {
+		set = []string{d.Quote(conflict[0]) + " = " + d.Quote(conflict[0])}
+	}
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+}
+
+func (d mysql) Excluded(column string) string {
+	return "VALUES(" + d.Quote(column) + ")"
+}
+
+// FirstInsertID is LastInsertId itself - MySQL reports the first id of the statement
+func (mysql) FirstInsertID(lastInsertID int64, n int) int64 {
+	return lastInsertID
+}
+
+// InsertIDStep is auto_increment_increment, which multi-primary setups like Galera set to the number of servers
+// innodb_autoinc_lock_mode 2 (the default since MySQL 8, and what Galera needs) lets concurrent INSERTs take turns at the counter, so one statement's ids can have gaps - 0 then
+func (mysql) InsertIDStep(db *gorm.DB) (int64, error) {
+	var step, lockMode int64
+	if err := db.New().Raw("SELECT @@auto_increment_increment, @@innodb_autoinc_lock_mode").Row().Scan(&step, &lockMode); err != nil {
+		return 0, fmt.Errorf("reading the auto increment settings: %w", err)
+	}
+	if lockMode == 2 {
+		return 0, nil
+	}
+	return step, nil
+}
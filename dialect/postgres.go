@@ -0,0 +1,215 @@
+package dialect
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	// Anonymous import - package just needs to initialize in order to establish itself as a database driver
+	// GORM has its own postgres dialect built in, so the driver is all we need
+	_ "github.com/lib/pq"
+)
+
+type postgres struct{}
+
+func init() {
+	Register(postgres{})
+}
+
+func (postgres) Name() string {
+	return "postgres"
+}
+
+func (postgres) Open(dsn string) (*gorm.DB, error) {
+	return gorm.Open("postgres", dsn)
+}
+
+func (postgres) AddForeignKey(db *gorm.DB, field, dest, onDelete, onUpdate string) error {
+	return db.AddForeignKey(field, dest, onDelete, onUpdate).Error
+}
+
+func (postgres) Quote(identifier string) string {
+	return `"` + identifier + `"`
+}
+
+// postgresColumnTypes match what GORM's postgres dialect picks for the same Go types
+var postgresColumnTypes = map[string]string{
+	"pk":       "serial PRIMARY KEY",
+	"uint":     "integer",
+	"int":      "integer",
+	"datetime": "timestamp with time zone",
+	"bool":     "boolean",
+	"text":     "text",
+}
+
+func (postgres) ColumnType(name string) (string, bool) {
+	t, ok := postgresColumnTypes[name]
+	return t, ok
+}
+
+// Columns reads information_schema for the current schema
+func (postgres) Columns(db *gorm.DB, table string) ([]Column, error) {
+	rows, err := db.New().Raw(`SELECT column_name, data_type, character_maximum_length, is_nullable, column_default
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = ?
+		ORDER BY ordinal_position`, table).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := []Column{}
+	for rows.Next() {
+		column := Column{}
+		var nullable string
+		var length *int
+		if err := rows.Scan(&column.Name, &column.Type, &length, &nullable, &column.Default); err != nil {
+			return nil, err
+		}
+		if length != nil {
+			column.Type = fmt.Sprintf("%s(%d)", column.Type, *length)
+		}
+		column.Nullable = nullable == "YES"
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// Indexes reads pg_index - one row per column per index, in column order
+func (postgres) Indexes(db *gorm.DB, table string) ([]Index, error) {
+	rows, err := db.New().Raw(`SELECT i.relname, ix.indisunique, ix.indisprimary, a.attname
+		FROM pg_class t
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		JOIN pg_index ix ON ix.indrelid = t.oid
+		JOIN pg_class i ON i.oid = ix.indexrelid
+		JOIN LATERAL unnest(ix.indkey) WITH ORDINALITY AS k(attnum, ord) ON true
+		JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+		WHERE n.nspname = current_schema() AND t.relname = ?
+		ORDER BY i.relname, k.ord`, table).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := []Index{}
+	for rows.Next() {
+		var name, column string
+		var unique, primary bool
+		if err := rows.Scan(&name, &unique, &primary, &column); err != nil {
+			return nil, err
+		}
+		if n := len(indexes); n > 0 && indexes[n-1].Name == name {
+			indexes[n-1].Columns = append(indexes[n-1].Columns, column)
+			continue
+		}
+		indexes = append(indexes, Index{Name: name, Columns: []string{column}, Unique: unique, Primary: primary})
+	}
+	return indexes, rows.Err()
+}
+
+// postgresActions spells out the one letter codes pg_constraint keeps the actions in
+var postgresActions = map[string]string{"a": "NO ACTION", "r": "RESTRICT", "c": "CASCADE", "n": "SET NULL", "d": "SET DEFAULT"}
+
+// ForeignKeys reads pg_constraint - only the first column of each constraint, which is all there is for the ones GORM adds
+func (postgres) ForeignKeys(db *gorm.DB, table string) ([]ForeignKey, error) {
+	rows, err := db.New().Raw(`SELECT c.conname, a.attname, rt.relname, ra.attname, c.confdeltype, c.confupdtype
+		FROM pg_constraint c
+		JOIN pg_class t ON t.oid = c.conrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		JOIN pg_class rt ON rt.oid = c.confrelid
+		JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = c.conkey[1]
+		JOIN pg_attribute ra ON ra.attrelid = c.confrelid AND ra.attnum = c.confkey[1]
+		WHERE c.contype = 'f' AND n.nspname = current_schema() AND t.relname = ?
+		ORDER BY c.conname`, table).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []ForeignKey{}
+	for rows.Next() {
+		key := ForeignKey{}
+		var onDelete, onUpdate string
+		if err := rows.Scan(&key.Name, &key.Column, &key.RefTable, &key.RefColumn, &onDelete, &onUpdate); err != nil {
+			return nil, err
+		}
+		key.OnDelete, key.OnUpdate = postgresActions[onDelete], postgresActions[onUpdate]
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// postgresTypeNames maps the long names information_schema reports, and the aliases GORM writes, onto one spelling
+var postgresTypeNames = map[string]string{
+	"character varying": "varchar",
+	"character":         "char",
+	"serial":            "integer",
+	"bigserial":         "bigint",
+	"int":               "integer",
+	"int4":              "integer",
+	"int8":              "bigint",
+	"bool":              "boolean",
+	"timestamptz":       "timestamp with time zone",
+}
+
+var postgresSize = regexp.MustCompile(`^(.*?)(\(\d+\))?$`)
+
+func (postgres) NormalizeType(typ string) string {
+	parts := postgresSize.FindStringSubmatch(strings.ToLower(strings.TrimSpace(typ)))
+	name, size := parts[1], parts[2]
+	if alias, ok := postgresTypeNames[name]; ok {
+		name = alias
+	}
+	return name + size
+}
+
+// ModifyColumnSQL splits the column definition up - ALTER COLUMN only takes the bare type, NOT NULL is set on its own
+func (d postgres) ModifyColumnSQL(table, column, typ string) (string, bool) {
+	lower := strings.ToLower(typ)
+	base := typ
+	for _, constraint := range []string{" not null", " null", " default", " unique"} {
+		if i := strings.Index(strings.ToLower(base), constraint); i >= 0 {
+			base = base[:i]
+		}
+	}
+	stmt := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", d.Quote(table), d.Quote(column), strings.TrimSpace(base))
+	if strings.Contains(lower, "not null") {
+		stmt += fmt.Sprintf(", ALTER COLUMN %s SET NOT NULL", d.Quote(column))
+	}
+	return stmt, true
+}
+
+func (d postgres) DropIndexSQL(table, index string) string {
+	return "DROP INDEX " + d.Quote(index)
+}
+
+func (d postgres) ForeignKeySQL(table, name, column, dest, onDelete, onUpdate string) (string, bool) {
+	return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s ON DELETE %s ON UPDATE %s",
+		d.Quote(table), d.Quote(name), d.Quote(column), dest, onDelete, onUpdate), true
+}
+
+// ResetSequenceSQL is needed after inserting ids by hand - a serial column's sequence doesn't notice them
+func (d postgres) ResetSequenceSQL(table, column string) (string, bool) {
+	return fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', '%s'), (SELECT COALESCE(MAX(%s), 0) + 1 FROM %s), false)",
+		table, column, d.Quote(column), d.Quote(table)), true
+}
+
+func (d postgres) UpsertSQL(conflict, set []string) string {
+	return onConflict(d, conflict, set)
+}
+
+func (d postgres) Excluded(column string) string {
+	return "excluded." + d.Quote(column)
+}
+
+// FirstInsertID is never needed - see the Dialect interface
+func (postgres) FirstInsertID(lastInsertID int64, n int) int64 {
+	return lastInsertID
+}
+
+// InsertIDStep is never needed either, but RETURNING hands the ids back in order whatever the sequence's increment
+func (postgres) InsertIDStep(db *gorm.DB) (int64, error) {
+	return 1, nil
+}
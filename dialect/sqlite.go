@@ -0,0 +1,225 @@
+package dialect
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	// Anonymous import - package just needs to initialize in order to establish itself as a database driver
+	// Note that this driver uses cgo, so a C compiler is needed to build it
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// gormSQLiteName is the name our tweaked copy of GORM's sqlite3 dialect is registered under
+const gormSQLiteName = "learngorm_sqlite3"
+
+type sqlite struct{}
+
+func init() {
+	Register(sqlite{})
+	gorm.RegisterDialect(gormSQLiteName, &sqliteGormDialect{})
+	gormAliases[gormSQLiteName] = "sqlite3"
+}
+
+func (sqlite) Name() string {
+	return "sqlite3"
+}
+
+// Open passes the driver name separately because GORM would otherwise look for a database/sql driver called learngorm_sqlite3
+func (sqlite) Open(dsn string) (*gorm.DB, error) {
+	return gorm.Open(gormSQLiteName, "sqlite3", dsn)
+}
+
+// AddForeignKey can only check - SQLite declares FK constraints in CREATE TABLE, there is no ALTER TABLE ... ADD CONSTRAINT
+// A constraint the table already has is fine, a missing one is ErrUnsupported
+func (sqlite) AddForeignKey(db *gorm.DB, field, dest, onDelete, onUpdate string) error {
+	table := db.NewScope(db.Value).TableName()
+	var count int
+	err := db.New().Raw(`SELECT count(*) FROM pragma_foreign_key_list(?) WHERE "from" = ?`, table, field).Row().Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("sqlite3: adding foreign key %s.%s -> %s to an existing table: %w", table, field, dest, ErrUnsupported)
+	}
+	return nil
+}
+
+func (sqlite) Quote(identifier string) string {
+	return `"` + identifier + `"`
+}
+
+// sqliteColumnTypes match what GORM's sqlite3 dialect picks for the same Go types
+var sqliteColumnTypes = map[string]string{
+	"pk":       "integer PRIMARY KEY AUTOINCREMENT",
+	"uint":     "integer",
+	"int":      "integer",
+	"datetime": "datetime",
+	"bool":     "bool",
+	"text":     "text",
+}
+
+func (sqlite) ColumnType(name string) (string, bool) {
+	t, ok := sqliteColumnTypes[name]
+	return t, ok
+}
+
+// Columns reads the table_info pragma
+func (sqlite) Columns(db *gorm.DB, table string) ([]Column, error) {
+	rows, err := db.New().Raw(`SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info(?) ORDER BY cid`, table).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := []Column{}
+	for rows.Next() {
+		column := Column{}
+		var notNull, pk int
+		if err := rows.Scan(&column.Name, &column.Type, &notNull, &column.Default, &pk); err != nil {
+			return nil, err
+		}
+		// SQLite doesn't flag an INTEGER PRIMARY KEY as not null, but it can't hold one
+		column.Nullable = notNull == 0 && pk == 0
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// Indexes reads the index_list pragma, then index_info for each index's columns
+// An INTEGER PRIMARY KEY is the rowid rather than an index, so it doesn't show up here
+func (sqlite) Indexes(db *gorm.DB, table string) ([]Index, error) {
+	rows, err := db.New().Raw(`SELECT name, "unique", origin FROM pragma_index_list(?)`, table).Rows()
+	if err != nil {
+		return nil, err
+	}
+	indexes := []Index{}
+	for rows.Next() {
+		index := Index{}
+		var unique int
+		var origin string
+		if err := rows.Scan(&index.Name, &unique, &origin); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index.Unique = unique == 1
+		index.Primary = origin == "pk"
+		indexes = append(indexes, index)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range indexes {
+		rows, err := db.New().Raw(`SELECT name FROM pragma_index_info(?) ORDER BY seqno`, indexes[i].Name).Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			indexes[i].Columns = append(indexes[i].Columns, column)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return indexes, nil
+}
+
+// NormalizeType only needs to ignore case - SQLite reports the type exactly as CREATE TABLE declared it
+func (sqlite) NormalizeType(typ string) string {
+	return strings.ToLower(strings.TrimSpace(typ))
+}
+
+// ModifyColumnSQL can't help - SQLite has no ALTER COLUMN, the table has to be rebuilt
+func (sqlite) ModifyColumnSQL(table, column, typ string) (string, bool) {
+	return "", false
+}
+
+func (d sqlite) DropIndexSQL(table, index string) string {
+	return "DROP INDEX " + d.Quote(index)
+}
+
+// ForeignKeys reads pragma_foreign_key_list - "to" is NULL for a constraint that names just the table, which means its primary key
+func (sqlite) ForeignKeys(db *gorm.DB, table string) ([]ForeignKey, error) {
+	rows, err := db.New().Raw(`SELECT "from", "table", COALESCE("to", ''), on_delete, on_update FROM pragma_foreign_key_list(?) ORDER BY id, seq`, table).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []ForeignKey{}
+	for rows.Next() {
+		key := ForeignKey{}
+		if err := rows.Scan(&key.Column, &key.RefTable, &key.RefColumn, &key.OnDelete, &key.OnUpdate); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// ForeignKeySQL has nothing to offer - see AddForeignKey
+func (sqlite) ForeignKeySQL(table, name, column, dest, onDelete, onUpdate string) (string, bool) {
+	return "", false
+}
+
+// ResetSequenceSQL isn't needed - AUTOINCREMENT always carries on from the highest rowid
+func (sqlite) ResetSequenceSQL(table, column string) (string, bool) {
+	return "", false
+}
+
+// UpsertSQL borrows PostgreSQL's syntax, which SQLite has had since 3.24
+// The conflict columns have to match a unique index or constraint exactly
+func (d sqlite) UpsertSQL(conflict, set []string) string {
+	return onConflict(d, conflict, set)
+}
+
+func (d sqlite) Excluded(column string) string {
+	return "excluded." + d.Quote(column)
+}
+
+// FirstInsertID counts back from the rowid of the last row - nothing else can write while the statement runs
+func (sqlite) FirstInsertID(lastInsertID int64, n int) int64 {
+	return lastInsertID - int64(n) + 1
+}
+
+// InsertIDStep is always 1 - rowids go up one at a time
+func (sqlite) InsertIDStep(db *gorm.DB) (int64, error) {
+	return 1, nil
+}
+
+// sqliteGormDialect wraps GORM's own sqlite3 dialect to smooth over the MySQL-isms in our model tags
+// GORM creates a fresh copy of a registered dialect for every connection by reflecting on its type, so the wrapped dialect is built in SetDB
+type sqliteGormDialect struct {
+	gorm.Dialect
+}
+
+// GetName has to report our own name - GORM rebuilds the dialect by name every time it clones a *gorm.DB
+func (d *sqliteGormDialect) GetName() string {
+	return gormSQLiteName
+}
+
+func (d *sqliteGormDialect) SetDB(db gorm.SQLCommon) {
+	base, _ := gorm.GetDialect("sqlite3")
+	d.Dialect = reflect.New(reflect.TypeOf(base).Elem()).Interface().(gorm.Dialect)
+	d.Dialect.SetDB(db)
+}
+
+// DataTypeOf handles AUTO_INCREMENT on a column that isn't the primary key (like BasicUser.Count)
+// GORM would render it as a second "integer primary key autoincrement", which SQLite rejects - so it becomes a plain integer instead
+// GORM skips the column on insert when it is zero, so it needs a default to avoid reading back NULL
+func (d *sqliteGormDialect) DataTypeOf(field *gorm.StructField) string {
+	if _, ok := field.TagSettingsGet("AUTO_INCREMENT"); ok && !field.IsPrimaryKey {
+		return "integer NOT NULL DEFAULT 0"
+	}
+	return d.Dialect.DataTypeOf(field)
+}
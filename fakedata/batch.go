@@ -0,0 +1,109 @@
+package fakedata
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/dialect"
+)
+
+// batch collects rows for one table and writes them as multi-row INSERTs
+// It goes straight to database/sql - GORM's Exec rewrites the placeholders one at a time, which crawls with thousands of them
+type batch struct {
+	ctx     context.Context
+	tx      *gorm.DB
+	table   string
+	columns []string
+	size    int
+	rows    []interface{}
+	count   int
+	// parents are flushed first, so a row never goes in before the row its key points at
+	parents []*batch
+	prefix  string
+}
+
+// execer is what both *sql.Tx and *sql.DB offer for a statement that stops when its context is cancelled
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func newBatch(ctx context.Context, tx *gorm.DB, d dialect.Dialect, size int, table string, columns ...string) *batch {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = d.Quote(column)
+	}
+	return &batch{
+		ctx:     ctx,
+		tx:      tx,
+		table:   table,
+		columns: columns,
+		size:    size,
+		prefix:  fmt.Sprintf("INSERT INTO %s (%s) VALUES ", d.Quote(table), strings.Join(quoted, ", ")),
+	}
+}
+
+// after makes the parents flush before b does - nil parents are skipped, for tables a target doesn't have
+func (b *batch) after(parents ...*batch) *batch {
+	for _, parent := range parents {
+		if parent != nil {
+			b.parents = append(b.parents, parent)
+		}
+	}
+	return b
+}
+
+func (b *batch) add(values ...interface{}) error {
+	b.rows = append(b.rows, values...)
+	if len(b.rows)/len(b.columns) >= b.size {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *batch) flush() error {
+	for _, parent := range b.parents {
+		if err := parent.flush(); err != nil {
+			return err
+		}
+	}
+	if len(b.rows) == 0 {
+		return nil
+	}
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
+
+	stmt := &strings.Builder{}
+	stmt.WriteString(b.prefix)
+	n := len(b.rows) / len(b.columns)
+	for row := 0; row < n; row++ {
+		if row > 0 {
+			stmt.WriteString(", ")
+		}
+		stmt.WriteString("(")
+		for col := range b.columns {
+			if col > 0 {
+				stmt.WriteString(", ")
+			}
+			stmt.WriteString(dialect.BindVar(b.tx, row*len(b.columns)+col+1))
+		}
+		stmt.WriteString(")")
+	}
+	// With ExecContext, Ctrl-C stops the INSERT that is running as well as the ones after it
+	var err error
+	if db, ok := b.tx.CommonDB().(execer); ok {
+		_, err = db.ExecContext(b.ctx, stmt.String(), b.rows...)
+	} else {
+		_, err = b.tx.CommonDB().Exec(stmt.String(), b.rows...)
+	}
+	if err != nil {
+		return fmt.Errorf("inserting into %s: %w", b.table, err)
+	}
+	b.count += n
+	b.rows = b.rows[:0]
+	return nil
+}
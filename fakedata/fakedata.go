@@ -0,0 +1,331 @@
+package fakedata
+
+/*
+* The seed data is a handful of rows - nowhere near enough to notice a missing index or a slow Preload
+	* Generate fills the calendar tables with as many users as you like, each with a calendar, a task list and a spread of appointments
+	* Everything comes from a seeded random number generator, so the same Config always produces the same rows
+	* Rows are written as multi-row INSERTs in one transaction, with ids picked up from the highest id already in each table
+* There are two targets: the relationships tables (with task lists and polymorphic appointment owners) and the query tables the query demos read from
+*/
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/transaction"
+)
+
+// Targets for Config.Target
+const (
+	TargetRelationships = "relationships"
+	TargetQuery         = "query"
+)
+
+// Config describes what to generate
+type Config struct {
+	// Users is how many users to add - each gets a calendar and (for the relationships target) a task list
+	Users  int
+	Target string
+	Seed   int64
+	// Appointments per calendar and per task list - the query target has no task lists
+	CalendarAppointments Distribution
+	TaskListAppointments Distribution
+	// Attendees per appointment, picked from all the users being generated
+	Attendees Distribution
+	// Appointments start somewhere in [Start, Start+Spread), on a Granularity boundary
+	Start       time.Time
+	Spread      time.Duration
+	Granularity time.Duration
+	// Lengths in minutes are picked from this list
+	Lengths []uint
+	// BatchSize is the number of rows per INSERT
+	BatchSize int
+	// Reset clears the target's tables first
+	Reset bool
+}
+
+// DefaultConfig generates a thousand users with a year of appointments
+func DefaultConfig() Config {
+	return Config{
+		Users:                1000,
+		Target:               TargetRelationships,
+		Seed:                 1,
+		CalendarAppointments: Distribution{Kind: Uniform, Min: 0, Max: 20},
+		TaskListAppointments: Distribution{Kind: Uniform, Min: 0, Max: 10},
+		Attendees:            Distribution{Kind: Zipf, Min: 0, Max: 8},
+		Start:                time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Spread:               365 * 24 * time.Hour,
+		Granularity:          15 * time.Minute,
+		Lengths:              []uint{15, 30, 45, 60, 90, 120, 240},
+		BatchSize:            500,
+	}
+}
+
+// Distribution kinds
+const (
+	Fixed   = "fixed"
+	Uniform = "uniform"
+	// Zipf mostly picks numbers near Min, with a long tail up to Max - most meetings are small, a few are huge
+	Zipf = "zipf"
+)
+
+// Distribution says how many of something to generate
+type Distribution struct {
+	Kind     string
+	Min, Max int
+}
+
+// ParseDistribution reads the command line form: fixed:3, uniform:0-20 or zipf:0-8
+func ParseDistribution(s string) (Distribution, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return Distribution{}, fmt.Errorf("distribution %q should look like uniform:0-20", s)
+	}
+	d := Distribution{Kind: parts[0]}
+	bounds := strings.SplitN(parts[1], "-", 2)
+	var err error
+	if d.Min, err = strconv.Atoi(bounds[0]); err != nil {
+		return d, fmt.Errorf("distribution %q: %v", s, err)
+	}
+	d.Max = d.Min
+	if len(bounds) == 2 {
+		if d.Max, err = strconv.Atoi(bounds[1]); err != nil {
+			return d, fmt.Errorf("distribution %q: %v", s, err)
+		}
+	}
+	return d, d.validate()
+}
+
+func (d Distribution) String() string {
+	if d.Kind == Fixed {
+		return fmt.Sprintf("%s:%d", d.Kind, d.Min)
+	}
+	return fmt.Sprintf("%s:%d-%d", d.Kind, d.Min, d.Max)
+}
+
+func (d Distribution) validate() error {
+	switch {
+	case d.Kind != Fixed && d.Kind != Uniform && d.Kind != Zipf:
+		return fmt.Errorf("unknown distribution %q (use %s, %s or %s)", d.Kind, Fixed, Uniform, Zipf)
+	case d.Min < 0 || d.Max < d.Min:
+		return fmt.Errorf("distribution %s: need 0 <= min <= max", d)
+	}
+	return nil
+}
+
+// sampler returns a function drawing numbers from the distribution using r
+func (d Distribution) sampler(r *rand.Rand) func() int {
+	switch {
+	case d.Kind == Fixed || d.Min == d.Max:
+		return func() int { return d.Min }
+	case d.Kind == Zipf:
+		z := rand.NewZipf(r, 1.5, 1, uint64(d.Max-d.Min))
+		return func() int { return d.Min + int(z.Uint64()) }
+	default:
+		return func() int { return d.Min + r.Intn(d.Max-d.Min+1) }
+	}
+}
+
+// Stats counts the rows Generate added
+type Stats struct {
+	Users, Calendars, TaskLists, Appointments, Attendees int
+	Duration                                             time.Duration
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d users, %d calendars, %d task lists, %d appointments, %d attendees in %v",
+		s.Users, s.Calendars, s.TaskLists, s.Appointments, s.Attendees, s.Duration.Round(time.Millisecond))
+}
+
+// tables names the tables and key columns for one target
+type tables struct {
+	users, calendars, taskLists, appointments, attendees string
+	// userKey is the FK column calendars and task lists point back at their user with
+	userKey string
+	// appointmentKey and attendeeKey are the join table's columns
+	appointmentKey, attendeeKey string
+}
+
+var targets = map[string]tables{
+	TargetRelationships: {
+		users: "relationship_users", calendars: "calendars", taskLists: "task_lists", appointments: "appointments", attendees: "appoinment_user",
+		userKey: "relationship_user_id", appointmentKey: "appointment_id", attendeeKey: "relationship_user_id",
+	},
+	TargetQuery: {
+		users: "user_queries", calendars: "calendar_queries", appointments: "appointment_queries", attendees: "appointment_query_user_query",
+		userKey: "user_query_id", appointmentKey: "appointment_query_id", attendeeKey: "user_query_id",
+	},
+}
+
+// Generate adds the rows described by cfg - the tables have to exist already
+func Generate(ctx context.Context, db *gorm.DB, cfg Config) (Stats, error) {
+	stats := Stats{}
+	t, ok := targets[cfg.Target]
+	if !ok {
+		return stats, fmt.Errorf("unknown target %q (use %s or %s)", cfg.Target, TargetRelationships, TargetQuery)
+	}
+	for _, d := range []Distribution{cfg.CalendarAppointments, cfg.TaskListAppointments, cfg.Attendees} {
+		if err := d.validate(); err != nil {
+			return stats, err
+		}
+	}
+	if cfg.Users < 1 || cfg.BatchSize < 1 || len(cfg.Lengths) == 0 || cfg.Granularity <= 0 {
+		return stats, fmt.Errorf("need at least one user, a batch size, some lengths and a granularity")
+	}
+
+	started := time.Now()
+	if err := transaction.WithTx(ctx, db, func(tx *gorm.DB) error {
+		return generate(ctx, tx, cfg, t, &stats)
+	}); err != nil {
+		return Stats{}, err
+	}
+	stats.Duration = time.Since(started)
+	return stats, nil
+}
+
+func generate(ctx context.Context, tx *gorm.DB, cfg Config, t tables, stats *Stats) error {
+	d := dialect.Of(tx)
+	all := []string{t.attendees, t.appointments, t.taskLists, t.calendars, t.users}
+	if cfg.Reset {
+		for _, table := range all {
+			if table == "" {
+				continue
+			}
+			if err := tx.Exec("DELETE FROM " + d.Quote(table)).Error; err != nil {
+				return fmt.Errorf("clearing %s: %w", table, err)
+			}
+		}
+	}
+	next := map[string]uint{}
+	for _, table := range all[1:] {
+		if table == "" {
+			continue
+		}
+		var last uint
+		if err := tx.New().Raw("SELECT COALESCE(MAX(id), 0) FROM " + d.Quote(table)).Row().Scan(&last); err != nil {
+			return fmt.Errorf("finding the highest id in %s: %w", table, err)
+		}
+		next[table] = last + 1
+	}
+
+	r := rand.New(rand.NewSource(cfg.Seed))
+	now := time.Now()
+	size := cfg.BatchSize
+
+	users := newBatch(ctx, tx, d, size, t.users, "id", "created_at", "updated_at", "username", "first_name", "last_name")
+	calendars := newBatch(ctx, tx, d, size, t.calendars, "id", "created_at", "updated_at", "name", t.userKey).after(users)
+	var taskLists *batch
+	if t.taskLists != "" {
+		taskLists = newBatch(ctx, tx, d, size, t.taskLists, "id", "created_at", "updated_at", "name", t.userKey).after(users)
+	}
+	var appointments *batch
+	if cfg.Target == TargetRelationships {
+		// Appointments belong to either a calendar or a task list - owner_type holds the owner's table name, the way GORM's polymorphic tag fills it in
+		appointments = newBatch(ctx, tx, d, size, t.appointments,
+			"id", "created_at", "updated_at", "subject", "description", "start_time", "length", "owner_id", "owner_type").after(calendars, taskLists)
+	} else {
+		appointments = newBatch(ctx, tx, d, size, t.appointments,
+			"id", "created_at", "updated_at", "subject", "description", "start_time", "length", "calendar_query_id").after(calendars)
+	}
+	attendees := newBatch(ctx, tx, d, size, t.attendees, t.appointmentKey, t.attendeeKey).after(appointments, users)
+
+	// Users, calendars and task lists all go in first, so attendees can be anyone
+	firstUser := next[t.users]
+	type owner struct {
+		id    uint
+		table string
+		count func() int
+	}
+	owners := []owner{}
+	calendarCount := cfg.CalendarAppointments.sampler(r)
+	taskListCount := cfg.TaskListAppointments.sampler(r)
+	for i := 0; i < cfg.Users; i++ {
+		first, last := firstNames[r.Intn(len(firstNames))], lastNames[r.Intn(len(lastNames))]
+		userID := next[t.users]
+		next[t.users]++
+		// The id on the end keeps usernames unique
+		username := fmt.Sprintf("%s%s%d", strings.ToLower(first[:1]), strings.ToLower(last), userID)
+		if err := users.add(userID, now, now, username, first, last); err != nil {
+			return err
+		}
+
+		calendarID := next[t.calendars]
+		next[t.calendars]++
+		if err := calendars.add(calendarID, now, now, calendarNames[r.Intn(len(calendarNames))], userID); err != nil {
+			return err
+		}
+		owners = append(owners, owner{calendarID, t.calendars, calendarCount})
+
+		if taskLists != nil {
+			taskListID := next[t.taskLists]
+			next[t.taskLists]++
+			if err := taskLists.add(taskListID, now, now, taskListNames[r.Intn(len(taskListNames))], userID); err != nil {
+				return err
+			}
+			owners = append(owners, owner{taskListID, t.taskLists, taskListCount})
+		}
+	}
+
+	attendeeCount := cfg.Attendees.sampler(r)
+	slots := int64(cfg.Spread / cfg.Granularity)
+	if slots < 1 {
+		slots = 1
+	}
+	for _, o := range owners {
+		for n := o.count(); n > 0; n-- {
+			id := next[t.appointments]
+			next[t.appointments]++
+			subject := verbs[r.Intn(len(verbs))] + " " + nouns[r.Intn(len(nouns))]
+			start := cfg.Start.Add(time.Duration(r.Int63n(slots)) * cfg.Granularity)
+			length := cfg.Lengths[r.Intn(len(cfg.Lengths))]
+			values := []interface{}{id, now, now, subject, descriptions[r.Intn(len(descriptions))], start, length, o.id}
+			if cfg.Target == TargetRelationships {
+				values = append(values, o.table)
+			}
+			if err := appointments.add(values...); err != nil {
+				return err
+			}
+
+			// The join table's primary key is (appointment, user), so nobody attends twice
+			picked := map[int]bool{}
+			for want := attendeeCount(); len(picked) < want && len(picked) < cfg.Users; {
+				i := r.Intn(cfg.Users)
+				if picked[i] {
+					continue
+				}
+				picked[i] = true
+				if err := attendees.add(id, firstUser+uint(i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// attendees flushes everything else on its way
+	if err := attendees.flush(); err != nil {
+		return err
+	}
+	for _, table := range all[1:] {
+		if table == "" {
+			continue
+		}
+		if stmt, ok := d.ResetSequenceSQL(table, "id"); ok {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return fmt.Errorf("resetting the id sequence of %s: %w", table, err)
+			}
+		}
+	}
+
+	stats.Users, stats.Calendars, stats.Appointments, stats.Attendees = users.count, calendars.count, appointments.count, attendees.count
+	if taskLists != nil {
+		stats.TaskLists = taskLists.count
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package fakedata_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/fakedata"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+// dump lists the generated rows, leaving out the timestamps that come from the clock rather than the seed
+func dump(t *testing.T, db *gorm.DB) string {
+	t.Helper()
+	queries := []string{
+		"SELECT id, username, first_name, last_name FROM relationship_users ORDER BY id",
+		"SELECT id, name, relationship_user_id FROM calendars ORDER BY id",
+		"SELECT id, name, relationship_user_id FROM task_lists ORDER BY id",
+		"SELECT id, subject, description, start_time, length, owner_id, owner_type FROM appointments ORDER BY id",
+		"SELECT appointment_id, relationship_user_id FROM appoinment_user ORDER BY appointment_id, relationship_user_id",
+	}
+	var b strings.Builder
+	for _, query := range queries {
+		rows, err := db.Raw(query).Rows()
+		if err != nil {
+			t.Fatal(err)
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			pointers := make([]interface{}, len(values))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			if err := rows.Scan(pointers...); err != nil {
+				t.Fatal(err)
+			}
+			for i, value := range values {
+				if v, ok := value.([]byte); ok {
+					values[i] = string(v)
+				}
+			}
+			fmt.Fprintln(&b, values...)
+		}
+		rows.Close()
+	}
+	return b.String()
+}
+
+func generate(t *testing.T, seed int64) (string, fakedata.Stats) {
+	t.Helper()
+	db := testdb.Open(t)
+	cfg := fakedata.DefaultConfig()
+	cfg.Users = 25
+	cfg.Seed = seed
+	// A batch size that doesn't divide anything evenly, so the last INSERT of each table is a short one
+	cfg.BatchSize = 7
+	stats, err := fakedata.Generate(context.Background(), db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "appointments"); n != stats.Appointments {
+		t.Errorf("appointments has %d rows, Generate says it added %d", n, stats.Appointments)
+	}
+	if n := testdb.Count(t, db, "appoinment_user"); n != stats.Attendees {
+		t.Errorf("appoinment_user has %d rows, Generate says it added %d", n, stats.Attendees)
+	}
+	return dump(t, db), stats
+}
+
+func TestSameSeedSameData(t *testing.T) {
+	first, stats := generate(t, 42)
+	if stats.Users != 25 || stats.Calendars != 25 || stats.TaskLists != 25 || stats.Appointments == 0 || stats.Attendees == 0 {
+		t.Fatalf("generated %v", stats)
+	}
+	second, _ := generate(t, 42)
+	if first != second {
+		t.Errorf("the same seed generated different rows:\n%s\nthen\n%s", first, second)
+	}
+	if other, _ := generate(t, 43); other == first {
+		t.Error("a different seed generated the same rows")
+	}
+}
+
+func TestParseDistribution(t *testing.T) {
+	cases := []struct {
+		in   string
+		want fakedata.Distribution
+		ok   bool
+	}{
+		{"fixed:3", fakedata.Distribution{Kind: fakedata.Fixed, Min: 3, Max: 3}, true},
+		{"uniform:0-20", fakedata.Distribution{Kind: fakedata.Uniform, Min: 0, Max: 20}, true},
+		{"zipf:1-8", fakedata.Distribution{Kind: fakedata.Zipf, Min: 1, Max: 8}, true},
+		{"uniform:5-2", fakedata.Distribution{}, false},
+		{"normal:0-5", fakedata.Distribution{}, false},
+		{"5", fakedata.Distribution{}, false},
+	}
+	for _, c := range cases {
+		got, err := fakedata.ParseDistribution(c.in)
+		if (err == nil) != c.ok || (c.ok && got != c.want) {
+			t.Errorf("ParseDistribution(%q) = %v, %v", c.in, got, err)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	db := testdb.Open(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cfg := fakedata.DefaultConfig()
+	cfg.Users = 25
+	if _, err := fakedata.Generate(ctx, db, cfg); !errors.Is(err, context.Canceled) {
+		t.Errorf("Generate returned %v, want context.Canceled", err)
+	}
+	if n := testdb.Count(t, db, "relationship_users"); n != 0 {
+		t.Errorf("a cancelled run left %d users behind", n)
+	}
+}
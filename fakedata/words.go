@@ -0,0 +1,41 @@
+package fakedata
+
+// Word lists the generator builds names and subjects from - long enough that the data doesn't look obviously repeated
+
+var firstNames = []string{
+	"Aaliyah", "Aaron", "Abigail", "Adam", "Adrian", "Aiden", "Alexander", "Alice", "Amelia", "Andrew",
+	"Anna", "Anthony", "Aria", "Arthur", "Ava", "Benjamin", "Caleb", "Camila", "Carlos", "Charlotte",
+	"Chloe", "Christopher", "Daniel", "David", "Dylan", "Eleanor", "Elijah", "Elizabeth", "Ella", "Emily",
+	"Emma", "Ethan", "Evelyn", "Ford", "Gabriel", "Grace", "Hannah", "Harper", "Henry", "Isaac",
+	"Isabella", "Jack", "Jacob", "James", "Jayden", "John", "Joseph", "Joshua", "Julian", "Layla",
+	"Leah", "Levi", "Liam", "Lily", "Logan", "Lucas", "Luke", "Madison", "Marvin", "Mason",
+	"Matthew", "Mia", "Michael", "Mila", "Nathan", "Noah", "Nora", "Oliver", "Olivia", "Owen",
+	"Penelope", "Priya", "Riley", "Ryan", "Samuel", "Scarlett", "Sebastian", "Sofia", "Sophia", "Stella",
+	"Theodore", "Thomas", "Tricia", "Victoria", "William", "Wyatt", "Yusuf", "Zaphod", "Zoe", "Zoey",
+}
+
+var lastNames = []string{
+	"Adams", "Allen", "Anderson", "Baker", "Beeblebrox", "Brown", "Campbell", "Carter", "Chen", "Clark",
+	"Collins", "Davis", "Dent", "Diaz", "Edwards", "Evans", "Flores", "Garcia", "Gomez", "Green",
+	"Hall", "Harris", "Hernandez", "Hill", "Jackson", "Johnson", "Jones", "Kaur", "King", "Kumar",
+	"Lee", "Lewis", "Lopez", "Macmillan", "Martin", "Martinez", "Miller", "Mitchell", "Moore", "Morris",
+	"Nguyen", "Nelson", "Okafor", "Parker", "Patel", "Perez", "Phillips", "Prefect", "Ramirez", "Roberts",
+	"Robinson", "Rodriguez", "Sanchez", "Scott", "Singh", "Smith", "Stewart", "Taylor", "Thomas", "Thompson",
+	"Torres", "Turner", "Walker", "White", "Williams", "Wilson", "Wright", "Yamamoto", "Young", "Zhang",
+}
+
+var verbs = []string{
+	"Review", "Plan", "Discuss", "Prepare", "Finalize", "Kick off", "Sync on", "Present", "Demo", "Brainstorm",
+	"Estimate", "Retro on", "Sign off", "Interview for", "Catch up on", "Draft", "Audit", "Triage", "Test", "Celebrate",
+}
+
+var nouns = []string{
+	"budget", "roadmap", "release", "hiring plan", "quarterly goals", "design doc", "launch", "migration", "incident", "backlog",
+	"offsite", "onboarding", "pricing", "contract", "security review", "customer feedback", "sprint", "prototype", "expenses", "tea break",
+}
+
+var descriptions = []string{"", "easy", "hard", "recurring", "optional", "bring a towel", "remote", "in person"}
+
+var calendarNames = []string{"Calendar", "Work", "Personal", "Family", "Team", "Travel"}
+
+var taskListNames = []string{"ToDos", "Urgent ToDos", "Someday", "Errands", "Chores", "Reading List"}
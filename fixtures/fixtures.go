@@ -0,0 +1,421 @@
+package fixtures
+
+/*
+* Fixtures are seed data written as YAML (or JSON - YAML reads that too) rather than Go code
+	* The top level maps table names to their records - either a map of labelled records, or a list of anonymous ones (handy for join tables)
+	* Labelled records get ids 1, 2, 3... in the order they are written, unless they set id themselves - so the ids come out the same on every load
+	* A value of the form <table>.<label> refers to another record and is replaced by its id, e.g. attendee_id: users.adent
+	* Strings that look like timestamps (2006-01-02 15:04) are parsed - a bad one is reported rather than quietly becoming the zero time
+	* created_at and updated_at are filled in if the table has them and the record doesn't set them
+* Load clears the tables and inserts everything in one transaction, parents before children, so a bad fixture leaves the old rows in place
+*/
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"gopkg.in/yaml.v3"
+
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/transaction"
+)
+
+// Set is a group of fixtures that are loaded together - references can point at any table in the set
+type Set struct {
+	tables []*table
+}
+
+type table struct {
+	name    string
+	records []*record
+	// nextID is the id the next labelled record without one of its own will get
+	nextID uint
+}
+
+type record struct {
+	// label is empty for records written as a list
+	label   string
+	id      uint
+	columns []string
+	values  []interface{}
+	// source is where the record came from, for error messages
+	source string
+}
+
+// New returns an empty Set ready for Parse
+func New() *Set {
+	return &Set{}
+}
+
+// ReadFiles parses each fixture file into one Set
+func ReadFiles(paths ...string) (*Set, error) {
+	s := New()
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.Parse(path, data); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// ReadFS parses the files in fsys matching pattern, in name order - for fixtures embedded with go:embed
+func ReadFS(fsys fs.FS, pattern string) (*Set, error) {
+	paths, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("fixtures: nothing matches %s", pattern)
+	}
+	sort.Strings(paths)
+	s := New()
+	for _, path := range paths {
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.Parse(path, data); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Parse adds the fixtures in data to the set - name is only used in error messages
+// A table can be spread over several files, as long as its labels don't clash
+func (s *Set) Parse(name string, data []byte) error {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("fixtures: %s: %w", name, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("fixtures: %s: the top level should map table names to records", name)
+	}
+	for i := 0; i < len(root.Content); i += 2 {
+		t := s.table(root.Content[i].Value)
+		body := root.Content[i+1]
+		switch body.Kind {
+		case yaml.MappingNode:
+			for j := 0; j < len(body.Content); j += 2 {
+				label := body.Content[j].Value
+				source := fmt.Sprintf("%s:%d %s.%s", name, body.Content[j].Line, t.name, label)
+				if strings.Contains(label, ".") {
+					return fmt.Errorf("fixtures: %s: labels can't contain a dot", source)
+				}
+				if t.find(label) != nil {
+					return fmt.Errorf("fixtures: %s: label used twice", source)
+				}
+				r, err := parseRecord(body.Content[j+1], source)
+				if err != nil {
+					return err
+				}
+				r.label = label
+				if err := t.assignID(r); err != nil {
+					return err
+				}
+				t.records = append(t.records, r)
+			}
+		case yaml.SequenceNode:
+			for _, item := range body.Content {
+				r, err := parseRecord(item, fmt.Sprintf("%s:%d %s", name, item.Line, t.name))
+				if err != nil {
+					return err
+				}
+				t.records = append(t.records, r)
+			}
+		default:
+			return fmt.Errorf("fixtures: %s:%d: %s should be a map of labelled records or a list of records", name, body.Line, t.name)
+		}
+	}
+	return nil
+}
+
+func (s *Set) table(name string) *table {
+	for _, t := range s.tables {
+		if t.name == name {
+			return t
+		}
+	}
+	t := &table{name: name, nextID: 1}
+	s.tables = append(s.tables, t)
+	return t
+}
+
+func (t *table) find(label string) *record {
+	for _, r := range t.records {
+		if r.label == label {
+			return r
+		}
+	}
+	return nil
+}
+
+// assignID hands out the next id, or takes note of one the record set itself so later records don't reuse it
+func (t *table) assignID(r *record) error {
+	for i, column := range r.columns {
+		if column != "id" {
+			continue
+		}
+		id, ok := r.values[i].(int)
+		if !ok || id < 1 {
+			return fmt.Errorf("fixtures: %s: id should be a positive whole number", r.source)
+		}
+		r.id = uint(id)
+		if r.id >= t.nextID {
+			t.nextID = r.id + 1
+		}
+		return nil
+	}
+	r.id = t.nextID
+	t.nextID++
+	r.columns = append([]string{"id"}, r.columns...)
+	r.values = append([]interface{}{r.id}, r.values...)
+	return nil
+}
+
+// timeLayouts are tried in order on every string value
+var timeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func parseRecord(node *yaml.Node, source string) (*record, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("fixtures: %s: a record should map column names to values", source)
+	}
+	r := &record{source: source}
+	for i := 0; i < len(node.Content); i += 2 {
+		column, valueNode := node.Content[i].Value, node.Content[i+1]
+		if valueNode.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("fixtures: %s: %s should be a single value", source, column)
+		}
+		var value interface{}
+		if err := valueNode.Decode(&value); err != nil {
+			return nil, fmt.Errorf("fixtures: %s: %s: %w", source, column, err)
+		}
+		if str, ok := value.(string); ok && valueNode.Tag == "!!str" && looksLikeTime(str) {
+			t, err := parseTime(str)
+			if err != nil {
+				return nil, fmt.Errorf("fixtures: %s: %s: %w", source, column, err)
+			}
+			value = t
+		}
+		r.columns = append(r.columns, column)
+		r.values = append(r.values, value)
+	}
+	return r, nil
+}
+
+// looksLikeTime is deliberately loose - anything starting with a date is meant to be a time, and should fail loudly if it isn't one
+func looksLikeTime(s string) bool {
+	if len(s) < 10 {
+		return false
+	}
+	for i, c := range s[:10] {
+		if (i == 4 || i == 7) && c != '-' || i != 4 && i != 7 && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q isn't a time in any of the formats %v", s, timeLayouts)
+}
+
+// ID returns the id a labelled record will be loaded with - ref is <table>.<label>
+func (s *Set) ID(ref string) (uint, error) {
+	r, err := s.resolve(ref)
+	if err != nil {
+		return 0, fmt.Errorf("fixtures: %w", err)
+	}
+	return r.id, nil
+}
+
+func (s *Set) resolve(ref string) (*record, error) {
+	parts := strings.SplitN(ref, ".", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%q isn't a <table>.<label> reference", ref)
+	}
+	for _, t := range s.tables {
+		if t.name == parts[0] {
+			if r := t.find(parts[1]); r != nil {
+				return r, nil
+			}
+			return nil, fmt.Errorf("no record labelled %s in %s", parts[1], parts[0])
+		}
+	}
+	return nil, fmt.Errorf("no table %s", parts[0])
+}
+
+// reference reports whether value refers to a record in the set, and which table it lives in
+// Only strings naming a table in the set count - anything else is an ordinary value that happens to have a dot in it
+func (s *Set) reference(value interface{}) (string, bool) {
+	str, ok := value.(string)
+	if !ok {
+		return "", false
+	}
+	parts := strings.SplitN(str, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	for _, t := range s.tables {
+		if t.name == parts[0] {
+			return t.name, true
+		}
+	}
+	return "", false
+}
+
+// order sorts the tables so every table comes after the ones it refers to, otherwise keeping the order they were written in
+func (s *Set) order() ([]*table, error) {
+	deps := map[string]map[string]bool{}
+	for _, t := range s.tables {
+		deps[t.name] = map[string]bool{}
+		for _, r := range t.records {
+			for _, value := range r.values {
+				if ref, ok := s.reference(value); ok && ref != t.name {
+					deps[t.name][ref] = true
+				}
+			}
+		}
+	}
+
+	ordered := []*table{}
+	done := map[string]bool{}
+	for len(ordered) < len(s.tables) {
+		progress := false
+		for _, t := range s.tables {
+			if done[t.name] {
+				continue
+			}
+			ready := true
+			for dep := range deps[t.name] {
+				if !done[dep] {
+					ready = false
+				}
+			}
+			if ready {
+				ordered = append(ordered, t)
+				done[t.name] = true
+				progress = true
+			}
+		}
+		if !progress {
+			stuck := []string{}
+			for _, t := range s.tables {
+				if !done[t.name] {
+					stuck = append(stuck, t.name)
+				}
+			}
+			return nil, fmt.Errorf("fixtures: these tables refer to each other in a circle: %s", strings.Join(stuck, ", "))
+		}
+	}
+	return ordered, nil
+}
+
+// Load replaces the contents of every table in the set with its fixtures
+func (s *Set) Load(ctx context.Context, db *gorm.DB) error {
+	tables, err := s.order()
+	if err != nil {
+		return err
+	}
+	d := dialect.Of(db)
+	now := time.Now()
+
+	return transaction.WithTx(ctx, db, func(tx *gorm.DB) error {
+		// Children first, so clearing a parent never trips over a FK constraint
+		for i := len(tables) - 1; i >= 0; i-- {
+			if err := tx.Exec("DELETE FROM " + d.Quote(tables[i].name)).Error; err != nil {
+				return fmt.Errorf("fixtures: clearing %s: %w", tables[i].name, err)
+			}
+		}
+		for _, t := range tables {
+			if err := s.insert(tx, d, t, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Set) insert(tx *gorm.DB, d dialect.Dialect, t *table, now time.Time) error {
+	existing, err := d.Columns(tx, t.name)
+	if err != nil {
+		return fmt.Errorf("fixtures: reading the columns of %s: %w", t.name, err)
+	}
+	timestamps := []string{}
+	for _, c := range existing {
+		if c.Name == "created_at" || c.Name == "updated_at" {
+			timestamps = append(timestamps, c.Name)
+		}
+	}
+
+	labelled := false
+	for _, r := range t.records {
+		columns := append([]string{}, r.columns...)
+		values := make([]interface{}, len(r.values))
+		for i, value := range r.values {
+			values[i] = value
+			if _, ok := s.reference(value); ok {
+				ref, err := s.resolve(value.(string))
+				if err != nil {
+					return fmt.Errorf("fixtures: %s: %s: %w", r.source, columns[i], err)
+				}
+				values[i] = ref.id
+			}
+		}
+		for _, name := range timestamps {
+			if !contains(columns, name) {
+				columns = append(columns, name)
+				values = append(values, now)
+			}
+		}
+
+		quoted := make([]string, len(columns))
+		for i, column := range columns {
+			quoted[i] = d.Quote(column)
+		}
+		stmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+			d.Quote(t.name), strings.Join(quoted, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "))
+		if err := tx.Exec(stmt, values...).Error; err != nil {
+			return fmt.Errorf("fixtures: %s: %w", r.source, err)
+		}
+		labelled = labelled || r.label != ""
+	}
+
+	// The ids were written out by hand, so a database with a separate sequence needs telling where to carry on from
+	if labelled {
+		if stmt, ok := d.ResetSequenceSQL(t.name, "id"); ok {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return fmt.Errorf("fixtures: resetting the id sequence of %s: %w", t.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package fixtures_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/fixtures"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+// The children come first, and in a file of their own, so Load has to work out the order
+const appointments = `
+calendar_queries:
+  adent:    {name: Calendar, user_query_id: user_queries.adent}
+  fprefect: {name: Work, user_query_id: user_queries.fprefect}
+
+appointment_queries:
+  pub:  {subject: Pub, start_time: 1979-07-02 10:00, length: 11, calendar_query_id: calendar_queries.fprefect}
+  ride: {subject: Hitch a ride, start_time: 1979-07-02 10:12, length: 60, calendar_query_id: calendar_queries.fprefect}
+
+appointment_query_user_query:
+  - {appointment_query_id: appointment_queries.pub, user_query_id: user_queries.adent}
+  - {appointment_query_id: appointment_queries.ride, user_query_id: user_queries.adent}
+`
+
+const users = `
+user_queries:
+  adent:    {username: adent, first_name: Arthur}
+  fprefect: {username: fprefect, first_name: Ford}
+`
+
+func parse(t *testing.T, files ...string) *fixtures.Set {
+	t.Helper()
+	set := fixtures.New()
+	for i, data := range files {
+		if err := set.Parse(fmt.Sprintf("file%d.yaml", i), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return set
+}
+
+// snapshot lists every row's id and references, to compare one load with the next
+func snapshot(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+	queries := []string{
+		"SELECT 'user', id, 0 FROM user_queries",
+		"SELECT 'calendar', id, user_query_id FROM calendar_queries",
+		"SELECT 'appointment', id, calendar_query_id FROM appointment_queries",
+		"SELECT 'attendee', appointment_query_id, user_query_id FROM appointment_query_user_query",
+	}
+	rows := []string{}
+	for _, query := range queries {
+		result, err := db.Raw(query + " ORDER BY 2, 3").Rows()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for result.Next() {
+			var kind string
+			var id, ref uint
+			if err := result.Scan(&kind, &id, &ref); err != nil {
+				t.Fatal(err)
+			}
+			rows = append(rows, fmt.Sprintf("%s %d -> %d", kind, id, ref))
+		}
+		result.Close()
+	}
+	return rows
+}
+
+func TestLoadTwice(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.Open(t)
+	set := parse(t, appointments, users)
+
+	if err := set.Load(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	first := snapshot(t, db)
+	want := []string{
+		"user 1 -> 0", "user 2 -> 0",
+		"calendar 1 -> 1", "calendar 2 -> 2",
+		"appointment 1 -> 2", "appointment 2 -> 2",
+		"attendee 1 -> 1", "attendee 2 -> 1",
+	}
+	if strings.Join(first, "\n") != strings.Join(want, "\n") {
+		t.Errorf("first load gave\n%s\nwant\n%s", strings.Join(first, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Rows added in between move the auto increment on, which the fixtures' ids mustn't follow
+	if err := db.Exec("INSERT INTO user_queries (username) VALUES ('mrobot')").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := parse(t, appointments, users).Load(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if second := snapshot(t, db); strings.Join(second, "\n") != strings.Join(first, "\n") {
+		t.Errorf("second load gave\n%s\nwant the same as the first\n%s", strings.Join(second, "\n"), strings.Join(first, "\n"))
+	}
+
+	if id, err := set.ID("appointment_queries.ride"); err != nil || id != 2 {
+		t.Errorf("ID of appointment_queries.ride is %d (%v), want 2", id, err)
+	}
+	if _, err := set.ID("appointment_queries.dinner"); err == nil {
+		t.Error("ID of a missing label didn't fail")
+	}
+}
+
+func TestLoadFailures(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.Open(t)
+	if err := parse(t, appointments, users).Load(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"missing label", "user_queries:\n  zaphod: {username: zbeeblebrox}\ncalendar_queries:\n  zaphod: {name: Calendar, user_query_id: user_queries.nobody}\n", "no record labelled nobody"},
+		{"circle", "user_queries:\n  a: {username: calendar_queries.b}\ncalendar_queries:\n  b: {name: user_queries.a}\n", "in a circle"},
+		{"bad time", "appointment_queries:\n  late: {subject: Late, start_time: 1979-13-45 10:00}\n", "isn't a time"},
+	}
+	for _, c := range cases {
+		set := fixtures.New()
+		err := set.Parse(c.name+".yaml", []byte(c.data))
+		if err == nil {
+			err = set.Load(ctx, db)
+		}
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want an error about %q", c.name, err, c.want)
+		}
+	}
+	// A fixture that fails to load leaves the last good load in place
+	if n := testdb.Count(t, db, "user_queries"); n != 2 {
+		t.Errorf("user_queries has %d rows after the failed loads, want the 2 loaded first", n)
+	}
+}
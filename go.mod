@@ -0,0 +1,13 @@
+module github.com/annicaburns/learngorm
+
+go 1.20
+
+require (
+	github.com/go-sql-driver/mysql v1.5.0
+	github.com/jinzhu/gorm v1.9.16
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.22
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/jinzhu/inflection v1.0.0 // indirect
@@ -0,0 +1,242 @@
+package integrity
+
+/*
+* A polymorphic reference - Appointment's owner_id and owner_type - can point at a Calendar or a TaskList, so no FK constraint can cover it
+	* The owner_type values come from the polymorphic relationships of the registered models: Calendar.Appointments means "calendars", TaskList.Appointments "task_lists"
+	* Both columns blank means no owner, which is allowed - it's what relationships.Associations leaves behind when it removes an appointment
+* Checked on save: a callback before every INSERT and UPDATE makes sure owner_type is one of the known values and owner_id is a live row of that table
+	* Update and Updates only check when they set one of the two columns
+	* UpdateColumn and UpdateColumns, Exec and raw SQL skip the check, like they skip every other callback - ScanPolymorphic finds what got past it
+* ScanPolymorphic reports the rows that point nowhere, and Repair detaches or deletes them
+* Scan goes through every relationship of the models - ScanPolymorphic for the polymorphic ones, ScanLinks for the has-one, has-many, belongs-to and many2many ones
+	* Those have FK constraints only where a migration added them, and SQLite doesn't enforce them unless asked - tables dropped and recreated one at a time leave rows behind
+	* Fix nulls or deletes whatever Scan found, in one transaction, and Report.Write lists it all
+*/
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/registry"
+)
+
+// ErrUnknownOwnerType is an owner_type that isn't the table of any model that owns the row - check for it with errors.Is
+var ErrUnknownOwnerType = errors.New("integrity: unknown owner type")
+
+// ErrMissingOwner is an owner_id with no live row behind it, or only half of a reference filled in
+var ErrMissingOwner = errors.New("integrity: owner doesn't exist")
+
+// Reference is one polymorphic reference - the pair of columns on the child table, and the tables they may point at
+type Reference struct {
+	// Table is the child's table, like appointments
+	Table string
+	// Model is a pointer to a blank child, like &Appointment{}
+	Model interface{}
+	// TypeColumn and IDColumn hold the owner's type and id - owner_type and owner_id
+	TypeColumn string
+	IDColumn   string
+	typeField  string
+	idField    string
+	// Owners maps each owner_type value to the owner it names
+	Owners map[string]Owner
+}
+
+// Owner is a model that owns children through a Reference
+type Owner struct {
+	Table string
+	Model interface{}
+	// Key is the owner's column that IDColumn holds - its primary key
+	Key string
+}
+
+// Types lists the owner_type values, sorted
+func (r Reference) Types() []string {
+	types := make([]string, 0, len(r.Owners))
+	for value := range r.Owners {
+		types = append(types, value)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// References finds the polymorphic references among the models - each child table once, with every owner that points at it
+func References(db *gorm.DB, models ...interface{}) []Reference {
+	refs := []Reference{}
+	index := map[string]int{}
+	for _, model := range models {
+		scope := db.NewScope(model)
+		for _, field := range scope.GetModelStruct().StructFields {
+			rel := field.Relationship
+			if rel == nil || rel.PolymorphicType == "" || len(rel.ForeignDBNames) != 1 {
+				continue
+			}
+			child := reflect.New(field.Struct.Type).Interface()
+			if field.Struct.Type.Kind() == reflect.Slice {
+				child = reflect.New(field.Struct.Type.Elem()).Interface()
+			}
+			childScope := db.NewScope(child)
+			table := childScope.TableName()
+			key := table + "." + rel.PolymorphicDBName
+			i, ok := index[key]
+			if !ok {
+				i = len(refs)
+				index[key] = i
+				refs = append(refs, Reference{
+					Table:      table,
+					Model:      child,
+					TypeColumn: rel.PolymorphicDBName,
+					IDColumn:   rel.ForeignDBNames[0],
+					typeField:  rel.PolymorphicType,
+					idField:    rel.ForeignFieldNames[0],
+					Owners:     map[string]Owner{},
+				})
+			}
+			refs[i].Owners[rel.PolymorphicValue] = Owner{Table: scope.TableName(), Model: model, Key: rel.AssociationForeignDBNames[0]}
+		}
+	}
+	return refs
+}
+
+var (
+	registered     map[reflect.Type][]Reference
+	registeredOnce sync.Once
+)
+
+// referencesOf finds the references the registered models hold on rows of the scope's model
+// The models are all registered from init functions, so they're read once, the first time anything is saved
+func referencesOf(scope *gorm.Scope) []Reference {
+	registeredOnce.Do(func() {
+		registered = map[reflect.Type][]Reference{}
+		for _, ref := range References(scope.NewDB(), registry.Models()...) {
+			t := reflect.TypeOf(ref.Model).Elem()
+			registered[t] = append(registered[t], ref)
+		}
+	})
+	return registered[scope.GetModelStruct().ModelType]
+}
+
+func init() {
+	gorm.DefaultCallback.Create().Before("gorm:create").Register("integrity:check_owner", checkOwner)
+	gorm.DefaultCallback.Update().Before("gorm:update").Register("integrity:check_owner", checkOwner)
+}
+
+// checkOwner stops a save that would leave the model pointing at an owner that isn't there
+func checkOwner(scope *gorm.Scope) {
+	if scope.HasError() {
+		return
+	}
+	if _, ok := scope.Get("gorm:update_column"); ok {
+		return
+	}
+	refs := referencesOf(scope)
+	if len(refs) == 0 {
+		return
+	}
+	attrs, partial := scope.InstanceGet("gorm:update_attrs")
+	for _, ref := range refs {
+		typeField, ok := scope.FieldByName(ref.typeField)
+		if !ok {
+			continue
+		}
+		idField, ok := scope.FieldByName(ref.idField)
+		if !ok {
+			continue
+		}
+		ownerType, ownerID := typeField.Field.Interface(), idField.Field.Interface()
+		if partial {
+			// Only the columns being set matter, and the values being written may not be in the model
+			changes := attrs.(map[string]interface{})
+			newType, typeSet := changes[ref.TypeColumn]
+			newID, idSet := changes[ref.IDColumn]
+			if !typeSet && !idSet {
+				continue
+			}
+			if isExpr(newType) || isExpr(newID) {
+				continue
+			}
+			if typeSet {
+				ownerType = newType
+			}
+			if idSet {
+				ownerID = newID
+			}
+		}
+		if err := check(scope.NewDB(), ref, ownerType, ownerID); err != nil {
+			scope.Err(err)
+			return
+		}
+	}
+}
+
+func isExpr(value interface{}) bool {
+	_, ok := value.(*gorm.SqlExpr)
+	return ok
+}
+
+// Check makes sure value, a pointer to a model, points at owners that exist
+// Packages that write rows without GORM's callbacks, like bulk, call it themselves
+func Check(db *gorm.DB, value interface{}) error {
+	scope := db.NewScope(value)
+	for _, ref := range referencesOf(scope) {
+		typeField, ok := scope.FieldByName(ref.typeField)
+		if !ok {
+			continue
+		}
+		idField, ok := scope.FieldByName(ref.idField)
+		if !ok {
+			continue
+		}
+		if err := check(db, ref, typeField.Field.Interface(), idField.Field.Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check looks up one reference's owner
+func check(db *gorm.DB, ref Reference, ownerType, ownerID interface{}) error {
+	typ := blankAsEmpty(ownerType)
+	id := blankAsEmpty(ownerID)
+	switch {
+	case typ == "" && id == "":
+		return nil
+	case typ == "":
+		return fmt.Errorf("%s.%s is %s without a %s: %w", ref.Table, ref.IDColumn, id, ref.TypeColumn, ErrMissingOwner)
+	}
+	owner, ok := ref.Owners[typ]
+	if !ok {
+		return fmt.Errorf("%s.%s %q isn't one of %v: %w", ref.Table, ref.TypeColumn, typ, ref.Types(), ErrUnknownOwnerType)
+	}
+	if id == "" {
+		return fmt.Errorf("%s.%s is %q without a %s: %w", ref.Table, ref.TypeColumn, typ, ref.IDColumn, ErrMissingOwner)
+	}
+	// Through the owner's model, so a soft deleted owner counts as missing
+	n := 0
+	if err := db.Model(owner.Model).Where(db.Dialect().Quote(owner.Key)+" = ?", ownerID).Count(&n).Error; err != nil {
+		return fmt.Errorf("integrity: looking up %s %s: %w", owner.Table, id, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s.%s points at %s %s: %w", ref.Table, ref.IDColumn, owner.Table, id, ErrMissingOwner)
+	}
+	return nil
+}
+
+// blankAsEmpty turns nil, zero and "" into "" and anything else into its string form
+func blankAsEmpty(value interface{}) string {
+	v := reflect.ValueOf(value)
+	for v.IsValid() && v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.IsZero() {
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
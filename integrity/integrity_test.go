@@ -0,0 +1,415 @@
+package integrity_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/bulk"
+	"github.com/annicaburns/learngorm/integrity"
+	"github.com/annicaburns/learngorm/registry"
+	"github.com/annicaburns/learngorm/relationships"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+// owners adds a calendar and a task list to point appointments at, both belonging to a user since their FK to relationship_users is enforced
+func owners(t *testing.T, db *gorm.DB) (relationships.Calendar, relationships.TaskList) {
+	t.Helper()
+	user := relationships.RelationshipUser{Username: "owner"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	calendar := relationships.Calendar{Name: "Work", RelationshipUserID: user.ID}
+	taskList := relationships.TaskList{Name: "Chores", RelationshipUserID: user.ID}
+	if err := db.Create(&calendar).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&taskList).Error; err != nil {
+		t.Fatal(err)
+	}
+	return calendar, taskList
+}
+
+func TestReferences(t *testing.T) {
+	db := testdb.Open(t)
+	refs := integrity.References(db, registry.Models()...)
+	if len(refs) != 1 {
+		t.Fatalf("found %d polymorphic references, want appointments' owner", len(refs))
+	}
+	ref := refs[0]
+	if ref.Table != "appointments" || ref.TypeColumn != "owner_type" || ref.IDColumn != "owner_id" {
+		t.Errorf("reference is %s.%s/%s", ref.Table, ref.TypeColumn, ref.IDColumn)
+	}
+	if got := ref.Types(); len(got) != 2 || got[0] != "calendars" || got[1] != "task_lists" {
+		t.Errorf("owner types are %v, want calendars and task_lists", got)
+	}
+}
+
+func TestCheckOnSave(t *testing.T) {
+	db := testdb.Open(t)
+	calendar, taskList := owners(t, db)
+
+	cases := []struct {
+		name        string
+		appointment relationships.Appointment
+		want        error
+	}{
+		{"calendar", relationships.Appointment{OwnerID: calendar.ID, OwnerType: "calendars"}, nil},
+		{"task list", relationships.Appointment{OwnerID: taskList.ID, OwnerType: "task_lists"}, nil},
+		{"no owner", relationships.Appointment{}, nil},
+		{"unknown type", relationships.Appointment{OwnerID: calendar.ID, OwnerType: "diaries"}, integrity.ErrUnknownOwnerType},
+		{"missing owner", relationships.Appointment{OwnerID: taskList.ID + 100, OwnerType: "task_lists"}, integrity.ErrMissingOwner},
+		{"type only", relationships.Appointment{OwnerType: "calendars"}, integrity.ErrMissingOwner},
+		{"id only", relationships.Appointment{OwnerID: calendar.ID}, integrity.ErrMissingOwner},
+	}
+	for _, c := range cases {
+		err := db.Create(&c.appointment).Error
+		if !errors.Is(err, c.want) || (c.want == nil && err != nil) {
+			t.Errorf("%s: Create returned %v, want %v", c.name, err, c.want)
+		}
+	}
+	if n := testdb.Count(t, db, "appointments"); n != 3 {
+		t.Errorf("appointments has %d rows, want only the valid ones", n)
+	}
+
+	// Moving an appointment to a deleted owner fails just like a missing one
+	appointment := relationships.Appointment{}
+	if err := db.Where("owner_type = ?", "calendars").First(&appointment).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(&taskList).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&appointment).Update("owner_type", "task_lists").Error; !errors.Is(err, integrity.ErrMissingOwner) {
+		t.Errorf("moving to a deleted task list returned %v, want ErrMissingOwner", err)
+	}
+	// Partial updates that leave the owner alone aren't checked - the appointment still points at the calendar
+	if err := db.Model(&appointment).Update("subject", "Standup").Error; err != nil {
+		t.Errorf("updating the subject returned %v", err)
+	}
+	// UpdateColumn skips the check, which is how a bad owner gets past it
+	if err := db.Model(&appointment).UpdateColumn("owner_type", "diaries").Error; err != nil {
+		t.Errorf("UpdateColumn returned %v", err)
+	}
+
+	// bulk writes its own INSERT, so it checks each row itself
+	err := bulk.CreateInBatches(context.Background(), db, []relationships.Appointment{{OwnerID: calendar.ID, OwnerType: "journals"}}, 10)
+	if !errors.Is(err, integrity.ErrUnknownOwnerType) {
+		t.Errorf("CreateInBatches returned %v, want ErrUnknownOwnerType", err)
+	}
+}
+
+// orphans inserts one appointment for every kind of problem, past the callbacks, and one that's fine
+func orphans(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	calendar, taskList := owners(t, db)
+	deleted := relationships.TaskList{Name: "Gone"}
+	if err := db.Create(&deleted).Error; err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]interface{}{
+		{"fine", calendar.ID, "calendars"},
+		{"unknown", calendar.ID, "diaries"},
+		{"half", 0, "task_lists"},
+		{"missing", taskList.ID + 100, "task_lists"},
+		{"deleted", deleted.ID, "task_lists"},
+	}
+	for _, row := range rows {
+		if err := db.Exec("INSERT INTO appointments (subject, owner_id, owner_type) VALUES (?, ?, ?)", row...).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(&deleted).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanPolymorphic(t *testing.T) {
+	db := testdb.Open(t)
+	orphans(t, db)
+
+	found, err := integrity.ScanPolymorphic(context.Background(), db, registry.Models()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := map[string]string{}
+	for _, orphan := range found {
+		appointment := relationships.Appointment{}
+		if err := db.Unscoped().First(&appointment, orphan.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		problems[appointment.Subject] = orphan.Problem
+	}
+	want := map[string]string{
+		"unknown": integrity.UnknownOwnerType,
+		"half":    integrity.HalfReference,
+		"missing": integrity.MissingOwner,
+		"deleted": integrity.DeletedOwner,
+	}
+	if len(problems) != len(want) {
+		t.Errorf("found %v, want %v", problems, want)
+	}
+	for subject, problem := range want {
+		if problems[subject] != problem {
+			t.Errorf("%q was reported as %q, want %q", subject, problems[subject], problem)
+		}
+	}
+	if got, want := integrity.Summary(found), "appointments: 1 unknown owner type, 1 half a reference, 1 missing owner, 1 deleted owner"; got != want {
+		t.Errorf("Summary is %q, want %q", got, want)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	for _, how := range []string{integrity.Detach, integrity.Delete} {
+		t.Run(how, func(t *testing.T) {
+			db := testdb.Open(t)
+			orphans(t, db)
+			found, err := integrity.ScanPolymorphic(ctx, db, registry.Models()...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repaired, err := integrity.Repair(ctx, db, found, how)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repaired["appointments"] != 4 {
+				t.Errorf("repaired %v, want 4 appointments", repaired)
+			}
+			if left, err := integrity.ScanPolymorphic(ctx, db, registry.Models()...); err != nil || len(left) > 0 {
+				t.Errorf("%d orphans left after repair (%v)", len(left), err)
+			}
+
+			live := 0
+			if err := db.Model(&relationships.Appointment{}).Count(&live).Error; err != nil {
+				t.Fatal(err)
+			}
+			detached := testdb.Count(t, db, "appointments", "owner_id IS NULL AND owner_type IS NULL")
+			switch how {
+			case integrity.Detach:
+				if live != 5 || detached != 4 {
+					t.Errorf("%d appointments left with %d detached, want 5 with 4", live, detached)
+				}
+			case integrity.Delete:
+				if live != 1 || testdb.Count(t, db, "appointments") != 5 {
+					t.Errorf("%d appointments left, want the 4 orphans soft deleted", live)
+				}
+			}
+		})
+	}
+
+	db := testdb.Open(t)
+	if _, err := integrity.Repair(ctx, db, nil, "shred"); err == nil {
+		t.Error("Repair accepted an unknown way to repair")
+	}
+}
+
+var relationshipModels = []interface{}{&relationships.RelationshipUser{}, &relationships.Calendar{}, &relationships.TaskList{}, &relationships.Appointment{}, &relationships.Attendance{}}
+
+func TestLinks(t *testing.T) {
+	db := testdb.Open(t)
+	got := []string{}
+	for _, link := range integrity.Links(db, relationshipModels...) {
+		got = append(got, link.String())
+	}
+	// Attendance's belongs-to is the same reference as Appointment.Attendees' join row, so it's only listed once
+	want := []string{
+		"calendars.relationship_user_id -> relationship_users.id (has one)",
+		"task_lists.relationship_user_id -> relationship_users.id (has one)",
+		"appoinment_user.appointment_id -> appointments.id (many2many)",
+		"appoinment_user.relationship_user_id -> relationship_users.id (many2many)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("links are\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// dangling leaves a calendar pointing at a deleted user, a task list at a missing one, and join rows at a missing appointment
+// It returns the calendar and the task list, and the id of the appointment that's gone
+func dangling(t *testing.T, db *gorm.DB) (relationships.Calendar, relationships.TaskList, uint) {
+	t.Helper()
+	deleted, missing, attendee := relationships.RelationshipUser{Username: "deleted"}, relationships.RelationshipUser{Username: "missing"}, relationships.RelationshipUser{Username: "attendee"}
+	for _, user := range []*relationships.RelationshipUser{&deleted, &missing, &attendee} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	calendar := relationships.Calendar{Name: "Work", RelationshipUserID: deleted.ID}
+	taskList := relationships.TaskList{Name: "Chores", RelationshipUserID: missing.ID}
+	fine := relationships.TaskList{Name: "Fine", RelationshipUserID: attendee.ID}
+	gone := relationships.Appointment{Subject: "Gone", Attendees: []relationships.RelationshipUser{attendee}}
+	kept := relationships.Appointment{Subject: "Kept", Attendees: []relationships.RelationshipUser{attendee}}
+	for _, value := range []interface{}{&calendar, &taskList, &fine, &gone, &kept} {
+		if err := db.Create(value).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(&deleted).Error; err != nil {
+		t.Fatal(err)
+	}
+	// A soft deleted appointment keeps its join rows, for Restore - they aren't dangling
+	if err := db.Delete(&kept).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DELETE FROM relationship_users WHERE id = ?", missing.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DELETE FROM appointments WHERE id = ?", gone.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return calendar, taskList, gone.ID
+}
+
+func TestScan(t *testing.T) {
+	db := testdb.Open(t)
+	calendar, taskList, gone := dangling(t, db)
+	if err := db.Exec("INSERT INTO appointments (subject, owner_id, owner_type) VALUES (?, ?, ?)", "Orphan", 0, "calendars").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := integrity.Scan(context.Background(), db, relationshipModels...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].Problem != integrity.HalfReference {
+		t.Errorf("polymorphic orphans are %v, want the half reference", report.Orphans)
+	}
+	got := []string{}
+	for _, d := range report.Dangling {
+		got = append(got, d.Table+" "+d.Key+" "+d.Problem)
+	}
+	want := []string{
+		"calendars " + fmt.Sprint(calendar.ID) + " " + integrity.DeletedOwner,
+		"task_lists " + fmt.Sprint(taskList.ID) + " " + integrity.MissingOwner,
+		"appoinment_user " + fmt.Sprintf("%d,3", gone) + " " + integrity.MissingOwner,
+	}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("found %s, want %s", strings.Join(got, "; "), strings.Join(want, "; "))
+	}
+
+	var b strings.Builder
+	if err := report.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"4 problems", "  calendars: 1 deleted owner", "  appointments: 1 half a reference"} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("report is missing %q:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestFix(t *testing.T) {
+	ctx := context.Background()
+	for _, how := range []string{integrity.Detach, integrity.Delete} {
+		t.Run(how, func(t *testing.T) {
+			db := testdb.Open(t)
+			calendar, taskList, _ := dangling(t, db)
+			report, err := integrity.Scan(ctx, db, relationshipModels...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := integrity.Fix(ctx, db, report, how); err != nil {
+				t.Fatal(err)
+			}
+			if report.How != how || report.Fixed["appoinment_user"] != 1 || report.Fixed["calendars"] != 1 || report.Fixed["task_lists"] != 1 {
+				t.Errorf("fixed %v by %s, want a row of each table", report.Fixed, report.How)
+			}
+			if again, err := integrity.Scan(ctx, db, relationshipModels...); err != nil || again.Len() > 0 {
+				t.Errorf("%d problems left after the fix (%v)", again.Len(), err)
+			}
+			// The join row of the soft deleted appointment is still there
+			if n := testdb.Count(t, db, "appoinment_user"); n != 1 {
+				t.Errorf("appoinment_user has %d rows, want the soft deleted appointment's", n)
+			}
+
+			live := 0
+			if err := db.Model(&relationships.Calendar{}).Where("id = ?", calendar.ID).Count(&live).Error; err != nil {
+				t.Fatal(err)
+			}
+			nulled := testdb.Count(t, db, "task_lists", "id = ? AND relationship_user_id IS NULL", taskList.ID)
+			switch how {
+			case integrity.Detach:
+				if live != 1 || nulled != 1 {
+					t.Errorf("calendar live=%d, task list nulled=%d - want the calendar kept and the task list detached", live, nulled)
+				}
+			case integrity.Delete:
+				if live != 0 || testdb.Count(t, db, "calendars", "id = ?", calendar.ID) != 1 {
+					t.Error("the calendar wasn't soft deleted")
+				}
+			}
+		})
+	}
+
+	db := testdb.Open(t)
+	if err := integrity.Fix(ctx, db, &integrity.Report{}, "shred"); err == nil {
+		t.Error("Fix accepted an unknown way to fix")
+	}
+}
+
+// An edition's key is two columns, so Fix picks its rows out by the shelf they point at instead
+type shelf struct {
+	ID       uint
+	Editions []edition
+}
+
+type edition struct {
+	Title   string `gorm:"primary_key"`
+	Number  int    `gorm:"primary_key;auto_increment:false"`
+	ShelfID *uint
+}
+
+func TestFixCompositeKey(t *testing.T) {
+	ctx := context.Background()
+	for _, how := range []string{integrity.Detach, integrity.Delete} {
+		t.Run(how, func(t *testing.T) {
+			db := testdb.Open(t)
+			if err := db.CreateTable(&shelf{}, &edition{}).Error; err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.DropTableIfExists(&shelf{}, &edition{}) })
+			kept, gone := shelf{}, shelf{}
+			for _, value := range []*shelf{&kept, &gone} {
+				if err := db.Create(value).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, shelfID := range []uint{kept.ID, gone.ID, gone.ID} {
+				if err := db.Create(&edition{Title: "Guide", Number: i + 1, ShelfID: &shelfID}).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Exec("DELETE FROM shelves WHERE id = ?", gone.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := integrity.Scan(ctx, db, &shelf{}, &edition{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Dangling) != 2 {
+				t.Fatalf("found %v, want the two editions on the missing shelf", report.Dangling)
+			}
+			if err := integrity.Fix(ctx, db, report, how); err != nil {
+				t.Fatal(err)
+			}
+			if report.Fixed["editions"] != 2 {
+				t.Errorf("fixed %v by %s, want 2 editions", report.Fixed, how)
+			}
+			nulled, left := testdb.Count(t, db, "editions", "shelf_id IS NULL"), testdb.Count(t, db, "editions")
+			switch how {
+			case integrity.Detach:
+				if nulled != 2 || left != 3 {
+					t.Errorf("%d of %d editions nulled, want the 2 on the missing shelf kept and detached", nulled, left)
+				}
+			case integrity.Delete:
+				if nulled != 0 || left != 1 {
+					t.Errorf("%d editions left, %d nulled - want only the one on the kept shelf", left, nulled)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package integrity
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/dialect"
+)
+
+// Kinds of relationship a Link comes from
+const (
+	HasOne     = "has one"
+	HasMany    = "has many"
+	BelongsTo  = "belongs to"
+	ManyToMany = "many2many"
+)
+
+// Link is a plain reference - a column of one table holding the key of a row in another, like calendars.relationship_user_id
+// Polymorphic references have a Reference instead, since the table they point at depends on the row
+type Link struct {
+	Kind      string
+	Table     string
+	Column    string
+	RefTable  string
+	RefColumn string
+	// model is a blank row of Table, if any of the models has that table - a many2many join table usually doesn't
+	model interface{}
+	// keys are Table's primary key columns - both foreign keys, for a join table
+	keys []string
+	// refModel is a blank row of RefTable, to tell whether it has soft deletes
+	refModel interface{}
+}
+
+func (l Link) String() string {
+	return fmt.Sprintf("%s.%s -> %s.%s (%s)", l.Table, l.Column, l.RefTable, l.RefColumn, l.Kind)
+}
+
+// join reports whether Table is a many2many join table - its rows are nothing but references, so they can be deleted but not nulled
+func (l Link) join() bool {
+	return l.Kind == ManyToMany
+}
+
+// Links finds the plain references among the models' has-one, has-many, belongs-to and many2many relationships - each one once, even when both sides declare it
+func Links(db *gorm.DB, models ...interface{}) []Link {
+	byTable := map[string]interface{}{}
+	for _, model := range models {
+		byTable[db.NewScope(model).TableName()] = model
+	}
+	links := []Link{}
+	seen := map[string]bool{}
+	add := func(l Link) {
+		key := l.Table + "." + l.Column + ">" + l.RefTable
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		if l.model == nil {
+			l.model = byTable[l.Table]
+		}
+		if l.model != nil && !l.join() {
+			l.keys = nil
+			for _, field := range db.NewScope(l.model).PrimaryFields() {
+				l.keys = append(l.keys, field.DBName)
+			}
+		}
+		links = append(links, l)
+	}
+
+	for _, model := range models {
+		scope := db.NewScope(model)
+		for _, field := range scope.GetModelStruct().StructFields {
+			rel := field.Relationship
+			if rel == nil || rel.PolymorphicType != "" {
+				continue
+			}
+			typ := field.Struct.Type
+			for typ.Kind() == reflect.Slice || typ.Kind() == reflect.Ptr {
+				typ = typ.Elem()
+			}
+			other := reflect.New(typ).Interface()
+			otherScope := db.NewScope(other)
+			switch rel.Kind {
+			case "has_one", "has_many":
+				kind := HasOne
+				if rel.Kind == "has_many" {
+					kind = HasMany
+				}
+				for i := range rel.ForeignDBNames {
+					add(Link{Kind: kind, Table: otherScope.TableName(), Column: rel.ForeignDBNames[i],
+						RefTable: scope.TableName(), RefColumn: rel.AssociationForeignDBNames[i], model: other, refModel: model})
+				}
+			case "belongs_to":
+				for i := range rel.ForeignDBNames {
+					add(Link{Kind: BelongsTo, Table: scope.TableName(), Column: rel.ForeignDBNames[i],
+						RefTable: otherScope.TableName(), RefColumn: rel.AssociationForeignDBNames[i], model: model, refModel: other})
+				}
+			case "many_to_many":
+				if rel.JoinTableHandler == nil {
+					continue
+				}
+				join := rel.JoinTableHandler.Table(db)
+				keys := append(append([]string{}, rel.ForeignDBNames...), rel.AssociationForeignDBNames...)
+				for i, name := range rel.ForeignFieldNames {
+					if key, ok := scope.FieldByName(name); ok {
+						add(Link{Kind: ManyToMany, Table: join, Column: rel.ForeignDBNames[i],
+							RefTable: scope.TableName(), RefColumn: key.DBName, keys: keys, refModel: model})
+					}
+				}
+				for i, name := range rel.AssociationForeignFieldNames {
+					if key, ok := otherScope.FieldByName(name); ok {
+						add(Link{Kind: ManyToMany, Table: join, Column: rel.AssociationForeignDBNames[i],
+							RefTable: otherScope.TableName(), RefColumn: key.DBName, keys: keys, refModel: other})
+					}
+				}
+			}
+		}
+	}
+	return links
+}
+
+// Dangling is a row whose Link points at a row that isn't there
+type Dangling struct {
+	Link
+	// Key is the row's primary key - the values of every key column joined with commas for a join table, like the audit log's record ids
+	Key string
+	// Value is what Column holds
+	Value interface{}
+	// Problem is MissingOwner or DeletedOwner
+	Problem string
+	keys    []interface{}
+}
+
+func (d Dangling) String() string {
+	return fmt.Sprintf("%s %s: %s - %s=%v, %s", d.Table, d.Key, d.Problem, d.Column, d.Value, d.Link)
+}
+
+// ScanLinks finds the rows of the models' plain references that point nowhere
+// A reference to a soft deleted row is only a problem for a live row of a soft deletable model - softdelete.Delete would have taken it along
+// Join rows are kept by a soft delete, so Restore can put them back, and soft deleted rows have nothing left to point at - neither is reported
+// Zero and NULL mean no reference, and are skipped too
+func ScanLinks(ctx context.Context, db *gorm.DB, models ...interface{}) ([]Dangling, error) {
+	d := dialect.Of(db)
+	dangling := []Dangling{}
+	for _, link := range Links(db, models...) {
+		if err := ctx.Err(); err != nil {
+			return dangling, err
+		}
+		if len(link.keys) == 0 || !db.Dialect().HasTable(link.Table) || !db.Dialect().HasTable(link.RefTable) {
+			continue
+		}
+		c := func(column string) string { return "c." + d.Quote(column) }
+		keys := make([]string, len(link.keys))
+		for i, key := range link.keys {
+			keys[i] = c(key)
+		}
+		where := fmt.Sprintf("%s IS NOT NULL AND %s <> 0", c(link.Column), c(link.Column))
+		softDeletes := len(link.keys) == 1 && link.model != nil && !link.join() && db.NewScope(link.model).HasColumn("deleted_at")
+		if softDeletes {
+			where += " AND " + c("deleted_at") + " IS NULL"
+		}
+		query := fmt.Sprintf("SELECT %s, %s FROM %s c LEFT JOIN %s p ON p.%s = %s WHERE %s",
+			strings.Join(keys, ", "), c(link.Column), d.Quote(link.Table), d.Quote(link.RefTable), d.Quote(link.RefColumn), c(link.Column), where)
+
+		found, err := scanLink(db, link, MissingOwner, query+" AND p."+d.Quote(link.RefColumn)+" IS NULL ORDER BY "+strings.Join(keys, ", "))
+		if err != nil {
+			return dangling, err
+		}
+		dangling = append(dangling, found...)
+		if softDeletes && db.NewScope(link.refModel).HasColumn("deleted_at") {
+			found, err := scanLink(db, link, DeletedOwner, query+" AND p.deleted_at IS NOT NULL ORDER BY "+strings.Join(keys, ", "))
+			if err != nil {
+				return dangling, err
+			}
+			dangling = append(dangling, found...)
+		}
+	}
+	return dangling, nil
+}
+
+// scanLink runs one of ScanLinks' queries
+func scanLink(db *gorm.DB, link Link, problem, query string) ([]Dangling, error) {
+	rows, err := db.New().Raw(query).Rows()
+	if err != nil {
+		return nil, fmt.Errorf("integrity: scanning %s.%s for %ss: %w", link.Table, link.Column, problem, err)
+	}
+	defer rows.Close()
+	dangling := []Dangling{}
+	for rows.Next() {
+		values := make([]interface{}, len(link.keys)+1)
+		pointers := make([]interface{}, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		parts := make([]string, len(link.keys))
+		for i := range values {
+			// MySQL hands back numbers as text
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			if i < len(parts) {
+				parts[i] = fmt.Sprint(values[i])
+			}
+		}
+		dangling = append(dangling, Dangling{
+			Link:    link,
+			Key:     strings.Join(parts, ","),
+			Value:   values[len(values)-1],
+			Problem: problem,
+			keys:    values[:len(link.keys)],
+		})
+	}
+	return dangling, rows.Err()
+}
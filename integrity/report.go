@@ -0,0 +1,184 @@
+package integrity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/audit"
+	"github.com/annicaburns/learngorm/softdelete"
+	"github.com/annicaburns/learngorm/transaction"
+)
+
+// Report is what Scan found, and what Fix did about it
+type Report struct {
+	ScannedAt time.Time
+	Orphans   []Orphan
+	Dangling  []Dangling
+	// How is Detach or Delete once Fix has run, and Fixed how many rows of each table it changed
+	How   string
+	Fixed softdelete.Counts
+}
+
+// Len is the number of problems found
+func (r *Report) Len() int {
+	return len(r.Orphans) + len(r.Dangling)
+}
+
+// Scan checks every relationship among the models - the polymorphic references with ScanPolymorphic and the rest with ScanLinks
+func Scan(ctx context.Context, db *gorm.DB, models ...interface{}) (*Report, error) {
+	report := &Report{ScannedAt: time.Now()}
+	var err error
+	if report.Orphans, err = ScanPolymorphic(ctx, db, models...); err != nil {
+		return report, err
+	}
+	report.Dangling, err = ScanLinks(ctx, db, models...)
+	return report, err
+}
+
+// Fix detaches or deletes everything the report found, in one transaction, and fills in How and Fixed
+// Detach nulls the column that points nowhere - except in a join table, whose rows are nothing but their keys, so those rows are deleted either way
+// Delete soft deletes rows that can be, with their children, and hard deletes the rest - rows with no model or a composite key are picked out by the missing value and hard deleted
+// Changes made through a model are recorded in the audit log against the actor in ctx - join table rows have no model, so their deletes aren't
+func Fix(ctx context.Context, db *gorm.DB, report *Report, how string) error {
+	if how != Detach && how != Delete {
+		return fmt.Errorf("integrity: fix by %s or %s, not %q", Detach, Delete, how)
+	}
+	fixed := softdelete.Counts{}
+	err := transaction.WithTx(ctx, audit.DB(ctx, db), func(tx *gorm.DB) error {
+		// Repair runs in a savepoint of this transaction
+		repaired, err := Repair(ctx, tx, report.Orphans, how)
+		if err != nil {
+			return err
+		}
+		for table, n := range repaired {
+			fixed[table] += n
+		}
+
+		// One statement per link, in the order they were found
+		byLink := map[string][]Dangling{}
+		order := []string{}
+		for _, d := range report.Dangling {
+			key := d.Link.String()
+			if byLink[key] == nil {
+				order = append(order, key)
+			}
+			byLink[key] = append(byLink[key], d)
+		}
+		for _, key := range order {
+			if err := fixLink(ctx, tx, byLink[key], how, fixed); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	report.How, report.Fixed = how, fixed
+	return nil
+}
+
+// fixLink fixes the dangling rows of one link
+func fixLink(ctx context.Context, tx *gorm.DB, dangling []Dangling, how string, fixed softdelete.Counts) error {
+	link := dangling[0].Link
+	quote := tx.Dialect().Quote
+	if link.join() || len(link.keys) != 1 || link.model == nil {
+		// Every row holding a missing value is a dangling one, so the value picks them out, whatever the key
+		values := make([]interface{}, len(dangling))
+		for i, d := range dangling {
+			values[i] = d.Value
+		}
+		statement := fmt.Sprintf("UPDATE %s SET %s = NULL WHERE %s IN (?)", quote(link.Table), quote(link.Column), quote(link.Column))
+		if how == Delete || link.join() {
+			statement = fmt.Sprintf("DELETE FROM %s WHERE %s IN (?)", quote(link.Table), quote(link.Column))
+		}
+		result := tx.Exec(statement, values)
+		if result.Error != nil {
+			return fmt.Errorf("integrity: fixing %s.%s: %w", link.Table, link.Column, result.Error)
+		}
+		fixed[link.Table] += result.RowsAffected
+		return nil
+	}
+
+	ids := make([]interface{}, len(dangling))
+	for i, d := range dangling {
+		ids[i] = d.keys[0]
+	}
+	if how == Delete {
+		counts, err := softdelete.Delete(ctx, tx, link.model, ids...)
+		if errors.Is(err, softdelete.ErrNotSoftDeletable) {
+			result := tx.Where(quote(link.keys[0])+" IN (?)", ids).Delete(link.model)
+			counts, err = softdelete.Counts{link.Table: result.RowsAffected}, result.Error
+		}
+		if err != nil {
+			return fmt.Errorf("integrity: deleting from %s: %w", link.Table, err)
+		}
+		for table, n := range counts {
+			fixed[table] += n
+		}
+		return nil
+	}
+	result := tx.Model(link.model).Where(quote(link.keys[0])+" IN (?)", ids).UpdateColumn(link.Column, gorm.Expr("NULL"))
+	if result.Error != nil {
+		return fmt.Errorf("integrity: nulling %s.%s: %w", link.Table, link.Column, result.Error)
+	}
+	fixed[link.Table] += result.RowsAffected
+	return nil
+}
+
+// Write writes the report as text - a summary by table, then every problem, then what was fixed
+func (r *Report) Write(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Integrity report, %s\n", r.ScannedAt.Format(time.RFC3339))
+	if r.Len() == 0 {
+		b.WriteString("No problems found\n")
+	} else {
+		byTable := map[string]map[string]int{}
+		count := func(table, problem string) {
+			if byTable[table] == nil {
+				byTable[table] = map[string]int{}
+			}
+			byTable[table][problem]++
+		}
+		for _, o := range r.Orphans {
+			count(o.Table, o.Problem)
+		}
+		for _, d := range r.Dangling {
+			count(d.Table, d.Problem)
+		}
+		tables := make([]string, 0, len(byTable))
+		for table := range byTable {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		fmt.Fprintf(&b, "%d problems\n", r.Len())
+		for _, table := range tables {
+			parts := []string{}
+			for _, problem := range []string{UnknownOwnerType, HalfReference, MissingOwner, DeletedOwner} {
+				if n := byTable[table][problem]; n > 0 {
+					parts = append(parts, fmt.Sprintf("%d %s", n, problem))
+				}
+			}
+			fmt.Fprintf(&b, "  %s: %s\n", table, strings.Join(parts, ", "))
+		}
+		b.WriteString("\n")
+		for _, o := range r.Orphans {
+			fmt.Fprintln(&b, o)
+		}
+		for _, d := range r.Dangling {
+			fmt.Fprintln(&b, d)
+		}
+	}
+	if r.How != "" {
+		fmt.Fprintf(&b, "\nFixed by %s: %s\n", r.How, r.Fixed)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
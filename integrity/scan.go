@@ -0,0 +1,193 @@
+package integrity
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/audit"
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/softdelete"
+	"github.com/annicaburns/learngorm/transaction"
+)
+
+// Problems an Orphan can have
+const (
+	UnknownOwnerType = "unknown owner type"
+	HalfReference    = "half a reference"
+	MissingOwner     = "missing owner"
+	DeletedOwner     = "deleted owner"
+)
+
+// Orphan is a row whose polymorphic reference points nowhere
+type Orphan struct {
+	Table     string
+	ID        uint
+	OwnerType string
+	OwnerID   uint
+	Problem   string
+	ref       Reference
+}
+
+func (o Orphan) String() string {
+	return fmt.Sprintf("%s %d: %s - %s=%q %s=%d", o.Table, o.ID, o.Problem, o.ref.TypeColumn, o.OwnerType, o.ref.IDColumn, o.OwnerID)
+}
+
+// ScanPolymorphic finds the live rows of the models' polymorphic references whose owner isn't there
+// Soft deleted rows are skipped - there's nothing left to point at their owner
+func ScanPolymorphic(ctx context.Context, db *gorm.DB, models ...interface{}) ([]Orphan, error) {
+	d := dialect.Of(db)
+	orphans := []Orphan{}
+	for _, ref := range References(db, models...) {
+		if err := ctx.Err(); err != nil {
+			return orphans, err
+		}
+		c := func(column string) string { return "c." + d.Quote(column) }
+		live := "1 = 1"
+		if db.NewScope(ref.Model).HasColumn("deleted_at") {
+			live = c("deleted_at") + " IS NULL"
+		}
+		hasType := fmt.Sprintf("(%s IS NOT NULL AND %s <> '')", c(ref.TypeColumn), c(ref.TypeColumn))
+		hasID := fmt.Sprintf("(%s IS NOT NULL AND %s <> 0)", c(ref.IDColumn), c(ref.IDColumn))
+		from := fmt.Sprintf("SELECT %s, %s, %s FROM %s c", c(ref.key(db)), c(ref.TypeColumn), c(ref.IDColumn), d.Quote(ref.Table))
+
+		found, err := scan(db, ref, UnknownOwnerType, fmt.Sprintf("%s WHERE %s AND %s AND %s NOT IN (?)", from, live, hasType, c(ref.TypeColumn)), ref.Types())
+		if err != nil {
+			return orphans, err
+		}
+		orphans = append(orphans, found...)
+		found, err = scan(db, ref, HalfReference, fmt.Sprintf("%s WHERE %s AND ((%s AND NOT %s) OR (%s AND NOT %s))", from, live, hasType, hasID, hasID, hasType))
+		if err != nil {
+			return orphans, err
+		}
+		orphans = append(orphans, found...)
+
+		for _, value := range ref.Types() {
+			owner := ref.Owners[value]
+			join := fmt.Sprintf("%s LEFT JOIN %s o ON o.%s = %s WHERE %s AND %s = ? AND %s",
+				from, d.Quote(owner.Table), d.Quote(owner.Key), c(ref.IDColumn), live, c(ref.TypeColumn), hasID)
+			found, err := scan(db, ref, MissingOwner, join+" AND o."+d.Quote(owner.Key)+" IS NULL", value)
+			if err != nil {
+				return orphans, err
+			}
+			orphans = append(orphans, found...)
+			if db.NewScope(owner.Model).HasColumn("deleted_at") {
+				found, err := scan(db, ref, DeletedOwner, join+" AND o.deleted_at IS NOT NULL", value)
+				if err != nil {
+					return orphans, err
+				}
+				orphans = append(orphans, found...)
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// key is the child's primary key column
+func (r Reference) key(db *gorm.DB) string {
+	return db.NewScope(r.Model).PrimaryKey()
+}
+
+// scan runs one of ScanPolymorphic's queries
+func scan(db *gorm.DB, ref Reference, problem, query string, args ...interface{}) ([]Orphan, error) {
+	rows, err := db.New().Raw(query+" ORDER BY c."+db.Dialect().Quote(ref.key(db)), args...).Rows()
+	if err != nil {
+		return nil, fmt.Errorf("integrity: scanning %s for %ss: %w", ref.Table, problem, err)
+	}
+	defer rows.Close()
+	orphans := []Orphan{}
+	for rows.Next() {
+		var ownerType sql.NullString
+		var ownerID sql.NullInt64
+		orphan := Orphan{Table: ref.Table, Problem: problem, ref: ref}
+		if err := rows.Scan(&orphan.ID, &ownerType, &ownerID); err != nil {
+			return nil, err
+		}
+		orphan.OwnerType, orphan.OwnerID = ownerType.String, uint(ownerID.Int64)
+		orphans = append(orphans, orphan)
+	}
+	return orphans, rows.Err()
+}
+
+// Ways Repair can fix an Orphan
+const (
+	// Detach clears both columns, leaving a row without an owner
+	Detach = "detach"
+	// Delete deletes the row - softly, with its children, when the model has a DeletedAt
+	Delete = "delete"
+)
+
+// Repair detaches or deletes the orphans, all in one transaction, and returns how many rows of each table it changed
+// Changes are recorded in the audit log against the actor in ctx
+func Repair(ctx context.Context, db *gorm.DB, orphans []Orphan, how string) (softdelete.Counts, error) {
+	if how != Detach && how != Delete {
+		return nil, fmt.Errorf("integrity: repair by %s or %s, not %q", Detach, Delete, how)
+	}
+	byTable := map[string][]interface{}{}
+	refs := map[string]Reference{}
+	for _, orphan := range orphans {
+		byTable[orphan.Table] = append(byTable[orphan.Table], orphan.ID)
+		refs[orphan.Table] = orphan.ref
+	}
+
+	repaired := softdelete.Counts{}
+	err := transaction.WithTx(ctx, audit.DB(ctx, db), func(tx *gorm.DB) error {
+		for table, ids := range byTable {
+			ref := refs[table]
+			if how == Delete {
+				counts, err := softdelete.Delete(ctx, tx, ref.Model, ids...)
+				if errors.Is(err, softdelete.ErrNotSoftDeletable) {
+					result := tx.Where(tx.Dialect().Quote(ref.key(tx))+" IN (?)", ids).Delete(ref.Model)
+					counts, err = softdelete.Counts{table: result.RowsAffected}, result.Error
+				}
+				if err != nil {
+					return fmt.Errorf("integrity: deleting orphaned %s: %w", table, err)
+				}
+				for t, n := range counts {
+					repaired[t] += n
+				}
+				continue
+			}
+			// A plain nil would be written as 0 and '' - GORM sets it on the model's fields first
+			result := tx.Model(ref.Model).Where(tx.Dialect().Quote(ref.key(tx))+" IN (?)", ids).
+				UpdateColumns(map[string]interface{}{ref.TypeColumn: gorm.Expr("NULL"), ref.IDColumn: gorm.Expr("NULL")})
+			if result.Error != nil {
+				return fmt.Errorf("integrity: detaching orphaned %s: %w", table, result.Error)
+			}
+			repaired[table] += result.RowsAffected
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repaired, nil
+}
+
+// Summary counts the orphans by table and problem - "appointments: 2 missing owner, 1 unknown owner type"
+func Summary(orphans []Orphan) string {
+	counts := map[string]map[string]int{}
+	tables := []string{}
+	for _, orphan := range orphans {
+		if counts[orphan.Table] == nil {
+			counts[orphan.Table] = map[string]int{}
+			tables = append(tables, orphan.Table)
+		}
+		counts[orphan.Table][orphan.Problem]++
+	}
+	lines := []string{}
+	for _, table := range tables {
+		parts := []string{}
+		for _, problem := range []string{UnknownOwnerType, HalfReference, MissingOwner, DeletedOwner} {
+			if n := counts[table][problem]; n > 0 {
+				parts = append(parts, fmt.Sprintf("%d %s", n, problem))
+			}
+		}
+		lines = append(lines, table+": "+strings.Join(parts, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
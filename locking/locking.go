@@ -0,0 +1,135 @@
+package locking
+
+/*
+* Optimistic locking - two people load the same row, both change it, and the second save should fail instead of silently undoing the first
+	* Opt in by giving a model a Version field (any unsigned or signed integer) backed by a NOT NULL version column
+	* Every Save, Update and Updates of one record then adds WHERE version = <the version it was loaded with> and bumps the version by one
+	* If nothing matched, someone else got there first (or deleted the row) and the call fails with ErrStaleObject
+	* Updates of many rows at once (no primary key on the model) just bump the version, so open copies of those rows go stale too
+	* UpdateColumn and UpdateColumns skip the check, like they skip every other update callback
+* The callbacks go into GORM's DefaultCallback when the package is imported, the way GORM registers its own
+	* The callbacks package imports it, so every connection the CLI and the tests make has them
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrStaleObject is returned when the row changed since it was loaded - check for it with errors.Is
+var ErrStaleObject = errors.New("locking: stale object - the row was changed or deleted since it was loaded")
+
+// DefaultAttempts is how many times Retry tries when it's given 0
+const DefaultAttempts = 3
+
+// versionKey carries the version a record was loaded with from checkVersion to verifyVersion
+const versionKey = "locking:version"
+
+func init() {
+	gorm.DefaultCallback.Update().Before("gorm:update").Register("locking:check_version", checkVersion)
+	gorm.DefaultCallback.Update().After("gorm:update").Register("locking:verify_version", verifyVersion)
+}
+
+// VersionField finds the model's Version field - a Version that is the primary key, like SchemaMigration's, doesn't count
+// Packages that write rows without GORM's update callbacks, like bulk, use it to keep the version moving
+func VersionField(scope *gorm.Scope) (*gorm.Field, bool) {
+	field, ok := scope.FieldByName("Version")
+	if !ok || field.IsPrimaryKey || !field.IsNormal {
+		return nil, false
+	}
+	switch field.Field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return field, true
+	}
+	return nil, false
+}
+
+// checkVersion adds the version condition and the increment to the UPDATE
+func checkVersion(scope *gorm.Scope) {
+	if scope.HasError() {
+		return
+	}
+	if _, ok := scope.Get("gorm:update_column"); ok {
+		return
+	}
+	field, ok := VersionField(scope)
+	if !ok {
+		return
+	}
+	column := scope.Quote(field.DBName)
+
+	if scope.PrimaryKeyZero() {
+		if attrs, ok := scope.InstanceGet("gorm:update_attrs"); ok {
+			attrs.(map[string]interface{})[field.DBName] = gorm.Expr(column + " + 1")
+		}
+		return
+	}
+
+	loaded := field.Field.Interface()
+	scope.Search.Where(fmt.Sprintf("%s.%s = ?", scope.QuotedTableName(), column), loaded)
+	// SetColumn puts the new version into the struct, and into the column map when this is an Updates
+	next := reflect.New(field.Field.Type()).Elem()
+	if field.Field.CanInt() {
+		next.SetInt(field.Field.Int() + 1)
+	} else {
+		next.SetUint(field.Field.Uint() + 1)
+	}
+	if err := scope.SetColumn(field, next.Interface()); err != nil {
+		scope.Err(err)
+		return
+	}
+	scope.InstanceSet(versionKey, loaded)
+}
+
+// verifyVersion fails the update if the version condition matched nothing
+func verifyVersion(scope *gorm.Scope) {
+	loaded, ok := scope.InstanceGet(versionKey)
+	if !ok {
+		return
+	}
+	field, _ := VersionField(scope)
+	if scope.HasError() || scope.DB().RowsAffected == 0 {
+		// Put the struct back the way it was loaded, so it doesn't claim a version the database never had
+		field.Set(loaded)
+	}
+	if !scope.HasError() && scope.DB().RowsAffected == 0 {
+		// The error also keeps Save from falling back to inserting the row
+		scope.Err(fmt.Errorf("%s %v version %v: %w", scope.TableName(), scope.PrimaryKeyValue(), loaded, ErrStaleObject))
+	}
+}
+
+// Retry applies mutate to value and saves it, reloading value and trying again when the save is stale
+// mutate should only change value - it runs once per attempt, against whatever the row held when it was reloaded
+// db is used as it is - hand it audit.DB(ctx, db) to record the saves against the actor in ctx
+func Retry[T any](ctx context.Context, db *gorm.DB, value *T, attempts int, mutate func(value *T) error) error {
+	if attempts <= 0 {
+		attempts = DefaultAttempts
+	}
+	id := db.NewScope(value).PrimaryKeyValue()
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if attempt > 0 {
+			fresh := new(T)
+			if err := db.First(fresh, id).Error; err != nil {
+				return fmt.Errorf("reloading after a stale save: %w", err)
+			}
+			*value = *fresh
+		}
+		if err := mutate(value); err != nil {
+			return err
+		}
+		err = db.Save(value).Error
+		if !errors.Is(err, ErrStaleObject) {
+			return err
+		}
+	}
+	return fmt.Errorf("gave up after %d attempts: %w", attempts, err)
+}
@@ -0,0 +1,127 @@
+package locking_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/annicaburns/learngorm/crud"
+	"github.com/annicaburns/learngorm/locking"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+func TestStaleSave(t *testing.T) {
+	db := testdb.Open(t)
+	user := crud.CruddyUser3{FirstName: "Tricia", LastName: "Dent", Salary: 50000}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	stale := user
+
+	user.Salary = 55000
+	if err := db.Save(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Version != 1 {
+		t.Errorf("version after one save is %d, want 1", user.Version)
+	}
+
+	stale.Salary = 60000
+	if err := db.Save(&stale).Error; !errors.Is(err, locking.ErrStaleObject) {
+		t.Fatalf("saving the stale copy returned %v, want ErrStaleObject", err)
+	}
+	if stale.Version != 0 {
+		t.Errorf("the stale copy's version moved to %d, want it left at 0", stale.Version)
+	}
+	if err := db.Model(&stale).Update("salary", 60000).Error; !errors.Is(err, locking.ErrStaleObject) {
+		t.Errorf("updating the stale copy returned %v, want ErrStaleObject", err)
+	}
+
+	saved := crud.CruddyUser3{}
+	if err := db.First(&saved, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.Salary != 55000 || saved.Version != 1 {
+		t.Errorf("got salary %d at version %d, want 55000 at version 1", saved.Salary, saved.Version)
+	}
+}
+
+func TestDeletedRowIsStale(t *testing.T) {
+	db := testdb.Open(t)
+	user := crud.CruddyUser2{FirstName: "Ford"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Unscoped().Delete(&crud.CruddyUser2{}, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Without the lock Save would put the row back
+	user.LastName = "Prefect"
+	if err := db.Save(&user).Error; !errors.Is(err, locking.ErrStaleObject) {
+		t.Errorf("saving a deleted row returned %v, want ErrStaleObject", err)
+	}
+	if n := testdb.Count(t, db, "cruddy_user2"); n != 0 {
+		t.Errorf("cruddy_user2 has %d rows, want the deleted one to stay deleted", n)
+	}
+}
+
+func TestBatchUpdateBumpsVersion(t *testing.T) {
+	db := testdb.Open(t)
+	for _, name := range []string{"Arthur", "Tricia"} {
+		if err := db.Create(&crud.CruddyUser3{FirstName: name, LastName: "Dent"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Model(&crud.CruddyUser3{}).Where("last_name = ?", "Dent").Updates(map[string]interface{}{"salary": 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "cruddy_user3", "version = ?", 1); n != 2 {
+		t.Errorf("%d rows are at version 1, want both", n)
+	}
+	// UpdateColumn skips the callbacks, version included
+	if err := db.Model(&crud.CruddyUser3{}).Where("last_name = ?", "Dent").UpdateColumn("salary", 2).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "cruddy_user3", "version = ?", 1); n != 2 {
+		t.Errorf("%d rows are at version 1 after UpdateColumn, want both", n)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	user := crud.CruddyUser3{FirstName: "Arthur", Salary: 30000}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	stale := user
+	if err := db.Model(&user).Update("salary", 35000).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	err := locking.Retry(ctx, db, &stale, 0, func(user *crud.CruddyUser3) error {
+		calls++
+		user.Salary += 1000
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first attempt raises the stale 30000, the retry raises what's really there
+	if calls != 2 || stale.Salary != 36000 || stale.Version != 2 {
+		t.Errorf("after %d calls got salary %d at version %d, want 2 calls and 36000 at version 2", calls, stale.Salary, stale.Version)
+	}
+
+	// A writer that always gets in first wears out every attempt
+	err = locking.Retry(ctx, db, &stale, 2, func(user *crud.CruddyUser3) error {
+		if err := db.Model(&crud.CruddyUser3{}).Where("id = ?", user.ID).Updates(map[string]interface{}{"first_name": "Zaphod"}).Error; err != nil {
+			return err
+		}
+		user.Salary = 0
+		return nil
+	})
+	if !errors.Is(err, locking.ErrStaleObject) {
+		t.Errorf("Retry returned %v, want ErrStaleObject once the attempts ran out", err)
+	}
+}
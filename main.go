@@ -1,20 +1,609 @@
 package main
 
-import "github.com/annicaburns/learngorm/advanced"
+/*
+* learngorm runs the demos from the command line
+	* learngorm list - show every registered demo
+	* learngorm run crud.transactions query.retrieve-simple - run demos by name
+	* learngorm seed [file...] - refill the query tables that query and advanced demos read from, or load the given fixture files instead
+	* learngorm generate users=100000 seed=7 - fill the calendar tables with fake data for load testing
+	* learngorm migrate up|down [n]|status|redo - manage the schema (run and seed apply pending migrations on their own)
+	* learngorm schema diff - compare the models with the database and print the SQL to reconcile them
+	* learngorm schema ddl [dir] - write the CREATE statements for the models to a .sql file per dialect
+	* learngorm schema foreign-keys [key=value...] - add the FK constraints the models' relationships imply
+	* learngorm integrity scan [--fix=detach|delete] [--report=file] - find rows pointing at rows that are gone, through every relationship, and null or delete them
+	* learngorm trash list|delete|restore|purge <table> - manage soft deleted rows, see trash.go
+* Connection flags can go before or after the command: -config, -dsn, -dialect, -debug
+* So can integrity scan's own, --fix and --report - the other commands refuse them
+*/
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/connection"
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/fakedata"
+	"github.com/annicaburns/learngorm/fixtures"
+	"github.com/annicaburns/learngorm/integrity"
+	"github.com/annicaburns/learngorm/migrations"
+	"github.com/annicaburns/learngorm/query"
+	"github.com/annicaburns/learngorm/registry"
+	"github.com/annicaburns/learngorm/schema"
+
+	// Anonymous imports - these packages register their demos from init functions
+	_ "github.com/annicaburns/learngorm/advanced"
+	_ "github.com/annicaburns/learngorm/crud"
+	_ "github.com/annicaburns/learngorm/dbSchema"
+	_ "github.com/annicaburns/learngorm/relationships"
+)
+
+// options holds the flags shared by every command
+type options struct {
+	configPath string
+	dsn        string
+	dialect    string
+	debug      bool
+}
+
+// integrityOptions holds the flags only integrity scan takes
+type integrityOptions struct {
+	fix    string
+	report string
+}
 
 func main() {
-	// dbSchema.BasicMethods()
-	// dbSchema.EmbedChildObjects()
-	// relationships.BasicRelationships()
-	// relationships.ModelAssociationMethod()
-	// crud.CreateWithChildRecords()
-	// crud.UpdateRecords()
-	// crud.BatchUpdates()
-	// crud.DeleteRecords()
-	// crud.BatchDeletes()
-	// crud.Transactions()
-	// query.RetrieveSimple()
-	// query.RetrieveAdvanced()
-	// advanced.CallBacks()
-	advanced.Scope()
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	opts := options{}
+	flags := flag.NewFlagSet("learngorm", flag.ContinueOnError)
+	flags.StringVar(&opts.configPath, "config", os.Getenv(connection.EnvConfigFile), "JSON config `file`")
+	flags.StringVar(&opts.dsn, "dsn", "", "connection `string` - overrides the config")
+	flags.StringVar(&opts.dialect, "dialect", "", fmt.Sprintf("database `dialect` %v", dialect.Names()))
+	flags.BoolVar(&opts.debug, "debug", false, "log every SQL statement")
+	integrityOpts := integrityOptions{}
+	flags.StringVar(&integrityOpts.fix, "fix", "", fmt.Sprintf("integrity scan only - fix what it finds `how`, %s or %s", integrity.Detach, integrity.Delete))
+	flags.StringVar(&integrityOpts.report, "report", "", "integrity scan only - write the report to a `file` instead of printing it")
+	flags.Usage = func() { usage(flags) }
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) == 0 {
+		usage(flags)
+		return 2
+	}
+
+	command, commandArgs := positional[0], positional[1:]
+	if command != "integrity" && (integrityOpts.fix != "" || integrityOpts.report != "") {
+		fmt.Fprintln(os.Stderr, "--fix and --report only go with integrity scan")
+		return 2
+	}
+	switch command {
+	case "list":
+		list()
+		return 0
+	case "run":
+		if len(commandArgs) == 0 {
+			fmt.Fprintln(os.Stderr, "run needs at least one demo name - see learngorm list")
+			return 2
+		}
+		demos := []registry.Demo{}
+		for _, name := range commandArgs {
+			demo, ok := registry.Lookup(name)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "unknown demo %q - see learngorm list\n", name)
+				return 2
+			}
+			demos = append(demos, demo)
+		}
+		return runDemos(opts, demos)
+	case "seed":
+		if len(commandArgs) > 0 {
+			return runDemos(opts, []registry.Demo{{Name: "seed", Description: "Load fixture files", Run: loadFixtures(commandArgs)}})
+		}
+		return runDemos(opts, []registry.Demo{{Name: "seed", Description: "Seed the query tables", Run: query.SeedDB}})
+	case "migrate":
+		return migrate(opts, commandArgs)
+	case "generate":
+		return generate(opts, commandArgs)
+	case "schema":
+		return schemaCommand(opts, commandArgs)
+	case "integrity":
+		return integrityCommand(opts, integrityOpts, commandArgs)
+	case "trash":
+		return trash(opts, commandArgs)
+	case "help":
+		usage(flags)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", command)
+		usage(flags)
+		return 2
+	}
+}
+
+// parseInterspersed lets flags appear anywhere - the flag package stops at the first positional argument on its own
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// runDemos runs each demo against the connection described by opts, then prints a pass/fail report
+// Ctrl-C cancels the context handed to the demos
+func runDemos(opts options, demos []registry.Demo) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return withDB(opts, func(db *gorm.DB) int {
+		// The demos expect the schema to be current, so bring it up to date first
+		if code := migrateUp(ctx, db); code != 0 {
+			return code
+		}
+		results := registry.Run(ctx, db, demos, os.Stdout)
+		fmt.Println()
+		if failed := registry.Report(os.Stdout, results); failed > 0 {
+			return 1
+		}
+		return 0
+	})
+}
+
+// loadFixtures loads the fixture files as one set, so they can refer to each other's records
+func loadFixtures(paths []string) registry.Func {
+	return func(ctx context.Context, db *gorm.DB) error {
+		set, err := fixtures.ReadFiles(paths...)
+		if err != nil {
+			return registry.Step("read fixtures", err)
+		}
+		if err := set.Load(ctx, db); err != nil {
+			return registry.Step("load fixtures", err)
+		}
+		return nil
+	}
+}
+
+// withDB opens the connection described by opts, hands it to fn and closes it afterwards
+func withDB(opts options, fn func(db *gorm.DB) int) int {
+	cfg, err := connection.Load(opts.configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if opts.dialect != "" {
+		cfg.Driver = opts.dialect
+	}
+	if opts.dsn != "" {
+		cfg.RawDSN = opts.dsn
+	}
+	db, err := connection.Open(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+	// LogMode is the same switch the demos flip with .Debug(), just for every statement
+	db.LogMode(opts.debug)
+
+	return fn(db)
+}
+
+// migrate handles learngorm migrate up|down [n]|status|redo
+func migrate(opts options, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "migrate needs one of: up, down [n], status, redo")
+		return 2
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	switch args[0] {
+	case "up":
+		return withDB(opts, func(db *gorm.DB) int {
+			return migrateUp(ctx, db)
+		})
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				fmt.Fprintf(os.Stderr, "down needs a positive number of steps, not %q\n", args[1])
+				return 2
+			}
+			steps = n
+		}
+		return withDB(opts, func(db *gorm.DB) int {
+			reverted, err := migrations.Down(ctx, db, steps)
+			for _, m := range reverted {
+				fmt.Printf("reverted %04d %s\n", m.Version, m.Name)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			return 0
+		})
+	case "redo":
+		return withDB(opts, func(db *gorm.DB) int {
+			m, err := migrations.Redo(ctx, db)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			fmt.Printf("redid %04d %s\n", m.Version, m.Name)
+			return 0
+		})
+	case "status":
+		return withDB(opts, func(db *gorm.DB) int {
+			statuses, err := migrations.Statuses(db)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED AT")
+			for _, status := range statuses {
+				appliedAt := ""
+				if status.AppliedAt != nil {
+					appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05")
+				}
+				fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", status.Version, status.Name, status.State, appliedAt)
+			}
+			w.Flush()
+			return 0
+		})
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q\n", args[0])
+		return 2
+	}
+}
+
+// generate handles learngorm generate [key=value...] - see generateUsage
+func generate(opts options, args []string) int {
+	if len(args) == 1 && args[0] == "help" {
+		fmt.Print(generateUsage)
+		return 0
+	}
+	cfg := fakedata.DefaultConfig()
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			fmt.Fprintf(os.Stderr, "generate takes key=value settings, not %q\n%s", arg, generateUsage)
+			return 2
+		}
+		if err := setGenerateOption(&cfg, kv[0], kv[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", kv[0], err)
+			return 2
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return withDB(opts, func(db *gorm.DB) int {
+		if code := migrateUp(ctx, db); code != 0 {
+			return code
+		}
+		stats, err := fakedata.Generate(ctx, db, cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("generated", stats)
+		return 0
+	})
+}
+
+const generateUsage = `Settings:
+  users=1000                  users to add, each with a calendar and a task list
+  target=relationships        relationships or query - which set of tables to fill
+  seed=1                      random seed - the same settings and seed give the same rows
+  calendar=uniform:0-20       appointments per calendar - fixed:N, uniform:MIN-MAX or zipf:MIN-MAX
+  tasklist=uniform:0-10       appointments per task list
+  attendees=zipf:0-8          attendees per appointment
+  start=2020-01-01            earliest appointment
+  spread=8760h                appointments start within this long after start
+  batch=500                   rows per INSERT
+  reset=false                 clear the tables first
+`
+
+func setGenerateOption(cfg *fakedata.Config, key, value string) error {
+	var err error
+	switch key {
+	case "users":
+		cfg.Users, err = strconv.Atoi(value)
+	case "target":
+		cfg.Target = value
+	case "seed":
+		cfg.Seed, err = strconv.ParseInt(value, 10, 64)
+	case "calendar":
+		cfg.CalendarAppointments, err = fakedata.ParseDistribution(value)
+	case "tasklist":
+		cfg.TaskListAppointments, err = fakedata.ParseDistribution(value)
+	case "attendees":
+		cfg.Attendees, err = fakedata.ParseDistribution(value)
+	case "start":
+		cfg.Start, err = time.Parse("2006-01-02", value)
+	case "spread":
+		cfg.Spread, err = time.ParseDuration(value)
+	case "batch":
+		cfg.BatchSize, err = strconv.Atoi(value)
+	case "reset":
+		cfg.Reset, err = strconv.ParseBool(value)
+	default:
+		err = fmt.Errorf("unknown setting\n%s", generateUsage)
+	}
+	return err
+}
+
+// schemaCommand handles learngorm schema diff|ddl [dir]|foreign-keys [key=value...]
+func schemaCommand(opts options, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "schema needs one of: diff, ddl [dir], foreign-keys [key=value...]")
+		return 2
+	}
+	switch args[0] {
+	case "diff":
+		return schemaDiff(opts)
+	case "ddl":
+		dir := "."
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		return schemaDDL(dir)
+	case "foreign-keys":
+		return schemaForeignKeys(opts, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown schema command %q\n", args[0])
+		return 2
+	}
+}
+
+// schemaDiff exits 1 when the database and the models disagree, so it can guard a build
+func schemaDiff(opts options) int {
+	return withDB(opts, func(db *gorm.DB) int {
+		diffs, err := schema.Diff(db, registry.Models()...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(diffs) == 0 {
+			fmt.Println("the database matches the models")
+			return 0
+		}
+		fixes := []string{}
+		for _, diff := range diffs {
+			fmt.Println(diff)
+			if diff.Fix != "" {
+				fixes = append(fixes, diff.Fix)
+			}
+		}
+		if len(fixes) > 0 {
+			fmt.Println()
+			fmt.Println("-- to reconcile the database with the models:")
+			for _, fix := range fixes {
+				if strings.HasPrefix(fix, "--") {
+					fmt.Println(fix)
+				} else {
+					fmt.Println(fix + ";")
+				}
+			}
+		}
+		return 1
+	})
+}
+
+// schemaForeignKeys adds the missing FK constraints for every registered model - see foreignKeysUsage
+func schemaForeignKeys(opts options, args []string) int {
+	if len(args) == 1 && args[0] == "help" {
+		fmt.Print(foreignKeysUsage)
+		return 0
+	}
+	fkOpts := schema.ForeignKeyOptions{Override: map[string]schema.Actions{}}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "foreign-keys takes key=value settings, not %q\n%s", arg, foreignKeysUsage)
+			return 2
+		}
+		var err error
+		switch {
+		case key == "on_delete":
+			fkOpts.Actions.OnDelete = value
+		case key == "on_update":
+			fkOpts.Actions.OnUpdate = value
+		case key == "dry_run":
+			fkOpts.DryRun, err = strconv.ParseBool(value)
+		case strings.Contains(key, "."):
+			onDelete, onUpdate, _ := strings.Cut(value, "/")
+			fkOpts.Override[key] = schema.Actions{OnDelete: onDelete, OnUpdate: onUpdate}
+		default:
+			err = fmt.Errorf("unknown setting\n%s", foreignKeysUsage)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", key, err)
+			return 2
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return withDB(opts, func(db *gorm.DB) int {
+		if code := migrateUp(ctx, db); code != 0 {
+			return code
+		}
+		results, err := schema.AddForeignKeys(ctx, db, fkOpts, registry.Models()...)
+		fixes := []string{}
+		for _, result := range results {
+			fmt.Println(result)
+			if result.Outcome == schema.FKUnsupported || result.Outcome == schema.FKWouldAdd {
+				fixes = append(fixes, result.SQL)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(fixes) > 0 {
+			fmt.Println()
+			for _, fix := range fixes {
+				if strings.HasPrefix(fix, "--") {
+					fmt.Println(fix)
+				} else {
+					fmt.Println(fix + ";")
+				}
+			}
+		}
+		return 0
+	})
+}
+
+const foreignKeysUsage = `Settings:
+  on_delete=CASCADE           what a constraint does to child rows when the parent is deleted - CASCADE, "SET NULL", "SET DEFAULT", RESTRICT or "NO ACTION"
+  on_update=CASCADE           and when the parent's key changes
+  table.column=DELETE/UPDATE  the actions for one constraint, by the child's column - e.g. appoinment_user.relationship_user_id=RESTRICT/CASCADE
+  dry_run=false               print the statements instead of running them
+Constraints already in the database are left alone, even when their actions differ - that is reported for a migration to sort out
+`
+
+// schemaDDL writes schema.<dialect>.sql for every dialect into dir - it doesn't need a database
+func schemaDDL(dir string) int {
+	for _, name := range dialect.Names() {
+		ddl, err := schema.DDL(name, registry.Models()...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		path := filepath.Join(dir, "schema."+name+".sql")
+		if err := ioutil.WriteFile(path, []byte(ddl), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("wrote", path)
+	}
+	return 0
+}
+
+// integrityCommand handles learngorm integrity scan [--fix=detach|delete] [--report=file]
+// scan exits 1 when it finds problems and isn't told to fix them, so it can guard a deploy like schema diff
+func integrityCommand(opts options, integrityOpts integrityOptions, args []string) int {
+	if len(args) != 1 || args[0] != "scan" {
+		fmt.Fprint(os.Stderr, integrityUsage)
+		return 2
+	}
+	how, reportPath := integrityOpts.fix, integrityOpts.report
+	if how != "" && how != integrity.Detach && how != integrity.Delete {
+		fmt.Fprintf(os.Stderr, "--fix takes %s or %s, not %q\n%s", integrity.Detach, integrity.Delete, how, integrityUsage)
+		return 2
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return withDB(opts, func(db *gorm.DB) int {
+		if code := migrateUp(ctx, db); code != 0 {
+			return code
+		}
+		report, err := integrity.Scan(ctx, db, registry.Models()...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		code := 0
+		if how != "" && report.Len() > 0 {
+			if err := integrity.Fix(ctx, db, report, how); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				code = 1
+			}
+		} else if report.Len() > 0 {
+			code = 1
+		}
+		out := os.Stdout
+		if reportPath != "" {
+			if out, err = os.Create(reportPath); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			defer out.Close()
+		}
+		if err := report.Write(out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if reportPath != "" {
+			fmt.Printf("%d problems - report written to %s\n", report.Len(), reportPath)
+		}
+		return code
+	})
+}
+
+const integrityUsage = `Usage: learngorm integrity scan [--fix=detach|delete] [--report=file]
+
+Flags:
+  --fix=detach     null the references, in one transaction - join table rows are deleted instead
+  --fix=delete     delete the rows, softly where the model allows it
+  --report=file    write the report to a file instead of printing it
+`
+
+func migrateUp(ctx context.Context, db *gorm.DB) int {
+	applied, err := migrations.Up(ctx, db)
+	for _, m := range applied {
+		fmt.Printf("applied %04d %s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func list() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, demo := range registry.All() {
+		fmt.Fprintf(w, "%s\t%s\n", demo.Name, demo.Description)
+	}
+	w.Flush()
+}
+
+func usage(flags *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, `Usage: learngorm [flags] <command> [args]
+
+Commands:
+  list              list the registered demos
+  run <demo>...     run one or more demos by name
+  seed [file...]    clear and refill the query tables, or the tables in the given fixture files
+  generate k=v...   add fake users, calendars and appointments - learngorm generate help lists the settings
+  migrate up        apply pending migrations
+  migrate down [n]  revert the last n applied migrations (default 1)
+  migrate status    show which migrations are applied, pending or modified
+  migrate redo      revert and reapply the last applied migration
+  schema diff       compare the models with the database and print the SQL to reconcile them
+  schema ddl [dir]  write schema.<dialect>.sql files with the CREATE statements for the models
+  schema foreign-keys k=v...  add the FK constraints the relationships imply - learngorm schema foreign-keys help lists the settings
+  integrity scan    list rows whose references point at missing or deleted rows - has-one, has-many, many2many and polymorphic
+                    --fix=detach|delete nulls those references or deletes the rows, --report=file keeps a record
+  trash <cmd> <table> list, delete, restore or purge soft deleted rows - learngorm trash help has the details
+
+Flags:`)
+	flags.PrintDefaults()
 }
@@ -0,0 +1,302 @@
+package migrations
+
+/*
+* The demos used to drop and recreate their tables on every run - fine while the schema was changing every lesson, but it throws away all the data
+	* A migration is a numbered, named pair of Up and Down SQL statement lists
+	* Applied migrations are recorded in the schema_migrations table along with a checksum of their SQL
+	* If an applied migration's SQL is edited later, the checksum no longer matches and Up/Down refuse to run until it is put back
+	* Add a new migration rather than editing an old one
+* The SQL is written once for every dialect. Column types and quoting that differ go in {{...}} placeholders:
+	* {{pk}} {{uint}} {{int}} {{datetime}} {{bool}} {{text}} - see dialect.ColumnType
+	* {{quote Name}} - quotes an identifier, for mixed case column names
+	* {{dropindex table index}} - MySQL wants to know the table, the others don't
+* Note that MySQL commits DDL statements immediately, so a migration that fails half way through can leave its first statements behind
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/transaction"
+)
+
+// Migration is one step in the evolution of the schema
+type Migration struct {
+	Version uint
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// Checksum fingerprints the migration's SQL as written, before placeholders are filled in, so it is the same for every dialect
+func (m Migration) Checksum() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", m.Name)
+	for _, stmt := range m.Up {
+		fmt.Fprintf(h, "up: %s\n", stmt)
+	}
+	for _, stmt := range m.Down {
+		fmt.Fprintf(h, "down: %s\n", stmt)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SchemaMigration is a row in the schema_migrations tracking table
+type SchemaMigration struct {
+	Version   uint `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	Checksum  string `sql:"size:64"`
+	AppliedAt time.Time
+}
+
+// TableName pins the table name, so renaming the struct can't lose track of which migrations were applied
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+var registered = map[uint]Migration{}
+
+// Register adds a migration - usually from an init function next to the models it creates
+// Versions must be unique, so a clash is a programming error and panics
+func Register(m Migration) {
+	if existing, ok := registered[m.Version]; ok {
+		panic(fmt.Sprintf("migrations: version %d registered for both %s and %s", m.Version, existing.Name, m.Name))
+	}
+	registered[m.Version] = m
+}
+
+// All returns the registered migrations in version order
+func All() []Migration {
+	all := make([]Migration, 0, len(registered))
+	for _, m := range registered {
+		all = append(all, m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	return all
+}
+
+// States reported by Statuses
+const (
+	StateApplied  = "applied"
+	StatePending  = "pending"
+	StateModified = "modified" // applied, but the SQL has changed since
+	StateMissing  = "missing"  // applied, but no longer registered
+)
+
+// Status describes one migration as the database sees it
+type Status struct {
+	Version   uint
+	Name      string
+	State     string
+	AppliedAt *time.Time
+}
+
+// ChecksumError means an applied migration's SQL was edited after it ran
+type ChecksumError struct {
+	Version uint
+	Name    string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("migration %d %s has been modified since it was applied - add a new migration instead of editing this one", e.Version, e.Name)
+}
+
+// ensureTable creates schema_migrations the first time through
+// This is the one table GORM creates for us - it has to exist before any migration can be recorded
+func ensureTable(db *gorm.DB) error {
+	if db.HasTable(&SchemaMigration{}) {
+		return nil
+	}
+	return db.CreateTable(&SchemaMigration{}).Error
+}
+
+func applied(db *gorm.DB) (map[uint]SchemaMigration, error) {
+	if err := ensureTable(db); err != nil {
+		return nil, fmt.Errorf("creating schema_migrations: %w", err)
+	}
+	rows := []SchemaMigration{}
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("reading schema_migrations: %w", err)
+	}
+	byVersion := map[uint]SchemaMigration{}
+	for _, row := range rows {
+		byVersion[row.Version] = row
+	}
+	return byVersion, nil
+}
+
+// Statuses lists every registered migration plus any applied ones that have since disappeared
+func Statuses(db *gorm.DB) ([]Status, error) {
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []Status{}
+	for _, m := range All() {
+		status := Status{Version: m.Version, Name: m.Name, State: StatePending}
+		if row, ok := done[m.Version]; ok {
+			appliedAt := row.AppliedAt
+			status.AppliedAt = &appliedAt
+			status.State = StateApplied
+			if row.Checksum != m.Checksum() {
+				status.State = StateModified
+			}
+			delete(done, m.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, row := range done {
+		appliedAt := row.AppliedAt
+		statuses = append(statuses, Status{Version: row.Version, Name: row.Name, State: StateMissing, AppliedAt: &appliedAt})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// verify refuses to go any further if an applied migration was edited or removed
+func verify(db *gorm.DB) (map[uint]SchemaMigration, error) {
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range done {
+		m, ok := registered[row.Version]
+		if !ok {
+			return nil, fmt.Errorf("migration %d %s was applied but is no longer registered", row.Version, row.Name)
+		}
+		if row.Checksum != m.Checksum() {
+			return nil, &ChecksumError{Version: m.Version, Name: m.Name}
+		}
+	}
+	return done, nil
+}
+
+// Up applies every pending migration in version order and returns the ones it applied
+func Up(ctx context.Context, db *gorm.DB) ([]Migration, error) {
+	done, err := verify(db)
+	if err != nil {
+		return nil, err
+	}
+	ran := []Migration{}
+	for _, m := range All() {
+		if _, ok := done[m.Version]; ok {
+			continue
+		}
+		if err := apply(ctx, db, m, m.Up, func(tx *gorm.DB) error {
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, Checksum: m.Checksum(), AppliedAt: time.Now()}).Error
+		}); err != nil {
+			return ran, err
+		}
+		ran = append(ran, m)
+	}
+	return ran, nil
+}
+
+// Down reverts the most recently applied migrations, newest first, and returns the ones it reverted
+func Down(ctx context.Context, db *gorm.DB, steps int) ([]Migration, error) {
+	done, err := verify(db)
+	if err != nil {
+		return nil, err
+	}
+	all := All()
+	ran := []Migration{}
+	for i := len(all) - 1; i >= 0 && len(ran) < steps; i-- {
+		m := all[i]
+		if _, ok := done[m.Version]; !ok {
+			continue
+		}
+		if err := apply(ctx, db, m, m.Down, func(tx *gorm.DB) error {
+			return tx.Delete(&SchemaMigration{Version: m.Version}).Error
+		}); err != nil {
+			return ran, err
+		}
+		ran = append(ran, m)
+	}
+	return ran, nil
+}
+
+// Redo reverts the most recently applied migration and applies it again
+func Redo(ctx context.Context, db *gorm.DB) (*Migration, error) {
+	reverted, err := Down(ctx, db, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(reverted) == 0 {
+		return nil, fmt.Errorf("no applied migrations to redo")
+	}
+	m := reverted[0]
+	if err := apply(ctx, db, m, m.Up, func(tx *gorm.DB) error {
+		return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, Checksum: m.Checksum(), AppliedAt: time.Now()}).Error
+	}); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// apply runs the statements and the bookkeeping for one migration in a single transaction
+func apply(ctx context.Context, db *gorm.DB, m Migration, statements []string, record func(tx *gorm.DB) error) error {
+	d := dialect.Of(db)
+	err := transaction.WithTx(ctx, db, func(tx *gorm.DB) error {
+		for _, stmt := range statements {
+			rendered, err := Render(d, stmt)
+			if err != nil {
+				return err
+			}
+			if err := tx.Exec(rendered).Error; err != nil {
+				return fmt.Errorf("%s: %w", rendered, err)
+			}
+		}
+		if err := record(tx); err != nil {
+			return fmt.Errorf("recording in schema_migrations: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+	}
+	return nil
+}
+
+var placeholder = regexp.MustCompile(`\{\{\s*(\w+)((?:\s+\w+)*)\s*\}\}`)
+
+// Render fills in the {{...}} placeholders in stmt for dialect d
+func Render(d dialect.Dialect, stmt string) (string, error) {
+	var renderErr error
+	rendered := placeholder.ReplaceAllStringFunc(stmt, func(match string) string {
+		parts := placeholder.FindStringSubmatch(match)
+		name, args := parts[1], strings.Fields(parts[2])
+		switch name {
+		case "quote":
+			if len(args) != 1 {
+				if renderErr == nil {
+					renderErr = fmt.Errorf("%s needs one identifier to quote", match)
+				}
+				return match
+			}
+			return d.Quote(args[0])
+		case "dropindex":
+			if len(args) != 2 {
+				if renderErr == nil {
+					renderErr = fmt.Errorf("%s needs a table and an index", match)
+				}
+				return match
+			}
+			return d.DropIndexSQL(args[0], args[1])
+		}
+		t, ok := d.ColumnType(name)
+		if (!ok || len(args) > 0) && renderErr == nil {
+			renderErr = fmt.Errorf("unknown placeholder %s for %s", match, d.Name())
+		}
+		return t
+	})
+	return strings.TrimSpace(rendered), renderErr
+}
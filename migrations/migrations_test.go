@@ -0,0 +1,226 @@
+package migrations_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/migrations"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+// Two migrations of the tests' own, well past the real ones, so testdb.Open applies them last
+func init() {
+	migrations.Register(migrations.Migration{
+		Version: 1000,
+		Name:    "create_migration_tests",
+		Up:      []string{"CREATE TABLE migration_tests (id {{pk}}, {{quote Name}} varchar(32), created_at {{datetime}})"},
+		Down:    []string{"DROP TABLE migration_tests"},
+	})
+	migrations.Register(migrations.Migration{
+		Version: 1001,
+		Name:    "create_migration_notes",
+		Up:      []string{"CREATE TABLE migration_notes (id {{pk}}, body {{text}})"},
+		Down:    []string{"DROP TABLE migration_notes"},
+	})
+}
+
+func TestRender(t *testing.T) {
+	cases := []struct {
+		dialect string
+		stmt    string
+		want    string
+	}{
+		{"mysql", "CREATE TABLE t (id {{pk}}, n {{uint}})", "CREATE TABLE t (id int unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY, n int unsigned)"},
+		{"postgres", "CREATE TABLE t (id {{pk}}, n {{uint}})", "CREATE TABLE t (id serial PRIMARY KEY, n integer)"},
+		{"sqlite3", "CREATE TABLE t (id {{pk}}, n {{uint}})", "CREATE TABLE t (id integer PRIMARY KEY AUTOINCREMENT, n integer)"},
+		{"mysql", "ALTER TABLE t ADD {{ quote FirstName }} {{text}}", "ALTER TABLE t ADD `FirstName` longtext"},
+		{"postgres", "ALTER TABLE t ADD {{quote FirstName}} {{datetime}}", `ALTER TABLE t ADD "FirstName" timestamp with time zone`},
+		{"mysql", "{{dropindex t idx_t_name}}", "DROP INDEX `idx_t_name` ON `t`"},
+		{"sqlite3", "{{dropindex t idx_t_name}}", `DROP INDEX "idx_t_name"`},
+		{"sqlite3", "  SELECT 1\n", "SELECT 1"},
+	}
+	for _, c := range cases {
+		d, err := dialect.Get(c.dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := migrations.Render(d, c.stmt)
+		if err != nil {
+			t.Errorf("%s: Render(%q) returned %v", c.dialect, c.stmt, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: Render(%q) = %q, want %q", c.dialect, c.stmt, got, c.want)
+		}
+	}
+
+	d, err := dialect.Get("sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{"{{money}}", "{{pk extra}}", "{{quote}}", "{{quote a b}}", "{{dropindex t}}"} {
+		if _, err := migrations.Render(d, stmt); err == nil {
+			t.Errorf("Render(%q) didn't fail", stmt)
+		}
+	}
+}
+
+// states maps each version to its state
+func states(statuses []migrations.Status) map[uint]string {
+	byVersion := map[uint]string{}
+	for _, status := range statuses {
+		byVersion[status.Version] = status.State
+	}
+	return byVersion
+}
+
+func TestUpDownRedo(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.Open(t)
+	if !db.HasTable("migration_tests") || !db.HasTable("migration_notes") {
+		t.Fatal("Open didn't apply the test migrations")
+	}
+	if ran, err := migrations.Up(ctx, db); err != nil || len(ran) != 0 {
+		t.Fatalf("Up with nothing pending ran %d migrations (%v)", len(ran), err)
+	}
+
+	reverted, err := migrations.Down(ctx, db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != 2 || reverted[0].Version != 1001 || reverted[1].Version != 1000 {
+		t.Fatalf("Down 2 reverted %v, want 1001 then 1000", reverted)
+	}
+	if db.HasTable("migration_tests") || db.HasTable("migration_notes") {
+		t.Error("Down left the tables behind")
+	}
+	statuses, err := migrations.Statuses(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := states(statuses); got[1000] != migrations.StatePending || got[1001] != migrations.StatePending || got[1] != migrations.StateApplied {
+		t.Errorf("after Down the states are %v", got)
+	}
+
+	ran, err := migrations.Up(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 2 || ran[0].Version != 1000 || ran[1].Version != 1001 {
+		t.Fatalf("Up ran %v, want 1000 then 1001", ran)
+	}
+
+	// Redo only touches the newest one - the rows in the older table survive
+	if err := db.Exec("INSERT INTO migration_tests (" + dialect.Of(db).Quote("Name") + ") VALUES ('kept')").Error; err != nil {
+		t.Fatal(err)
+	}
+	redone, err := migrations.Redo(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redone.Version != 1001 {
+		t.Errorf("Redo redid %d, want 1001", redone.Version)
+	}
+	if n := testdb.Count(t, db, "migration_tests"); n != 1 {
+		t.Errorf("migration_tests has %d rows after Redo, want 1", n)
+	}
+	if n := testdb.Count(t, db, "schema_migrations", "version = ?", 1001); n != 1 {
+		t.Errorf("schema_migrations has %d rows for 1001 after Redo, want 1", n)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.Open(t)
+
+	// A checksum that no longer matches is what an edited migration looks like
+	if err := db.Exec("UPDATE schema_migrations SET checksum = ? WHERE version = ?", "edited", 1000).Error; err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := migrations.Statuses(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := states(statuses)[1000]; got != migrations.StateModified {
+		t.Errorf("edited migration is %s, want %s", got, migrations.StateModified)
+	}
+	var checksumErr *migrations.ChecksumError
+	if _, err := migrations.Up(ctx, db); !errors.As(err, &checksumErr) || checksumErr.Version != 1000 {
+		t.Errorf("Up returned %v, want a ChecksumError for 1000", err)
+	}
+	if _, err := migrations.Down(ctx, db, 1); !errors.As(err, &checksumErr) {
+		t.Errorf("Down returned %v, want a ChecksumError", err)
+	}
+	if !db.HasTable("migration_notes") {
+		t.Error("Down reverted a migration despite the edited one")
+	}
+
+	// Putting the migration back as it was lets them run again
+	for _, m := range migrations.All() {
+		if m.Version == 1000 {
+			if err := db.Exec("UPDATE schema_migrations SET checksum = ? WHERE version = ?", m.Checksum(), m.Version).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := migrations.Down(ctx, db, 1); err != nil {
+		t.Errorf("Down after the edit was undone returned %v", err)
+	}
+}
+
+func TestMissingAndOutOfOrder(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.Open(t)
+
+	// An applied migration whose file has gone is reported, and blocks Up
+	if err := db.Create(&migrations.SchemaMigration{Version: 999, Name: "deleted_file", Checksum: "gone", AppliedAt: time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := migrations.Statuses(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := states(statuses)[999]; got != migrations.StateMissing {
+		t.Errorf("unregistered migration is %q, want %s", got, migrations.StateMissing)
+	}
+	if _, err := migrations.Up(ctx, db); err == nil || !strings.Contains(err.Error(), "no longer registered") {
+		t.Errorf("Up returned %v, want a complaint about 999", err)
+	}
+	if err := db.Delete(&migrations.SchemaMigration{Version: 999}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// A migration that turns up with a lower version than one already applied - merged from another branch, say - still runs
+	if _, err := migrations.Down(ctx, db, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations.All() {
+		if m.Version != 1001 {
+			continue
+		}
+		rendered, err := migrations.Render(dialect.Of(db), m.Up[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Exec(rendered).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Create(&migrations.SchemaMigration{Version: m.Version, Name: m.Name, Checksum: m.Checksum(), AppliedAt: time.Now()}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	ran, err := migrations.Up(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 1 || ran[0].Version != 1000 {
+		t.Errorf("Up ran %v, want just the late 1000", ran)
+	}
+	if !db.HasTable("migration_tests") {
+		t.Error("the late migration's table wasn't created")
+	}
+}
@@ -0,0 +1,298 @@
+package migrations
+
+/*
+* The starting schema - one migration per demo package, matching the tables GORM's CreateTable used to build from the models
+	* Tables with gorm.Model get the same idx_<table>_deleted_at index GORM adds for DeletedAt's `sql:"index"` tag
+	* Many-to-many join tables are listed with the model that declares them
+*/
+
+func init() {
+	Register(Migration{
+		Version: 1,
+		Name:    "create_basic_users",
+		Up: []string{
+			// BasicUser.Count is tagged AUTO_INCREMENT, but only the primary key can auto increment - so it is a plain integer here
+			`CREATE TABLE basic_users (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				username VARCHAR(15) NOT NULL,
+				first_name varchar(100) NOT NULL DEFAULT 'Annica',
+				{{quote LastName}} varchar(255) UNIQUE,
+				count {{int}} NOT NULL DEFAULT 0
+			)`,
+			`CREATE INDEX idx_basic_users_deleted_at ON basic_users(deleted_at)`,
+		},
+		Down: []string{
+			`DROP TABLE basic_users`,
+		},
+	})
+
+	Register(Migration{
+		Version: 2,
+		Name:    "create_clean_users",
+		Up: []string{
+			`CREATE TABLE clean_users (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				first_name varchar(255),
+				last_name varchar(255)
+			)`,
+			`CREATE INDEX idx_clean_users_deleted_at ON clean_users(deleted_at)`,
+			`CREATE INDEX idx_first_name ON clean_users(first_name)`,
+		},
+		Down: []string{
+			`DROP TABLE clean_users`,
+		},
+	})
+
+	Register(Migration{
+		Version: 3,
+		Name:    "create_relationship_tables",
+		Up: []string{
+			`CREATE TABLE relationship_users (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				username varchar(255),
+				first_name varchar(255),
+				last_name varchar(255)
+			)`,
+			`CREATE INDEX idx_relationship_users_deleted_at ON relationship_users(deleted_at)`,
+			// Writing the FK into CREATE TABLE works for SQLite too, which can't add one afterwards
+			// The constraint name is the one GORM's AddForeignKey would have picked
+			`CREATE TABLE calendars (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				name varchar(255),
+				relationship_user_id {{uint}},
+				CONSTRAINT calendars_relationship_user_id_relationship_users_id_foreign
+					FOREIGN KEY (relationship_user_id) REFERENCES relationship_users(id) ON DELETE CASCADE ON UPDATE CASCADE
+			)`,
+			`CREATE INDEX idx_calendars_deleted_at ON calendars(deleted_at)`,
+			`CREATE TABLE task_lists (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				name varchar(255),
+				relationship_user_id {{uint}}
+			)`,
+			`CREATE INDEX idx_task_lists_deleted_at ON task_lists(deleted_at)`,
+			`CREATE TABLE appointments (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				subject varchar(255),
+				description varchar(255),
+				start_time {{datetime}},
+				length {{uint}},
+				owner_id {{uint}},
+				owner_type varchar(255)
+			)`,
+			`CREATE INDEX idx_appointments_deleted_at ON appointments(deleted_at)`,
+			`CREATE TABLE appoinment_user (
+				appointment_id {{uint}},
+				relationship_user_id {{uint}},
+				PRIMARY KEY (appointment_id, relationship_user_id)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE appoinment_user`,
+			`DROP TABLE appointments`,
+			`DROP TABLE task_lists`,
+			`DROP TABLE calendars`,
+			`DROP TABLE relationship_users`,
+		},
+	})
+
+	Register(Migration{
+		Version: 4,
+		Name:    "create_cruddy_tables",
+		Up: []string{
+			`CREATE TABLE cruddy_users (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				first_name varchar(255),
+				last_name varchar(255)
+			)`,
+			`CREATE INDEX idx_cruddy_users_deleted_at ON cruddy_users(deleted_at)`,
+			`CREATE TABLE cruddy_appointments (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				cruddy_user_id {{uint}},
+				subject varchar(255),
+				description varchar(255),
+				start_time {{datetime}},
+				length {{uint}}
+			)`,
+			`CREATE INDEX idx_cruddy_appointments_deleted_at ON cruddy_appointments(deleted_at)`,
+			`CREATE TABLE cruddy_user2 (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				first_name varchar(255),
+				last_name varchar(255)
+			)`,
+			`CREATE INDEX idx_cruddy_user2_deleted_at ON cruddy_user2(deleted_at)`,
+			`CREATE TABLE cruddy_user3 (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				first_name varchar(255),
+				last_name varchar(255),
+				salary {{uint}}
+			)`,
+			`CREATE INDEX idx_cruddy_user3_deleted_at ON cruddy_user3(deleted_at)`,
+			// CruddyUser4 has a plain ID instead of gorm.Model, so no timestamps and hard deletes
+			`CREATE TABLE cruddy_user4 (
+				id {{pk}},
+				first_name varchar(255),
+				last_name varchar(255)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE cruddy_user4`,
+			`DROP TABLE cruddy_user3`,
+			`DROP TABLE cruddy_user2`,
+			`DROP TABLE cruddy_appointments`,
+			`DROP TABLE cruddy_users`,
+		},
+	})
+
+	Register(Migration{
+		Version: 5,
+		Name:    "create_query_tables",
+		Up: []string{
+			`CREATE TABLE user_queries (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				username varchar(255),
+				first_name varchar(255),
+				last_name varchar(255)
+			)`,
+			`CREATE INDEX idx_user_queries_deleted_at ON user_queries(deleted_at)`,
+			`CREATE TABLE calendar_queries (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				name varchar(255),
+				user_query_id {{uint}}
+			)`,
+			`CREATE INDEX idx_calendar_queries_deleted_at ON calendar_queries(deleted_at)`,
+			`CREATE TABLE appointment_queries (
+				id {{pk}},
+				created_at {{datetime}},
+				updated_at {{datetime}},
+				deleted_at {{datetime}},
+				subject varchar(255),
+				description varchar(255),
+				start_time {{datetime}},
+				length {{uint}},
+				calendar_query_id {{uint}}
+			)`,
+			`CREATE INDEX idx_appointment_queries_deleted_at ON appointment_queries(deleted_at)`,
+			`CREATE TABLE appointment_query_user_query (
+				appointment_query_id {{uint}},
+				user_query_id {{uint}},
+				PRIMARY KEY (appointment_query_id, user_query_id)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE appointment_query_user_query`,
+			`DROP TABLE appointment_queries`,
+			`DROP TABLE calendar_queries`,
+			`DROP TABLE user_queries`,
+		},
+	})
+
+	// Version columns for the locking package - existing rows start at 0 like new ones do
+	Register(Migration{
+		Version: 6,
+		Name:    "add_cruddy_user_versions",
+		Up: []string{
+			`ALTER TABLE cruddy_user2 ADD COLUMN version {{uint}} NOT NULL DEFAULT 0`,
+			`ALTER TABLE cruddy_user3 ADD COLUMN version {{uint}} NOT NULL DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE cruddy_user3 DROP COLUMN version`,
+			`ALTER TABLE cruddy_user2 DROP COLUMN version`,
+		},
+	})
+
+	// Usernames were only unique by convention - the upsert in the bulk package needs a real unique key to conflict on
+	Register(Migration{
+		Version: 7,
+		Name:    "add_user_queries_username_unique",
+		Up: []string{
+			`CREATE UNIQUE INDEX uix_user_queries_username ON user_queries(username)`,
+		},
+		Down: []string{
+			`{{dropindex user_queries uix_user_queries_username}}`,
+		},
+	})
+
+	// The audit package's log - one row per create, update or delete, looked up by record
+	Register(Migration{
+		Version: 8,
+		Name:    "create_audit_log",
+		Up: []string{
+			`CREATE TABLE audit_log (
+				id {{pk}},
+				table_name varchar(64) NOT NULL,
+				record_id varchar(64) NOT NULL,
+				operation varchar(16) NOT NULL,
+				changes {{text}} NOT NULL,
+				actor varchar(255) NOT NULL,
+				created_at {{datetime}}
+			)`,
+			`CREATE INDEX idx_audit_log_record ON audit_log(table_name, record_id)`,
+		},
+		Down: []string{
+			`DROP TABLE audit_log`,
+		},
+	})
+
+	// The attendee join tables become Attendance rows - the pair of ids plus an RSVP
+	// Existing attendees, and any added through the many2many tags, are required invitees who haven't answered yet
+	Register(Migration{
+		Version: 9,
+		Name:    "add_attendance_columns",
+		Up: []string{
+			`ALTER TABLE appoinment_user ADD COLUMN status varchar(16) NOT NULL DEFAULT 'invited'`,
+			`ALTER TABLE appoinment_user ADD COLUMN role varchar(16) NOT NULL DEFAULT 'required'`,
+			`ALTER TABLE appoinment_user ADD COLUMN responded_at {{datetime}}`,
+			`ALTER TABLE appoinment_user ADD COLUMN notes {{text}}`,
+			`ALTER TABLE appointment_query_user_query ADD COLUMN status varchar(16) NOT NULL DEFAULT 'invited'`,
+			`ALTER TABLE appointment_query_user_query ADD COLUMN role varchar(16) NOT NULL DEFAULT 'required'`,
+			`ALTER TABLE appointment_query_user_query ADD COLUMN responded_at {{datetime}}`,
+			`ALTER TABLE appointment_query_user_query ADD COLUMN notes {{text}}`,
+		},
+		Down: []string{
+			`ALTER TABLE appointment_query_user_query DROP COLUMN notes`,
+			`ALTER TABLE appointment_query_user_query DROP COLUMN responded_at`,
+			`ALTER TABLE appointment_query_user_query DROP COLUMN role`,
+			`ALTER TABLE appointment_query_user_query DROP COLUMN status`,
+			`ALTER TABLE appoinment_user DROP COLUMN notes`,
+			`ALTER TABLE appoinment_user DROP COLUMN responded_at`,
+			`ALTER TABLE appoinment_user DROP COLUMN role`,
+			`ALTER TABLE appoinment_user DROP COLUMN status`,
+		},
+	})
+}
@@ -9,24 +9,30 @@ package query
 */
 
 import (
+	"context"
+	"embed"
 	"fmt"
 	"time"
 
-	// Anonymous import - package just needs to initialize in order to establish itself as a database driver
-	_ "github.com/go-sql-driver/mysql"
-
 	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/bulk"
+	"github.com/annicaburns/learngorm/fixtures"
+	"github.com/annicaburns/learngorm/registry"
 )
 
+func init() {
+	registry.Register("query.retrieve-simple", "Find users with Where, Or, Not and friends", RetrieveSimple)
+	registry.Register("query.retrieve-advanced", "Preload, paging, plucking, joins, aggregates and raw SQL", RetrieveAdvanced)
+	registry.Register("query.import-users", "Upsert a batch of users - new usernames are inserted, existing ones updated", ImportUsers)
+	registry.Register("query.attendance", "Read the RSVP columns of a many2many join table through a model of its own", Attendance)
+	registry.RegisterModels(&UserQuery{}, &CalendarQuery{}, &AppointmentQuery{}, &AttendanceQuery{})
+}
+
 // RetrieveSimple demonstrates some basic query language
-func RetrieveSimple() {
+func RetrieveSimple(ctx context.Context, db *gorm.DB) error {
 	// Only seed the database once
-	// SeedDB()
-
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
-	if err != nil {
-		panic(err.Error())
-	}
+	// SeedDB(ctx, db)
 
 	// Queries for individual records
 	// Create an empty user struct
@@ -69,21 +75,18 @@ func RetrieveSimple() {
 	// Not method - The Where clause is only looking for positive matches, so use the Not method for the reverse
 	// db.Not("username = ?", "adent").Find(&users)
 	// Or method. Chain this on to a where clause to combine two different fetches
-	db.Where("username = ?", "fprefect").Or("username = ?", "tmacmillan").Find(&users)
+	if err := db.Where("username = ?", "fprefect").Or("username = ?", "tmacmillan").Find(&users).Error; err != nil {
+		return registry.Step("find fprefect or tmacmillan", err)
+	}
 	fmt.Printf("\n%v\n", users)
-
+	return nil
 }
 
 // RetrieveAdvanced demonstrates some more advanced ways to select and join and deliver data
-func RetrieveAdvanced() {
+func RetrieveAdvanced(ctx context.Context, db *gorm.DB) error {
 
 	// Only seed the database once
-	// SeedDB()
-
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
-	if err != nil {
-		panic(err.Error())
-	}
+	// SeedDB(ctx, db)
 
 	// Gorm defaults to lazy loading to prefer speed over convenience
 	// Preload method indicates to gorm which child objects we want to inflate (load)
@@ -168,16 +171,26 @@ func RetrieveAdvanced() {
 	*/
 
 	/*
-		// Work with Raw Result Rows for more control. Returns a set of rows (potentially) and an error. Ignoring the error for now.
+		// Work with Raw Result Rows for more control. Returns a set of rows (potentially) and an error.
+		// Rows must be closed, and rows.Err() reports anything that went wrong part way through iterating
 		userVM3s := []UserViewModel3{}
-		rows, _ := db.Model(&UserQuery{}).Joins("inner join calendar_queries on calendar_queries.user_query_id = user_queries.id").
+		rows, err := db.Model(&UserQuery{}).Joins("inner join calendar_queries on calendar_queries.user_query_id = user_queries.id").
 			Select("user_queries.first_name, user_queries.last_name, calendar_queries.name").
 			Rows()
+		if err != nil {
+			return registry.Step("query user calendars", err)
+		}
+		defer rows.Close()
 		for rows.Next() {
 			uvm3 := UserViewModel3{}
-			rows.Scan(&uvm3.FirstName, &uvm3.LastName, &uvm3.CalendarName)
+			if err := rows.Scan(&uvm3.FirstName, &uvm3.LastName, &uvm3.CalendarName); err != nil {
+				return registry.Step("scan user calendar", err)
+			}
 			userVM3s = append(userVM3s, uvm3)
 		}
+		if err := rows.Err(); err != nil {
+			return registry.Step("iterate user calendars", err)
+		}
 		for _, userVM := range userVM3s {
 			fmt.Printf("\n%v\n", userVM)
 		}
@@ -185,110 +198,126 @@ func RetrieveAdvanced() {
 
 	// Aggregations
 	/*
-		rows, _ := db.Model(&AppointmentQuery{}).Select("calendar_query_id, sum(length) as total_length").
+		rows, err := db.Model(&AppointmentQuery{}).Select("calendar_query_id, sum(length) as total_length").
 			Group("calendar_query_id").Having("calendar_query_id = ?", 1).Rows()
+		if err != nil {
+			return registry.Step("sum appointment lengths", err)
+		}
+		defer rows.Close()
 
 		for rows.Next() {
 			var id, length int
-			rows.Scan(&id, &length)
+			if err := rows.Scan(&id, &length); err != nil {
+				return registry.Step("scan appointment lengths", err)
+			}
 			fmt.Println(id, length)
 		}
+		if err := rows.Err(); err != nil {
+			return registry.Step("iterate appointment lengths", err)
+		}
 	*/
 
 	// Using Raw SQL when all else fails
 	users := []UserQuery{}
-	db.Exec("SELECT * FROM user_queries").Find(&users)
+	if err := db.Exec("SELECT * FROM user_queries").Find(&users).Error; err != nil {
+		return registry.Step("raw select of user_queries", err)
+	}
 
 	for _, user := range users {
 		fmt.Printf("\n%v\n", user)
 	}
-
+	return nil
 }
 
-// SeedDB can be used from any package
-func SeedDB() {
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
-	if err != nil {
-		panic(err.Error())
+// ImportUsers demonstrates an upsert - the kind of import that used to fail (or duplicate users) whenever one of them already existed
+func ImportUsers(ctx context.Context, db *gorm.DB) error {
+	if err := SeedDB(ctx, db); err != nil {
+		return err
 	}
 
-	db.DropTableIfExists(&UserQuery{})
-	db.CreateTable(&UserQuery{})
-	db.DropTableIfExists(&CalendarQuery{})
-	db.CreateTable(&CalendarQuery{})
-	db.DropTableIfExists(&AppointmentQuery{})
-	db.CreateTable(&AppointmentQuery{})
-
-	users := map[string]*UserQuery{
-		"adent":       &UserQuery{Username: "adent", FirstName: "Arthur", LastName: "Dent"},
-		"fprefect":    &UserQuery{Username: "fprefect", FirstName: "Ford", LastName: "Prefect"},
-		"tmacmillan":  &UserQuery{Username: "tmacmillan", FirstName: "Tricia", LastName: "Macmillan"},
-		"zbeeblebrox": &UserQuery{Username: "zbeeblebrox", FirstName: "Zaphod", LastName: "Beeblebrox"},
-		"mrobot":      &UserQuery{Username: "mrobot", FirstName: "Marvin", LastName: "Robot"},
+	// fprefect is already there under a different last name, lprosser isn't there at all
+	imported := []UserQuery{
+		{Username: "fprefect", FirstName: "Ford", LastName: "Prefect (Ix)"},
+		{Username: "lprosser", FirstName: "Lunkwill", LastName: "Prosser"},
+	}
+	// Only the names are overwritten - the existing row keeps its id and created_at
+	err := bulk.Upsert(ctx, db, imported, bulk.UpsertOptions{On: []string{"username"}, Update: []string{"first_name", "last_name", "updated_at"}})
+	if err != nil {
+		return registry.Step("import users", err)
 	}
 
+	users := []UserQuery{}
+	if err := db.Where("username in (?)", []string{"fprefect", "lprosser"}).Order("id").Find(&users).Error; err != nil {
+		return registry.Step("find the imported users", err)
+	}
 	for _, user := range users {
-		user.CalendarQuery = CalendarQuery{Name: "Calendar"}
+		fmt.Printf("\n%d %s %s %s\n", user.ID, user.Username, user.FirstName, user.LastName)
 	}
+	return nil
+}
 
-	users["adent"].AddAppointment(&AppointmentQuery{
-		Subject:   "Save House",
-		StartTime: parseTime("1979-07-02 08:00"),
-		Length:    60,
-	})
-	users["fprefect"].AddAppointment(&AppointmentQuery{
-		Subject:   "Get a drink at a local pub",
-		StartTime: parseTime("1979-07-02 10:00"),
-		Length:    11,
-		Attendees: []*UserQuery{users["adent"]},
-	})
-	users["fprefect"].AddAppointment(&AppointmentQuery{
-		Subject:   "Hitch a ride",
-		StartTime: parseTime("1979-07-02 10:12"),
-		Length:    60,
-		Attendees: []*UserQuery{users["adent"]},
-	})
-	users["fprefect"].AddAppointment(&AppointmentQuery{
-		Subject:   "Attend a poetry reading",
-		StartTime: parseTime("1979-07-02 11:00"),
-		Length:    30,
-		Attendees: []*UserQuery{users["adent"]},
-	})
-	users["fprefect"].AddAppointment(&AppointmentQuery{
-		Subject:   "Get thrown into Space",
-		StartTime: parseTime("1979-07-02 11:40"),
-		Length:    5,
-		Attendees: []*UserQuery{users["adent"]},
-	})
-	users["fprefect"].AddAppointment(&AppointmentQuery{
-		Subject:   "Get saved from Space",
-		StartTime: parseTime("1979-07-02 11:45"),
-		Length:    1,
-		Attendees: []*UserQuery{users["adent"]},
-	})
-	users["zbeeblebrox"].AddAppointment(&AppointmentQuery{
-		Subject:   "Explore Planet Builder's Homeworld",
-		StartTime: parseTime("1979-07-03 11:00"),
-		Length:    240,
-		Attendees: []*UserQuery{users["adent"], users["fprefect"], users["tmacmillan"], users["mrobot"]},
-	})
+// Attendance demonstrates a join table with columns of its own
+// AppointmentQuery.Attendees only knows the pair of ids - AttendanceQuery maps the same rows, RSVP and all
+func Attendance(ctx context.Context, db *gorm.DB) error {
+	if err := SeedDB(ctx, db); err != nil {
+		return err
+	}
+	magrathea := AppointmentQuery{}
+	if err := db.Where("subject = ?", "Explore Planet Builder's Homeworld").First(&magrathea).Error; err != nil {
+		return registry.Step("find the trip to Magrathea", err)
+	}
 
-	for _, user := range users {
-		db.Save(&user)
+	// Preload fills in the user behind each row, like it would for any belongs-to
+	attendances := []AttendanceQuery{}
+	if err := db.Preload("UserQuery").Where("appointment_query_id = ?", magrathea.ID).Order("user_query_id").Find(&attendances).Error; err != nil {
+		return registry.Step("list the attendances", err)
+	}
+	for _, attendance := range attendances {
+		fmt.Printf("%s (%s): %s %s\n", attendance.UserQuery.FirstName, attendance.Role, attendance.Status, attendance.Notes)
+	}
+
+	// The payload can be filtered and grouped on like any other column
+	rows, err := db.Model(&AttendanceQuery{}).Select("status, count(*)").Group("status").Order("status").Rows()
+	if err != nil {
+		return registry.Step("count the answers", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return registry.Step("scan the answers", err)
+		}
+		fmt.Println(status, n)
+	}
+	if err := rows.Err(); err != nil {
+		return registry.Step("iterate the answers", err)
 	}
+	return nil
 }
 
-func parseTime(rawTime string) time.Time {
-	// Apparently it has to be this exact date ???? WTF ???
-	const timeLayout = "2006-01-02 15:04"
-	t, _ := time.Parse(timeLayout, rawTime)
-	return t
+// fixtureFiles hold the seed data - they used to be built up in Go here, in a map that came back in a different order every run
+//
+//go:embed fixtures/*.yaml
+var fixtureFiles embed.FS
+
+// SeedDB can be used from any package
+// It replaces whatever is in the query tables with the fixtures, so the ids are the same every time
+func SeedDB(ctx context.Context, db *gorm.DB) error {
+	set, err := fixtures.ReadFS(fixtureFiles, "fixtures/*.yaml")
+	if err != nil {
+		return registry.Step("read fixtures", err)
+	}
+	if err := set.Load(ctx, db); err != nil {
+		return registry.Step("load fixtures", err)
+	}
+	return nil
 }
 
 // UserQuery is specific to this class file
 type UserQuery struct {
 	gorm.Model
-	Username      string
+	Username      string `gorm:"unique_index"`
 	FirstName     string
 	LastName      string
 	CalendarQuery CalendarQuery
@@ -318,6 +347,22 @@ type AppointmentQuery struct {
 	Attendees       []*UserQuery `gorm:"many2many:appointment_query_user_query"`
 }
 
+// AttendanceQuery is a row of AppointmentQuery.Attendees' join table, with the RSVP columns - like relationships.Attendance
+type AttendanceQuery struct {
+	AppointmentQueryID uint   `gorm:"primary_key;auto_increment:false"`
+	UserQueryID        uint   `gorm:"primary_key;auto_increment:false"`
+	Status             string `sql:"type:varchar(16);not null;default:'invited'" validate:"oneof=invited|accepted|declined|tentative"`
+	Role               string `sql:"type:varchar(16);not null;default:'required'" validate:"oneof=organizer|required|optional"`
+	RespondedAt        *time.Time
+	Notes              string    `sql:"type:text"`
+	UserQuery          UserQuery `gorm:"save_associations:false"`
+}
+
+// TableName is the join table's - AttendanceQuery doesn't get a table of its own
+func (AttendanceQuery) TableName() string {
+	return "appointment_query_user_query"
+}
+
 // UserViewModel is specific to this class file
 type UserViewModel struct {
 	FirstName string
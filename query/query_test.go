@@ -0,0 +1,149 @@
+package query
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+// seeded returns a test database loaded with the fixtures
+func seeded(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := testdb.Open(t)
+	if err := SeedDB(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSeedDB(t *testing.T) {
+	db := seeded(t)
+	// Seeding again replaces the rows instead of adding to them, and the ids come out the same
+	if err := SeedDB(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	for table, want := range map[string]int{
+		"user_queries":                 5,
+		"calendar_queries":             5,
+		"appointment_queries":          7,
+		"appointment_query_user_query": 9,
+	} {
+		if n := testdb.Count(t, db, table); n != want {
+			t.Errorf("%s has %d rows, want %d", table, n, want)
+		}
+	}
+
+	user := UserQuery{}
+	if err := db.First(&user, 2).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "fprefect" {
+		t.Errorf("user 2 is %s, want fprefect", user.Username)
+	}
+}
+
+func TestRetrieveSimple(t *testing.T) {
+	db := seeded(t)
+	if err := RetrieveSimple(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	users := []UserQuery{}
+	if err := db.Where("username = ?", "fprefect").Or("username = ?", "tmacmillan").Order("id").Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Username != "fprefect" || users[1].Username != "tmacmillan" {
+		t.Errorf("Where/Or found %v, want fprefect and tmacmillan", users)
+	}
+}
+
+func TestFirstOrInit(t *testing.T) {
+	db := seeded(t)
+	user := UserQuery{}
+	if err := db.FirstOrInit(&user, &UserQuery{Username: "lprosser"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "lprosser" || user.ID != 0 {
+		t.Errorf("FirstOrInit gave %+v, want an unsaved lprosser", user)
+	}
+	if n := testdb.Count(t, db, "user_queries", "username = ?", "lprosser"); n != 0 {
+		t.Errorf("FirstOrInit saved lprosser %d times, want it left unsaved", n)
+	}
+}
+
+func TestFirstOrCreate(t *testing.T) {
+	db := seeded(t)
+	for i := 0; i < 2; i++ {
+		user := UserQuery{}
+		if err := db.FirstOrCreate(&user, &UserQuery{Username: "lprosser"}).Error; err != nil {
+			t.Fatal(err)
+		}
+		if user.ID == 0 {
+			t.Error("FirstOrCreate left lprosser without an id")
+		}
+	}
+	if n := testdb.Count(t, db, "user_queries", "username = ?", "lprosser"); n != 1 {
+		t.Errorf("lprosser was saved %d times, want once", n)
+	}
+}
+
+func TestRetrieveAdvanced(t *testing.T) {
+	db := seeded(t)
+	if err := RetrieveAdvanced(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Preload inflates the graph that a plain Find leaves empty
+	user := UserQuery{}
+	if err := db.Preload("CalendarQuery.AppointmentQuerys").Where("username = ?", "fprefect").First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n := len(user.CalendarQuery.AppointmentQuerys); n != 5 {
+		t.Errorf("fprefect's calendar has %d appointments, want 5", n)
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	db := testdb.Open(t)
+	if err := ImportUsers(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "user_queries"); n != 6 {
+		t.Errorf("user_queries has %d rows, want the 5 fixtures and lprosser", n)
+	}
+	ford := UserQuery{}
+	if err := db.Where("username = ?", "fprefect").First(&ford).Error; err != nil {
+		t.Fatal(err)
+	}
+	if ford.ID != 2 || ford.LastName != "Prefect (Ix)" {
+		t.Errorf("got fprefect %d %s, want id 2 kept and the last name updated", ford.ID, ford.LastName)
+	}
+}
+
+func TestAttendance(t *testing.T) {
+	db := seeded(t)
+	if err := Attendance(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	// The bare many2many still sees every row, whatever the answer
+	magrathea := AppointmentQuery{}
+	if err := db.Preload("Attendees").Where("subject = ?", "Explore Planet Builder's Homeworld").First(&magrathea).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(magrathea.Attendees) != 4 {
+		t.Errorf("Magrathea has %d attendees, want 4", len(magrathea.Attendees))
+	}
+	organizer := AttendanceQuery{}
+	if err := db.Preload("UserQuery").Where("role = ?", "organizer").First(&organizer).Error; err != nil {
+		t.Fatal(err)
+	}
+	if organizer.UserQuery.Username != "tmacmillan" || organizer.Status != "accepted" || organizer.RespondedAt == nil {
+		t.Errorf("the organizer is %s, %s at %v - want tmacmillan, accepted with a time", organizer.UserQuery.Username, organizer.Status, organizer.RespondedAt)
+	}
+	if n := testdb.Count(t, db, "appointment_query_user_query", "status = ? AND role = ?", "invited", "required"); n != 5 {
+		t.Errorf("%d rows kept the column defaults, want the 5 fixtures that don't set them", n)
+	}
+}
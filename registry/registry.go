@@ -0,0 +1,65 @@
+package registry
+
+/*
+* Each demo package registers its demos here from an init function
+	* The CLI in main.go looks demos up by name instead of needing a commented-out call for each one
+	* Names take the form package.demo-name - e.g. crud.transactions
+*/
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Func is the signature every demo shares
+// Demos return an error rather than panicking so the runner can report which one failed and why
+type Func func(ctx context.Context, db *gorm.DB) error
+
+// Demo is a named, runnable example
+type Demo struct {
+	Name        string
+	Description string
+	Run         Func
+}
+
+var demos = map[string]Demo{}
+
+// Register adds a demo - registering the same name twice is a programming error, so it panics
+func Register(name, description string, run Func) {
+	if _, exists := demos[name]; exists {
+		panic(fmt.Sprintf("registry: demo %q registered twice", name))
+	}
+	demos[name] = Demo{Name: name, Description: description, Run: run}
+}
+
+// Lookup finds a demo by name
+func Lookup(name string) (Demo, bool) {
+	demo, ok := demos[name]
+	return demo, ok
+}
+
+// All returns every registered demo sorted by name
+func All() []Demo {
+	all := make([]Demo, 0, len(demos))
+	for _, demo := range demos {
+		all = append(all, demo)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+var models = []interface{}{}
+
+// RegisterModels records the models a demo package persists, for tools that work across the whole schema
+// Pass pointers to empty structs - &CruddyUser{}
+func RegisterModels(m ...interface{}) {
+	models = append(models, m...)
+}
+
+// Models returns every registered model in registration order
+func Models() []interface{} {
+	return append([]interface{}{}, models...)
+}
@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// StepError records which step of a demo failed
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return e.Step + ": " + e.Err.Error()
+}
+
+// Unwrap lets errors.Is and errors.As see the underlying gorm or driver error
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Step wraps err with a short description of what the demo was doing when it failed
+func Step(step string, err error) error {
+	return &StepError{Step: step, Err: err}
+}
+
+// Result is the outcome of running one demo
+type Result struct {
+	Demo     string
+	Duration time.Duration
+	Err      error
+}
+
+// Run runs each demo in turn - a failing (or panicking) demo is recorded and the rest still run
+func Run(ctx context.Context, db *gorm.DB, demos []Demo, out io.Writer) []Result {
+	results := make([]Result, 0, len(demos))
+	for _, demo := range demos {
+		if err := ctx.Err(); err != nil {
+			results = append(results, Result{Demo: demo.Name, Err: err})
+			continue
+		}
+		fmt.Fprintf(out, "== %s ==\n", demo.Name)
+		start := time.Now()
+		err := runOne(ctx, db, demo)
+		results = append(results, Result{Demo: demo.Name, Duration: time.Since(start), Err: err})
+	}
+	return results
+}
+
+func runOne(ctx context.Context, db *gorm.DB, demo Demo) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return demo.Run(ctx, db)
+}
+
+// Report writes a pass/fail line per demo, with the failing step and error underneath each failure
+// It returns the number of failures
+func Report(out io.Writer, results []Result) int {
+	failed := 0
+	for _, result := range results {
+		if result.Err == nil {
+			fmt.Fprintf(out, "PASS  %s (%v)\n", result.Demo, result.Duration.Round(time.Millisecond))
+			continue
+		}
+		failed++
+		fmt.Fprintf(out, "FAIL  %s (%v)\n", result.Demo, result.Duration.Round(time.Millisecond))
+		var stepErr *StepError
+		if errors.As(result.Err, &stepErr) {
+			fmt.Fprintf(out, "      step:  %s\n", stepErr.Step)
+			fmt.Fprintf(out, "      error: %v\n", stepErr.Err)
+		} else {
+			fmt.Fprintf(out, "      error: %v\n", result.Err)
+		}
+	}
+	fmt.Fprintf(out, "%d passed, %d failed\n", len(results)-failed, failed)
+	return failed
+}
+
+// ResetTables deletes every row (soft deleted or not) from each table so a demo starts from a known state
+// The tables themselves belong to the migrations package - demos no longer drop and recreate them
+func ResetTables(db *gorm.DB, tables ...string) error {
+	for _, table := range tables {
+		if err := db.Exec("DELETE FROM " + db.Dialect().Quote(table)).Error; err != nil {
+			return Step("clear "+table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package relationships
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/audit"
+	"github.com/annicaburns/learngorm/transaction"
+)
+
+// ErrNotFound is returned when an owner, appointment or attendee doesn't exist (or is soft deleted) - check for it with errors.Is
+var ErrNotFound = errors.New("relationships: not found")
+
+// Owner is a model that holds appointments through the polymorphic owner_id and owner_type columns - *Calendar or *TaskList
+type Owner interface {
+	ownsAppointments()
+}
+
+func (*Calendar) ownsAppointments() {}
+func (*TaskList) ownsAppointments() {}
+
+// Associations manages the appointments of calendars and task lists, and the attendees of appointments
+// It wraps GORM's Association calls, checking first that every record named exists - Append would quietly create a blank owner or attendee instead
+// Owners, appointments and attendees are identified by ID, and the owner or appointment passed in is reloaded along the way
+// Writes run in a transaction (a savepoint inside one already) and are recorded in the audit log against the actor in ctx
+type Associations struct {
+	db *gorm.DB
+}
+
+// NewAssociations returns an Associations that works on db
+func NewAssociations(db *gorm.DB) *Associations {
+	return &Associations{db: db}
+}
+
+// WithDB returns a copy that uses db - usually a transaction
+func (a *Associations) WithDB(db *gorm.DB) *Associations {
+	return &Associations{db: db}
+}
+
+// Appointments lists the owner's appointments, oldest first
+func (a *Associations) Appointments(ctx context.Context, owner Owner) ([]Appointment, error) {
+	appointments := []Appointment{}
+	err := a.read(ctx, owner, func(db *gorm.DB) error {
+		return db.Model(owner).Order("id").Association("Appointments").Find(&appointments).Error
+	})
+	return appointments, err
+}
+
+// CountAppointments counts the owner's appointments
+func (a *Associations) CountAppointments(ctx context.Context, owner Owner) (int, error) {
+	n := 0
+	err := a.read(ctx, owner, func(db *gorm.DB) error {
+		association := db.Model(owner).Association("Appointments")
+		n = association.Count()
+		return association.Error
+	})
+	return n, err
+}
+
+// AddAppointments gives the appointments to the owner - new ones (ID 0) are created, and existing ones move over from whatever owned them before
+// Existing ones are reloaded first, like the owner, so only their owner changes - the rest of a stale copy isn't saved over the row
+func (a *Associations) AddAppointments(ctx context.Context, owner Owner, appointments ...*Appointment) error {
+	return a.write(ctx, owner, func(tx *gorm.DB) error {
+		if err := reload(tx, appointments); err != nil {
+			return err
+		}
+		return tx.Model(owner).Association("Appointments").Append(appointments).Error
+	})
+}
+
+// RemoveAppointments takes the appointments away from the owner, leaving them without one - appointments the owner doesn't have are ignored
+func (a *Associations) RemoveAppointments(ctx context.Context, owner Owner, appointments ...*Appointment) error {
+	return a.write(ctx, owner, func(tx *gorm.DB) error {
+		if err := exist(tx, appointments, true); err != nil {
+			return err
+		}
+		if len(appointments) == 0 {
+			return nil
+		}
+		return detach(tx.Where("id IN (?)", appointmentIDs(appointments)), owner).Error
+	})
+}
+
+// ReplaceAppointments makes the appointments the owner's only ones - adding them as AddAppointments does, and removing the rest
+func (a *Associations) ReplaceAppointments(ctx context.Context, owner Owner, appointments ...*Appointment) error {
+	return a.write(ctx, owner, func(tx *gorm.DB) error {
+		if err := reload(tx, appointments); err != nil {
+			return err
+		}
+		if len(appointments) > 0 {
+			if err := tx.Model(owner).Association("Appointments").Append(appointments).Error; err != nil {
+				return err
+			}
+			// Read after Append, which gave the new ones their ids
+			return detach(tx.Where("id NOT IN (?)", appointmentIDs(appointments)), owner).Error
+		}
+		return detach(tx, owner).Error
+	})
+}
+
+// ClearAppointments removes all of the owner's appointments - they're left without an owner, not deleted
+func (a *Associations) ClearAppointments(ctx context.Context, owner Owner) error {
+	return a.write(ctx, owner, func(tx *gorm.DB) error {
+		return detach(tx, owner).Error
+	})
+}
+
+// detach clears owner_id and owner_type on the owner's appointments that db's conditions pick out
+// GORM's Association.Delete only clears owner_id, leaving an owner_type that points at nothing
+func detach(db *gorm.DB, owner Owner) *gorm.DB {
+	scope := db.NewScope(owner)
+	return db.Model(&Appointment{}).Where("owner_id = ? AND owner_type = ?", scope.PrimaryKeyValue(), scope.TableName()).
+		// A plain nil would be written as 0 and '' - GORM sets it on the model's fields first
+		UpdateColumns(map[string]interface{}{"owner_id": gorm.Expr("NULL"), "owner_type": gorm.Expr("NULL")})
+}
+
+// Attendees lists the users attending the appointment, by id
+func (a *Associations) Attendees(ctx context.Context, appointment *Appointment) ([]RelationshipUser, error) {
+	users := []RelationshipUser{}
+	err := a.read(ctx, appointment, func(db *gorm.DB) error {
+		return db.Model(appointment).Order("id").Association("Attendees").Find(&users).Error
+	})
+	return users, err
+}
+
+// CountAttendees counts the users attending the appointment
+func (a *Associations) CountAttendees(ctx context.Context, appointment *Appointment) (int, error) {
+	n := 0
+	err := a.read(ctx, appointment, func(db *gorm.DB) error {
+		association := db.Model(appointment).Association("Attendees")
+		n = association.Count()
+		return association.Error
+	})
+	return n, err
+}
+
+// AddAttendees adds users to the appointment - they must exist already, and users who are attending already are left alone
+func (a *Associations) AddAttendees(ctx context.Context, appointment *Appointment, users ...*RelationshipUser) error {
+	return a.write(ctx, appointment, func(tx *gorm.DB) error {
+		if err := exist(tx, users, true); err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return nil
+		}
+		return tx.Model(appointment).Association("Attendees").Append(users).Error
+	})
+}
+
+// RemoveAttendees takes users off the appointment - the users themselves aren't touched
+func (a *Associations) RemoveAttendees(ctx context.Context, appointment *Appointment, users ...*RelationshipUser) error {
+	return a.write(ctx, appointment, func(tx *gorm.DB) error {
+		if err := exist(tx, users, true); err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return nil
+		}
+		return tx.Model(appointment).Association("Attendees").Delete(users).Error
+	})
+}
+
+// ReplaceAttendees makes users the appointment's only attendees
+func (a *Associations) ReplaceAttendees(ctx context.Context, appointment *Appointment, users ...*RelationshipUser) error {
+	return a.write(ctx, appointment, func(tx *gorm.DB) error {
+		if err := exist(tx, users, true); err != nil {
+			return err
+		}
+		return tx.Model(appointment).Association("Attendees").Replace(users).Error
+	})
+}
+
+// ClearAttendees takes everyone off the appointment
+func (a *Associations) ClearAttendees(ctx context.Context, appointment *Appointment) error {
+	return a.write(ctx, appointment, func(tx *gorm.DB) error {
+		return tx.Model(appointment).Association("Attendees").Clear().Error
+	})
+}
+
+// read loads the record the association hangs off, then calls fn
+func (a *Associations) read(ctx context.Context, record interface{}, fn func(db *gorm.DB) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := load(a.db, record); err != nil {
+		return err
+	}
+	return a.wrap(record, fn(a.db))
+}
+
+// write does what read does, in a transaction
+func (a *Associations) write(ctx context.Context, record interface{}, fn func(tx *gorm.DB) error) error {
+	err := transaction.WithTx(ctx, audit.DB(ctx, a.db), func(tx *gorm.DB) error {
+		if err := load(tx, record); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+	return a.wrap(record, err)
+}
+
+func (a *Associations) wrap(record interface{}, err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) {
+		return err
+	}
+	scope := a.db.NewScope(record)
+	return fmt.Errorf("%s %v: %w", scope.TableName(), scope.PrimaryKeyValue(), err)
+}
+
+// load reloads record by its id, so a missing or soft deleted one is ErrNotFound rather than a blank row for Append to fill in
+func load(db *gorm.DB, record interface{}) error {
+	scope := db.NewScope(record)
+	if scope.PrimaryKeyZero() {
+		return fmt.Errorf("%s without an id: %w", scope.TableName(), ErrNotFound)
+	}
+	id := scope.PrimaryKeyValue()
+	// Start from blank - a stale preloaded Appointments slice would be saved again by Append
+	value := reflect.ValueOf(record).Elem()
+	value.Set(reflect.Zero(value.Type()))
+	if err := db.First(record, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return fmt.Errorf("%s %v: %w", scope.TableName(), id, ErrNotFound)
+		}
+		return err
+	}
+	return nil
+}
+
+// exist checks that every record with an id is still there, and with required that none are missing an id
+func exist[T any](db *gorm.DB, records []*T, required bool) error {
+	wanted := map[uint]bool{}
+	for _, record := range records {
+		scope := db.NewScope(record)
+		if scope.PrimaryKeyZero() {
+			if required {
+				return fmt.Errorf("%s without an id: %w", scope.TableName(), ErrNotFound)
+			}
+			continue
+		}
+		wanted[scope.PrimaryKeyValue().(uint)] = true
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+	list := make([]uint, 0, len(wanted))
+	for id := range wanted {
+		list = append(list, id)
+	}
+	found := []uint{}
+	if err := db.Model(new(T)).Where("id IN (?)", list).Pluck("id", &found).Error; err != nil {
+		return err
+	}
+	for _, id := range found {
+		delete(wanted, id)
+	}
+	for id := range wanted {
+		return fmt.Errorf("%s %d: %w", db.NewScope(new(T)).TableName(), id, ErrNotFound)
+	}
+	return nil
+}
+
+// reload loads the appointments that have an id, for Append to move - the caller's copies may be older than the rows
+func reload(tx *gorm.DB, appointments []*Appointment) error {
+	for _, appointment := range appointments {
+		if appointment.ID == 0 {
+			continue
+		}
+		if err := load(tx, appointment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appointmentIDs(appointments []*Appointment) []uint {
+	list := make([]uint, len(appointments))
+	for i, appointment := range appointments {
+		list[i] = appointment.ID
+	}
+	return list
+}
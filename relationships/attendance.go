@@ -0,0 +1,116 @@
+package relationships
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// RSVP statuses - every attendee starts out Invited
+const (
+	Invited   = "invited"
+	Accepted  = "accepted"
+	Declined  = "declined"
+	Tentative = "tentative"
+)
+
+// Attendee roles
+const (
+	Organizer = "organizer"
+	Required  = "required"
+	Optional  = "optional"
+)
+
+// Attendance is a row of the appoinment_user join table, with the payload a bare many2many can't carry
+// Appointment.Attendees still reads and writes the same rows - the ones it adds get the column defaults, a required invitee who hasn't answered
+type Attendance struct {
+	AppointmentID      uint   `gorm:"primary_key;auto_increment:false"`
+	RelationshipUserID uint   `gorm:"primary_key;auto_increment:false"`
+	Status             string `sql:"type:varchar(16);not null;default:'invited'" validate:"oneof=invited|accepted|declined|tentative"`
+	Role               string `sql:"type:varchar(16);not null;default:'required'" validate:"oneof=organizer|required|optional"`
+	RespondedAt        *time.Time
+	Notes              string `sql:"type:text"`
+	// User is only read, for listing attendees by name - saving an Attendance leaves the user alone
+	User RelationshipUser `gorm:"foreignkey:RelationshipUserID;save_associations:false"`
+}
+
+// TableName keeps the join table's name, typo and all, so Appointment.Attendees and Attendance share the rows
+func (Attendance) TableName() string {
+	return "appoinment_user"
+}
+
+// Validate checks that RespondedAt goes with an answer
+func (a *Attendance) Validate() error {
+	if a.Status == Invited && a.RespondedAt != nil {
+		return errors.New("an invitee who hasn't answered can't have a responded_at")
+	}
+	if a.Status != Invited && a.RespondedAt == nil {
+		return fmt.Errorf("a %s answer needs a responded_at", a.Status)
+	}
+	return nil
+}
+
+// ErrNotInvited is a response from a user who isn't on the appointment
+var ErrNotInvited = errors.New("relationships: not invited")
+
+// Invite adds users to the appointment in the given role - users invited already keep their answer, and take the new role
+func (a *Associations) Invite(ctx context.Context, appointment *Appointment, role string, users ...*RelationshipUser) error {
+	return a.write(ctx, appointment, func(tx *gorm.DB) error {
+		if err := exist(tx, users, true); err != nil {
+			return err
+		}
+		for _, user := range users {
+			attendance := Attendance{}
+			err := tx.Where("appointment_id = ? AND relationship_user_id = ?", appointment.ID, user.ID).First(&attendance).Error
+			switch {
+			case gorm.IsRecordNotFoundError(err):
+				err = tx.Create(&Attendance{AppointmentID: appointment.ID, RelationshipUserID: user.ID, Status: Invited, Role: role}).Error
+			case err == nil && attendance.Role != role:
+				err = tx.Model(&attendance).Update("role", role).Error
+			}
+			if err != nil {
+				return fmt.Errorf("inviting relationship_users %d: %w", user.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Respond records the user's answer to an invitation - Accepted, Declined or Tentative - along with a note and the time
+// A user who wasn't invited gets ErrNotInvited
+func (a *Associations) Respond(ctx context.Context, appointment *Appointment, user *RelationshipUser, status, notes string) error {
+	if status != Accepted && status != Declined && status != Tentative {
+		return fmt.Errorf("relationships: answer %s, %s or %s, not %q", Accepted, Declined, Tentative, status)
+	}
+	return a.write(ctx, appointment, func(tx *gorm.DB) error {
+		attendance := Attendance{}
+		err := tx.Where("appointment_id = ? AND relationship_user_id = ?", appointment.ID, user.ID).First(&attendance).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return fmt.Errorf("relationship_users %d: %w", user.ID, ErrNotInvited)
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&attendance).Updates(map[string]interface{}{"status": status, "notes": notes, "responded_at": time.Now()}).Error
+	})
+}
+
+// Attendances lists the appointment's attendees with their answers, organizers first - only those with one of the statuses, if any are given
+// Each Attendance has its User loaded, and soft deleted users are left out, as they are from Attendees
+func (a *Associations) Attendances(ctx context.Context, appointment *Appointment, statuses ...string) ([]Attendance, error) {
+	attendances := []Attendance{}
+	err := a.read(ctx, appointment, func(db *gorm.DB) error {
+		query := db.Preload("User").
+			Joins("JOIN relationship_users ON relationship_users.id = appoinment_user.relationship_user_id AND relationship_users.deleted_at IS NULL").
+			Where("appoinment_user.appointment_id = ?", appointment.ID).
+			Order("CASE appoinment_user.role WHEN 'organizer' THEN 0 WHEN 'required' THEN 1 ELSE 2 END, appoinment_user.relationship_user_id")
+		if len(statuses) > 0 {
+			query = query.Where("appoinment_user.status IN (?)", statuses)
+		}
+		return query.Find(&attendances).Error
+	})
+	return attendances, err
+}
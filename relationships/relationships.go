@@ -1,36 +1,51 @@
 package relationships
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"time"
 
 	"github.com/jinzhu/gorm"
 
-	// Anonymous import - package just needs to initialize in order to establish itself as a database driver
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/annicaburns/learngorm/audit"
+	"github.com/annicaburns/learngorm/integrity"
+	"github.com/annicaburns/learngorm/registry"
+	"github.com/annicaburns/learngorm/schema"
+	"github.com/annicaburns/learngorm/transaction"
 )
 
+func init() {
+	registry.Register("relationships.basic-relationships", "Save a user with a has-one calendar, polymorphic appointments and many-to-many attendees", BasicRelationships)
+	registry.Register("relationships.model-association-method", "Scope to a calendar's Appointments association", ModelAssociationMethod)
+	registry.Register("relationships.attendance", "Invite attendees as organizer, required or optional, record their answers and list them", RSVP)
+	registry.Register("relationships.polymorphic-integrity", "Refuse appointments whose owner isn't there, then find and detach the ones that got in anyway", PolymorphicIntegrity)
+	registry.Register("relationships.orphans", "Delete a user behind GORM's back, then find and clean up every row left pointing at them", Orphans)
+	registry.Register("relationships.concurrent-attendees", "Writers racing to join one appointment, retried when the database aborts them", ConcurrentAttendees)
+	registry.RegisterModels(&RelationshipUser{}, &Calendar{}, &TaskList{}, &Appointment{}, &Attendance{})
+}
+
 // BasicRelationships demonstrates some basic principles of relationships in GORM
-func BasicRelationships() {
-	// Need to include the ?parseTime=true parameter to connection string if you want the gorm model fields to update updated_at when anything related to the object changes
-	// https://github.com/jinzhu/gorm/issues/958
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
-	if err != nil {
-		panic(err.Error())
+func BasicRelationships(ctx context.Context, db *gorm.DB) error {
+	// The tables come from the migrations package - clear out the rows from last time, children first
+	if err := registry.ResetTables(db, "appoinment_user", "appointments", "calendars", "task_lists", "relationship_users"); err != nil {
+		return err
 	}
-
-	db.DropTableIfExists(&Appointment{})
-	db.CreateTable(&Appointment{})
-	db.DropTableIfExists(&Calendar{})
-	db.CreateTable(&Calendar{})
-	db.DropTableIfExists(&RelationshipUser{})
-	db.CreateTable(&RelationshipUser{})
-	db.DropTableIfExists(&TaskList{})
-	db.CreateTable(&TaskList{})
 	// .Debug method logs the SQL statements as they are being made
-	db.Debug().Model(&Calendar{}).
-		AddForeignKey("relationship_user_id", "relationship_users(id)", "CASCADE", "CASCADE")
+	// GORM infers the keys from the relationship fields but never adds the FK constraints for them - the schema package works out the same keys and adds them
+	// Every run after the first finds them there already - and SQLite can't add one to an existing table, so the migration declares calendars' in CREATE TABLE
+	results, err := schema.AddForeignKeys(ctx, db.Debug(), schema.ForeignKeyOptions{}, &RelationshipUser{}, &Calendar{}, &TaskList{}, &Appointment{})
+	if err != nil {
+		return registry.Step("add foreign keys", err)
+	}
+	for _, result := range results {
+		fmt.Println(result)
+	}
 
 	users := []RelationshipUser{
 		{Username: "fprefect"},
@@ -38,10 +53,12 @@ func BasicRelationships() {
 		{Username: "mrobot"},
 	}
 	for i := range users {
-		db.Save(&users[i])
+		if err := db.Save(&users[i]).Error; err != nil {
+			return registry.Step("save "+users[i].Username, err)
+		}
 	}
 	// Interestingly... as we add each appointment with it's associated list of users, the updated_at field of each user will get updated because something "related to the user" has changed.
-	db.Save(&RelationshipUser{
+	err = db.Save(&RelationshipUser{
 		Username: "adent",
 		Calendar: Calendar{
 			Name: "Improbable Events",
@@ -57,7 +74,10 @@ func BasicRelationships() {
 				{Subject: "Jira Work", Description: "hard", StartTime: time.Now()},
 			},
 		},
-	})
+	}).Error
+	if err != nil {
+		return registry.Step("save adent with calendar and task list", err)
+	}
 
 	// To query the user and calendar records we just created, create empty structs and inflate them with the .FirstMethod
 	// u := User{}
@@ -68,28 +88,293 @@ func BasicRelationships() {
 	// fmt.Println()
 	// fmt.Println(c)
 
+	return nil
 }
 
-// ModelAssociationMethod demonstrates capabilities of the Model function's Association Method
-func ModelAssociationMethod() {
-	db, err := gorm.Open("mysql", "gorm:gorm@tcp(localhost:23306)/gorm?parseTime=true")
+// ModelAssociationMethod demonstrates capabilities of the Model function's Association Method, through the Associations service
+func ModelAssociationMethod(ctx context.Context, db *gorm.DB) error {
+	if err := BasicRelationships(ctx, db); err != nil {
+		return err
+	}
+
+	// The parameter for the Association method scopes subsequent code to the named field of the scoped table (Calendar in this case)
+	// Association reports problems on its own Error field - scoping to an empty &Calendar{} fails with "primary key can't be nil", so load one first
+	// Associations wraps .Find, .Append, .Delete, .Replace, .Count and .Clear, and checks the records exist before they're linked
+	calendar := Calendar{}
+	if err := db.First(&calendar).Error; err != nil {
+		return registry.Step("find a calendar", err)
+	}
+	taskList := TaskList{}
+	if err := db.First(&taskList).Error; err != nil {
+		return registry.Step("find a task list", err)
+	}
+	associations := NewAssociations(db)
+
+	appointments, err := associations.Appointments(ctx, &calendar)
 	if err != nil {
-		panic(err.Error())
+		return registry.Step("list the calendar's appointments", err)
+	}
+	tasks, err := associations.Appointments(ctx, &taskList)
+	if err != nil {
+		return registry.Step("list the task list's appointments", err)
+	}
+
+	// A new appointment is created, and one that belonged to the task list moves over
+	lunch := Appointment{Subject: "Lunch at Milliways", StartTime: time.Now(), Length: 90}
+	if err := associations.AddAppointments(ctx, &calendar, &lunch, &tasks[0]); err != nil {
+		return registry.Step("add appointments to the calendar", err)
+	}
+	// Removing leaves the appointment without an owner, rather than deleting it
+	if err := associations.RemoveAppointments(ctx, &calendar, &appointments[0]); err != nil {
+		return registry.Step("remove an appointment from the calendar", err)
 	}
 
-	BasicRelationships()
+	attendees, err := associations.Attendees(ctx, &appointments[1])
+	if err != nil {
+		return registry.Step("list attendees", err)
+	}
+	if err := associations.ReplaceAttendees(ctx, &lunch, &attendees[0], &attendees[1]); err != nil {
+		return registry.Step("invite people to lunch", err)
+	}
 
-	// The parameter for the Association method scopes subsequent code to the named field of the scoped table (Calendar in this case)
-	db.Model(&Calendar{}).Association("Appointments")
-	appointments := []Appointment{}
-	db.Find(&appointments)
-	fmt.Println(appointments)
-	// .Find(&appointments)
-	// .Append(&appointments)
-	// .Delete(&appointments)
-	// .Replace(&appointments)
-	// .Count()
-	// .Clear()
+	// Nothing is appended to a calendar that isn't there
+	missing := Calendar{Model: gorm.Model{ID: calendar.ID + 1000}}
+	if err := associations.AddAppointments(ctx, &missing, &Appointment{Subject: "Nowhere"}); !errors.Is(err, ErrNotFound) {
+		return registry.Step("add to a missing calendar", fmt.Errorf("want ErrNotFound, got %v", err))
+	}
+
+	for _, owner := range []Owner{&calendar, &taskList} {
+		appointments, err := associations.Appointments(ctx, owner)
+		if err != nil {
+			return registry.Step("list appointments", err)
+		}
+		subjects := []string{}
+		for _, appointment := range appointments {
+			n, err := associations.CountAttendees(ctx, &appointment)
+			if err != nil {
+				return registry.Step("count attendees", err)
+			}
+			subjects = append(subjects, fmt.Sprintf("%s (%d attending)", appointment.Subject, n))
+		}
+		fmt.Printf("%T: %s\n", owner, strings.Join(subjects, ", "))
+	}
+	return nil
+}
+
+// RSVP demonstrates Attendance - the appoinment_user join table read and written as a model, with an answer for each attendee
+func RSVP(ctx context.Context, db *gorm.DB) error {
+	if err := BasicRelationships(ctx, db); err != nil {
+		return err
+	}
+	appointment := Appointment{}
+	if err := db.Where("subject = ?", "Spontaneous Whale Generation").First(&appointment).Error; err != nil {
+		return registry.Step("find the appointment", err)
+	}
+	users := map[string]*RelationshipUser{}
+	for _, username := range []string{"adent", "fprefect", "tmacmillan", "mrobot"} {
+		user := RelationshipUser{}
+		if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+			return registry.Step("find "+username, err)
+		}
+		users[username] = &user
+	}
+
+	// The attendees BasicRelationships added through the many2many tag got the column defaults - required, and no answer yet
+	associations := NewAssociations(db)
+	ctx = audit.WithActor(ctx, "zbeeblebrox")
+	if err := associations.Invite(ctx, &appointment, Organizer, users["adent"]); err != nil {
+		return registry.Step("invite the organizer", err)
+	}
+	// Marvin was invited already - he keeps his place and becomes optional
+	if err := associations.Invite(ctx, &appointment, Optional, users["mrobot"]); err != nil {
+		return registry.Step("make marvin optional", err)
+	}
+	if err := associations.Respond(ctx, &appointment, users["fprefect"], Accepted, "Bringing a towel"); err != nil {
+		return registry.Step("accept", err)
+	}
+	if err := associations.Respond(ctx, &appointment, users["mrobot"], Declined, "I'd only make it worse"); err != nil {
+		return registry.Step("decline", err)
+	}
+
+	zaphod := RelationshipUser{Username: "zbeeblebrox"}
+	if err := db.Create(&zaphod).Error; err != nil {
+		return registry.Step("create zaphod", err)
+	}
+	if err := associations.Respond(ctx, &appointment, &zaphod, Accepted, ""); !errors.Is(err, ErrNotInvited) {
+		return registry.Step("answer without an invitation", fmt.Errorf("want ErrNotInvited, got %v", err))
+	}
+
+	attendances, err := associations.Attendances(ctx, &appointment)
+	if err != nil {
+		return registry.Step("list the attendees", err)
+	}
+	for _, attendance := range attendances {
+		fmt.Printf("%-10s %-9s %-9s %s\n", attendance.User.Username, attendance.Role, attendance.Status, attendance.Notes)
+	}
+	// Appointment.Attendees still sees everyone, whatever their answer
+	coming, err := associations.Attendances(ctx, &appointment, Accepted, Tentative)
+	if err != nil {
+		return registry.Step("list who's coming", err)
+	}
+	all, err := associations.CountAttendees(ctx, &appointment)
+	if err != nil {
+		return registry.Step("count the attendees", err)
+	}
+	fmt.Printf("%d of %d coming\n", len(coming), all)
+	return nil
+}
+
+// PolymorphicIntegrity demonstrates the integrity package
+// No FK constraint can cover owner_id, since it holds the id of a calendar or a task list depending on owner_type
+func PolymorphicIntegrity(ctx context.Context, db *gorm.DB) error {
+	if err := BasicRelationships(ctx, db); err != nil {
+		return err
+	}
+	calendar := Calendar{}
+	if err := db.First(&calendar).Error; err != nil {
+		return registry.Step("find a calendar", err)
+	}
+
+	// The integrity callback checks both columns before the INSERT
+	diary := Appointment{Subject: "Dear diary", OwnerID: calendar.ID, OwnerType: "diaries"}
+	if err := db.Create(&diary).Error; !errors.Is(err, integrity.ErrUnknownOwnerType) {
+		return registry.Step("create an appointment owned by a diary", fmt.Errorf("want ErrUnknownOwnerType, got %v", err))
+	}
+	fmt.Println(db.Create(&Appointment{Subject: "Lost", OwnerID: calendar.ID + 1000, OwnerType: "calendars"}).Error)
+
+	// Raw SQL skips the callbacks, and deleting the owner leaves its appointments behind - the scanner finds both
+	err := db.Exec("INSERT INTO appointments (subject, owner_id, owner_type) VALUES (?, ?, ?), (?, ?, ?)",
+		"Smuggled in", calendar.ID+1000, "calendars", "Half filled in", 0, "task_lists").Error
+	if err != nil {
+		return registry.Step("insert orphans", err)
+	}
+	taskList := TaskList{}
+	if err := db.First(&taskList).Error; err != nil {
+		return registry.Step("find a task list", err)
+	}
+	if err := db.Delete(&taskList).Error; err != nil {
+		return registry.Step("delete the task list on its own", err)
+	}
+
+	orphans, err := integrity.ScanPolymorphic(ctx, db, registry.Models()...)
+	if err != nil {
+		return registry.Step("scan for orphans", err)
+	}
+	for _, orphan := range orphans {
+		fmt.Println(orphan)
+	}
+	repaired, err := integrity.Repair(ctx, db, orphans, integrity.Detach)
+	if err != nil {
+		return registry.Step("detach orphans", err)
+	}
+	fmt.Println("detached", repaired)
+
+	if orphans, err := integrity.ScanPolymorphic(ctx, db, registry.Models()...); err != nil || len(orphans) > 0 {
+		return registry.Step("scan again", fmt.Errorf("%d orphans left (%v)", len(orphans), err))
+	}
+	return nil
+}
+
+// Orphans demonstrates integrity.Scan and integrity.Fix across every relationship, not just the polymorphic ones
+func Orphans(ctx context.Context, db *gorm.DB) error {
+	if err := BasicRelationships(ctx, db); err != nil {
+		return err
+	}
+	// A hard delete in raw SQL runs no callbacks - the calendar's FK constraint cascades it away, but adent's task list and every appointment are left behind
+	// Ford goes too, so the appointments he was attending still list him
+	adent, ford := RelationshipUser{}, RelationshipUser{}
+	if err := db.Where("username = ?", "adent").First(&adent).Error; err != nil {
+		return registry.Step("find adent", err)
+	}
+	if err := db.Where("username = ?", "fprefect").First(&ford).Error; err != nil {
+		return registry.Step("find ford", err)
+	}
+	if err := db.Exec("DELETE FROM relationship_users WHERE id IN (?)", []uint{adent.ID, ford.ID}).Error; err != nil {
+		return registry.Step("delete adent and ford", err)
+	}
+
+	models := []interface{}{&RelationshipUser{}, &Calendar{}, &TaskList{}, &Appointment{}, &Attendance{}}
+	report, err := integrity.Scan(ctx, db, models...)
+	if err != nil {
+		return registry.Step("scan", err)
+	}
+	// Deleting the task list soft deletes the appointments too - the join rows for ford have nothing to soft delete, so they go for good
+	if err := integrity.Fix(audit.WithActor(ctx, "integrity"), db, report, integrity.Delete); err != nil {
+		return registry.Step("fix", err)
+	}
+	if err := report.Write(os.Stdout); err != nil {
+		return registry.Step("write the report", err)
+	}
+
+	if report, err := integrity.Scan(ctx, db, models...); err != nil || report.Len() > 0 {
+		return registry.Step("scan again", fmt.Errorf("%d problems left (%v)", report.Len(), err))
+	}
+	return nil
+}
+
+// ConcurrentAttendees demonstrates transaction.WithRetry
+// Every writer adds a join row and bumps the appointment's length in one transaction - on MySQL that's the pattern that deadlocks, on SQLite the writers find the database locked
+func ConcurrentAttendees(ctx context.Context, db *gorm.DB) error {
+	if err := registry.ResetTables(db, "appoinment_user", "appointments", "relationship_users"); err != nil {
+		return err
+	}
+	appointment := Appointment{Subject: "Vogon poetry reading"}
+	if err := db.Create(&appointment).Error; err != nil {
+		return registry.Step("create appointment", err)
+	}
+	users := []RelationshipUser{}
+	for _, name := range []string{"adent", "fprefect", "zbeeblebrox", "tmcmillan", "marvin", "slartibartfast"} {
+		user := RelationshipUser{Username: name}
+		if err := db.Create(&user).Error; err != nil {
+			return registry.Step("create "+name, err)
+		}
+		users = append(users, user)
+	}
+
+	var retries int64
+	policy := transaction.Policy{
+		MaxAttempts: 10,
+		// A real service would count these in its metrics - here they're just added up for the summary
+		Observe: func(attempt transaction.Attempt) {
+			if attempt.Delay > 0 {
+				atomic.AddInt64(&retries, 1)
+			}
+		},
+	}
+	errs := make([]error, len(users))
+	wg := sync.WaitGroup{}
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = transaction.WithRetry(ctx, db, policy, func(tx *gorm.DB) error {
+				// Read inside the transaction, so a retry starts from what's there now
+				current := Appointment{}
+				if err := tx.First(&current, appointment.ID).Error; err != nil {
+					return err
+				}
+				if err := tx.Model(&current).Association("Attendees").Append(&users[i]).Error; err != nil {
+					return err
+				}
+				return tx.Model(&current).UpdateColumn("length", gorm.Expr("length + ?", 15)).Error
+			})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return registry.Step("add "+users[i].Username, err)
+		}
+	}
+
+	if err := db.Preload("Attendees").First(&appointment, appointment.ID).Error; err != nil {
+		return registry.Step("reload appointment", err)
+	}
+	fmt.Printf("%d attendees, %d minutes long, %d retries\n", len(appointment.Attendees), appointment.Length, atomic.LoadInt64(&retries))
+	if len(appointment.Attendees) != len(users) || appointment.Length != uint(15*len(users)) {
+		return registry.Step("check appointment", fmt.Errorf("want %d attendees and %d minutes", len(users), 15*len(users)))
+	}
+	return nil
 }
 
 // RelationshipUser is used to demonstrate relationship stuff
@@ -109,7 +394,7 @@ type Calendar struct {
 	gorm.Model
 	Name string
 	// Named this way, GORM can infer during inserts that this field is a foreign key for the RelationshipUser table
-	// But GORM won't automatically add a FK constraint >> That has to be explicitly added.
+	// But GORM won't automatically add a FK constraint >> That has to be explicitly added - see schema.AddForeignKeys
 	RelationshipUserID uint
 	Appointments       []Appointment `gorm:"polymorphic:owner"`
 }
@@ -126,6 +411,7 @@ type Appointment struct {
 	OwnerType string
 	// Creating a many-to-many relationship by specifying the name of the lookup table that we want GORM to create.
 	// In this case: "appointment_user"
+	// The table has RSVP columns too - read and write those through Attendance
 	Attendees []RelationshipUser `gorm:"many2many:appoinment_user"`
 }
 
@@ -0,0 +1,295 @@
+package relationships
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/testdb"
+	"github.com/annicaburns/learngorm/validation"
+)
+
+func TestBasicRelationships(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := BasicRelationships(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := testdb.Count(t, db, "relationship_users"); n != 4 {
+		t.Errorf("relationship_users has %d rows, want 4", n)
+	}
+
+	adent := RelationshipUser{}
+	err := db.Preload("Calendar.Appointments.Attendees").Preload("TaskList.Appointments").
+		Where("username = ?", "adent").First(&adent).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adent.Calendar.Name != "Improbable Events" {
+		t.Errorf("adent's calendar is %q, want %q", adent.Calendar.Name, "Improbable Events")
+	}
+	if adent.TaskList.Name != "Urgent ToDos" {
+		t.Errorf("adent's task list is %q, want %q", adent.TaskList.Name, "Urgent ToDos")
+	}
+
+	// Both owners keep their ids in owner_id, so owner_type is what tells the calendar's appointments from the task list's
+	if len(adent.Calendar.Appointments) != 2 {
+		t.Fatalf("the calendar has %d appointments, want 2", len(adent.Calendar.Appointments))
+	}
+	for _, appointment := range adent.Calendar.Appointments {
+		if appointment.OwnerType != "calendars" || appointment.OwnerID != adent.Calendar.ID {
+			t.Errorf("%s is owned by %s %d, want calendars %d", appointment.Subject, appointment.OwnerType, appointment.OwnerID, adent.Calendar.ID)
+		}
+		if len(appointment.Attendees) != 3 {
+			t.Errorf("%s has %d attendees, want 3", appointment.Subject, len(appointment.Attendees))
+		}
+	}
+	if len(adent.TaskList.Appointments) != 2 {
+		t.Fatalf("the task list has %d appointments, want 2", len(adent.TaskList.Appointments))
+	}
+	for _, appointment := range adent.TaskList.Appointments {
+		if appointment.OwnerType != "task_lists" {
+			t.Errorf("%s is owned by %s, want task_lists", appointment.Subject, appointment.OwnerType)
+		}
+	}
+}
+
+func TestModelAssociationMethod(t *testing.T) {
+	db := testdb.Open(t)
+	if err := ModelAssociationMethod(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	calendar := Calendar{}
+	if err := db.First(&calendar).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Two to start with, one removed, one created and one moved from the task list
+	if n := db.Model(&calendar).Association("Appointments").Count(); n != 3 {
+		t.Errorf("the calendar's Appointments association counts %d, want 3", n)
+	}
+	if n := testdb.Count(t, db, "appointments", "owner_id IS NULL AND owner_type IS NULL"); n != 1 {
+		t.Errorf("%d appointments without an owner, want the removed one", n)
+	}
+	if n := testdb.Count(t, db, "appointments", "owner_type = ?", "task_lists"); n != 1 {
+		t.Errorf("the task list has %d appointments, want 1", n)
+	}
+}
+
+func TestConcurrentAttendees(t *testing.T) {
+	db := testdb.Open(t)
+	if err := ConcurrentAttendees(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "appoinment_user"); n != 6 {
+		t.Errorf("appoinment_user has %d rows, want one per writer", n)
+	}
+}
+
+func TestRSVP(t *testing.T) {
+	db := testdb.Open(t)
+	if err := RSVP(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "audit_log", "table_name = ? AND actor = ?", "appoinment_user", "zbeeblebrox"); n != 4 {
+		t.Errorf("%d audited attendance changes, want the organizer's invite, marvin's new role and both answers", n)
+	}
+}
+
+func TestAttendance(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	appointment := Appointment{Subject: "Lunch"}
+	if err := db.Create(&appointment).Error; err != nil {
+		t.Fatal(err)
+	}
+	users := []*RelationshipUser{{Username: "arthur"}, {Username: "ford"}, {Username: "trillian"}}
+	for _, user := range users {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	arthur, ford, trillian := users[0], users[1], users[2]
+	associations := NewAssociations(db)
+
+	if err := associations.Invite(ctx, &appointment, Required, arthur, ford); err != nil {
+		t.Fatal(err)
+	}
+	if err := associations.Respond(ctx, &appointment, arthur, Accepted, "Tea, not coffee"); err != nil {
+		t.Fatal(err)
+	}
+	// Inviting again changes the role and keeps the answer
+	if err := associations.Invite(ctx, &appointment, Organizer, arthur); err != nil {
+		t.Fatal(err)
+	}
+	// Added through the many2many tag, trillian gets the column defaults
+	if err := associations.AddAttendees(ctx, &appointment, trillian); err != nil {
+		t.Fatal(err)
+	}
+
+	attendances, err := associations.Attendances(ctx, &appointment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, attendance := range attendances {
+		got = append(got, attendance.User.Username+":"+attendance.Role+":"+attendance.Status)
+	}
+	if want := "arthur:organizer:accepted ford:required:invited trillian:required:invited"; strings.Join(got, " ") != want {
+		t.Errorf("attendances are %s, want %s", strings.Join(got, " "), want)
+	}
+	if attendances[0].RespondedAt == nil || attendances[0].Notes != "Tea, not coffee" {
+		t.Errorf("arthur's answer is %+v, want it timed and with the note", attendances[0])
+	}
+	answered, err := associations.Attendances(ctx, &appointment, Accepted, Declined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answered) != 1 || answered[0].RelationshipUserID != arthur.ID {
+		t.Errorf("filtering by answer found %v, want only arthur", answered)
+	}
+
+	zaphod := RelationshipUser{Username: "zaphod"}
+	if err := db.Create(&zaphod).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := associations.Respond(ctx, &appointment, &zaphod, Accepted, ""); !errors.Is(err, ErrNotInvited) {
+		t.Errorf("an uninvited answer returned %v, want ErrNotInvited", err)
+	}
+	if err := associations.Respond(ctx, &appointment, ford, Invited, ""); err == nil {
+		t.Error("answering invited was accepted")
+	}
+	var invalid validation.ValidationErrors
+	if err := associations.Invite(ctx, &appointment, "heckler", &zaphod); !errors.As(err, &invalid) || invalid.Field("Role") == nil {
+		t.Errorf("inviting as a heckler returned %v, want a ValidationErrors for Role", err)
+	}
+	if err := associations.Invite(ctx, &appointment, Optional, &RelationshipUser{Model: gorm.Model{ID: 999}}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("inviting a missing user returned %v, want ErrNotFound", err)
+	}
+
+	// Soft deleted users drop off the list, as they do from Attendees
+	if err := db.Delete(ford).Error; err != nil {
+		t.Fatal(err)
+	}
+	if attendances, err := associations.Attendances(ctx, &appointment); err != nil || len(attendances) != 2 {
+		t.Errorf("%d attendances after ford was deleted (%v), want 2", len(attendances), err)
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	db := testdb.Open(t)
+	if err := Orphans(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "audit_log", "actor = ? AND operation = ?", "integrity", "delete"); n != 5 {
+		t.Errorf("%d audited deletes, want the task list and the 4 appointments - the calendar cascaded with adent", n)
+	}
+}
+
+func TestPolymorphicIntegrity(t *testing.T) {
+	db := testdb.Open(t)
+	if err := PolymorphicIntegrity(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "appointments", "owner_id IS NULL AND owner_type IS NULL"); n != 4 {
+		t.Errorf("%d appointments were detached, want the 2 inserted with raw SQL and the 2 of the deleted task list", n)
+	}
+}
+
+func TestAssociations(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	if err := BasicRelationships(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	calendar, taskList := Calendar{}, TaskList{}
+	if err := db.First(&calendar).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(&taskList).Error; err != nil {
+		t.Fatal(err)
+	}
+	associations := NewAssociations(db)
+
+	// Replace keeps the one given, creates the new one and takes the calendar's other one away
+	appointments, err := associations.Appointments(ctx, &calendar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := appointments[1]
+	if err := associations.ReplaceAppointments(ctx, &calendar, &kept, &Appointment{Subject: "Pan Galactic Gargle Blaster"}); err != nil {
+		t.Fatal(err)
+	}
+	appointments, err = associations.Appointments(ctx, &calendar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(appointments) != 2 || appointments[0].ID != kept.ID || appointments[1].Subject != "Pan Galactic Gargle Blaster" {
+		t.Errorf("after Replace the calendar has %v, want %s and the new one", appointments, kept.Subject)
+	}
+	if err := associations.ClearAppointments(ctx, &taskList); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving a stale copy only moves it - the subject someone changed since it was loaded stays changed
+	stale := appointments[1]
+	if err := db.Model(&Appointment{}).Where("id = ?", stale.ID).Update("subject", "Hangover").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := associations.AddAppointments(ctx, &taskList, &stale); err != nil {
+		t.Fatal(err)
+	}
+	moved := Appointment{}
+	if err := db.First(&moved, stale.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if moved.Subject != "Hangover" || moved.OwnerType != "task_lists" || moved.OwnerID != taskList.ID {
+		t.Errorf("moved appointment is %q owned by %s %d, want Hangover owned by task_lists %d", moved.Subject, moved.OwnerType, moved.OwnerID, taskList.ID)
+	}
+	if stale.Subject != "Hangover" {
+		t.Errorf("the copy passed in still says %q, want it reloaded", stale.Subject)
+	}
+	if err := associations.ClearAppointments(ctx, &taskList); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := associations.CountAppointments(ctx, &taskList); err != nil || n != 0 {
+		t.Errorf("after Clear the task list has %d appointments (%v), want none", n, err)
+	}
+
+	// Attendees have to exist - Append on its own would create a blank user
+	stranger := RelationshipUser{Username: "agrajag"}
+	if err := associations.AddAttendees(ctx, &kept, &stranger); !errors.Is(err, ErrNotFound) {
+		t.Errorf("adding an unsaved user returned %v, want ErrNotFound", err)
+	}
+	attendees, err := associations.Attendees(ctx, &kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := associations.RemoveAttendees(ctx, &kept, &attendees[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := associations.CountAttendees(ctx, &kept); n != len(attendees)-1 {
+		t.Errorf("%d attendees after removing one of %d", n, len(attendees))
+	}
+	if n := testdb.Count(t, db, "relationship_users", "id = ?", attendees[0].ID); n != 1 {
+		t.Error("removing an attendee deleted the user")
+	}
+	if err := associations.ClearAttendees(ctx, &kept); err != nil {
+		t.Fatal(err)
+	}
+	if n := testdb.Count(t, db, "appoinment_user", "appointment_id = ?", kept.ID); n != 0 {
+		t.Errorf("%d join rows left after Clear", n)
+	}
+
+	// A soft deleted owner is as missing as one that was never there
+	if err := db.Delete(&taskList).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := associations.Appointments(ctx, &TaskList{Model: gorm.Model{ID: taskList.ID}}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("listing a deleted task list's appointments returned %v, want ErrNotFound", err)
+	}
+}
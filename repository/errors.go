@@ -0,0 +1,17 @@
+package repository
+
+import (
+	"errors"
+
+	"github.com/annicaburns/learngorm/softdelete"
+)
+
+// ErrNotFound is returned when no row has the id asked for - check for it with errors.Is
+var ErrNotFound = errors.New("repository: not found")
+
+// ErrConflict is returned when a row would break a unique constraint or primary key, or was changed since it was loaded
+// The *dberrors.ErrUniqueViolation or locking.ErrStaleObject it wraps says which
+var ErrConflict = errors.New("repository: conflict")
+
+// ErrNotSoftDeletable is returned by Trashed, Restore and Purge for models without a DeletedAt field - it's softdelete's, so either name matches
+var ErrNotSoftDeletable = softdelete.ErrNotSoftDeletable
@@ -0,0 +1,309 @@
+package repository
+
+/*
+* A Repository wraps the Create/Save/Updates/Delete calls the crud demos make inline, once for any model
+	* repository.New[crud.CruddyUser2](db) - T is the struct, not a pointer to it
+	* Errors come back as ErrNotFound or ErrConflict so callers don't need to know which database they're on
+	* Constraint violations wrap dberrors' typed errors, which wrap the driver's
+	* Saving a copy of a versioned model that someone else has changed since is a conflict too, wrapping locking.ErrStaleObject
+	* Soft deletes work the way GORM does them - rows of models with gorm.Model are hidden from Get and List until Restore brings them back
+	* Deleting, restoring and purging cascade to the model's children - see the softdelete package
+* Writes are recorded in the audit log against the actor in ctx - see audit.WithActor
+* jinzhu/gorm can't pass a context down to a query, so ctx is only checked before each call
+	* To tie the statements to ctx, run them inside transaction.WithTx and hand the repository the tx with WithDB
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/audit"
+	"github.com/annicaburns/learngorm/dberrors"
+	"github.com/annicaburns/learngorm/locking"
+	"github.com/annicaburns/learngorm/softdelete"
+)
+
+// Repository reads and writes one model
+type Repository[T any] struct {
+	db *gorm.DB
+}
+
+// New returns a repository for the model T
+func New[T any](db *gorm.DB) *Repository[T] {
+	return &Repository[T]{db: db}
+}
+
+// WithDB returns a copy of the repository that uses db - usually a transaction
+func (r *Repository[T]) WithDB(db *gorm.DB) *Repository[T] {
+	return &Repository[T]{db: db}
+}
+
+// Filter is one where clause, in any of the forms GORM's Where accepts
+type Filter struct {
+	Query interface{}
+	Args  []interface{}
+}
+
+// Where builds a Filter - Where("last_name = ?", "Dent"), Where(&CruddyUser2{LastName: "Dent"}) or Where(map[string]interface{}{"last_name": "Dent"})
+func Where(query interface{}, args ...interface{}) Filter {
+	return Filter{Query: query, Args: args}
+}
+
+// ListOptions narrows and orders a List - the zero value lists every row
+type ListOptions struct {
+	// Where filters are ANDed together
+	Where []Filter
+	// Order is applied in turn - e.g. "last_name", "created_at desc"
+	Order []string
+	// Limit of 0 means no limit, and Offset can only be used along with a Limit
+	Limit  int
+	Offset int
+	// WithDeleted includes soft deleted rows
+	WithDeleted bool
+}
+
+// Get finds a row by its primary key
+func (r *Repository[T]) Get(ctx context.Context, id uint) (*T, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	value := new(T)
+	if err := r.db.First(value, id).Error; err != nil {
+		return nil, r.wrap(err, id)
+	}
+	return value, nil
+}
+
+// List finds the rows matching opts
+func (r *Repository[T]) List(ctx context.Context, opts ListOptions) ([]T, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// SQLite can't OFFSET without a LIMIT, and GORM won't write one for MySQL
+	if opts.Offset > 0 && opts.Limit <= 0 {
+		return nil, errors.New("repository: Offset needs a Limit")
+	}
+	scoped := r.filter(opts)
+	for _, order := range opts.Order {
+		scoped = scoped.Order(order)
+	}
+	if opts.Limit > 0 {
+		scoped = scoped.Limit(opts.Limit)
+	}
+	if opts.Offset > 0 {
+		scoped = scoped.Offset(opts.Offset)
+	}
+	values := []T{}
+	if err := scoped.Find(&values).Error; err != nil {
+		return nil, r.wrap(err, 0)
+	}
+	return values, nil
+}
+
+// Count counts the rows matching opts - Order, Limit and Offset are ignored
+func (r *Repository[T]) Count(ctx context.Context, opts ListOptions) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var n int
+	if err := r.filter(opts).Count(&n).Error; err != nil {
+		return 0, r.wrap(err, 0)
+	}
+	return n, nil
+}
+
+// Create inserts value and fills in its ID, CreatedAt and UpdatedAt
+func (r *Repository[T]) Create(ctx context.Context, value *T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := audit.DB(ctx, r.db).Create(value).Error; err != nil {
+		return r.wrap(err, 0)
+	}
+	return nil
+}
+
+// Update saves every field of value, blank ones included
+func (r *Repository[T]) Update(ctx context.Context, value *T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	id, err := r.id(value)
+	if err != nil {
+		return err
+	}
+	// Save quietly inserts a row when nothing matches the primary key - an update of a missing row should fail instead
+	if err := r.exists(id); err != nil {
+		return err
+	}
+	if err := audit.DB(ctx, r.db).Save(value).Error; err != nil {
+		return r.wrap(err, id)
+	}
+	return nil
+}
+
+// UpdateFields changes only the columns in fields, keyed by column name like UpdateRecords' map, and copies them into value
+func (r *Repository[T]) UpdateFields(ctx context.Context, value *T, fields map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	id, err := r.id(value)
+	if err != nil {
+		return err
+	}
+	result := audit.DB(ctx, r.db).Model(value).Updates(fields)
+	if result.Error != nil {
+		return r.wrap(result.Error, id)
+	}
+	// GORM skips the UPDATE when no field changes, so no rows affected doesn't have to mean no row
+	if result.RowsAffected == 0 {
+		return r.exists(id)
+	}
+	return nil
+}
+
+// Delete removes a row by its primary key - a soft delete for models with a DeletedAt field, which takes the row's children with it
+func (r *Repository[T]) Delete(ctx context.Context, id uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var affected int64
+	counts, err := softdelete.Delete(ctx, r.db, new(T), id)
+	switch {
+	case errors.Is(err, softdelete.ErrNotSoftDeletable):
+		result := audit.DB(ctx, r.db).Delete(new(T), id)
+		if result.Error != nil {
+			return r.wrap(result.Error, id)
+		}
+		affected = result.RowsAffected
+	case err != nil:
+		return r.wrap(err, id)
+	default:
+		affected = counts[r.table()]
+	}
+	if affected == 0 {
+		return r.notFound(id)
+	}
+	return nil
+}
+
+// Trashed lists the soft deleted rows matching opts - WithDeleted is implied
+func (r *Repository[T]) Trashed(ctx context.Context, opts ListOptions) ([]T, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	values := []T{}
+	scoped := r.filter(opts)
+	for _, order := range opts.Order {
+		scoped = scoped.Order(order)
+	}
+	if err := softdelete.Trashed(ctx, scoped, &values); err != nil {
+		return nil, r.wrap(err, 0)
+	}
+	return values, nil
+}
+
+// Restore brings back a soft deleted row, and the children that were deleted along with it
+func (r *Repository[T]) Restore(ctx context.Context, id uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	counts, err := softdelete.Restore(ctx, r.db, new(T), id)
+	if err != nil {
+		return r.wrap(err, id)
+	}
+	if counts[r.table()] == 0 {
+		return r.notFound(id)
+	}
+	return nil
+}
+
+// RestoreWhere brings back every soft deleted row matching the filters, with their children, and returns how many rows of T came back
+func (r *Repository[T]) RestoreWhere(ctx context.Context, filters ...Filter) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	counts, err := softdelete.Restore(ctx, r.filter(ListOptions{Where: filters}), new(T))
+	if err != nil {
+		return 0, r.wrap(err, 0)
+	}
+	return counts[r.table()], nil
+}
+
+// Purge permanently deletes the rows soft deleted before cutoff, with their deleted children, and returns how many rows of T went
+// It fails with softdelete.ErrLiveChildren, and purges nothing, if one of those rows has children that aren't deleted
+func (r *Repository[T]) Purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	counts, err := softdelete.Purge(ctx, r.db, new(T), cutoff)
+	if err != nil {
+		return 0, r.wrap(err, 0)
+	}
+	return counts[r.table()], nil
+}
+
+// filter applies the Where filters and WithDeleted, scoped to T's table
+func (r *Repository[T]) filter(opts ListOptions) *gorm.DB {
+	scoped := r.db.Model(new(T))
+	if opts.WithDeleted {
+		scoped = scoped.Unscoped()
+	}
+	for _, filter := range opts.Where {
+		scoped = scoped.Where(filter.Query, filter.Args...)
+	}
+	return scoped
+}
+
+// id reads value's primary key - a blank one can't match a row
+func (r *Repository[T]) id(value *T) (uint, error) {
+	scope := r.db.NewScope(value)
+	if scope.PrimaryKeyZero() {
+		return 0, r.notFound(0)
+	}
+	id, ok := scope.PrimaryKeyValue().(uint)
+	if !ok {
+		return 0, fmt.Errorf("repository: %s has a %T primary key, want uint", scope.TableName(), scope.PrimaryKeyValue())
+	}
+	return id, nil
+}
+
+// exists returns ErrNotFound unless a row that isn't soft deleted has the id
+func (r *Repository[T]) exists(id uint) error {
+	n, err := r.Count(context.Background(), ListOptions{Where: []Filter{Where(r.db.NewScope(new(T)).PrimaryKey()+" = ?", id)}})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return r.notFound(id)
+	}
+	return nil
+}
+
+func (r *Repository[T]) notFound(id uint) error {
+	return fmt.Errorf("%s %d: %w", r.table(), id, ErrNotFound)
+}
+
+func (r *Repository[T]) table() string {
+	return r.db.NewScope(new(T)).TableName()
+}
+
+// wrap turns GORM, driver and locking errors into ErrNotFound, ErrConflict and dberrors' types, and names the table for anything else
+func (r *Repository[T]) wrap(err error, id uint) error {
+	// Most errors are classified already by dberrors' callbacks, but the softdelete calls use Exec
+	err = dberrors.Classify(err)
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return r.notFound(id)
+	case errors.Is(err, &dberrors.ErrUniqueViolation{}), errors.Is(err, locking.ErrStaleObject):
+		return fmt.Errorf("%s: %w: %w", r.table(), ErrConflict, err)
+	case errors.Is(err, ErrNotSoftDeletable):
+		return err
+	default:
+		return fmt.Errorf("%s: %w", r.table(), err)
+	}
+}
@@ -0,0 +1,270 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/annicaburns/learngorm/crud"
+	"github.com/annicaburns/learngorm/dbSchema"
+	"github.com/annicaburns/learngorm/locking"
+	"github.com/annicaburns/learngorm/query"
+	"github.com/annicaburns/learngorm/repository"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+func TestCRUD(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	users := repository.New[crud.CruddyUser2](db)
+
+	user := crud.CruddyUser2{FirstName: "Arthur", LastName: "Dent"}
+	if err := users.Create(ctx, &user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == 0 {
+		t.Fatal("Create didn't fill in the ID")
+	}
+
+	user.FirstName = "Zaphod"
+	user.LastName = ""
+	if err := users.Update(ctx, &user); err != nil {
+		t.Fatal(err)
+	}
+	got, err := users.Get(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstName != "Zaphod" || got.LastName != "" {
+		t.Errorf("after Update got %s %q, want Zaphod with the blank last name saved", got.FirstName, got.LastName)
+	}
+
+	if err := users.UpdateFields(ctx, got, map[string]interface{}{"last_name": "Beeblebrox"}); err != nil {
+		t.Fatal(err)
+	}
+	// Setting the same values again changes nothing but is still fine
+	if err := users.UpdateFields(ctx, got, map[string]interface{}{"last_name": "Beeblebrox"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := users.Get(ctx, user.ID); got.LastName != "Beeblebrox" {
+		t.Errorf("after UpdateFields the last name is %q, want Beeblebrox", got.LastName)
+	}
+
+	if err := users.Delete(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Get(ctx, user.ID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Get of a soft deleted user returned %v, want ErrNotFound", err)
+	}
+	if n, _ := users.Count(ctx, repository.ListOptions{WithDeleted: true}); n != 1 {
+		t.Errorf("counted %d users with the deleted ones, want 1", n)
+	}
+	if err := users.Delete(ctx, user.ID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("deleting twice returned %v, want ErrNotFound", err)
+	}
+
+	if err := users.Restore(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Get(ctx, user.ID); err != nil {
+		t.Errorf("Get after Restore: %v", err)
+	}
+	if err := users.Restore(ctx, user.ID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("restoring a row that isn't deleted returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	users := repository.New[crud.CruddyUser](db)
+
+	if _, err := users.Get(ctx, 42); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Get returned %v, want ErrNotFound", err)
+	}
+	missing := crud.CruddyUser{FirstName: "Nobody"}
+	missing.ID = 42
+	// Save would have inserted this one
+	if err := users.Update(ctx, &missing); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Update returned %v, want ErrNotFound", err)
+	}
+	if n := testdb.Count(t, db, "cruddy_users"); n != 0 {
+		t.Errorf("Update inserted %d rows", n)
+	}
+	if err := users.UpdateFields(ctx, &missing, map[string]interface{}{"first_name": "Somebody"}); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UpdateFields returned %v, want ErrNotFound", err)
+	}
+	if err := users.Delete(ctx, 42); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Delete returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestRestoreWithoutDeletedAt(t *testing.T) {
+	db := testdb.Open(t)
+	users := repository.New[crud.CruddyUser4](db)
+	if err := users.Restore(context.Background(), 1); !errors.Is(err, repository.ErrNotSoftDeletable) {
+		t.Errorf("Restore returned %v, want ErrNotSoftDeletable", err)
+	}
+}
+
+func TestCanceled(t *testing.T) {
+	db := testdb.Open(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	users := repository.New[crud.CruddyUser](db)
+
+	if _, err := users.Get(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Get returned %v, want context.Canceled", err)
+	}
+	if err := users.Restore(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Restore returned %v, want context.Canceled", err)
+	}
+	if _, err := users.RestoreWhere(ctx, repository.Where("first_name = ?", "Arthur")); !errors.Is(err, context.Canceled) {
+		t.Errorf("RestoreWhere returned %v, want context.Canceled", err)
+	}
+	if _, err := users.Purge(ctx, time.Now()); !errors.Is(err, context.Canceled) {
+		t.Errorf("Purge returned %v, want context.Canceled", err)
+	}
+}
+
+func TestTrashAndPurge(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	users := repository.New[crud.CruddyUser](db)
+
+	for _, first := range []string{"Arthur", "Ford", "Tricia"} {
+		user := crud.CruddyUser{FirstName: first, Appointments: []crud.CruddyAppointment{{Subject: first + "'s lunch"}}}
+		if err := users.Create(ctx, &user); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.Delete(ctx, user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := testdb.Count(t, db, "cruddy_appointments", "deleted_at IS NULL"); n != 0 {
+		t.Errorf("Delete left %d appointments behind", n)
+	}
+
+	trashed, err := users.Trashed(ctx, repository.ListOptions{Order: []string{"first_name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trashed) != 3 || trashed[0].FirstName != "Arthur" {
+		t.Errorf("trashed %v, want all three with Arthur first", trashed)
+	}
+
+	n, err := users.RestoreWhere(ctx, repository.Where("first_name IN (?)", []string{"Ford", "Tricia"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("restored %d users, want 2", n)
+	}
+	if n, err = users.Purge(ctx, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("purged %d users, want Arthur", n)
+	}
+	if n := testdb.Count(t, db, "cruddy_appointments"); n != 2 {
+		t.Errorf("%d appointments left, want Ford's and Tricia's", n)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	users := repository.New[dbSchema.BasicUser](db)
+
+	if err := users.Create(ctx, &dbSchema.BasicUser{Username: "adent", FirstName: "Arthur", LastName: "Dent"}); err != nil {
+		t.Fatal(err)
+	}
+	// LastName is unique
+	err := users.Create(ctx, &dbSchema.BasicUser{Username: "fdent", FirstName: "Fenchurch", LastName: "Dent"})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("a second Dent returned %v, want ErrConflict", err)
+	}
+}
+
+func TestStaleObject(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	users := repository.New[crud.CruddyUser2](db)
+
+	user := crud.CruddyUser2{FirstName: "Arthur", LastName: "Dent"}
+	if err := users.Create(ctx, &user); err != nil {
+		t.Fatal(err)
+	}
+	mine, err := users.Get(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := users.Get(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.UpdateFields(ctx, theirs, map[string]interface{}{"last_name": "Beeblebrox"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// CruddyUser2 has a Version, so the copy loaded before their change is stale
+	mine.FirstName = "Zaphod"
+	err = users.Update(ctx, mine)
+	if !errors.Is(err, repository.ErrConflict) || !errors.Is(err, locking.ErrStaleObject) {
+		t.Errorf("Update of a stale copy returned %v, want ErrConflict wrapping ErrStaleObject", err)
+	}
+	err = users.UpdateFields(ctx, mine, map[string]interface{}{"first_name": "Zaphod"})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("UpdateFields of a stale copy returned %v, want ErrConflict", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	if err := query.SeedDB(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	appointments := repository.New[query.AppointmentQuery](db)
+
+	page, err := appointments.List(ctx, repository.ListOptions{
+		Where:  []repository.Filter{repository.Where("length >= ?", 30)},
+		Order:  []string{"length desc", "subject"},
+		Limit:  2,
+		Offset: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 240, then the two 60s by subject, then 30 - the page skips the first
+	want := []string{"Hitch a ride", "Save House"}
+	if len(page) != len(want) {
+		t.Fatalf("got %d appointments, want %d", len(page), len(want))
+	}
+	for i := range want {
+		if page[i].Subject != want[i] {
+			t.Errorf("appointment %d is %q, want %q", i, page[i].Subject, want[i])
+		}
+	}
+
+	n, err := appointments.Count(ctx, repository.ListOptions{Where: []repository.Filter{repository.Where(&query.AppointmentQuery{Length: 60})}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("counted %d hour long appointments, want 2", n)
+	}
+
+	users := repository.New[query.UserQuery](db)
+	if _, err := users.List(ctx, repository.ListOptions{Offset: 2}); err == nil {
+		t.Error("listing with an Offset and no Limit worked, want an error")
+	}
+	found, err := users.List(ctx, repository.ListOptions{Where: []repository.Filter{repository.Where(map[string]interface{}{"username": "fprefect"})}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].FirstName != "Ford" {
+		t.Errorf("found %v, want Ford", found)
+	}
+}
@@ -0,0 +1,71 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/annicaburns/learngorm/dialect"
+)
+
+// DDL renders the CREATE TABLE, CREATE INDEX and FK statements for the models in the named dialect
+// Nothing needs to be connected - the statements are built the way GORM's CreateTable would build them, but written out instead of run
+// The migrations are still the schema of record - they can be stricter than the model tags, like varchar(255) where GORM writes text for Postgres
+func DDL(dialectName string, models ...interface{}) (string, error) {
+	db, err := dialect.Offline(dialectName)
+	if err != nil {
+		return "", err
+	}
+	d := dialect.Of(db)
+	tables := Describe(db, models...)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "-- %s schema for the learngorm models, generated by learngorm schema ddl\n", d.Name())
+	deferred := []string{}
+	for _, table := range tables {
+		fmt.Fprintf(b, "\n-- %s\n", table.Model)
+		lines := []string{}
+		primaryKeys := []string{}
+		inlinePrimaryKey := false
+		for _, c := range table.Columns {
+			lines = append(lines, d.Quote(c.Name)+" "+c.Type)
+			if c.PrimaryKey {
+				primaryKeys = append(primaryKeys, d.Quote(c.Name))
+			}
+			// Like GORM's createTable, don't add a PRIMARY KEY clause if the column type already has one
+			if strings.Contains(strings.ToLower(c.Type), "primary key") {
+				inlinePrimaryKey = true
+			}
+		}
+		if len(primaryKeys) > 0 && !inlinePrimaryKey {
+			lines = append(lines, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(primaryKeys, ", ")))
+		}
+		for _, fk := range table.ForeignKeys {
+			dest := fmt.Sprintf("%s(%s)", d.Quote(fk.RefTable), d.Quote(fk.RefColumn))
+			// ON DELETE/UPDATE CASCADE matches the constraint the relationships demo adds
+			if stmt, ok := d.ForeignKeySQL(table.Name, fk.Name, fk.Column, dest, "CASCADE", "CASCADE"); ok {
+				deferred = append(deferred, stmt)
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s ON DELETE CASCADE ON UPDATE CASCADE",
+				d.Quote(fk.Name), d.Quote(fk.Column), dest))
+		}
+		fmt.Fprintf(b, "CREATE TABLE %s (\n    %s\n);\n", d.Quote(table.Name), strings.Join(lines, ",\n    "))
+
+		for _, index := range table.Indexes {
+			create := "CREATE INDEX"
+			if index.Unique {
+				create = "CREATE UNIQUE INDEX"
+			}
+			fmt.Fprintf(b, "%s %s ON %s(%s);\n", create, d.Quote(index.Name), d.Quote(table.Name), quoteAll(d, index.Columns))
+		}
+	}
+
+	// Added once every table exists, so the tables can be created in any order
+	if len(deferred) > 0 {
+		fmt.Fprintf(b, "\n-- Foreign keys\n")
+		for _, stmt := range deferred {
+			fmt.Fprintf(b, "%s;\n", stmt)
+		}
+	}
+	return b.String(), nil
+}
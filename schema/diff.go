@@ -0,0 +1,286 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/dialect"
+)
+
+// Kinds of Difference
+const (
+	MissingTable    = "missing table"
+	MissingColumn   = "missing column"
+	ExtraColumn     = "extra column"
+	TypeMismatch    = "type mismatch"
+	NullMismatch    = "nullability mismatch"
+	MissingIndex    = "missing index"
+	ExtraIndex      = "extra index"
+	DuplicateUnique = "duplicate unique index"
+)
+
+// Difference is one way the database disagrees with the models
+type Difference struct {
+	Table  string
+	Column string
+	Kind   string
+	// Expected is what the models say, Actual is what the database has
+	Expected string
+	Actual   string
+	// Fix is the SQL that would reconcile the database with the models
+	// Empty when there is nothing to do (an extra column might hold data the models don't know about), or a -- comment when the database can't do it for us
+	Fix string
+}
+
+func (d Difference) String() string {
+	where := d.Table
+	if d.Column != "" {
+		where += "." + d.Column
+	}
+	s := fmt.Sprintf("%s: %s", where, d.Kind)
+	switch {
+	case d.Expected != "" && d.Actual != "":
+		s += fmt.Sprintf(" - model has %s, database has %s", d.Expected, d.Actual)
+	case d.Expected != "":
+		s += " - model has " + d.Expected
+	case d.Actual != "":
+		s += " - database has " + d.Actual
+	}
+	return s
+}
+
+// Diff compares the tables the models describe with the ones in the database
+func Diff(db *gorm.DB, models ...interface{}) ([]Difference, error) {
+	d := dialect.Of(db)
+	diffs := []Difference{}
+	for _, expected := range Describe(db, models...) {
+		actual, ok, err := Inspect(db, expected.Name)
+		if err != nil {
+			return diffs, fmt.Errorf("inspecting %s: %w", expected.Name, err)
+		}
+		if !ok {
+			diffs = append(diffs, Difference{
+				Table:    expected.Name,
+				Kind:     MissingTable,
+				Expected: expected.Model,
+				Fix:      fmt.Sprintf("-- add a migration that creates %s", expected.Name),
+			})
+			continue
+		}
+		diffs = append(diffs, diffColumns(d, expected, actual)...)
+		diffs = append(diffs, diffIndexes(d, expected, actual)...)
+	}
+	return diffs, nil
+}
+
+func diffColumns(d dialect.Dialect, expected, actual Table) []Difference {
+	diffs := []Difference{}
+	for _, want := range expected.Columns {
+		got, ok := actual.column(want.Name)
+		if !ok {
+			diffs = append(diffs, Difference{
+				Table:    expected.Name,
+				Column:   want.Name,
+				Kind:     MissingColumn,
+				Expected: want.Type,
+				Fix:      fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", d.Quote(expected.Name), d.Quote(want.Name), withoutUnique(want.Type)),
+			})
+			continue
+		}
+		if want.BaseType != got.BaseType {
+			diffs = append(diffs, Difference{
+				Table:    expected.Name,
+				Column:   want.Name,
+				Kind:     TypeMismatch,
+				Expected: want.BaseType,
+				Actual:   got.BaseType,
+				Fix:      modifyColumn(d, expected.Name, want),
+			})
+		}
+		// Only a database that is looser than the model is reported - a NOT NULL column the model doesn't insist on is usually deliberate
+		if want.NotNull && !got.NotNull {
+			diffs = append(diffs, Difference{
+				Table:    expected.Name,
+				Column:   want.Name,
+				Kind:     NullMismatch,
+				Expected: "NOT NULL",
+				Actual:   "NULL",
+				Fix:      modifyColumn(d, expected.Name, want),
+			})
+		}
+	}
+	for _, got := range actual.Columns {
+		if _, ok := expected.column(got.Name); !ok {
+			diffs = append(diffs, Difference{Table: expected.Name, Column: got.Name, Kind: ExtraColumn, Actual: got.Type})
+		}
+	}
+	return diffs
+}
+
+// withoutUnique drops UNIQUE from a column definition - the unique index is reported as missing and created on its own, and SQLite can't add a UNIQUE column anyway
+func withoutUnique(typ string) string {
+	return strings.Replace(typ, " UNIQUE", "", 1)
+}
+
+func modifyColumn(d dialect.Dialect, table string, want Column) string {
+	if stmt, ok := d.ModifyColumnSQL(table, want.Name, want.Type); ok {
+		return stmt
+	}
+	return fmt.Sprintf("-- %s can't change %s in place: rebuild %s with %s %s", d.Name(), want.Name, table, want.Name, want.Type)
+}
+
+func diffIndexes(d dialect.Dialect, expected, actual Table) []Difference {
+	diffs := []Difference{}
+	has := func(columns []string, unique bool) bool {
+		for _, index := range actual.Indexes {
+			if sameColumns(index.Columns, columns) && (index.Unique || !unique) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, want := range expected.Indexes {
+		found := false
+		for _, got := range actual.Indexes {
+			if got.Name == want.Name {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		create := "CREATE INDEX"
+		if want.Unique {
+			create = "CREATE UNIQUE INDEX"
+		}
+		diffs = append(diffs, Difference{
+			Table:    expected.Name,
+			Kind:     MissingIndex,
+			Expected: fmt.Sprintf("%s(%s)", want.Name, strings.Join(want.Columns, ", ")),
+			Fix:      fmt.Sprintf("%s %s ON %s(%s)", create, d.Quote(want.Name), d.Quote(expected.Name), quoteAll(d, want.Columns)),
+		})
+	}
+
+	// A sql:"unique" column only needs some unique index on it - the database picks the name
+	for _, want := range expected.Columns {
+		if want.Unique && !has([]string{want.Name}, true) {
+			name := "uix_" + expected.Name + "_" + want.Name
+			diffs = append(diffs, Difference{
+				Table:    expected.Name,
+				Column:   want.Name,
+				Kind:     MissingIndex,
+				Expected: "UNIQUE",
+				Fix:      fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s(%s)", d.Quote(name), d.Quote(expected.Name), d.Quote(want.Name)),
+			})
+		}
+		// Both tags on one field build two unique indexes on the same column - see BasicUser.LastName
+		if want.Unique {
+			for _, index := range expected.Indexes {
+				if index.Unique && sameColumns(index.Columns, []string{want.Name}) {
+					diffs = append(diffs, Difference{
+						Table:    expected.Name,
+						Column:   want.Name,
+						Kind:     DuplicateUnique,
+						Expected: fmt.Sprintf(`sql:"unique" and unique_index %s`, index.Name),
+						Fix:      fmt.Sprintf("-- drop either the unique or the unique_index tag from %s.%s", expected.Model, want.Field),
+					})
+				}
+			}
+		}
+	}
+
+	for _, got := range actual.Indexes {
+		if !got.Primary && !expectsIndex(expected, got) {
+			diffs = append(diffs, Difference{
+				Table:  expected.Name,
+				Kind:   ExtraIndex,
+				Actual: fmt.Sprintf("%s(%s)", got.Name, strings.Join(got.Columns, ", ")),
+			})
+		}
+	}
+	return append(diffs, duplicateUniques(d, actual)...)
+}
+
+// duplicateUniques finds unique indexes that cover exactly the same columns - every one after the first is wasted work on insert
+// The one to keep is the constraint the database built itself, rather than a uix_ index added on top of it
+func duplicateUniques(d dialect.Dialect, actual Table) []Difference {
+	groups := map[string][]dialect.Index{}
+	keys := []string{}
+	for _, index := range actual.Indexes {
+		if !index.Unique || index.Primary {
+			continue
+		}
+		key := strings.ToLower(strings.Join(index.Columns, ","))
+		if groups[key] == nil {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], index)
+	}
+	sort.Strings(keys)
+
+	diffs := []Difference{}
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		sort.SliceStable(group, func(i, j int) bool { return builtIn(group[i]) && !builtIn(group[j]) })
+		for _, extra := range group[1:] {
+			diffs = append(diffs, Difference{
+				Table:  actual.Name,
+				Column: strings.Join(extra.Columns, ", "),
+				Kind:   DuplicateUnique,
+				Actual: group[0].Name + " and " + extra.Name,
+				Fix:    d.DropIndexSQL(actual.Name, extra.Name),
+			})
+		}
+	}
+	return diffs
+}
+
+// builtIn reports whether the database named the index itself for a UNIQUE constraint
+func builtIn(index dialect.Index) bool {
+	return !strings.HasPrefix(index.Name, "uix_") && !strings.HasPrefix(index.Name, "idx_")
+}
+
+func expectsIndex(expected Table, got dialect.Index) bool {
+	for _, want := range expected.Indexes {
+		if want.Name == got.Name {
+			return true
+		}
+	}
+	return got.Unique && expectsUnique(expected, got.Columns)
+}
+
+func expectsUnique(expected Table, columns []string) bool {
+	if len(columns) != 1 {
+		return false
+	}
+	c, ok := expected.column(columns[0])
+	return ok && c.Unique
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func quoteAll(d dialect.Dialect, names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = d.Quote(name)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,191 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/dialect"
+)
+
+// Actions are what a FK constraint does to the child rows when their parent row is deleted, or its key is changed
+type Actions struct {
+	// CASCADE, SET NULL, SET DEFAULT, RESTRICT or NO ACTION - CASCADE when blank
+	OnDelete string
+	OnUpdate string
+}
+
+// ForeignKeyOptions say how AddForeignKeys builds the constraints
+type ForeignKeyOptions struct {
+	// Actions apply to every constraint without an Override
+	Actions Actions
+	// Override sets the actions for single constraints, keyed by the child's table.column - e.g. "appoinment_user.relationship_user_id"
+	Override map[string]Actions
+	// DryRun reports what would be added without running anything
+	DryRun bool
+}
+
+// Outcomes of AddForeignKeys, one per constraint
+const (
+	FKAdded       = "added"
+	FKWouldAdd    = "would add"
+	FKExists      = "exists"
+	FKActionsDiff = "exists with other actions"
+	FKUnsupported = "can't add"
+)
+
+// ForeignKeyResult says what AddForeignKeys did about one constraint
+type ForeignKeyResult struct {
+	Table string
+	ForeignKey
+	Actions Actions
+	Outcome string
+	// SQL is the statement run (or that would be), or a -- comment saying what to do by hand
+	SQL string
+	// Existing is the constraint already there, for FKExists and FKActionsDiff
+	Existing *dialect.ForeignKey
+}
+
+func (r ForeignKeyResult) String() string {
+	s := fmt.Sprintf("%s.%s -> %s(%s): %s", r.Table, r.Column, r.RefTable, r.RefColumn, r.Outcome)
+	if r.Outcome == FKActionsDiff {
+		s += fmt.Sprintf(" - models want ON DELETE %s ON UPDATE %s, database has ON DELETE %s ON UPDATE %s",
+			r.Actions.OnDelete, r.Actions.OnUpdate, r.Existing.OnDelete, r.Existing.OnUpdate)
+	}
+	return s
+}
+
+// actions picks the actions for one constraint
+func (o ForeignKeyOptions) actions(table, column string) Actions {
+	if override, ok := o.Override[table+"."+column]; ok {
+		return override.normalize()
+	}
+	return o.Actions.normalize()
+}
+
+// normalize upper cases the actions and fills in the CASCADE default
+func (a Actions) normalize() Actions {
+	a.OnDelete = strings.ToUpper(strings.TrimSpace(a.OnDelete))
+	a.OnUpdate = strings.ToUpper(strings.TrimSpace(a.OnUpdate))
+	if a.OnDelete == "" {
+		a.OnDelete = "CASCADE"
+	}
+	if a.OnUpdate == "" {
+		a.OnUpdate = "CASCADE"
+	}
+	return a
+}
+
+// check rejects actions that aren't SQL's - they're written into the statement as they are
+func (a Actions) check(what string) error {
+	a = a.normalize()
+	for _, action := range []string{a.OnDelete, a.OnUpdate} {
+		if !validActions[action] {
+			return fmt.Errorf("schema: unknown foreign key action %q for %s", action, what)
+		}
+	}
+	return nil
+}
+
+// validActions are the only words that go into the statement - they can't be bound as parameters
+var validActions = map[string]bool{"CASCADE": true, "SET NULL": true, "SET DEFAULT": true, "RESTRICT": true, "NO ACTION": true}
+
+// AddForeignKeys adds the FK constraints Describe finds in the models' relationships, skipping the ones the database has already
+// A constraint counts as there when the column already references the same table and column, whatever it's called
+// One that's there with other actions is reported, not replaced - dropping it is a decision for a migration
+// SQLite can't add a constraint to an existing table, so there the missing ones come back as FKUnsupported
+// Adding a constraint fails if rows already break it - the first failure stops the pass, with the results so far
+func AddForeignKeys(ctx context.Context, db *gorm.DB, opts ForeignKeyOptions, models ...interface{}) ([]ForeignKeyResult, error) {
+	if err := opts.Actions.check("every foreign key"); err != nil {
+		return nil, err
+	}
+	for key, a := range opts.Override {
+		if !strings.Contains(key, ".") {
+			return nil, fmt.Errorf("schema: foreign key override %q needs to be table.column", key)
+		}
+		if err := a.check(key); err != nil {
+			return nil, err
+		}
+	}
+
+	tables := Describe(db, models...)
+	for key := range opts.Override {
+		if !implied(tables, key) {
+			return nil, fmt.Errorf("schema: no relationship implies a foreign key on %s", key)
+		}
+	}
+
+	d := dialect.Of(db)
+	results := []ForeignKeyResult{}
+	for _, table := range tables {
+		if len(table.ForeignKeys) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		existing, err := d.ForeignKeys(db, table.Name)
+		if err != nil {
+			return results, fmt.Errorf("schema: reading the foreign keys of %s: %w", table.Name, err)
+		}
+
+		for _, fk := range table.ForeignKeys {
+			result := ForeignKeyResult{Table: table.Name, ForeignKey: fk, Actions: opts.actions(table.Name, fk.Column)}
+			if found := findForeignKey(existing, fk); found != nil {
+				result.Existing = found
+				result.Outcome = FKExists
+				if found.OnDelete != result.Actions.OnDelete || found.OnUpdate != result.Actions.OnUpdate {
+					result.Outcome = FKActionsDiff
+				}
+				results = append(results, result)
+				continue
+			}
+
+			dest := fmt.Sprintf("%s(%s)", d.Quote(fk.RefTable), d.Quote(fk.RefColumn))
+			stmt, ok := d.ForeignKeySQL(table.Name, fk.Name, fk.Column, dest, result.Actions.OnDelete, result.Actions.OnUpdate)
+			switch {
+			case !ok:
+				result.Outcome = FKUnsupported
+				result.SQL = fmt.Sprintf("-- declare FOREIGN KEY (%s) REFERENCES %s ON DELETE %s ON UPDATE %s in a migration that rebuilds %s",
+					fk.Column, dest, result.Actions.OnDelete, result.Actions.OnUpdate, table.Name)
+			case opts.DryRun:
+				result.Outcome, result.SQL = FKWouldAdd, stmt
+			default:
+				result.SQL = stmt
+				if err := db.Exec(stmt).Error; err != nil {
+					return results, fmt.Errorf("schema: adding %s: %w", fk.Name, err)
+				}
+				result.Outcome = FKAdded
+			}
+			results = append(results, result)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Table < results[j].Table })
+	return results, nil
+}
+
+// implied reports whether table.column is the child side of one of the tables' foreign keys
+func implied(tables []Table, key string) bool {
+	for _, table := range tables {
+		for _, fk := range table.ForeignKeys {
+			if table.Name+"."+fk.Column == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findForeignKey matches on what the constraint does rather than its name - SQLite has no names, and one added by hand may have any
+func findForeignKey(existing []dialect.ForeignKey, want ForeignKey) *dialect.ForeignKey {
+	for i, fk := range existing {
+		if strings.EqualFold(fk.Column, want.Column) && strings.EqualFold(fk.RefTable, want.RefTable) &&
+			(fk.RefColumn == "" || strings.EqualFold(fk.RefColumn, want.RefColumn)) {
+			return &existing[i]
+		}
+	}
+	return nil
+}
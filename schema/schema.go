@@ -0,0 +1,293 @@
+package schema
+
+/*
+* GORM reads the model structs to decide what SQL to write - but nothing checks the database still agrees with them
+	* Describe reads the same metadata GORM does: column types from the sql/gorm tags, NOT NULL, UNIQUE, INDEX and UNIQUE_INDEX, plus many2many join tables
+	* It also works out the FK constraints GORM never adds on its own, from the has-one, has-many, belongs-to and many2many relationships between the models
+	* Inspect reads what the database actually has, through the dialect package
+	* Diff compares the two and suggests the SQL to bring the database back in line with the models
+	* AddForeignKeys adds the FK constraints Describe finds and the database doesn't have yet, with the ON DELETE/ON UPDATE actions asked for
+* The suggestions are there to be read and edited into a migration, not run blindly - the models aren't always the ones that are right
+*/
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/dialect"
+)
+
+// Table is a table as the models describe it, or as the database reports it
+type Table struct {
+	Name    string
+	Model   string
+	Columns []Column
+	Indexes []dialect.Index
+	// ForeignKeys are only filled in by Describe
+	ForeignKeys []ForeignKey
+}
+
+// ForeignKey is a FK constraint implied by a relationship - polymorphic ones are left out, their owner could be in any of several tables
+type ForeignKey struct {
+	Name      string
+	Column    string
+	RefTable  string
+	RefColumn string
+}
+
+// Column is one column of a Table
+type Column struct {
+	Name string
+	// Field is the Go struct field the column comes from
+	Field string
+	// Type is the full column definition GORM would write - e.g. varchar(100) NOT NULL DEFAULT 'Annica'
+	Type string
+	// BaseType is Type without the constraints, normalized by the dialect so it can be compared
+	BaseType   string
+	NotNull    bool
+	Unique     bool
+	PrimaryKey bool
+}
+
+// column finds a column by name - MySQL column names aren't case sensitive, so neither is this
+func (t Table) column(name string) (Column, bool) {
+	for _, c := range t.Columns {
+		if strings.EqualFold(c.Name, name) {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+// Describe returns the tables GORM would create for the models - each model's own table, followed by its join tables
+func Describe(db *gorm.DB, models ...interface{}) []Table {
+	d := dialect.Of(db)
+	tables := []Table{}
+	seen := map[string]int{}
+	// A join table can have a model of its own, with more columns than the keys - like relationships.Attendance - and then the model wins
+	joinTables := map[string]bool{}
+	add := func(t Table, join bool) {
+		i, ok := seen[t.Name]
+		switch {
+		case !ok:
+			seen[t.Name] = len(tables)
+			joinTables[t.Name] = join
+			tables = append(tables, t)
+		case joinTables[t.Name] && !join:
+			joinTables[t.Name] = false
+			tables[i] = t
+		}
+	}
+
+	for _, model := range models {
+		scope := db.NewScope(model)
+		ms := scope.GetModelStruct()
+		table := Table{Name: scope.TableName(), Model: ms.ModelType.Name()}
+		indexes := map[string]*dialect.Index{}
+		addIndex := func(name, column string, unique bool) {
+			if indexes[name] == nil {
+				indexes[name] = &dialect.Index{Name: name, Unique: unique}
+			}
+			indexes[name].Columns = append(indexes[name].Columns, column)
+		}
+
+		for _, field := range ms.StructFields {
+			if field.IsNormal {
+				table.Columns = append(table.Columns, describeColumn(db, d, field))
+			}
+			// Index names follow the same rules as GORM's autoIndex - a bare tag gets idx_<table>_<column> or uix_<table>_<column>
+			if names, ok := field.TagSettingsGet("INDEX"); ok {
+				for _, name := range strings.Split(names, ",") {
+					if name == "INDEX" || name == "" {
+						name = db.Dialect().BuildKeyName("idx", table.Name, field.DBName)
+					}
+					addIndex(name, field.DBName, false)
+				}
+			}
+			if names, ok := field.TagSettingsGet("UNIQUE_INDEX"); ok {
+				for _, name := range strings.Split(names, ",") {
+					if name == "UNIQUE_INDEX" || name == "" {
+						name = db.Dialect().BuildKeyName("uix", table.Name, field.DBName)
+					}
+					addIndex(name, field.DBName, true)
+				}
+			}
+		}
+		for _, index := range indexes {
+			table.Indexes = append(table.Indexes, *index)
+		}
+		sort.Slice(table.Indexes, func(i, j int) bool { return table.Indexes[i].Name < table.Indexes[j].Name })
+		add(table, false)
+
+		for _, field := range ms.StructFields {
+			if rel := field.Relationship; rel != nil && rel.Kind == "many_to_many" && rel.JoinTableHandler != nil {
+				add(describeJoinTable(db, d, scope, field), true)
+			}
+		}
+	}
+
+	// Constraints go on whichever table holds the key, which isn't always the model that declares the relationship
+	byName := map[string]*Table{}
+	for i := range tables {
+		byName[tables[i].Name] = &tables[i]
+	}
+	addKey := func(table, column, refTable, refColumn string) {
+		t, ok := byName[table]
+		if !ok || byName[refTable] == nil {
+			return
+		}
+		name := db.Dialect().BuildKeyName(table, column, refTable+"("+refColumn+")", "foreign")
+		for _, fk := range t.ForeignKeys {
+			if fk.Name == name {
+				return
+			}
+		}
+		t.ForeignKeys = append(t.ForeignKeys, ForeignKey{Name: name, Column: column, RefTable: refTable, RefColumn: refColumn})
+	}
+	for _, model := range models {
+		scope := db.NewScope(model)
+		for _, field := range scope.GetModelStruct().StructFields {
+			rel := field.Relationship
+			if rel == nil || rel.PolymorphicType != "" {
+				continue
+			}
+			other := db.NewScope(reflect.New(field.Struct.Type).Interface())
+			switch rel.Kind {
+			case "has_one", "has_many":
+				for i := range rel.ForeignDBNames {
+					addKey(other.TableName(), rel.ForeignDBNames[i], scope.TableName(), rel.AssociationForeignDBNames[i])
+				}
+			case "belongs_to":
+				for i := range rel.ForeignDBNames {
+					addKey(scope.TableName(), rel.ForeignDBNames[i], other.TableName(), rel.AssociationForeignDBNames[i])
+				}
+			case "many_to_many":
+				join := rel.JoinTableHandler.Table(db)
+				for i, name := range rel.ForeignFieldNames {
+					if key, ok := scope.FieldByName(name); ok {
+						addKey(join, rel.ForeignDBNames[i], scope.TableName(), key.DBName)
+					}
+				}
+				for i, name := range rel.AssociationForeignFieldNames {
+					if key, ok := other.FieldByName(name); ok {
+						addKey(join, rel.AssociationForeignDBNames[i], other.TableName(), key.DBName)
+					}
+				}
+			}
+		}
+	}
+	return tables
+}
+
+func describeColumn(db *gorm.DB, d dialect.Dialect, field *gorm.StructField) Column {
+	_, notNull := field.TagSettingsGet("NOT NULL")
+	_, unique := field.TagSettingsGet("UNIQUE")
+	// GORM's dialects add and remove AUTO_INCREMENT as they go, so give them a copy rather than the cached model's field
+	typ := db.Dialect().DataTypeOf(copyField(field))
+	if _, ok := field.TagSettingsGet("AUTO_INCREMENT"); ok && !field.IsPrimaryKey {
+		// Only the primary key can auto increment everywhere, so migration 1 makes BasicUser.Count a plain integer - GORM would write a serial for Postgres
+		// It needs a default as well, since GORM leaves it out of an INSERT while it is zero
+		typ, _ = d.ColumnType("int")
+		typ += " NOT NULL DEFAULT 0"
+		notNull = true
+	}
+	return Column{
+		Name:       field.DBName,
+		Field:      field.Name,
+		Type:       typ,
+		BaseType:   d.NormalizeType(baseType(typ)),
+		NotNull:    notNull || field.IsPrimaryKey,
+		Unique:     unique,
+		PrimaryKey: field.IsPrimaryKey,
+	}
+}
+
+// describeJoinTable mirrors GORM's createJoinTable - one column per key on each side, copied from the key fields without AUTO_INCREMENT
+func describeJoinTable(db *gorm.DB, d dialect.Dialect, scope *gorm.Scope, field *gorm.StructField) Table {
+	rel := field.Relationship
+	table := Table{Name: rel.JoinTableHandler.Table(db), Model: scope.GetModelStruct().ModelType.Name() + "." + field.Name}
+	toScope := db.NewScope(reflect.New(field.Struct.Type).Interface())
+
+	addKeys := func(s *gorm.Scope, fieldNames, dbNames []string) {
+		for i, name := range fieldNames {
+			keyField, ok := s.FieldByName(name)
+			if !ok {
+				continue
+			}
+			key := copyField(keyField.StructField, "AUTO_INCREMENT", "PRIMARY_KEY")
+			key.DBName = dbNames[i]
+			key.IsPrimaryKey = false
+			key.TagSettings["IS_JOINTABLE_FOREIGNKEY"] = "true"
+			column := describeColumn(db, d, key)
+			// The keys on both sides make up the join table's primary key
+			column.NotNull, column.PrimaryKey = true, true
+			table.Columns = append(table.Columns, column)
+		}
+	}
+	addKeys(scope, rel.ForeignFieldNames, rel.ForeignDBNames)
+	addKeys(toScope, rel.AssociationForeignFieldNames, rel.AssociationForeignDBNames)
+	return table
+}
+
+// copyField copies the parts of a field DataTypeOf looks at, leaving out the tag settings named in drop
+func copyField(field *gorm.StructField, drop ...string) *gorm.StructField {
+	c := &gorm.StructField{
+		DBName:       field.DBName,
+		Name:         field.Name,
+		IsPrimaryKey: field.IsPrimaryKey,
+		IsNormal:     field.IsNormal,
+		Struct:       field.Struct,
+		TagSettings:  map[string]string{},
+	}
+	for k, v := range field.TagSettings {
+		c.TagSettings[k] = v
+	}
+	for _, k := range drop {
+		delete(c.TagSettings, k)
+	}
+	return c
+}
+
+// constraints that can follow the type in a column definition, lower case
+var constraints = []string{" not null", " null", " default", " unique", " primary key", " auto_increment", " autoincrement"}
+
+// baseType cuts a column definition down to just the type - varchar(100) NOT NULL DEFAULT 'Annica' becomes varchar(100)
+func baseType(typ string) string {
+	lower := strings.ToLower(typ)
+	end := len(lower)
+	for _, c := range constraints {
+		if i := strings.Index(lower, c); i >= 0 && i < end {
+			end = i
+		}
+	}
+	return strings.TrimSpace(typ[:end])
+}
+
+// Inspect reads a table as it exists in the database - ok is false if there is no such table
+func Inspect(db *gorm.DB, name string) (table Table, ok bool, err error) {
+	if !db.Dialect().HasTable(name) {
+		return Table{Name: name}, false, nil
+	}
+	d := dialect.Of(db)
+	columns, err := d.Columns(db, name)
+	if err != nil {
+		return table, true, err
+	}
+	indexes, err := d.Indexes(db, name)
+	if err != nil {
+		return table, true, err
+	}
+	table = Table{Name: name, Indexes: indexes}
+	for _, c := range columns {
+		table.Columns = append(table.Columns, Column{
+			Name:     c.Name,
+			Type:     c.Type,
+			BaseType: d.NormalizeType(c.Type),
+			NotNull:  !c.Nullable,
+		})
+	}
+	return table, true, nil
+}
@@ -0,0 +1,198 @@
+package schema_test
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/annicaburns/learngorm/dbSchema"
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/relationships"
+	"github.com/annicaburns/learngorm/schema"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+var relationshipModels = []interface{}{&relationships.RelationshipUser{}, &relationships.Calendar{}, &relationships.TaskList{}, &relationships.Appointment{}}
+
+// diffWidget disagrees with the table TestDiff creates for it in every way Diff knows about
+type diffWidget struct {
+	ID   uint
+	Name string `gorm:"type:varchar(64);not null"`
+	Size int
+	Code string `sql:"unique"`
+	// Both tags build a unique index, like BasicUser.LastName
+	Serial string `sql:"unique" gorm:"unique_index:uix_diff_widgets_serial"`
+	Kind   string `gorm:"index"`
+}
+
+type diffGadget struct {
+	ID uint
+}
+
+func TestDiff(t *testing.T) {
+	db := testdb.Open(t)
+	if dialect.Of(db).Name() != "sqlite3" {
+		t.Skip("the expected types and statements are SQLite's")
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE diff_widgets (id integer PRIMARY KEY AUTOINCREMENT, name text, size varchar(10), serial varchar(255), legacy text)",
+		"CREATE UNIQUE INDEX uix_one ON diff_widgets(serial)",
+		"CREATE UNIQUE INDEX uix_two ON diff_widgets(serial)",
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	diffs, err := schema.Diff(db, &diffWidget{}, &diffGadget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`diff_widgets.name: type mismatch - model has varchar(64), database has text | -- sqlite3 can't change name in place: rebuild diff_widgets with name varchar(64) NOT NULL`,
+		`diff_widgets.name: nullability mismatch - model has NOT NULL, database has NULL | -- sqlite3 can't change name in place: rebuild diff_widgets with name varchar(64) NOT NULL`,
+		`diff_widgets.size: type mismatch - model has integer, database has varchar(10) | -- sqlite3 can't change size in place: rebuild diff_widgets with size integer`,
+		`diff_widgets.code: missing column - model has varchar(255) UNIQUE | ALTER TABLE "diff_widgets" ADD COLUMN "code" varchar(255)`,
+		`diff_widgets.kind: missing column - model has varchar(255) | ALTER TABLE "diff_widgets" ADD COLUMN "kind" varchar(255)`,
+		`diff_widgets.legacy: extra column - database has TEXT | `,
+		`diff_widgets: missing index - model has idx_diff_widgets_kind(kind) | CREATE INDEX "idx_diff_widgets_kind" ON "diff_widgets"("kind")`,
+		`diff_widgets: missing index - model has uix_diff_widgets_serial(serial) | CREATE UNIQUE INDEX "uix_diff_widgets_serial" ON "diff_widgets"("serial")`,
+		`diff_widgets.code: missing index - model has UNIQUE | CREATE UNIQUE INDEX "uix_diff_widgets_code" ON "diff_widgets"("code")`,
+		`diff_widgets.serial: duplicate unique index - model has sql:"unique" and unique_index uix_diff_widgets_serial | -- drop either the unique or the unique_index tag from diffWidget.Serial`,
+		`diff_widgets.serial: duplicate unique index - database has uix_two and uix_one | DROP INDEX "uix_one"`,
+		`diff_gadgets: missing table - model has diffGadget | -- add a migration that creates diff_gadgets`,
+	}
+	got := make([]string, len(diffs))
+	for i, diff := range diffs {
+		got[i] = diff.String() + " | " + diff.Fix
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The statements have to run as they are, and leave nothing missing behind them
+	for _, diff := range diffs {
+		if diff.Fix != "" && !strings.HasPrefix(diff.Fix, "--") {
+			if err := db.Exec(diff.Fix).Error; err != nil {
+				t.Errorf("%s: %v", diff.Fix, err)
+			}
+		}
+	}
+	if diffs, err = schema.Diff(db, &diffWidget{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, diff := range diffs {
+		if diff.Kind == schema.MissingColumn || diff.Kind == schema.MissingIndex {
+			t.Errorf("%s is still there after its fix", diff)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the DDL golden files in testdata")
+
+func TestDDL(t *testing.T) {
+	models := append([]interface{}{&dbSchema.BasicUser{}}, relationshipModels...)
+	for _, name := range dialect.Names() {
+		got, err := schema.DDL(name, models...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join("testdata", "ddl."+name+".sql")
+		if *update {
+			if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s DDL doesn't match %s - go test ./schema -update rewrites it, then check the diff:\n%s", name, path, got)
+		}
+
+		// BasicUser.Count has to come out the way migration 1 creates it
+		d, err := dialect.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		integer, _ := d.ColumnType("int")
+		if count := d.Quote("count") + " " + integer + " NOT NULL DEFAULT 0"; !strings.Contains(got, count) {
+			t.Errorf("%s DDL doesn't have %s", name, count)
+		}
+	}
+}
+
+func TestAddForeignKeys(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	opts := schema.ForeignKeyOptions{Override: map[string]schema.Actions{"task_lists.relationship_user_id": {OnDelete: "set null"}}}
+	results, err := schema.AddForeignKeys(ctx, db, opts, relationshipModels...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcomes := map[string]schema.ForeignKeyResult{}
+	for _, result := range results {
+		outcomes[result.Table+"."+result.Column] = result
+	}
+	// The polymorphic owner_id could point at either owner's table, so there's no constraint for it
+	if len(outcomes) != 4 {
+		t.Errorf("got %v, want calendars', task_lists' and both of appoinment_user's keys", results)
+	}
+	calendars := outcomes["calendars.relationship_user_id"]
+	if calendars.Outcome != schema.FKExists || calendars.Existing.OnDelete != "CASCADE" {
+		t.Errorf("calendars.relationship_user_id is %+v, want the migration's CASCADE constraint found", calendars)
+	}
+	// SQLite has no ALTER TABLE ... ADD CONSTRAINT, so the rest are left to a migration
+	taskLists := outcomes["task_lists.relationship_user_id"]
+	if taskLists.Outcome != schema.FKUnsupported || !strings.Contains(taskLists.SQL, "ON DELETE SET NULL ON UPDATE CASCADE") {
+		t.Errorf("task_lists.relationship_user_id is %+v, want the override's actions in a note for a migration", taskLists)
+	}
+
+	// Asking for other actions than the ones the constraint has is reported, not acted on
+	results, err = schema.AddForeignKeys(ctx, db, schema.ForeignKeyOptions{Actions: schema.Actions{OnDelete: "restrict"}}, &relationships.RelationshipUser{}, &relationships.Calendar{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Outcome != schema.FKActionsDiff {
+		t.Errorf("got %v, want calendars' constraint reported with other actions", results)
+	}
+}
+
+func TestForeignKeyOptionsAreChecked(t *testing.T) {
+	db := testdb.Open(t)
+	for _, opts := range []schema.ForeignKeyOptions{
+		{Actions: schema.Actions{OnDelete: "DROP TABLE calendars"}},
+		{Override: map[string]schema.Actions{"calendars": {}}},
+		{Override: map[string]schema.Actions{"calendars.name": {}}},
+	} {
+		if _, err := schema.AddForeignKeys(context.Background(), db, opts, relationshipModels...); err == nil {
+			t.Errorf("%+v was accepted", opts)
+		}
+	}
+}
+
+func TestJoinTableModel(t *testing.T) {
+	db := testdb.Open(t)
+	// Appointment describes appoinment_user as a bare join table first - Attendance, with the RSVP columns, takes its place
+	models := append(relationshipModels, &relationships.Attendance{})
+	for _, table := range schema.Describe(db, models...) {
+		if table.Name == "appoinment_user" && (table.Model != "Attendance" || len(table.Columns) != 6) {
+			t.Errorf("appoinment_user is described as %s with %d columns, want Attendance's 6", table.Model, len(table.Columns))
+		}
+	}
+	diffs, err := schema.Diff(db, models...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diff := range diffs {
+		if diff.Table == "appoinment_user" {
+			t.Errorf("unexpected difference %s", diff)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+-- mysql schema for the learngorm models, generated by learngorm schema ddl
+
+-- BasicUser
+CREATE TABLE `basic_users` (
+    `id` int unsigned AUTO_INCREMENT,
+    `created_at` DATETIME NULL,
+    `updated_at` DATETIME NULL,
+    `deleted_at` DATETIME NULL,
+    `username` VARCHAR(15) NOT NULL,
+    `first_name` varchar(100) NOT NULL  DEFAULT 'Annica',
+    `LastName` varchar(255) UNIQUE,
+    `count` int NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`)
+);
+CREATE INDEX `idx_basic_users_deleted_at` ON `basic_users`(`deleted_at`);
+
+-- RelationshipUser
+CREATE TABLE `relationship_users` (
+    `id` int unsigned AUTO_INCREMENT,
+    `created_at` DATETIME NULL,
+    `updated_at` DATETIME NULL,
+    `deleted_at` DATETIME NULL,
+    `username` varchar(255),
+    `first_name` varchar(255),
+    `last_name` varchar(255),
+    PRIMARY KEY (`id`)
+);
+CREATE INDEX `idx_relationship_users_deleted_at` ON `relationship_users`(`deleted_at`);
+
+-- Calendar
+CREATE TABLE `calendars` (
+    `id` int unsigned AUTO_INCREMENT,
+    `created_at` DATETIME NULL,
+    `updated_at` DATETIME NULL,
+    `deleted_at` DATETIME NULL,
+    `name` varchar(255),
+    `relationship_user_id` int unsigned,
+    PRIMARY KEY (`id`)
+);
+CREATE INDEX `idx_calendars_deleted_at` ON `calendars`(`deleted_at`);
+
+-- TaskList
+CREATE TABLE `task_lists` (
+    `id` int unsigned AUTO_INCREMENT,
+    `created_at` DATETIME NULL,
+    `updated_at` DATETIME NULL,
+    `deleted_at` DATETIME NULL,
+    `name` varchar(255),
+    `relationship_user_id` int unsigned,
+    PRIMARY KEY (`id`)
+);
+CREATE INDEX `idx_task_lists_deleted_at` ON `task_lists`(`deleted_at`);
+
+-- Appointment
+CREATE TABLE `appointments` (
+    `id` int unsigned AUTO_INCREMENT,
+    `created_at` DATETIME NULL,
+    `updated_at` DATETIME NULL,
+    `deleted_at` DATETIME NULL,
+    `subject` varchar(255),
+    `description` varchar(255),
+    `start_time` DATETIME NULL,
+    `length` int unsigned,
+    `owner_id` int unsigned,
+    `owner_type` varchar(255),
+    PRIMARY KEY (`id`)
+);
+CREATE INDEX `idx_appointments_deleted_at` ON `appointments`(`deleted_at`);
+
+-- Appointment.Attendees
+CREATE TABLE `appoinment_user` (
+    `appointment_id` int unsigned,
+    `relationship_user_id` int unsigned,
+    PRIMARY KEY (`appointment_id`, `relationship_user_id`)
+);
+
+-- Foreign keys
+ALTER TABLE `calendars` ADD CONSTRAINT `calendars_relationship_user_id_relationship_users_id_foreign` FOREIGN KEY (`relationship_user_id`) REFERENCES `relationship_users`(`id`) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE `task_lists` ADD CONSTRAINT `task_lists_relationship_user_id_relationship_users_id_foreign` FOREIGN KEY (`relationship_user_id`) REFERENCES `relationship_users`(`id`) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE `appoinment_user` ADD CONSTRAINT `appoinment_user_appointment_id_appointments_id_foreign` FOREIGN KEY (`appointment_id`) REFERENCES `appointments`(`id`) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE `appoinment_user` ADD CONSTRAINT `relationship_users_id_0ef1ba0aed76d13519e05ca8c18d42afdf41280b` FOREIGN KEY (`relationship_user_id`) REFERENCES `relationship_users`(`id`) ON DELETE CASCADE ON UPDATE CASCADE;
@@ -0,0 +1,81 @@
+-- postgres schema for the learngorm models, generated by learngorm schema ddl
+
+-- BasicUser
+CREATE TABLE "basic_users" (
+    "id" serial,
+    "created_at" timestamp with time zone,
+    "updated_at" timestamp with time zone,
+    "deleted_at" timestamp with time zone,
+    "username" VARCHAR(15) NOT NULL,
+    "first_name" varchar(100) NOT NULL  DEFAULT 'Annica',
+    "LastName" text UNIQUE,
+    "count" integer NOT NULL DEFAULT 0,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_basic_users_deleted_at" ON "basic_users"("deleted_at");
+
+-- RelationshipUser
+CREATE TABLE "relationship_users" (
+    "id" serial,
+    "created_at" timestamp with time zone,
+    "updated_at" timestamp with time zone,
+    "deleted_at" timestamp with time zone,
+    "username" text,
+    "first_name" text,
+    "last_name" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_relationship_users_deleted_at" ON "relationship_users"("deleted_at");
+
+-- Calendar
+CREATE TABLE "calendars" (
+    "id" serial,
+    "created_at" timestamp with time zone,
+    "updated_at" timestamp with time zone,
+    "deleted_at" timestamp with time zone,
+    "name" text,
+    "relationship_user_id" integer,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_calendars_deleted_at" ON "calendars"("deleted_at");
+
+-- TaskList
+CREATE TABLE "task_lists" (
+    "id" serial,
+    "created_at" timestamp with time zone,
+    "updated_at" timestamp with time zone,
+    "deleted_at" timestamp with time zone,
+    "name" text,
+    "relationship_user_id" integer,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_task_lists_deleted_at" ON "task_lists"("deleted_at");
+
+-- Appointment
+CREATE TABLE "appointments" (
+    "id" serial,
+    "created_at" timestamp with time zone,
+    "updated_at" timestamp with time zone,
+    "deleted_at" timestamp with time zone,
+    "subject" text,
+    "description" text,
+    "start_time" timestamp with time zone,
+    "length" integer,
+    "owner_id" integer,
+    "owner_type" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_appointments_deleted_at" ON "appointments"("deleted_at");
+
+-- Appointment.Attendees
+CREATE TABLE "appoinment_user" (
+    "appointment_id" integer,
+    "relationship_user_id" integer,
+    PRIMARY KEY ("appointment_id", "relationship_user_id")
+);
+
+-- Foreign keys
+ALTER TABLE "calendars" ADD CONSTRAINT "calendars_relationship_user_id_relationship_users_id_foreign" FOREIGN KEY ("relationship_user_id") REFERENCES "relationship_users"("id") ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE "task_lists" ADD CONSTRAINT "task_lists_relationship_user_id_relationship_users_id_foreign" FOREIGN KEY ("relationship_user_id") REFERENCES "relationship_users"("id") ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE "appoinment_user" ADD CONSTRAINT "appoinment_user_appointment_id_appointments_id_foreign" FOREIGN KEY ("appointment_id") REFERENCES "appointments"("id") ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE "appoinment_user" ADD CONSTRAINT "appoinment_user_relationship_user_id_relationship_users_id_foreign" FOREIGN KEY ("relationship_user_id") REFERENCES "relationship_users"("id") ON DELETE CASCADE ON UPDATE CASCADE;
@@ -0,0 +1,74 @@
+-- sqlite3 schema for the learngorm models, generated by learngorm schema ddl
+
+-- BasicUser
+CREATE TABLE "basic_users" (
+    "id" integer primary key autoincrement,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "username" VARCHAR(15) NOT NULL,
+    "first_name" varchar(100) NOT NULL  DEFAULT 'Annica',
+    "LastName" varchar(255) UNIQUE,
+    "count" integer NOT NULL DEFAULT 0
+);
+CREATE INDEX "idx_basic_users_deleted_at" ON "basic_users"("deleted_at");
+
+-- RelationshipUser
+CREATE TABLE "relationship_users" (
+    "id" integer primary key autoincrement,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "username" varchar(255),
+    "first_name" varchar(255),
+    "last_name" varchar(255)
+);
+CREATE INDEX "idx_relationship_users_deleted_at" ON "relationship_users"("deleted_at");
+
+-- Calendar
+CREATE TABLE "calendars" (
+    "id" integer primary key autoincrement,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "name" varchar(255),
+    "relationship_user_id" integer,
+    CONSTRAINT "calendars_relationship_user_id_relationship_users_id_foreign" FOREIGN KEY ("relationship_user_id") REFERENCES "relationship_users"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX "idx_calendars_deleted_at" ON "calendars"("deleted_at");
+
+-- TaskList
+CREATE TABLE "task_lists" (
+    "id" integer primary key autoincrement,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "name" varchar(255),
+    "relationship_user_id" integer,
+    CONSTRAINT "task_lists_relationship_user_id_relationship_users_id_foreign" FOREIGN KEY ("relationship_user_id") REFERENCES "relationship_users"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX "idx_task_lists_deleted_at" ON "task_lists"("deleted_at");
+
+-- Appointment
+CREATE TABLE "appointments" (
+    "id" integer primary key autoincrement,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "subject" varchar(255),
+    "description" varchar(255),
+    "start_time" datetime,
+    "length" integer,
+    "owner_id" integer,
+    "owner_type" varchar(255)
+);
+CREATE INDEX "idx_appointments_deleted_at" ON "appointments"("deleted_at");
+
+-- Appointment.Attendees
+CREATE TABLE "appoinment_user" (
+    "appointment_id" integer,
+    "relationship_user_id" integer,
+    PRIMARY KEY ("appointment_id", "relationship_user_id"),
+    CONSTRAINT "appoinment_user_appointment_id_appointments_id_foreign" FOREIGN KEY ("appointment_id") REFERENCES "appointments"("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT "appoinment_user_relationship_user_id_relationship_users_id_foreign" FOREIGN KEY ("relationship_user_id") REFERENCES "relationship_users"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
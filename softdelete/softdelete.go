@@ -0,0 +1,395 @@
+package softdelete
+
+/*
+* Soft deletes beyond what GORM does on its own - GORM hides rows with a deleted_at, but can't list them, bring them back or clear them out
+	* Trashed loads only the soft deleted rows
+	* Restore brings rows back by id, or every deleted row matching the filters on db
+	* Purge deletes for good the rows soft deleted before a cutoff
+	* Delete soft deletes rows the way GORM's Delete does, and their children with them
+* Children are the has-one and has-many associations of a gorm.Model - a CruddyUser's CruddyAppointments, a Calendar's Appointments
+	* Delete gives the children the same deleted_at as their parent, so Restore can bring back exactly the children that went with it
+	* Purge removes the parent's deleted children and its many-to-many join rows too, so nothing is left pointing at a row that's gone
+	* That includes the join rows of many-to-manys declared on other registered models - an Appointment's Attendees for a purged RelationshipUser
+	* Children without a DeletedAt are left alone by Delete - cascading a soft delete into a hard one would lose data
+	* Purge refuses with ErrLiveChildren when a parent still has children that aren't deleted, those included - restore the parent or delete them first
+* Filters go on db the usual way - softdelete.Restore(ctx, db.Where("last_name = ?", "Dent"), &crud.CruddyUser{})
+* Every call runs in one transaction, or in a savepoint of the caller's if db is one already
+* learngorm trash list|delete|restore|purge does the same from the command line
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/audit"
+	"github.com/annicaburns/learngorm/registry"
+	"github.com/annicaburns/learngorm/transaction"
+)
+
+// ErrNotSoftDeletable is returned for models without a DeletedAt field - their deletes are hard ones, so there's nothing to manage
+var ErrNotSoftDeletable = errors.New("softdelete: model has no DeletedAt field")
+
+// ErrLiveChildren is returned by Purge when a row to purge still has children that aren't deleted - purging it would leave them pointing at nothing
+var ErrLiveChildren = errors.New("softdelete: rows to purge have live children")
+
+// Counts is the number of rows each call changed, by table
+type Counts map[string]int64
+
+// String lists the counts by table - "cruddy_users: 1, cruddy_appointments: 3"
+func (c Counts) String() string {
+	tables := make([]string, 0, len(c))
+	for table := range c {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	parts := make([]string, len(tables))
+	for i, table := range tables {
+		parts[i] = fmt.Sprintf("%s: %d", table, c[table])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Trashed loads the soft deleted rows matching db's filters into out, a pointer to a slice of models
+func Trashed(ctx context.Context, db *gorm.DB, out interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t, err := tableOf(db, out)
+	if err != nil {
+		return err
+	}
+	return db.Unscoped().Where(t.deletedAt + " IS NOT NULL").Find(out).Error
+}
+
+// Delete soft deletes the rows of model matching db's filters - just the ids given, if there are any - and their children
+func Delete(ctx context.Context, db *gorm.DB, model interface{}, ids ...interface{}) (Counts, error) {
+	counts := Counts{}
+	err := inTx(ctx, db, func(tx *gorm.DB) error {
+		t, err := tableOf(tx, model)
+		if err != nil {
+			return err
+		}
+		// One timestamp for the whole call, so the children can be matched to their parent when it's restored
+		now := gorm.NowFunc()
+		base := tx.New().SetNowFuncOverride(func() time.Time { return now })
+		rows := tx.Model(t.model)
+		if len(ids) > 0 {
+			rows = rows.Where(t.primaryKey+" IN (?)", ids)
+		}
+		return deleteRows(base, t, rows, counts)
+	})
+	return counts, err
+}
+
+// Restore clears deleted_at on the deleted rows of model matching db's filters - just the ids given, if there are any
+// The children that were deleted along with each row come back too, but not the ones deleted on their own before it
+func Restore(ctx context.Context, db *gorm.DB, model interface{}, ids ...interface{}) (Counts, error) {
+	counts := Counts{}
+	err := inTx(ctx, db, func(tx *gorm.DB) error {
+		t, err := tableOf(tx, model)
+		if err != nil {
+			return err
+		}
+		rows := tx.Unscoped().Model(t.model).Where(t.deletedAt + " IS NOT NULL")
+		if len(ids) > 0 {
+			rows = rows.Where(t.primaryKey+" IN (?)", ids)
+		}
+		return restoreRows(tx.New(), t, rows, counts)
+	})
+	return counts, err
+}
+
+// Purge permanently deletes the rows of model matching db's filters that were soft deleted before cutoff, with their deleted children and join rows
+// Nothing is purged if any of those rows has a child that isn't deleted - the error wraps ErrLiveChildren
+func Purge(ctx context.Context, db *gorm.DB, model interface{}, cutoff time.Time) (Counts, error) {
+	counts := Counts{}
+	err := inTx(ctx, db, func(tx *gorm.DB) error {
+		t, err := tableOf(tx, model)
+		if err != nil {
+			return err
+		}
+		rows := tx.Unscoped().Model(t.model).Where(t.deletedAt+" < ?", cutoff)
+		return purgeRows(tx.New(), t, rows, counts)
+	})
+	return counts, err
+}
+
+// deleteRows soft deletes the children of rows, then rows themselves
+func deleteRows(base *gorm.DB, t *table, rows *gorm.DB, counts Counts) error {
+	keys, err := pluck(rows, t.primaryKey)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	for _, c := range t.children(base) {
+		if c.table == nil {
+			continue
+		}
+		live, err := c.of(base, t, keys)
+		if err != nil {
+			return err
+		}
+		if err := deleteRows(base, c.table, live, counts); err != nil {
+			return err
+		}
+	}
+	result := base.Where(t.primaryKey+" IN (?)", keys).Delete(t.model)
+	if result.Error != nil {
+		return fmt.Errorf("deleting from %s: %w", t.name, result.Error)
+	}
+	counts[t.name] += result.RowsAffected
+	return nil
+}
+
+// restoreRows restores the children of rows that were deleted along with them, then rows themselves
+func restoreRows(base *gorm.DB, t *table, rows *gorm.DB, counts Counts) error {
+	keys, err := pluck(rows, t.primaryKey)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	for _, c := range t.children(base) {
+		if c.table == nil {
+			continue
+		}
+		children, err := c.of(base.Unscoped(), t, keys)
+		if err != nil {
+			return err
+		}
+		// Only the children whose deleted_at matches their parent's went with it - compared in SQL, so no time zone or precision gets lost on the way
+		withParent := fmt.Sprintf("%s = (SELECT p.%s FROM %s p WHERE p.%s = %s)",
+			c.table.deletedAt, base.Dialect().Quote(t.deletedAtColumn), base.Dialect().Quote(t.name),
+			base.Dialect().Quote(c.association), c.table.column(c.foreignKey))
+		if err := restoreRows(base, c.table, children.Where(withParent), counts); err != nil {
+			return err
+		}
+	}
+	// UpdateColumn leaves updated_at alone and skips the BeforeUpdate and AfterUpdate hooks - restoring isn't an edit, though the audit log still records it
+	result := base.Unscoped().Model(t.model).Where(t.primaryKey+" IN (?)", keys).UpdateColumn(t.deletedAtColumn, nil)
+	if result.Error != nil {
+		return fmt.Errorf("restoring %s: %w", t.name, result.Error)
+	}
+	counts[t.name] += result.RowsAffected
+	return nil
+}
+
+// purgeRows deletes the deleted children and the join rows of rows, then rows themselves
+func purgeRows(base *gorm.DB, t *table, rows *gorm.DB, counts Counts) error {
+	keys, err := pluck(rows, t.primaryKey)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	for _, c := range append(t.children(base), t.joinedFrom(base)...) {
+		if c.joinTable != "" {
+			values, err := c.values(base, t, keys)
+			if err != nil {
+				return err
+			}
+			result := base.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s IN (?)", base.Dialect().Quote(c.joinTable), base.Dialect().Quote(c.foreignKey)), values)
+			if result.Error != nil {
+				return fmt.Errorf("purging from %s: %w", c.joinTable, result.Error)
+			}
+			counts[c.joinTable] += result.RowsAffected
+			continue
+		}
+		live, err := c.live(base, t, keys)
+		if err != nil {
+			return err
+		}
+		if live > 0 {
+			return fmt.Errorf("purging %s: %d rows of %s still belong to them: %w", t.name, live, c.name, ErrLiveChildren)
+		}
+		if c.table == nil {
+			continue
+		}
+		children, err := c.of(base.Unscoped(), t, keys)
+		if err != nil {
+			return err
+		}
+		if err := purgeRows(base, c.table, children.Where(c.table.deletedAt+" IS NOT NULL"), counts); err != nil {
+			return err
+		}
+	}
+	result := base.Unscoped().Where(t.primaryKey+" IN (?)", keys).Delete(t.model)
+	if result.Error != nil {
+		return fmt.Errorf("purging %s: %w", t.name, result.Error)
+	}
+	counts[t.name] += result.RowsAffected
+	return nil
+}
+
+// table is a soft deletable model's table, with the columns the calls need quoted and qualified ready for a where clause
+type table struct {
+	scope *gorm.Scope
+	// model is a blank model, for Model and Delete - a non-blank one would add its own primary key to the conditions
+	model           interface{}
+	name            string
+	primaryKey      string
+	deletedAt       string
+	deletedAtColumn string
+}
+
+// tableOf reads model, which can be a model, a pointer to one or a pointer to a slice of them
+func tableOf(db *gorm.DB, model interface{}) (*table, error) {
+	typ := reflect.TypeOf(model)
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+	blank := reflect.New(typ).Interface()
+	scope := db.NewScope(blank)
+	field, ok := scope.FieldByName("DeletedAt")
+	if !ok || !field.IsNormal {
+		return nil, fmt.Errorf("%s: %w", scope.TableName(), ErrNotSoftDeletable)
+	}
+	if len(scope.PrimaryFields()) != 1 {
+		return nil, fmt.Errorf("softdelete: %s needs a primary key of one column", scope.TableName())
+	}
+	t := &table{scope: scope, model: blank, name: scope.TableName(), deletedAtColumn: field.DBName}
+	t.primaryKey = t.column(scope.PrimaryKey())
+	t.deletedAt = t.column(field.DBName)
+	return t, nil
+}
+
+// column qualifies a column with the table name, so the filters on db can join other tables
+func (t *table) column(name string) string {
+	return t.scope.QuotedTableName() + "." + t.scope.Quote(name)
+}
+
+// child is a has-one, has-many or many-to-many association of a table
+type child struct {
+	// table is nil when the child isn't soft deletable, or is on the far side of a join table
+	table *table
+	// name is the child's table, soft deletable or not - empty for a join table
+	name string
+	// foreignKey is the child's column pointing back at the parent - or the join table's, for a many-to-many
+	foreignKey string
+	// association is the parent column foreignKey holds, usually its id
+	association string
+	// polymorphic narrows the children to the parent's type - Appointments with owner_type "calendars"
+	polymorphicColumn, polymorphicValue string
+	joinTable                           string
+}
+
+// children lists the associations of t that cascade
+func (t *table) children(base *gorm.DB) []child {
+	children := []child{}
+	for _, field := range t.scope.GetModelStruct().StructFields {
+		rel := field.Relationship
+		if rel == nil || len(rel.ForeignDBNames) != 1 {
+			continue
+		}
+		switch rel.Kind {
+		case "many_to_many":
+			if rel.JoinTableHandler != nil {
+				children = append(children, child{
+					foreignKey:  rel.ForeignDBNames[0],
+					association: rel.ForeignFieldNames[0],
+					joinTable:   rel.JoinTableHandler.Table(base),
+				})
+			}
+		case "has_one", "has_many":
+			c := child{
+				foreignKey:        rel.ForeignDBNames[0],
+				association:       rel.AssociationForeignDBNames[0],
+				polymorphicColumn: rel.PolymorphicDBName,
+				polymorphicValue:  rel.PolymorphicValue,
+			}
+			model := reflect.New(field.Struct.Type).Interface()
+			c.name = base.NewScope(model).TableName()
+			// Children that aren't soft deletable are skipped, rather than failing the whole call
+			c.table, _ = tableOf(base, model)
+			children = append(children, c)
+		}
+	}
+	return children
+}
+
+// joinedFrom lists the many-to-manys of the registered models that point at t through a join table - t doesn't know about them itself
+func (t *table) joinedFrom(base *gorm.DB) []child {
+	children := []child{}
+	seen := map[string]bool{t.name: true}
+	for _, model := range registry.Models() {
+		scope := base.NewScope(model)
+		if seen[scope.TableName()] {
+			continue
+		}
+		seen[scope.TableName()] = true
+		for _, field := range scope.GetModelStruct().StructFields {
+			rel := field.Relationship
+			if rel == nil || rel.Kind != "many_to_many" || rel.JoinTableHandler == nil || len(rel.AssociationForeignDBNames) != 1 {
+				continue
+			}
+			if base.NewScope(reflect.New(field.Struct.Type).Interface()).TableName() != t.name {
+				continue
+			}
+			children = append(children, child{
+				foreignKey:  rel.AssociationForeignDBNames[0],
+				association: rel.AssociationForeignFieldNames[0],
+				joinTable:   rel.JoinTableHandler.Table(base),
+			})
+		}
+	}
+	return children
+}
+
+// values reads the parent column the child's foreign key holds, for the parent rows with the given keys
+func (c child) values(base *gorm.DB, parent *table, keys []interface{}) ([]interface{}, error) {
+	if parent.column(c.association) == parent.primaryKey {
+		return keys, nil
+	}
+	return pluck(base.Unscoped().Model(parent.model).Where(parent.primaryKey+" IN (?)", keys), parent.column(c.association))
+}
+
+// of selects the children of the parent rows with the given keys
+func (c child) of(base *gorm.DB, parent *table, keys []interface{}) (*gorm.DB, error) {
+	values, err := c.values(base, parent, keys)
+	if err != nil {
+		return nil, err
+	}
+	rows := base.Model(c.table.model).Where(c.table.column(c.foreignKey)+" IN (?)", values)
+	if c.polymorphicColumn != "" {
+		rows = rows.Where(c.table.column(c.polymorphicColumn)+" = ?", c.polymorphicValue)
+	}
+	return rows, nil
+}
+
+// live counts the children of the parent rows with the given keys that aren't deleted - every one of them, when the child isn't soft deletable
+func (c child) live(base *gorm.DB, parent *table, keys []interface{}) (int, error) {
+	values, err := c.values(base, parent, keys)
+	if err != nil {
+		return 0, err
+	}
+	quote := base.Dialect().Quote
+	rows := base.Table(c.name).Where(quote(c.name)+"."+quote(c.foreignKey)+" IN (?)", values)
+	if c.polymorphicColumn != "" {
+		rows = rows.Where(quote(c.name)+"."+quote(c.polymorphicColumn)+" = ?", c.polymorphicValue)
+	}
+	if c.table != nil {
+		rows = rows.Where(c.table.deletedAt + " IS NULL")
+	}
+	var count int
+	if err := rows.Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("counting the live rows of %s: %w", c.name, err)
+	}
+	return count, nil
+}
+
+// pluck reads one column of the rows
+func pluck(rows *gorm.DB, column string) ([]interface{}, error) {
+	values := []interface{}{}
+	if err := rows.Pluck(column, &values).Error; err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// inTx runs fn in a transaction tied to ctx, or in a savepoint when db is a transaction already
+// The changes are recorded in the audit log against the actor in ctx
+func inTx(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return transaction.WithTx(ctx, audit.DB(ctx, db), fn)
+}
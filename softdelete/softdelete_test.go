@@ -0,0 +1,234 @@
+package softdelete_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/crud"
+	"github.com/annicaburns/learngorm/relationships"
+	"github.com/annicaburns/learngorm/softdelete"
+	"github.com/annicaburns/learngorm/testdb"
+)
+
+// userWithAppointments creates a CruddyUser with the given appointments
+func userWithAppointments(t *testing.T, db *gorm.DB, first string, subjects ...string) crud.CruddyUser {
+	t.Helper()
+	user := crud.CruddyUser{FirstName: first, LastName: "Dent"}
+	for _, subject := range subjects {
+		user.Appointments = append(user.Appointments, crud.CruddyAppointment{Subject: subject})
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestDeleteCascades(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	arthur := userWithAppointments(t, db, "Arthur", "First", "Second")
+	userWithAppointments(t, db, "Ford", "Third")
+
+	counts, err := softdelete.Delete(ctx, db, &crud.CruddyUser{}, arthur.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["cruddy_users"] != 1 || counts["cruddy_appointments"] != 2 {
+		t.Errorf("deleted %v, want 1 user and 2 appointments", counts)
+	}
+	if n := testdb.Count(t, db, "cruddy_appointments", "deleted_at IS NULL"); n != 1 {
+		t.Errorf("%d appointments left, want Ford's 1", n)
+	}
+
+	trashed := []crud.CruddyUser{}
+	if err := softdelete.Trashed(ctx, db, &trashed); err != nil {
+		t.Fatal(err)
+	}
+	if len(trashed) != 1 || trashed[0].FirstName != "Arthur" {
+		t.Errorf("trashed %v, want just Arthur", trashed)
+	}
+}
+
+func TestRestoreOnlyTheChildrenThatWentWithTheParent(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	arthur := userWithAppointments(t, db, "Arthur", "First", "Second")
+
+	// Second was deleted on its own, before Arthur
+	if err := db.Model(&crud.CruddyAppointment{}).Where("subject = ?", "Second").UpdateColumn("deleted_at", gorm.NowFunc().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := softdelete.Delete(ctx, db, &crud.CruddyUser{}, arthur.ID); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := softdelete.Restore(ctx, db, &crud.CruddyUser{}, arthur.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["cruddy_users"] != 1 || counts["cruddy_appointments"] != 1 {
+		t.Errorf("restored %v, want 1 user and 1 appointment", counts)
+	}
+	live := []crud.CruddyAppointment{}
+	if err := db.Find(&live).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 1 || live[0].Subject != "First" {
+		t.Errorf("live appointments are %v, want just First", live)
+	}
+}
+
+func TestRestoreByFilter(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	userWithAppointments(t, db, "Arthur")
+	userWithAppointments(t, db, "Ford")
+	if _, err := softdelete.Delete(ctx, db, &crud.CruddyUser{}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := softdelete.Restore(ctx, db.Where("first_name = ?", "Ford"), &crud.CruddyUser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["cruddy_users"] != 1 {
+		t.Errorf("restored %v, want only Ford", counts)
+	}
+	if n := testdb.Count(t, db, "cruddy_users", "deleted_at IS NULL AND first_name = ?", "Ford"); n != 1 {
+		t.Error("Ford wasn't restored")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	arthur := userWithAppointments(t, db, "Arthur", "First")
+	ford := userWithAppointments(t, db, "Ford", "Second")
+	if _, err := softdelete.Delete(ctx, db, &crud.CruddyUser{}, arthur.ID, ford.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Arthur went a week ago, Ford just now
+	weekAgo := gorm.NowFunc().Add(-7 * 24 * time.Hour)
+	for _, table := range []string{"cruddy_users", "cruddy_appointments"} {
+		column := map[string]string{"cruddy_users": "id", "cruddy_appointments": "cruddy_user_id"}[table]
+		if err := db.Table(table).Where(column+" = ?", arthur.ID).UpdateColumn("deleted_at", weekAgo).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts, err := softdelete.Purge(ctx, db, &crud.CruddyUser{}, gorm.NowFunc().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["cruddy_users"] != 1 || counts["cruddy_appointments"] != 1 {
+		t.Errorf("purged %v, want Arthur and his appointment", counts)
+	}
+	if n := testdb.Count(t, db, "cruddy_users"); n != 1 {
+		t.Errorf("%d users left, want Ford still in the trash", n)
+	}
+	if n := testdb.Count(t, db, "cruddy_appointments"); n != 1 {
+		t.Errorf("%d appointments left, want Ford's", n)
+	}
+}
+
+func TestPurgeRefusesLiveChildren(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	arthur := userWithAppointments(t, db, "Arthur", "First", "Second")
+	if _, err := softdelete.Delete(ctx, db, &crud.CruddyUser{}, arthur.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Bringing back one appointment on its own leaves it pointing at a user still in the trash
+	if _, err := softdelete.Restore(ctx, db, &crud.CruddyAppointment{}, arthur.Appointments[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := softdelete.Purge(ctx, db, &crud.CruddyUser{}, gorm.NowFunc().Add(time.Minute))
+	if !errors.Is(err, softdelete.ErrLiveChildren) {
+		t.Fatalf("purging a user with a live appointment returned %v, want ErrLiveChildren", err)
+	}
+	if n := testdb.Count(t, db, "cruddy_users"); n != 1 {
+		t.Errorf("%d users left, want Arthur kept", n)
+	}
+	if n := testdb.Count(t, db, "cruddy_appointments"); n != 2 {
+		t.Errorf("%d appointments left, want both kept - the deleted one too, since the purge rolled back", n)
+	}
+}
+
+func TestPurgeJoinRowsDeclaredElsewhere(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	// Appointment declares Attendees - RelationshipUser has no many-to-many of its own to find appoinment_user by
+	lunch := relationships.Appointment{Subject: "Lunch", Attendees: []relationships.RelationshipUser{{Username: "fprefect"}}}
+	if err := db.Create(&lunch).Error; err != nil {
+		t.Fatal(err)
+	}
+	ford := lunch.Attendees[0]
+	if _, err := softdelete.Delete(ctx, db, &relationships.RelationshipUser{}, ford.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := softdelete.Purge(ctx, db, &relationships.RelationshipUser{}, gorm.NowFunc().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["relationship_users"] != 1 || counts["appoinment_user"] != 1 {
+		t.Errorf("purged %v, want ford and his place at lunch", counts)
+	}
+	if n := testdb.Count(t, db, "appoinment_user"); n != 0 {
+		t.Errorf("%d join rows left pointing at the purged user", n)
+	}
+	if n := testdb.Count(t, db, "appointments"); n != 1 {
+		t.Errorf("%d appointments left, want lunch kept", n)
+	}
+}
+
+func TestPolymorphicChildrenAndJoinRows(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	user := relationships.RelationshipUser{
+		Username: "adent",
+		Calendar: relationships.Calendar{Name: "Arthur's calendar", Appointments: []relationships.Appointment{{Subject: "Lunch"}}},
+		TaskList: relationships.TaskList{Name: "Arthur's tasks", Appointments: []relationships.Appointment{{Subject: "Towel"}}},
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	lunch := relationships.Appointment{}
+	if err := db.Where("subject = ?", "Lunch").First(&lunch).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&lunch).Association("Attendees").Append(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The calendar and the task list share owner_id 1 - only the calendar's appointments belong to it
+	counts, err := softdelete.Delete(ctx, db, &relationships.Calendar{}, user.Calendar.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["appointments"] != 1 {
+		t.Errorf("deleted %v, want only the calendar's appointment", counts)
+	}
+
+	counts, err = softdelete.Purge(ctx, db, &relationships.Appointment{}, gorm.NowFunc().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["appointments"] != 1 || counts["appoinment_user"] != 1 {
+		t.Errorf("purged %v, want the appointment and its attendee", counts)
+	}
+	if n := testdb.Count(t, db, "appoinment_user"); n != 0 {
+		t.Errorf("%d join rows left pointing at the purged appointment", n)
+	}
+}
+
+func TestNotSoftDeletable(t *testing.T) {
+	db := testdb.Open(t)
+	if _, err := softdelete.Restore(context.Background(), db, &crud.CruddyUser4{}, 1); !errors.Is(err, softdelete.ErrNotSoftDeletable) {
+		t.Errorf("Restore returned %v, want ErrNotSoftDeletable", err)
+	}
+}
@@ -0,0 +1,74 @@
+package testdb
+
+/*
+* Every package's tests get a database of their own with the migrations applied
+	* By default it is an in-memory SQLite database named after the test - no server to run, but cgo is needed for the driver
+	* Set LEARNGORM_TEST_DRIVER and LEARNGORM_TEST_DSN to run the same tests against MySQL, or anything else the dialect package supports
+	* A real server is shared by every test, which is fine while the demos clear out their own tables first - run go test -p 1 against one
+*/
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	// The same callbacks the CLI's connections get
+	_ "github.com/annicaburns/learngorm/callbacks"
+	"github.com/annicaburns/learngorm/dialect"
+	"github.com/annicaburns/learngorm/migrations"
+)
+
+// Environment variables read by Open
+const (
+	EnvDriver = "LEARNGORM_TEST_DRIVER"
+	EnvDSN    = "LEARNGORM_TEST_DSN"
+)
+
+var databases int32
+
+// Open returns a migrated database that is closed when the test finishes
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+	driver, dsn := os.Getenv(EnvDriver), os.Getenv(EnvDSN)
+	if driver == "" {
+		// mode=memory keeps it off disk, and cache=shared lets every pooled connection see the same database
+		// The number keeps subtests and -count=2 runs from sharing one by accident
+		name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+		driver = "sqlite3"
+		// _foreign_keys=1 enforces the FK constraints, like the connection package's SQLite DSN
+		dsn = fmt.Sprintf("file:%s_%d?mode=memory&cache=shared&_foreign_keys=1", name, atomic.AddInt32(&databases, 1))
+	}
+	d, err := dialect.Get(driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := d.Open(dsn)
+	if err != nil {
+		t.Fatalf("opening %s test database: %v", driver, err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := migrations.Up(context.Background(), db); err != nil {
+		t.Fatalf("migrating test database: %v", err)
+	}
+	return db
+}
+
+// Count returns the number of rows in table matching the optional where clause - deleted rows included, since it doesn't go through a model
+func Count(t testing.TB, db *gorm.DB, table string, where ...interface{}) int {
+	t.Helper()
+	scoped := db.Table(table)
+	if len(where) > 0 {
+		scoped = scoped.Where(where[0], where[1:]...)
+	}
+	var n int
+	if err := scoped.Count(&n).Error; err != nil {
+		t.Fatalf("counting %s: %v", table, err)
+	}
+	return n
+}
@@ -0,0 +1,136 @@
+package transaction
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Policy says how WithRetry retries - the zero value uses the defaults below
+type Policy struct {
+	// MaxAttempts counts the first try - DefaultMaxAttempts when 0
+	MaxAttempts int
+	// BaseDelay is the most the first retry waits, doubling each time after - DefaultBaseDelay when 0
+	BaseDelay time.Duration
+	// MaxDelay caps the doubling - DefaultMaxDelay when 0
+	MaxDelay time.Duration
+	// Observe is called after every attempt, successful or not - a place to count retries and failures
+	Observe func(Attempt)
+}
+
+// Policy defaults
+const (
+	DefaultMaxAttempts = 5
+	DefaultBaseDelay   = 10 * time.Millisecond
+	DefaultMaxDelay    = time.Second
+)
+
+// Attempt describes one try at the transaction, for Policy.Observe
+type Attempt struct {
+	// Number counts from 1
+	Number int
+	// Err is nil when the transaction committed
+	Err error
+	// Retryable says whether Err is worth another try - see IsRetryable
+	Retryable bool
+	// Delay is how long WithRetry waits before the next try, or 0 when there won't be one
+	Delay    time.Duration
+	Duration time.Duration
+}
+
+// WithRetry runs fn in a transaction like WithTx, running it again in a fresh transaction when it fails with a retryable error
+// Everything fn does is rolled back before a retry, so it must be safe to run more than once - read what it needs inside the transaction and keep side effects out
+// When db is a transaction already fn runs once, in a savepoint - a deadlock aborts the whole of the caller's transaction, so only the caller can retry it
+func WithRetry(ctx context.Context, db *gorm.DB, policy Policy, fn func(tx *gorm.DB) error) error {
+	if isTx(db) {
+		return WithTx(ctx, db, fn)
+	}
+	policy = policy.withDefaults()
+	for number := 1; ; number++ {
+		started := time.Now()
+		err := WithTx(ctx, db, fn)
+		attempt := Attempt{Number: number, Err: err, Retryable: IsRetryable(err), Duration: time.Since(started)}
+		if attempt.Retryable && number < policy.MaxAttempts {
+			attempt.Delay = policy.delay(number)
+		}
+		if policy.Observe != nil {
+			policy.Observe(attempt)
+		}
+		switch {
+		case err == nil || !attempt.Retryable:
+			return err
+		case attempt.Delay == 0:
+			return fmt.Errorf("transaction: gave up after %d attempts: %w", number, err)
+		}
+
+		timer := time.NewTimer(attempt.Delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("transaction: waiting to retry: %w", errors.Join(ctx.Err(), err))
+		case <-timer.C:
+		}
+	}
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultMaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = DefaultBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultMaxDelay
+	}
+	return p
+}
+
+// delay is the wait after the given attempt - exponential backoff with full jitter, so writers that collided don't collide again in step
+func (p Policy) delay(attempt int) time.Duration {
+	ceiling := p.MaxDelay
+	// Compared before shifting - a long BaseDelay shifted far enough wraps round to negative
+	if p.BaseDelay <= p.MaxDelay>>uint(attempt-1) {
+		ceiling = p.BaseDelay << uint(attempt-1)
+	}
+	// Never 0, which would read as no retry
+	return time.Duration(rand.Int63n(int64(ceiling))) + 1
+}
+
+// IsRetryable reports whether err is a failure that running the transaction again can fix - the database gave up on it to let another one through
+//   - MySQL: deadlock (1213) and lock wait timeout (1205)
+//   - PostgreSQL: serialization_failure (40001) and deadlock_detected (40P01)
+//   - SQLite: SQLITE_BUSY and SQLITE_LOCKED, when another connection holds the lock
+//
+// When GORM collects several errors from one call into gorm.Errors, any one of them being retryable is enough
+func IsRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	// gorm.Errors has no Unwrap, so errors.As can't see inside it
+	var errs gorm.Errors
+	if errors.As(err, &errs) {
+		for _, err := range errs {
+			if IsRetryable(err) {
+				return true
+			}
+		}
+	}
+	return false
+}
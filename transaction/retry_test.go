@@ -0,0 +1,116 @@
+package transaction_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/annicaburns/learngorm/testdb"
+	"github.com/annicaburns/learngorm/transaction"
+)
+
+func TestIsRetryable(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&mysql.MySQLError{Number: 1213}, true},
+		{&mysql.MySQLError{Number: 1205}, true},
+		{&mysql.MySQLError{Number: 1062}, false},
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "23505"}, false},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{fmt.Errorf("transaction: commit: %w", sqlite3.Error{Code: sqlite3.ErrLocked}), true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+		{gorm.Errors{errors.New("audit: recording the update"), &mysql.MySQLError{Number: 1213}}, true},
+		{fmt.Errorf("transaction: commit: %w", gorm.Errors{&pq.Error{Code: "40001"}}), true},
+		{gorm.Errors{&pq.Error{Code: "23505"}, gorm.ErrRecordNotFound}, false},
+		{gorm.ErrRecordNotFound, false},
+		{nil, false},
+	} {
+		if got := transaction.IsRetryable(test.err); got != test.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetriesUntilCommitted(t *testing.T) {
+	db := testdb.Open(t)
+	attempts := []transaction.Attempt{}
+	policy := transaction.Policy{
+		BaseDelay: time.Millisecond,
+		Observe:   func(attempt transaction.Attempt) { attempts = append(attempts, attempt) },
+	}
+	err := transaction.WithRetry(context.Background(), db, policy, func(tx *gorm.DB) error {
+		if err := create(tx, "Arthur"); err != nil {
+			return err
+		}
+		if len(attempts) < 2 {
+			return &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 3 || attempts[0].Delay == 0 || !attempts[1].Retryable || attempts[2].Err != nil || attempts[2].Delay != 0 {
+		t.Errorf("observed %+v, want two retried deadlocks then a commit", attempts)
+	}
+	if n := testdb.Count(t, db, "cruddy_user4"); n != 1 {
+		t.Errorf("%d users, want the failed attempts rolled back", n)
+	}
+}
+
+func TestGivesUpAfterMaxAttempts(t *testing.T) {
+	db := testdb.Open(t)
+	deadlock := &pq.Error{Code: "40P01"}
+	calls := 0
+	policy := transaction.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	err := transaction.WithRetry(context.Background(), db, policy, func(tx *gorm.DB) error {
+		calls++
+		return deadlock
+	})
+	if calls != 3 || !errors.Is(err, deadlock) {
+		t.Errorf("ran %d times and returned %v, want 3 runs and the deadlock", calls, err)
+	}
+}
+
+func TestLongDelaysDontOverflow(t *testing.T) {
+	db := testdb.Open(t)
+	// Far enough for BaseDelay to overflow a time.Duration once it has doubled 30 times
+	policy := transaction.Policy{MaxAttempts: 40, BaseDelay: 10 * time.Second, MaxDelay: time.Millisecond}
+	policy.Observe = func(attempt transaction.Attempt) {
+		if attempt.Number < policy.MaxAttempts && (attempt.Delay <= 0 || attempt.Delay > policy.MaxDelay) {
+			t.Errorf("attempt %d waits %v, want up to %v", attempt.Number, attempt.Delay, policy.MaxDelay)
+		}
+	}
+	calls := 0
+	err := transaction.WithRetry(context.Background(), db, policy, func(tx *gorm.DB) error {
+		calls++
+		return &mysql.MySQLError{Number: 1213}
+	})
+	if calls != policy.MaxAttempts || !transaction.IsRetryable(err) {
+		t.Errorf("ran %d times and returned %v, want %d runs and the deadlock", calls, err, policy.MaxAttempts)
+	}
+}
+
+func TestOtherErrorsAreNotRetried(t *testing.T) {
+	db := testdb.Open(t)
+	failed := errors.New("failed")
+	calls := 0
+	err := transaction.WithRetry(context.Background(), db, transaction.Policy{}, func(tx *gorm.DB) error {
+		calls++
+		return failed
+	})
+	if calls != 1 || err != failed {
+		t.Errorf("ran %d times and returned %v, want 1 run and fn's error", calls, err)
+	}
+}
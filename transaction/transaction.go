@@ -0,0 +1,93 @@
+package transaction
+
+/*
+* WithTx runs a function in a transaction - the Begin, Rollback and Commit calls crud.Transactions used to make by hand
+	* fn returning nil commits, and a failed commit is returned rather than lost
+	* fn returning an error or panicking rolls back - the panic carries on up once the rollback is done
+	* The transaction is tied to ctx, so a cancelled ctx rolls it back too
+* Calls nest - WithTx on a db that is already a transaction sets a SAVEPOINT instead of beginning another
+	* An error or panic in the inner call rolls back to the savepoint, leaving the outer transaction to carry on or give up
+	* This works the same on MySQL, PostgreSQL and SQLite, which all have SAVEPOINT, ROLLBACK TO SAVEPOINT and RELEASE SAVEPOINT
+* Hand the tx that fn gets to everything inside it - a call made on the original db runs outside the transaction
+* WithRetry runs the transaction again when the database aborted it to break a deadlock or a serialization conflict
+	* Concurrent writers to appointments and their attendee join rows can deadlock on MySQL - the retry is the fix, not a workaround
+	* Waits grow exponentially with random jitter, up to Policy.MaxAttempts tries, and Policy.Observe sees every attempt
+*/
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// depthKey counts the savepoints open on a transaction, so nested calls get their own names
+const depthKey = "transaction:depth"
+
+// WithTx runs fn in a transaction on db, or in a savepoint when db is a transaction already
+func WithTx(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if isTx(db) {
+		return withSavepoint(db, fn)
+	}
+
+	tx := db.BeginTx(ctx, nil)
+	if tx.Error != nil {
+		return fmt.Errorf("transaction: begin: %w", tx.Error)
+	}
+	tx = tx.Set(depthKey, 0)
+	return run(tx, fn,
+		func() error { return tx.Commit().Error },
+		func() error { return tx.Rollback().Error })
+}
+
+// isTx reports whether db is a transaction already
+func isTx(db *gorm.DB) bool {
+	_, ok := db.CommonDB().(*sql.Tx)
+	return ok
+}
+
+// withSavepoint runs fn between a SAVEPOINT and its RELEASE, or ROLLBACK TO it
+func withSavepoint(tx *gorm.DB, fn func(tx *gorm.DB) error) error {
+	depth := 0
+	if value, ok := tx.Get(depthKey); ok {
+		depth = value.(int)
+	}
+	// A name per level - siblings can reuse one, since the first is released before the second is set
+	name := fmt.Sprintf("sp_%d", depth+1)
+	if err := tx.Exec("SAVEPOINT " + name).Error; err != nil {
+		return fmt.Errorf("transaction: savepoint: %w", err)
+	}
+	tx = tx.Set(depthKey, depth+1)
+	return run(tx, fn,
+		func() error { return tx.Exec("RELEASE SAVEPOINT " + name).Error },
+		func() error { return tx.Exec("ROLLBACK TO SAVEPOINT " + name).Error })
+}
+
+// run calls fn, then commit if it succeeds or rollback if it fails or panics
+func run(tx *gorm.DB, fn func(tx *gorm.DB) error, commit, rollback func() error) (err error) {
+	panicked := true
+	defer func() {
+		// recover would swallow the panic, so let it carry on and just roll back on the way past
+		if panicked {
+			rollback()
+		}
+	}()
+	err = fn(tx)
+	panicked = false
+
+	if err != nil {
+		if rollbackErr := rollback(); rollbackErr != nil {
+			return errors.Join(err, fmt.Errorf("transaction: rollback: %w", rollbackErr))
+		}
+		return err
+	}
+	if err := commit(); err != nil {
+		return fmt.Errorf("transaction: commit: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package transaction_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/crud"
+	"github.com/annicaburns/learngorm/testdb"
+	"github.com/annicaburns/learngorm/transaction"
+)
+
+func create(tx *gorm.DB, first string) error {
+	return tx.Create(&crud.CruddyUser4{FirstName: first}).Error
+}
+
+func TestCommitAndRollback(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	if err := transaction.WithTx(ctx, db, func(tx *gorm.DB) error { return create(tx, "Arthur") }); err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("failed")
+	err := transaction.WithTx(ctx, db, func(tx *gorm.DB) error {
+		if err := create(tx, "Ford"); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("WithTx returned %v, want fn's error", err)
+	}
+	if n := testdb.Count(t, db, "cruddy_user4"); n != 1 {
+		t.Errorf("%d users, want only the committed one", n)
+	}
+}
+
+func TestPanicRollsBackAndCarriesOn(t *testing.T) {
+	db := testdb.Open(t)
+	func() {
+		defer func() {
+			if recover() != "boom" {
+				t.Error("the panic didn't come back out of WithTx")
+			}
+		}()
+		transaction.WithTx(context.Background(), db, func(tx *gorm.DB) error {
+			if err := create(tx, "Arthur"); err != nil {
+				return err
+			}
+			panic("boom")
+		})
+	}()
+	if n := testdb.Count(t, db, "cruddy_user4"); n != 0 {
+		t.Errorf("%d users after the panic, want the create rolled back", n)
+	}
+}
+
+func TestNestedCallsUseSavepoints(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	err := transaction.WithTx(ctx, db, func(tx *gorm.DB) error {
+		if err := create(tx, "Arthur"); err != nil {
+			return err
+		}
+		// Fails - only Ford and Zaphod go
+		transaction.WithTx(ctx, tx, func(tx *gorm.DB) error {
+			if err := create(tx, "Ford"); err != nil {
+				return err
+			}
+			transaction.WithTx(ctx, tx, func(tx *gorm.DB) error { return create(tx, "Zaphod") })
+			return errors.New("failed")
+		})
+		// A panic two levels down is rolled back to its own savepoint, then recovered here
+		func() {
+			defer func() { recover() }()
+			transaction.WithTx(ctx, tx, func(tx *gorm.DB) error {
+				return transaction.WithTx(ctx, tx, func(tx *gorm.DB) error {
+					if err := create(tx, "Trillian"); err != nil {
+						return err
+					}
+					panic("boom")
+				})
+			})
+		}()
+		// Succeeds, after a sibling used the same savepoint name
+		return transaction.WithTx(ctx, tx, func(tx *gorm.DB) error { return create(tx, "Tricia") })
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []crud.CruddyUser4{}
+	if err := db.Order("id").Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].FirstName != "Arthur" || users[1].FirstName != "Tricia" {
+		t.Errorf("found %v, want Arthur and Tricia", users)
+	}
+}
+
+func TestCommitErrorsAreReturned(t *testing.T) {
+	db := testdb.Open(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	err := transaction.WithTx(ctx, db, func(tx *gorm.DB) error {
+		if err := create(tx, "Arthur"); err != nil {
+			return err
+		}
+		// database/sql rolls the transaction back when its ctx is cancelled, so there's nothing left to commit
+		cancel()
+		return nil
+	})
+	if err == nil {
+		t.Error("WithTx returned nil after its transaction was cancelled")
+	}
+}
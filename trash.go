@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/registry"
+	"github.com/annicaburns/learngorm/softdelete"
+)
+
+const trashUsage = `Usage: learngorm trash <command> <table> [id...] [key=value...]
+
+Commands:
+  list <table>                 show the soft deleted rows
+  delete <table> <id>...       soft delete rows and their children
+  restore <table> <id>...      bring back soft deleted rows and the children deleted with them
+  purge <table> before=720h    permanently delete rows soft deleted before a cutoff, with their deleted children
+
+Settings:
+  where="last_name = 'Dent'"   a SQL condition - delete and restore take it instead of ids
+  before=720h                  purge cutoff, as an age or a date like 2020-01-31
+`
+
+// trashSettings are the ids and key=value settings after the table name
+type trashSettings struct {
+	ids    []interface{}
+	where  string
+	before time.Time
+}
+
+// trash handles learngorm trash list|delete|restore|purge - see trashUsage
+func trash(opts options, args []string) int {
+	if len(args) == 1 && args[0] == "help" {
+		fmt.Print(trashUsage)
+		return 0
+	}
+	if len(args) < 2 {
+		fmt.Fprint(os.Stderr, "trash needs a command and a table\n", trashUsage)
+		return 2
+	}
+	command, table := args[0], args[1]
+	settings, err := parseTrashSettings(args[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	switch command {
+	case "list":
+	case "delete", "restore":
+		// Without either, every row in the table would go
+		if len(settings.ids) == 0 && settings.where == "" {
+			fmt.Fprintf(os.Stderr, "%s needs ids or a where= condition\n", command)
+			return 2
+		}
+	case "purge":
+		if settings.before.IsZero() {
+			fmt.Fprintln(os.Stderr, "purge needs a before= cutoff")
+			return 2
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown trash command %q\n%s", command, trashUsage)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return withDB(opts, func(db *gorm.DB) int {
+		if code := migrateUp(ctx, db); code != 0 {
+			return code
+		}
+		model, ok := modelFor(db, table)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "no model has the table %q\n", table)
+			return 2
+		}
+		filtered := db
+		if settings.where != "" {
+			filtered = db.Where(settings.where)
+		}
+
+		var counts softdelete.Counts
+		switch command {
+		case "list":
+			err = listTrash(ctx, filtered, model)
+		case "delete":
+			counts, err = softdelete.Delete(ctx, filtered, model, settings.ids...)
+		case "restore":
+			counts, err = softdelete.Restore(ctx, filtered, model, settings.ids...)
+		case "purge":
+			counts, err = softdelete.Purge(ctx, filtered, model, settings.before)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if counts != nil {
+			fmt.Println(map[string]string{"delete": "deleted", "restore": "restored", "purge": "purged"}[command], counts)
+		}
+		return 0
+	})
+}
+
+func parseTrashSettings(args []string) (trashSettings, error) {
+	settings := trashSettings{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) == 1 {
+			id, err := strconv.ParseUint(arg, 10, 64)
+			if err != nil {
+				return settings, fmt.Errorf("%q isn't an id or a key=value setting", arg)
+			}
+			settings.ids = append(settings.ids, id)
+			continue
+		}
+		switch kv[0] {
+		case "where":
+			settings.where = kv[1]
+		case "before":
+			if age, err := time.ParseDuration(kv[1]); err == nil {
+				settings.before = gorm.NowFunc().Add(-age)
+			} else if date, err := time.ParseInLocation("2006-01-02", kv[1], time.Local); err == nil {
+				settings.before = date
+			} else {
+				return settings, fmt.Errorf("before takes an age like 720h or a date like 2020-01-31, not %q", kv[1])
+			}
+		default:
+			return settings, fmt.Errorf("unknown setting %q\n%s", kv[0], trashUsage)
+		}
+	}
+	return settings, nil
+}
+
+// modelFor finds the registered model stored in table
+func modelFor(db *gorm.DB, table string) (interface{}, bool) {
+	for _, model := range registry.Models() {
+		if db.NewScope(model).TableName() == table {
+			return model, true
+		}
+	}
+	return nil, false
+}
+
+// listTrash prints every column of the soft deleted rows, most recently deleted first
+func listTrash(ctx context.Context, db *gorm.DB, model interface{}) error {
+	rows := reflect.New(reflect.SliceOf(reflect.TypeOf(model).Elem()))
+	if err := softdelete.Trashed(ctx, db.Order("deleted_at desc"), rows.Interface()); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	for i := 0; i < rows.Elem().Len(); i++ {
+		fields := db.NewScope(rows.Elem().Index(i).Addr().Interface()).Fields()
+		cells := []string{}
+		if i == 0 {
+			for _, field := range fields {
+				if field.IsNormal {
+					cells = append(cells, strings.ToUpper(field.DBName))
+				}
+			}
+			fmt.Fprintln(w, strings.Join(cells, "\t"))
+			cells = cells[:0]
+		}
+		for _, field := range fields {
+			if field.IsNormal {
+				cells = append(cells, formatCell(field.Field))
+			}
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	if rows.Elem().Len() == 0 {
+		fmt.Fprintln(w, "the trash is empty")
+	}
+	return nil
+}
+
+func formatCell(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,225 @@
+package validation
+
+/*
+* Catch bad values before they get to the database - BasicUser's VARCHAR(15) username used to be checked by nothing but the column
+	* Rules go in a validate tag, comma separated - `validate:"required,max=15"`
+		* required - not the zero value
+		* min=N, max=N - the length of a string (in characters), slice or map, or the size of a number
+		* email - something@somewhere, when not blank
+		* oneof=a|b|c - one of the listed values
+	* A model can check more than one field at a time with a Validate() error method - see Validator
+* The check runs as a callback after the model's own BeforeSave/BeforeCreate/BeforeUpdate hooks, so values they fill in are checked too
+	* A failing check aborts the save, and rolls back the transaction GORM opened for it - the callback notes in the advanced package
+	* The error is a ValidationErrors listing every field that failed, not just the first
+	* Update and Updates only check the columns they change, and skip Validate(), since the rest of the model may not be loaded
+	* UpdateColumn and UpdateColumns skip the check, like they skip every other update callback
+*/
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Validator is implemented by models with rules a tag can't express
+// Return ValidationErrors, or a FieldError, to point at fields - any other error applies to the whole model
+type Validator interface {
+	Validate() error
+}
+
+// FieldError is one rule a field broke
+type FieldError struct {
+	// Field is the Go name, Column the database one - both blank for an error about the whole model
+	Field  string
+	Column string
+	// Rule is the tag rule that failed, like max=15 - or Validate for an error from a Validator
+	Rule    string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Message
+}
+
+// ValidationErrors lists every rule a model broke - check for it with errors.As
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldErr := range e {
+		messages[i] = fieldErr.Message
+	}
+	return "validation: " + strings.Join(messages, "; ")
+}
+
+// Field returns the errors for one field, by its Go name
+func (e ValidationErrors) Field(name string) []FieldError {
+	found := []FieldError{}
+	for _, fieldErr := range e {
+		if fieldErr.Field == name {
+			found = append(found, fieldErr)
+		}
+	}
+	return found
+}
+
+func init() {
+	gorm.DefaultCallback.Create().After("gorm:before_create").Before("gorm:save_before_associations").Register("validation:validate", validate)
+	gorm.DefaultCallback.Update().After("gorm:before_update").Before("gorm:save_before_associations").Register("validation:validate", validate)
+}
+
+// validate checks the model being saved
+func validate(scope *gorm.Scope) {
+	if scope.HasError() {
+		return
+	}
+	if _, ok := scope.Get("gorm:update_column"); ok {
+		return
+	}
+	// Update and Updates leave the columns they set here - the rest of the model wasn't necessarily loaded
+	var err error
+	if attrs, ok := scope.InstanceGet("gorm:update_attrs"); ok {
+		err = check(scope, attrs.(map[string]interface{}), false)
+	} else {
+		err = check(scope, nil, true)
+	}
+	if err != nil {
+		scope.Err(err)
+	}
+}
+
+// Check validates value, a pointer to a model, against its tags and its Validate method - nil, a ValidationErrors, or an error for a malformed tag
+// Packages that write rows without GORM's callbacks, like bulk, call it themselves
+func Check(db *gorm.DB, value interface{}) error {
+	return check(db.NewScope(value), nil, true)
+}
+
+// check validates the columns in only, or every field when only is nil
+func check(scope *gorm.Scope, only map[string]interface{}, whole bool) error {
+	failed := ValidationErrors{}
+	for _, field := range scope.Fields() {
+		tag, ok := field.Tag.Lookup("validate")
+		if !ok || tag == "" || tag == "-" {
+			continue
+		}
+		if only != nil {
+			value, ok := only[field.DBName]
+			if _, expr := value.(*gorm.SqlExpr); !ok || expr {
+				// The database works out an expression's value, so there's nothing to check
+				continue
+			}
+			// Check the value being written, which isn't in the model when it wasn't addressable
+			field = &gorm.Field{StructField: field.StructField, Field: reflect.ValueOf(value)}
+		}
+		for _, rule := range strings.Split(tag, ",") {
+			fieldErr, err := apply(field, strings.TrimSpace(rule))
+			if err != nil {
+				return fmt.Errorf("validation: %s.%s: %w", scope.GetModelStruct().ModelType.Name(), field.Name, err)
+			}
+			if fieldErr != nil {
+				failed = append(failed, *fieldErr)
+			}
+		}
+	}
+
+	if validator, ok := scope.Value.(Validator); ok && whole {
+		err := validator.Validate()
+		var list ValidationErrors
+		var one FieldError
+		switch {
+		case err == nil:
+		case errors.As(err, &list):
+			failed = append(failed, list...)
+		case errors.As(err, &one):
+			failed = append(failed, one)
+		default:
+			failed = append(failed, FieldError{Rule: "Validate", Message: err.Error()})
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+var email = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// apply checks one rule, returning a FieldError if the field breaks it, or an error if the rule makes no sense
+func apply(field *gorm.Field, rule string) (*FieldError, error) {
+	name, arg, _ := strings.Cut(rule, "=")
+	value := reflect.Indirect(field.Field)
+	fail := func(format string, args ...interface{}) (*FieldError, error) {
+		return &FieldError{Field: field.Name, Column: field.DBName, Rule: rule, Message: field.DBName + " " + fmt.Sprintf(format, args...)}, nil
+	}
+	if !value.IsValid() {
+		// A nil pointer only breaks required - the other rules check values that are there
+		if name == "required" {
+			return fail("is required")
+		}
+		return nil, nil
+	}
+
+	switch name {
+	case "required":
+		if value.IsZero() {
+			return fail("is required")
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a number, not %q", name, arg)
+		}
+		size, unit, err := measure(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if name == "min" && size < limit {
+			return fail("is less than %s%s", arg, unit)
+		}
+		if name == "max" && size > limit {
+			return fail("is more than %s%s", arg, unit)
+		}
+	case "email":
+		if value.Kind() != reflect.String {
+			return nil, fmt.Errorf("email needs a string field")
+		}
+		if s := value.String(); s != "" && !email.MatchString(s) {
+			return fail("isn't an email address")
+		}
+	case "oneof":
+		s := fmt.Sprint(value.Interface())
+		for _, allowed := range strings.Split(arg, "|") {
+			if s == allowed {
+				return nil, nil
+			}
+		}
+		return fail("must be one of %s", strings.ReplaceAll(arg, "|", ", "))
+	default:
+		return nil, fmt.Errorf("unknown rule %q", rule)
+	}
+	return nil, nil
+}
+
+// measure returns what min and max compare, and the unit to describe it with
+func measure(value reflect.Value) (float64, string, error) {
+	switch value.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(value.String())), " characters", nil
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(value.Len()), " items", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), "", nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), "", nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), "", nil
+	}
+	return 0, "", fmt.Errorf("can't measure a %s", value.Kind())
+}
@@ -0,0 +1,110 @@
+package validation_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/annicaburns/learngorm/audit"
+	"github.com/annicaburns/learngorm/bulk"
+	"github.com/annicaburns/learngorm/crud"
+	"github.com/annicaburns/learngorm/dbSchema"
+	"github.com/annicaburns/learngorm/testdb"
+	"github.com/annicaburns/learngorm/validation"
+)
+
+type signup struct {
+	Username string   `validate:"required,max=15"`
+	Email    string   `validate:"email"`
+	Age      *int     `validate:"required,min=18"`
+	Plan     string   `validate:"oneof=free|paid"`
+	Tags     []string `validate:"max=2"`
+}
+
+func (s *signup) Validate() error {
+	if strings.Contains(s.Email, s.Username) && s.Username != "" {
+		return errors.New("the email can't give away the username")
+	}
+	return nil
+}
+
+func TestRules(t *testing.T) {
+	db := testdb.Open(t)
+	seventeen := 17
+	err := validation.Check(db, &signup{Username: "zaphod", Email: "zaphod@heartofgold.ship", Age: &seventeen, Plan: "stolen", Tags: []string{"a", "b", "c"}})
+	var invalid validation.ValidationErrors
+	if !errors.As(err, &invalid) {
+		t.Fatalf("Check returned %v, want ValidationErrors", err)
+	}
+	rules := []string{}
+	for _, fieldErr := range invalid {
+		rules = append(rules, fieldErr.Field+":"+fieldErr.Rule)
+	}
+	if got, want := strings.Join(rules, " "), "Age:min=18 Plan:oneof=free|paid Tags:max=2 :Validate"; got != want {
+		t.Errorf("failed %s, want %s", got, want)
+	}
+
+	err = validation.Check(db, &signup{Username: "arthur-dent-of-earth", Email: "not an address"})
+	if !errors.As(err, &invalid) || len(invalid) != 4 {
+		t.Errorf("Check returned %v, want username too long, a bad email, a missing age and no plan", err)
+	}
+
+	eighteen := 18
+	if err := validation.Check(db, &signup{Username: "ford", Email: "fprefect@hitchhiker.guide", Age: &eighteen, Plan: "free"}); err != nil {
+		t.Errorf("a valid signup returned %v", err)
+	}
+
+	type bad struct {
+		Name string `validate:"longish"`
+	}
+	if err := validation.Check(db, &bad{}); err == nil || errors.As(err, &invalid) {
+		t.Errorf("an unknown rule returned %v, want a plain error", err)
+	}
+}
+
+func TestSaveIsAborted(t *testing.T) {
+	db := testdb.Open(t)
+	user := dbSchema.BasicUser{Username: "adent", LastName: "Dent"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	user.Username = "arthurphilipdent"
+	var invalid validation.ValidationErrors
+	if err := db.Save(&user).Error; !errors.As(err, &invalid) || invalid[0].Rule != "max=15" {
+		t.Errorf("saving a 16 character username returned %v, want max=15", err)
+	}
+	if err := db.Model(&user).Updates(map[string]interface{}{"username": nil}).Error; !errors.As(err, &invalid) || invalid[0].Rule != "required" {
+		t.Errorf("a NULL username returned %v, want required", err)
+	}
+	if err := bulk.CreateInBatches(context.Background(), db, []dbSchema.BasicUser{{Username: "fprefect"}, {Username: "fordprefectofbetelgeuse"}}, 0); !errors.As(err, &invalid) {
+		t.Errorf("CreateInBatches returned %v, want ValidationErrors", err)
+	}
+	if n := testdb.Count(t, db, "basic_users", "username = ?", "adent"); n != 1 || testdb.Count(t, db, "basic_users") != 1 {
+		t.Error("a save that failed validation reached the database")
+	}
+	if n := testdb.Count(t, db, "audit_log", "operation = ?", audit.Update); n != 0 {
+		t.Errorf("%d update entries logged for saves that never happened", n)
+	}
+}
+
+func TestPartialUpdatesCheckOnlyTheirColumns(t *testing.T) {
+	db := testdb.Open(t)
+	if err := db.Create(&dbSchema.BasicUser{Username: "adent", LastName: "Dent", Count: 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+	// The blank model would fail required - but only count is being set
+	if err := db.Model(&dbSchema.BasicUser{}).Where("username = ?", "adent").Update("count", gorm.Expr("count + 1")).Error; err != nil {
+		t.Errorf("updating count on a blank model returned %v", err)
+	}
+	if err := db.Model(&dbSchema.BasicUser{}).Where("username = ?", "adent").Update("LastName", "Dentarthurdent").Error; err != nil {
+		t.Errorf("updating a column without rules returned %v", err)
+	}
+	// No tags and no Validate - nothing to check
+	if err := db.Create(&crud.CruddyUser4{}).Error; err != nil {
+		t.Errorf("creating a model without rules returned %v", err)
+	}
+}